@@ -0,0 +1,113 @@
+package policylint
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"go.aporeto.io/trireme-lib/controller/pkg/policylint"
+	"go.aporeto.io/trireme-lib/policy"
+)
+
+// CLIRequest captures all CLI parameters
+type CLIRequest struct {
+	// PolicyFiles are the files with the JSON encoded public policies to lint
+	PolicyFiles []string
+	// Strict returns an error if any finding is reported
+	Strict bool
+}
+
+// ExecuteCommandFromArguments processes the command from the arguments and
+// writes the findings to the standard output.
+func ExecuteCommandFromArguments(arguments map[string]interface{}) error {
+
+	c, err := ParseCommand(arguments)
+	if err != nil {
+		return err
+	}
+
+	return ExecuteRequest(c, os.Stdout)
+}
+
+// Generic command line arguments
+// Assumes a command like that:
+// usage = `Trireme Policy Linter
+//
+// Usage: policylint -h | --help
+// 		 policylint [--strict] <policy>...
+//
+// Options:
+// 	--strict                  Fail if any finding is reported [default false].
+//
+// `
+
+// ParseCommand parses a command based on the above specification
+func ParseCommand(arguments map[string]interface{}) (*CLIRequest, error) {
+
+	c := &CLIRequest{}
+
+	value, ok := arguments["<policy>"]
+	if !ok || value == nil || len(value.([]string)) == 0 {
+		return nil, errors.New("policy file must be provided")
+	}
+	c.PolicyFiles = value.([]string)
+
+	if value, ok := arguments["--strict"]; ok && value != nil {
+		c.Strict = value.(bool)
+	}
+
+	return c, nil
+}
+
+// Report holds the findings of a policy file.
+type Report struct {
+	File     string                `json:"file"`
+	Findings []*policylint.Finding `json:"findings"`
+}
+
+// ExecuteRequest lints the policies and writes the JSON encoded findings to
+// the writer.
+func ExecuteRequest(c *CLIRequest, w io.Writer) error {
+
+	reports := []*Report{}
+	count := 0
+
+	for _, file := range c.PolicyFiles {
+
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("unable to read policy: %s", err)
+		}
+
+		public := &policy.PUPolicyPublic{}
+		if err := json.Unmarshal(data, public); err != nil {
+			return fmt.Errorf("unable to decode policy %s: %s", file, err)
+		}
+
+		puPolicy, err := public.ToPrivatePolicy(false)
+		if err != nil {
+			return fmt.Errorf("unable to convert policy %s: %s", file, err)
+		}
+
+		findings := policylint.Lint(puPolicy)
+		count += len(findings)
+
+		reports = append(reports, &Report{File: file, Findings: findings})
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	if err := encoder.Encode(reports); err != nil {
+		return err
+	}
+
+	if c.Strict && count > 0 {
+		return fmt.Errorf("%d findings reported", count)
+	}
+
+	return nil
+}
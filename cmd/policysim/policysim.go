@@ -0,0 +1,144 @@
+package policysim
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+
+	"go.aporeto.io/trireme-lib/controller/pkg/policysim"
+	"go.aporeto.io/trireme-lib/policy"
+)
+
+// CLIRequest captures all CLI parameters
+type CLIRequest struct {
+	// PolicyFile is the file with the JSON encoded public policy of the PU
+	PolicyFile string
+	// ContextID is the context ID of the PU
+	ContextID string
+	// Request is the simulated flow
+	Request *policysim.Request
+}
+
+// ExecuteCommandFromArguments processes the command from the arguments and
+// writes the decision to the standard output.
+func ExecuteCommandFromArguments(arguments map[string]interface{}) error {
+
+	c, err := ParseCommand(arguments)
+	if err != nil {
+		return err
+	}
+
+	return ExecuteRequest(c, os.Stdout)
+}
+
+// Generic command line arguments
+// Assumes a command like that:
+// usage = `Trireme Policy Simulator
+//
+// Usage: policysim -h | --help
+// 		 policysim <policy>
+// 			[[--tag=<keyvalue>]...]
+// 			[--ip=<ip>]
+// 			[--port=<port>]
+// 			[--protocol=<protocol>]
+// 			[--outgoing]
+// 			[--mutual-auth]
+// 			[--context-id=<id>]
+//
+// Options:
+// 	--tag=<keyvalue>          Tag (key=value pair) of the remote PU [default ].
+// 	--ip=<ip>                 IP address of the remote end when it is not a PU [default ].
+// 	--port=<port>             Destination port of the flow [default 0].
+// 	--protocol=<protocol>     Protocol of the flow (tcp or udp) [default tcp].
+// 	--outgoing                Simulate a flow initiated by the PU [default false].
+// 	--mutual-auth             Apply the reject rules to outgoing flows [default false].
+// 	--context-id=<id>         Context ID of the PU [default policysim].
+//
+// `
+
+// ParseCommand parses a command based on the above specification
+func ParseCommand(arguments map[string]interface{}) (*CLIRequest, error) {
+
+	c := &CLIRequest{
+		ContextID: "policysim",
+		Request:   &policysim.Request{},
+	}
+
+	value, ok := arguments["<policy>"]
+	if !ok || value == nil {
+		return nil, errors.New("policy file must be provided")
+	}
+	c.PolicyFile = value.(string)
+
+	if value, ok := arguments["--context-id"]; ok && value != nil && value.(string) != "" {
+		c.ContextID = value.(string)
+	}
+
+	if value, ok := arguments["--tag"]; ok && value != nil {
+		c.Request.Tags = value.([]string)
+	}
+
+	if value, ok := arguments["--ip"]; ok && value != nil && value.(string) != "" {
+		c.Request.IP = net.ParseIP(value.(string))
+		if c.Request.IP == nil {
+			return nil, fmt.Errorf("invalid ip address: %s", value.(string))
+		}
+	}
+
+	if value, ok := arguments["--port"]; ok && value != nil && value.(string) != "" {
+		port, err := strconv.ParseUint(value.(string), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port: %s", err)
+		}
+		c.Request.Port = uint16(port)
+	}
+
+	if value, ok := arguments["--protocol"]; ok && value != nil {
+		c.Request.Protocol = value.(string)
+	}
+
+	if value, ok := arguments["--outgoing"]; ok && value != nil && value.(bool) {
+		c.Request.Direction = policysim.Outgoing
+	}
+
+	if value, ok := arguments["--mutual-auth"]; ok && value != nil {
+		c.Request.MutualAuthorization = value.(bool)
+	}
+
+	return c, nil
+}
+
+// ExecuteRequest simulates the flow of the request and writes the JSON
+// encoded decision to the writer.
+func ExecuteRequest(c *CLIRequest, w io.Writer) error {
+
+	data, err := ioutil.ReadFile(c.PolicyFile)
+	if err != nil {
+		return fmt.Errorf("unable to read policy: %s", err)
+	}
+
+	public := &policy.PUPolicyPublic{}
+	if err := json.Unmarshal(data, public); err != nil {
+		return fmt.Errorf("unable to decode policy: %s", err)
+	}
+
+	puPolicy, err := public.ToPrivatePolicy(false)
+	if err != nil {
+		return fmt.Errorf("unable to convert policy: %s", err)
+	}
+
+	decision, err := policysim.Simulate(c.ContextID, puPolicy, c.Request)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(decision)
+}
@@ -50,6 +50,7 @@ func StatsFlowHash(r *FlowRecord) string {
 	hash.Write([]byte(r.ObservedAction.String())) // nolint errcheck
 	hash.Write([]byte(r.DropReason))              // nolint errcheck
 	hash.Write([]byte(r.Destination.URI))         // nolint errcheck
+	hash.Write([]byte{r.ICMPType, r.ICMPCode})    // nolint errcheck
 
 	return fmt.Sprintf("%d", hash.Sum64())
 }
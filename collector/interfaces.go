@@ -46,6 +46,10 @@ const (
 	DatapathVersionMismatch = "datapathversionmismatch"
 	// PacketDrop indicate a single packet drop
 	PacketDrop = "packetdrop"
+	// RateLimitDrop indicates that the flow is rejected because it exceeds the rate limit of the policy
+	RateLimitDrop = "ratelimit"
+	// ConnectionLimitDrop indicates that the flow is rejected because the PU reached its connection limit
+	ConnectionLimitDrop = "connectionlimit"
 )
 
 // Container event description
@@ -155,6 +159,10 @@ type FlowRecord struct {
 	Action           policy.ActionType
 	ObservedAction   policy.ActionType
 	L4Protocol       uint8
+	// ICMPType and ICMPCode are the type and the code of the ICMP and ICMPv6
+	// flows. They are zero for the other protocols.
+	ICMPType uint8
+	ICMPCode uint8
 }
 
 func (f *FlowRecord) String() string {
@@ -209,14 +217,40 @@ type PacketReport struct {
 	Payload         []byte
 }
 
-// DNSRequestReport object is used to report dns requests being made by PU's
+// DNSRequestReport object is used to report dns requests being made by PU's.
+// The requests are aggregated per PU, name and response code. The other
+// fields are the ones of the last request.
 type DNSRequestReport struct {
 	Namespace  string
 	Source     *EndPoint
 	NameLookup string
-	Error      string
-	Count      int
-	Ts         time.Time
+	// CNAMEs are the aliases followed from NameLookup to the addresses of
+	// the answer, in order.
+	CNAMEs []string
+	// QueryType is the type of the query, like A or AAAA.
+	QueryType string
+	// ResponseCode is the response code of the answer, like NOERROR or
+	// NXDOMAIN.
+	ResponseCode string
+	// Answers are the addresses of the answer.
+	Answers []DNSAnswer
+	// Upstream is the address of the server the requests were forwarded to.
+	// It is empty if the requests were answered by the proxy.
+	Upstream string
+	// Latency is the average time the upstream server took to answer.
+	Latency time.Duration
+	// PolicyMatched is true if a DNS ACL of the PU matched the name.
+	PolicyMatched bool
+	Error         string
+	Count         int
+	Ts            time.Time
+}
+
+// DNSAnswer is an address of the answer of a dns request.
+type DNSAnswer struct {
+	IP string
+	// TTL is the TTL of the address in seconds.
+	TTL uint32
 }
 
 // Counters represent a single entry with name and current val
@@ -225,9 +259,18 @@ type Counters struct {
 	Value uint32
 }
 
+// RuleCounters represent the hits of the rules with the same policy ID. Only
+// the connections are counted, since their packets bypass the datapath once
+// the connections are established.
+type RuleCounters struct {
+	PolicyID    string
+	Connections uint64
+}
+
 // CounterReport is called from the PU which reports Counters from the datapath
 type CounterReport struct {
-	Namespace string
-	ContextID string
-	Counters  []Counters
+	Namespace    string
+	ContextID    string
+	Counters     []Counters
+	RuleCounters []RuleCounters
 }
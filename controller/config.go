@@ -10,11 +10,14 @@ import (
 	"go.aporeto.io/trireme-lib/controller/constants"
 	"go.aporeto.io/trireme-lib/controller/internal/enforcer"
 	enforcerproxy "go.aporeto.io/trireme-lib/controller/internal/enforcer/proxy"
+	"go.aporeto.io/trireme-lib/controller/internal/enforcer/utils/rpcwrapper"
 	"go.aporeto.io/trireme-lib/controller/internal/supervisor"
 	supervisorproxy "go.aporeto.io/trireme-lib/controller/internal/supervisor/proxy"
+	"go.aporeto.io/trireme-lib/controller/pkg/canary"
 	"go.aporeto.io/trireme-lib/controller/pkg/env"
 	"go.aporeto.io/trireme-lib/controller/pkg/fqconfig"
 	"go.aporeto.io/trireme-lib/controller/pkg/packetprocessor"
+	"go.aporeto.io/trireme-lib/controller/pkg/policyhistory"
 	"go.aporeto.io/trireme-lib/controller/pkg/secrets"
 	"go.aporeto.io/trireme-lib/controller/runtime"
 
@@ -46,6 +49,8 @@ type config struct {
 	remoteParameters       *env.RemoteParameters
 	tokenIssuer            common.ServiceTokenIssuer
 	binaryTokens           bool
+	captureType            rpcwrapper.CaptureType
+	policyHistorySize      int
 }
 
 // Option is provided using functional arguments.
@@ -143,6 +148,21 @@ func OptionBinaryTokens(b bool) Option {
 	}
 }
 
+// OptionNFTables captures the traffic with nftables instead of iptables.
+func OptionNFTables() Option {
+	return func(cfg *config) {
+		cfg.captureType = rpcwrapper.NFTables
+	}
+}
+
+// OptionPolicyHistorySize sets the number of versions of the policy of each PU
+// that can be rolled back to.
+func OptionPolicyHistorySize(size int) Option {
+	return func(cfg *config) {
+		cfg.policyHistorySize = size
+	}
+}
+
 func (t *trireme) newEnforcers() error {
 	zap.L().Debug("LinuxProcessSupport", zap.Bool("Status", t.config.linuxProcess))
 	var err error
@@ -186,6 +206,7 @@ func (t *trireme) newEnforcers() error {
 			t.config.remoteParameters,
 			t.config.tokenIssuer,
 			t.config.binaryTokens,
+			t.config.captureType,
 		)
 	}
 
@@ -224,6 +245,7 @@ func (t *trireme) newSupervisors() error {
 			constants.LocalServer,
 			t.config.runtimeCfg,
 			t.config.service,
+			t.config.captureType,
 		)
 		if err != nil {
 			return fmt.Errorf("Could Not create process supervisor :: received error %v", err)
@@ -242,6 +264,7 @@ func (t *trireme) newSupervisors() error {
 			constants.Sidecar,
 			t.config.runtimeCfg,
 			t.config.service,
+			t.config.captureType,
 		)
 		if err != nil {
 			return fmt.Errorf("Could Not create process sidecar supervisor :: received error %v", err)
@@ -263,9 +286,15 @@ func newTrireme(c *config) TriremeController {
 		supervisors:          map[constants.ModeType]supervisor.Supervisor{},
 		puTypeToEnforcerType: map[common.PUType]constants.ModeType{},
 		locks:                sync.Map{},
+		schedules:            sync.Map{},
+		history:              policyhistory.New(c.policyHistorySize),
+		canaries:             canary.NewCollector(c.collector),
 		enablingTrace:        make(chan *traceTrigger, 10),
 	}
 
+	// The flows are counted for the canary rollouts before they are collected.
+	c.collector = t.canaries
+
 	zap.L().Debug("Creating Enforcers")
 	if err = t.newEnforcers(); err != nil {
 		zap.L().Error("Unable to create datapath enforcers", zap.Error(err))
@@ -9,6 +9,9 @@ const (
 	DefaultAporetoProcMountPoint = "/aporetoproc"
 	// DefaultSecretsPath is the default path for the secrets proxy.
 	DefaultSecretsPath = "@secrets"
+	// DefaultEnvoyAuthorizerPath is the default path prefix of the envoy authorizer
+	// sockets. The context ID of the PU is appended to it.
+	DefaultEnvoyAuthorizerPath = "@aporeto-envoy-authz-"
 )
 
 const (
@@ -133,3 +136,8 @@ const (
 	// DatapathTokenValidity determines how long the tokens are valid.
 	DatapathTokenValidity = 1 * time.Minute
 )
+
+const (
+	// DefaultPolicyHistorySize is the number of versions of the policy of a PU kept for rollbacks.
+	DefaultPolicyHistorySize = 10
+)
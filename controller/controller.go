@@ -12,11 +12,13 @@ import (
 	"go.aporeto.io/trireme-lib/controller/constants"
 	"go.aporeto.io/trireme-lib/controller/internal/enforcer"
 	"go.aporeto.io/trireme-lib/controller/internal/supervisor"
+	"go.aporeto.io/trireme-lib/controller/pkg/canary"
 	"go.aporeto.io/trireme-lib/controller/pkg/claimsheader"
 	"go.aporeto.io/trireme-lib/controller/pkg/dmesgparser"
 	"go.aporeto.io/trireme-lib/controller/pkg/env"
 	"go.aporeto.io/trireme-lib/controller/pkg/fqconfig"
 	"go.aporeto.io/trireme-lib/controller/pkg/packettracing"
+	"go.aporeto.io/trireme-lib/controller/pkg/policyhistory"
 	"go.aporeto.io/trireme-lib/controller/pkg/secrets"
 	"go.aporeto.io/trireme-lib/controller/runtime"
 	"go.aporeto.io/trireme-lib/policy"
@@ -38,6 +40,26 @@ type trireme struct {
 	puTypeToEnforcerType map[common.PUType]constants.ModeType
 	enablingTrace        chan *traceTrigger
 	locks                sync.Map
+	schedules            sync.Map
+	history              *policyhistory.History
+	canaries             *canary.Collector
+	rollouts             sync.Map
+}
+
+// scheduledPolicy is the policy of a PU with scheduled rules. The active
+// rules are enforced again every time the timer fires.
+type scheduledPolicy struct {
+	policy  *policy.PUPolicy
+	runtime *policy.PURuntime
+	timer   *time.Timer
+}
+
+// canaryRollout is a policy observed on a PU before it is enforced.
+type canaryRollout struct {
+	policy  *policy.PUPolicy
+	runtime *policy.PURuntime
+	cfg     *canary.Config
+	timer   *time.Timer
 }
 
 // New returns a trireme interface implementation based on configuration provided.
@@ -52,6 +74,7 @@ func New(serverID string, mode constants.ModeType, opts ...Option) TriremeContro
 		validity:               constants.DatapathTokenValidity,
 		procMountPoint:         constants.DefaultProcMountPoint,
 		externalIPcacheTimeout: -1,
+		policyHistorySize:      constants.DefaultPolicyHistorySize,
 		remoteParameters: &env.RemoteParameters{
 			LogToConsole:   true,
 			LogFormat:      "console",
@@ -105,11 +128,22 @@ func (t *trireme) CleanUp() error {
 }
 
 // Enforce asks the controller to enforce policy to a processing unit
-func (t *trireme) Enforce(ctx context.Context, puID string, policy *policy.PUPolicy, runtime *policy.PURuntime) error {
+func (t *trireme) Enforce(ctx context.Context, puID string, plc *policy.PUPolicy, runtime *policy.PURuntime) error {
 	lock, _ := t.locks.LoadOrStore(puID, &sync.Mutex{})
 	lock.(*sync.Mutex).Lock()
 	defer lock.(*sync.Mutex).Unlock()
-	return t.doHandleCreate(puID, policy, runtime)
+
+	// The policy is recorded as received since the controller adds tags to the enforced policies.
+	recorded := plc.Clone()
+
+	if err := t.doHandleCreate(puID, plc.ActivePolicy(time.Now()), runtime); err != nil {
+		return err
+	}
+
+	t.schedulePolicy(puID, plc, runtime)
+	t.recordPolicy(puID, recorded, runtime, 0)
+
+	return nil
 }
 
 // Enforce asks the controller to enforce policy to a processing unit
@@ -120,6 +154,11 @@ func (t *trireme) UnEnforce(ctx context.Context, puID string, policy *policy.PUP
 		t.locks.Delete(puID)
 		lock.(*sync.Mutex).Unlock()
 	}()
+
+	t.cancelCanary(puID)
+	t.unschedulePolicy(puID)
+	t.history.Delete(puID)
+
 	return t.doHandleDelete(puID, runtime)
 }
 
@@ -128,7 +167,317 @@ func (t *trireme) UpdatePolicy(ctx context.Context, puID string, plc *policy.PUP
 	lock, _ := t.locks.LoadOrStore(puID, &sync.Mutex{})
 	lock.(*sync.Mutex).Lock()
 	defer lock.(*sync.Mutex).Unlock()
-	return t.doUpdatePolicy(puID, plc, runtime)
+
+	t.cancelCanary(puID)
+
+	// The policy is recorded as received since the controller adds tags to the enforced policies.
+	recorded := plc.Clone()
+
+	if err := t.doUpdatePolicy(puID, plc.ActivePolicy(time.Now()), runtime); err != nil {
+		return err
+	}
+
+	t.schedulePolicy(puID, plc, runtime)
+	t.recordPolicy(puID, recorded, runtime, 0)
+
+	return nil
+}
+
+// PolicyVersions returns the versions of the policy of a PU, the oldest first.
+func (t *trireme) PolicyVersions(puID string) ([]*policyhistory.Version, error) {
+	return t.history.Versions(puID)
+}
+
+// DiffPolicyVersions returns the rules added and removed to go from one version
+// of the policy of a PU to another.
+func (t *trireme) DiffPolicyVersions(puID string, from, to int) (*policy.PolicyDiff, error) {
+	return t.history.Diff(puID, from, to)
+}
+
+// RollbackPolicy enforces a previous version of the policy of a PU with its
+// current runtime. If the supervisor or the enforcer fail to apply it, the
+// current version is enforced again so that they stay consistent.
+func (t *trireme) RollbackPolicy(ctx context.Context, puID string, version int) error {
+	lock, ok := t.locks.Load(puID)
+	if !ok {
+		return fmt.Errorf("unknown pu %s", puID)
+	}
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	target, err := t.history.Get(puID, version)
+	if err != nil {
+		return err
+	}
+
+	current, err := t.history.Current(puID)
+	if err != nil {
+		return err
+	}
+
+	t.cancelCanary(puID)
+
+	// The recorded policies are copied since the controller adds tags to the enforced policies.
+	plc := target.Policy.Clone()
+
+	if err := t.doUpdatePolicy(puID, plc.ActivePolicy(time.Now()), current.Runtime); err != nil {
+		if rerr := t.restorePolicy(puID, current); rerr != nil {
+			zap.L().Error("Unable to restore the policy after a failed rollback",
+				zap.String("contextID", puID),
+				zap.Int("version", current.Version),
+				zap.Error(rerr),
+			)
+		}
+		return fmt.Errorf("unable to roll back pu %s to version %d: %s", puID, version, err)
+	}
+
+	t.schedulePolicy(puID, plc, current.Runtime)
+	t.recordPolicy(puID, target.Policy, current.Runtime, version)
+
+	return nil
+}
+
+// restorePolicy enforces a recorded version of the policy of a PU again. It
+// must be called with the lock of the PU held.
+func (t *trireme) restorePolicy(puID string, v *policyhistory.Version) error {
+
+	plc := v.Policy.Clone()
+
+	if err := t.doUpdatePolicy(puID, plc.ActivePolicy(time.Now()), v.Runtime); err != nil {
+		return err
+	}
+
+	t.schedulePolicy(puID, plc, v.Runtime)
+
+	return nil
+}
+
+// CanaryUpdatePolicy observes the policy on the PU before enforcing it. The
+// rules of the policy are added as observation rules to the current policy of
+// the PU. At the end of the window, the policy is enforced if the rate of the
+// flows it would drop is under the threshold, or the current policy is
+// restored and the failure is reported otherwise.
+func (t *trireme) CanaryUpdatePolicy(ctx context.Context, puID string, plc *policy.PUPolicy, runtime *policy.PURuntime, cfg *canary.Config) error {
+
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	lock, ok := t.locks.Load(puID)
+	if !ok {
+		return fmt.Errorf("unknown pu %s", puID)
+	}
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	current, err := t.history.Current(puID)
+	if err != nil {
+		return err
+	}
+
+	t.cancelCanary(puID)
+
+	now := time.Now()
+	candidate := plc.ActivePolicy(now)
+
+	if err := t.doUpdatePolicy(puID, current.Policy.ActivePolicy(now).ObserveRules(candidate), runtime); err != nil {
+		if rerr := t.restorePolicy(puID, current); rerr != nil {
+			zap.L().Error("Unable to restore the policy after a failed canary rollout",
+				zap.String("contextID", puID),
+				zap.Int("version", current.Version),
+				zap.Error(rerr),
+			)
+		}
+		return fmt.Errorf("unable to observe policy for pu %s: %s", puID, err)
+	}
+
+	// The schedules of the current policy are suspended during the rollout.
+	t.unschedulePolicy(puID)
+
+	r := &canaryRollout{
+		policy:  plc,
+		runtime: runtime,
+		cfg:     cfg,
+	}
+
+	t.canaries.Start(puID, candidate.TriremeAction() == policy.Police)
+
+	r.timer = time.AfterFunc(cfg.Window, func() {
+		t.completeCanary(puID, r)
+	})
+
+	t.rollouts.Store(puID, r)
+
+	return nil
+}
+
+// cancelCanary stops the rollout of the PU if there is one. It must be called
+// with the lock of the PU held.
+func (t *trireme) cancelCanary(puID string) {
+
+	if r, ok := t.rollouts.Load(puID); ok {
+		r.(*canaryRollout).timer.Stop()
+		t.rollouts.Delete(puID)
+		t.canaries.Stop(puID)
+
+		zap.L().Info("Canary rollout cancelled", zap.String("contextID", puID))
+	}
+}
+
+// completeCanary promotes or aborts the rollout at the end of its window and
+// reports the result.
+func (t *trireme) completeCanary(puID string, r *canaryRollout) {
+
+	result := t.finishCanary(puID, r)
+	if result == nil {
+		return
+	}
+
+	if result.Promoted {
+		zap.L().Info("Canary rollout promoted",
+			zap.String("contextID", puID),
+			zap.Uint64("flows", result.Flows),
+			zap.Uint64("drops", result.Drops),
+		)
+	} else {
+		zap.L().Warn("Canary rollout aborted",
+			zap.String("contextID", puID),
+			zap.Uint64("flows", result.Flows),
+			zap.Uint64("drops", result.Drops),
+			zap.Error(result.Error),
+		)
+
+		if t.config.runtimeErrorChannel != nil {
+			t.config.runtimeErrorChannel <- &policy.RuntimeError{
+				ContextID: puID,
+				Error:     fmt.Errorf("canary rollout aborted: %s", result.Error),
+			}
+		}
+	}
+
+	if r.cfg.Notify != nil {
+		r.cfg.Notify(result)
+	}
+}
+
+// finishCanary enforces the candidate policy or restores the current policy
+// of the PU. It returns nil if the rollout was cancelled in the meantime.
+func (t *trireme) finishCanary(puID string, r *canaryRollout) *canary.Result {
+
+	lock, ok := t.locks.Load(puID)
+	if !ok {
+		return nil
+	}
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	if current, ok := t.rollouts.Load(puID); !ok || current.(*canaryRollout) != r {
+		return nil
+	}
+	t.rollouts.Delete(puID)
+
+	result := t.canaries.Stop(puID)
+	result.Evaluate(r.cfg)
+
+	if result.Promoted {
+		recorded := r.policy.Clone()
+
+		if err := t.doUpdatePolicy(puID, r.policy.ActivePolicy(time.Now()), r.runtime); err != nil {
+			result.Promoted = false
+			result.Error = fmt.Errorf("unable to enforce policy: %s", err)
+		} else {
+			t.schedulePolicy(puID, r.policy, r.runtime)
+			t.recordPolicy(puID, recorded, r.runtime, 0)
+			return result
+		}
+	}
+
+	current, err := t.history.Current(puID)
+	if err == nil {
+		err = t.restorePolicy(puID, current)
+	}
+
+	if err != nil {
+		zap.L().Error("Unable to restore the policy after an aborted canary rollout",
+			zap.String("contextID", puID),
+			zap.Error(err),
+		)
+	}
+
+	return result
+}
+
+// recordPolicy adds the policy enforced on the PU to its history. The policy
+// must not hold the tags added by the controller, which are added again when
+// it is restored. It must be called with the lock of the PU held.
+func (t *trireme) recordPolicy(puID string, plc *policy.PUPolicy, runtime *policy.PURuntime, rollbackOf int) {
+
+	if _, err := t.history.Record(puID, plc, runtime, rollbackOf); err != nil {
+		zap.L().Warn("Unable to record the policy history",
+			zap.String("contextID", puID),
+			zap.Error(err),
+		)
+	}
+}
+
+// schedulePolicy arms a timer that enforces the policy of the PU again the
+// next time one of its scheduled rules becomes active or inactive. It replaces
+// any previous timer of the PU and must be called with the lock of the PU held.
+func (t *trireme) schedulePolicy(puID string, plc *policy.PUPolicy, runtime *policy.PURuntime) {
+
+	t.unschedulePolicy(puID)
+
+	next, ok := plc.NextScheduleTransition(time.Now())
+	if !ok {
+		return
+	}
+
+	s := &scheduledPolicy{
+		policy:  plc,
+		runtime: runtime,
+	}
+
+	s.timer = time.AfterFunc(time.Until(next), func() {
+		t.applySchedule(puID, s)
+	})
+
+	t.schedules.Store(puID, s)
+}
+
+// unschedulePolicy stops the timer of the PU. It must be called with the lock
+// of the PU held.
+func (t *trireme) unschedulePolicy(puID string) {
+
+	if s, ok := t.schedules.Load(puID); ok {
+		s.(*scheduledPolicy).timer.Stop()
+		t.schedules.Delete(puID)
+	}
+}
+
+// applySchedule enforces the rules of the policy that are active now and arms
+// the timer for the next transition.
+func (t *trireme) applySchedule(puID string, s *scheduledPolicy) {
+
+	lock, ok := t.locks.Load(puID)
+	if !ok {
+		return
+	}
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	// The policy was updated or the PU was deleted while we were waiting.
+	if current, ok := t.schedules.Load(puID); !ok || current.(*scheduledPolicy) != s {
+		return
+	}
+
+	if err := t.doUpdatePolicy(puID, s.policy.ActivePolicy(time.Now()), s.runtime); err != nil {
+		zap.L().Error("Unable to enforce scheduled rules",
+			zap.String("contextID", puID),
+			zap.Error(err),
+		)
+	}
+
+	t.schedulePolicy(puID, s.policy, s.runtime)
 }
 
 // UpdateSecrets updates the secrets of the controllers.
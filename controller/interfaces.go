@@ -5,7 +5,9 @@ import (
 	"time"
 
 	"go.aporeto.io/trireme-lib/common"
+	"go.aporeto.io/trireme-lib/controller/pkg/canary"
 	"go.aporeto.io/trireme-lib/controller/pkg/packettracing"
+	"go.aporeto.io/trireme-lib/controller/pkg/policyhistory"
 	"go.aporeto.io/trireme-lib/controller/pkg/secrets"
 	"go.aporeto.io/trireme-lib/controller/runtime"
 	"go.aporeto.io/trireme-lib/policy"
@@ -35,6 +37,8 @@ type TriremeController interface {
 	// parameters can be updated during run time.
 	UpdateConfiguration(cfg *runtime.Configuration) error
 	DebugInfo
+	PolicyHistory
+	PolicyCanary
 }
 
 // DebugInfo is the interface implemented by controllers to support configuring debug options
@@ -44,3 +48,22 @@ type DebugInfo interface {
 	// EnablePacketTracing enable iptables -j trace for the particular pu and is much wider packet stream.
 	EnableIPTablesPacketTracing(ctx context.Context, contextID string, interval time.Duration, putype common.PUType) error
 }
+
+// PolicyHistory is the interface implemented by controllers to keep the versions
+// of the policies enforced on the processing units and to roll them back
+type PolicyHistory interface {
+	// PolicyVersions returns the versions of the policy of a processing unit, the oldest first.
+	PolicyVersions(puID string) ([]*policyhistory.Version, error)
+	// DiffPolicyVersions returns the rules added and removed from one version of the policy of a processing unit to another.
+	DiffPolicyVersions(puID string, from, to int) (*policy.PolicyDiff, error)
+	// RollbackPolicy enforces again a previous version of the policy of a processing unit.
+	RollbackPolicy(ctx context.Context, puID string, version int) error
+}
+
+// PolicyCanary is the interface implemented by controllers to roll out policies
+// in observation mode before enforcing them
+type PolicyCanary interface {
+	// CanaryUpdatePolicy observes the policy on a processing unit and enforces it
+	// if the rate of the flows it would drop stays under the threshold.
+	CanaryUpdatePolicy(ctx context.Context, puID string, policy *policy.PUPolicy, runtime *policy.PURuntime, cfg *canary.Config) error
+}
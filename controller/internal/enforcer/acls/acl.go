@@ -26,7 +26,7 @@ func newACL() *acl {
 
 var errNoMatch = errors.New("No Match")
 
-func (a *acl) addToCache(ip net.IP, mask int, port string, policy *policy.FlowPolicy) error {
+func (a *acl) addToCache(ip net.IP, mask int, port string, policy *policy.FlowPolicy, nomatch bool) error {
 	var err error
 	var portList portActionList
 
@@ -34,6 +34,7 @@ func (a *acl) addToCache(ip net.IP, mask int, port string, policy *policy.FlowPo
 	if err != nil {
 		return fmt.Errorf("unable to create port action: %s", err)
 	}
+	r.nomatch = nomatch
 
 	val, exists := a.cache.Get(ip, mask)
 	if !exists {
@@ -56,6 +57,38 @@ func (a *acl) addToCache(ip net.IP, mask int, port string, policy *policy.FlowPo
 	return nil
 }
 
+// removeFromCache removes the port action of the policy from the entry of the
+// (ip, mask). The entry is removed when it has no port actions left.
+func (a *acl) removeFromCache(ip net.IP, mask int, port string, policy *policy.FlowPolicy, nomatch bool) error {
+
+	r, err := newPortAction(port, policy)
+	if err != nil {
+		return fmt.Errorf("unable to create port action: %s", err)
+	}
+	r.nomatch = nomatch
+
+	val, exists := a.cache.Get(ip, mask)
+	if !exists || val == nil {
+		return nil
+	}
+
+	portList := portActionList{}
+	for _, portAction := range val.(portActionList) {
+		if *r != *portAction {
+			portList = append(portList, portAction)
+		}
+	}
+
+	if len(portList) == 0 {
+		a.removeIPMask(ip, mask)
+		return nil
+	}
+
+	a.cache.Put(ip, mask, portList)
+
+	return nil
+}
+
 func (a *acl) removeIPMask(ip net.IP, mask int) {
 	a.cache.Put(ip, mask, nil)
 }
@@ -64,12 +97,13 @@ func (a *acl) matchRule(ip net.IP, port uint16, preReport *policy.FlowPolicy) (r
 	report = preReport
 
 	err = errNoMatch
+	excluded := map[ruleKey]bool{}
 
 	lookup := func(val interface{}) bool {
 		if val != nil {
 			portList := val.(portActionList)
 
-			report, packet, err = portList.lookup(port, report)
+			report, packet, err = portList.lookupExcluding(port, report, excluded)
 			if err == nil {
 				return true
 			}
@@ -82,43 +116,50 @@ func (a *acl) matchRule(ip net.IP, port uint16, preReport *policy.FlowPolicy) (r
 	return report, packet, err
 }
 
-func (a *acl) addRule(rule policy.IPRule) (err error) {
+// parseAddress returns the ip and the mask of an address or a subnet, and
+// true if the address is excluded from the rule.
+func parseAddress(address string) (net.IP, int, bool, error) {
 
-	addCache := func(address, port string) error {
-		var mask int
-		parts := strings.Split(address, "/")
-		ip := net.ParseIP(parts[0])
-		if ip == nil {
-			return fmt.Errorf("invalid ip address: %s", parts[0])
-		}
+	address, excluded := policy.ExcludedAddress(address)
 
-		if len(parts) == 1 {
-			if ip.To4() != nil {
-				mask = 32
-			} else {
-				mask = 128
-			}
-		} else {
-			mask, err = strconv.Atoi(parts[1])
-			if err != nil {
-				return fmt.Errorf("invalid address: %s", err)
-			}
-		}
+	parts := strings.Split(address, "/")
+	ip := net.ParseIP(parts[0])
+	if ip == nil {
+		return nil, 0, false, fmt.Errorf("invalid ip address: %s", parts[0])
+	}
 
-		if err := a.addToCache(ip, mask, port, rule.Policy); err != nil {
-			return err
+	if len(parts) == 1 {
+		if ip.To4() != nil {
+			return ip, 32, excluded, nil
 		}
+		return ip, 128, excluded, nil
+	}
 
-		return nil
+	mask, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, 0, false, fmt.Errorf("invalid address: %s", err)
 	}
 
+	return ip, mask, excluded, nil
+}
+
+// forEachEntry calls the function for every address and port of the TCP
+// rule, which are the only rules in the cache. ICMP rules are only enforced
+// by the supervisor since ICMP packets are never queued to the datapath. The
+// excluded addresses are added as nomatch entries.
+func forEachEntry(rule policy.IPRule, f func(ip net.IP, mask int, port string, nomatch bool) error) error {
+
 	for _, proto := range rule.Protocols {
 		if strings.ToLower(proto) != constants.TCPProtoNum {
 			continue
 		}
 		for _, address := range rule.Addresses {
 			for _, port := range rule.Ports {
-				if err := addCache(address, port); err != nil {
+				ip, mask, nomatch, err := parseAddress(address)
+				if err != nil {
+					return err
+				}
+				if err := f(ip, mask, port, nomatch); err != nil {
 					return err
 				}
 			}
@@ -128,6 +169,21 @@ func (a *acl) addRule(rule policy.IPRule) (err error) {
 	return nil
 }
 
+func (a *acl) addRule(rule policy.IPRule) (err error) {
+
+	return forEachEntry(rule, func(ip net.IP, mask int, port string, nomatch bool) error {
+		return a.addToCache(ip, mask, port, rule.Policy, nomatch)
+	})
+}
+
+// removeRule removes the entries of a rule that was added to the acl.
+func (a *acl) removeRule(rule policy.IPRule) (err error) {
+
+	return forEachEntry(rule, func(ip net.IP, mask int, port string, nomatch bool) error {
+		return a.removeFromCache(ip, mask, port, rule.Policy, nomatch)
+	})
+}
+
 // getMatchingAction does lookup in acl in a common way for accept/reject rules.
 func (a *acl) getMatchingAction(ip net.IP, port uint16, preReport *policy.FlowPolicy) (report *policy.FlowPolicy, packet *policy.FlowPolicy, err error) {
 
@@ -52,6 +52,33 @@ func (c *ACLCache) AddRuleList(rules policy.IPRuleList) (err error) {
 	return
 }
 
+// RemoveRule removes a single rule that was added to the ACL Cache. The
+// entries are found by the policy of the rule.
+func (c *ACLCache) RemoveRule(rule policy.IPRule) (err error) {
+
+	if rule.Policy.ObserveAction.ObserveApply() {
+		return c.observe.removeRule(rule)
+	}
+
+	if rule.Policy.Action.Accepted() {
+		return c.accept.removeRule(rule)
+	}
+
+	return c.reject.removeRule(rule)
+}
+
+// RemoveRuleList removes a list of rules from the cache
+func (c *ACLCache) RemoveRuleList(rules policy.IPRuleList) (err error) {
+
+	for _, rule := range rules {
+		if err = c.RemoveRule(rule); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
 // RemoveIPMask removes the entries indexed with (ip, mask). This is an idempotent operation
 // and thus does not returns an error
 func (c *ACLCache) RemoveIPMask(ip net.IP, mask int) {
@@ -201,3 +201,157 @@ func TestObserveContinueApplyCacheLookup(t *testing.T) {
 		})
 	})
 }
+
+func TestRemoveRuleCacheLookup(t *testing.T) {
+
+	rules = policy.IPRuleList{
+		policy.IPRule{
+			Addresses: []string{"172.0.0.0/8"},
+			Ports:     []string{"1", "100:200"},
+			Protocols: []string{constants.TCPProtoNum},
+			Policy: &policy.FlowPolicy{
+				Action:   policy.Accept,
+				PolicyID: "tcp172/8"},
+		},
+		policy.IPRule{
+			Addresses: []string{"172.0.0.0/8"},
+			Ports:     []string{"2"},
+			Protocols: []string{constants.TCPProtoNum},
+			Policy: &policy.FlowPolicy{
+				Action:   policy.Accept,
+				PolicyID: "tcp172/8-2"},
+		},
+		policy.IPRule{
+			Addresses: []string{"172.1.1.1"},
+			Ports:     []string{"1"},
+			Protocols: []string{constants.TCPProtoNum},
+			Policy: &policy.FlowPolicy{
+				Action:   policy.Reject,
+				PolicyID: "host"},
+		},
+	}
+
+	Convey("Given an ACL Cache with accept and reject rules", t, func() {
+		c := NewACLCache()
+		So(c.AddRuleList(rules), ShouldBeNil)
+
+		ip := net.ParseIP("172.1.1.1").To4()
+
+		_, p, err := c.GetMatchingAction(ip, 1)
+		So(err, ShouldBeNil)
+		So(p.PolicyID, ShouldEqual, "host")
+
+		Convey("When I remove the reject rule, the accept rule should match", func() {
+			So(c.RemoveRule(rules[2]), ShouldBeNil)
+
+			_, p, err := c.GetMatchingAction(ip, 1)
+			So(err, ShouldBeNil)
+			So(p.PolicyID, ShouldEqual, "tcp172/8")
+
+			Convey("When I remove an accept rule, the other rule of the subnet should match", func() {
+				So(c.RemoveRule(rules[0]), ShouldBeNil)
+
+				_, _, err := c.GetMatchingAction(ip, 1)
+				So(err, ShouldNotBeNil)
+
+				_, _, err = c.GetMatchingAction(ip, 150)
+				So(err, ShouldNotBeNil)
+
+				_, p, err := c.GetMatchingAction(ip, 2)
+				So(err, ShouldBeNil)
+				So(p.PolicyID, ShouldEqual, "tcp172/8-2")
+			})
+		})
+
+		Convey("When I remove a rule that is not in the cache, nothing should change", func() {
+			So(c.RemoveRuleList(policy.IPRuleList{
+				policy.IPRule{
+					Addresses: []string{"172.1.1.1"},
+					Ports:     []string{"1"},
+					Protocols: []string{constants.TCPProtoNum},
+					Policy:    &policy.FlowPolicy{Action: policy.Reject, PolicyID: "host"},
+				},
+			}), ShouldBeNil)
+
+			_, p, err := c.GetMatchingAction(ip, 1)
+			So(err, ShouldBeNil)
+			So(p.PolicyID, ShouldEqual, "host")
+		})
+	})
+}
+
+func TestExcludedAddressesCacheLookup(t *testing.T) {
+
+	rules = policy.IPRuleList{
+		policy.IPRule{
+			Addresses: []string{"0.0.0.0/0", "!10.0.0.0/8", "!169.254.169.254/32", "10.1.0.0/16"},
+			Ports:     []string{"443"},
+			Protocols: []string{constants.TCPProtoNum},
+			Policy: &policy.FlowPolicy{
+				Action:   policy.Accept,
+				PolicyID: "internet"},
+		},
+		policy.IPRule{
+			Addresses: []string{"10.0.0.0/8"},
+			Ports:     []string{"1:1000"},
+			Protocols: []string{constants.TCPProtoNum},
+			Policy: &policy.FlowPolicy{
+				Action:   policy.Accept,
+				PolicyID: "private"},
+		},
+	}
+
+	Convey("Given an ACL Cache with a rule with excluded addresses", t, func() {
+		c := NewACLCache()
+		So(c.AddRuleList(rules), ShouldBeNil)
+
+		Convey("The addresses that are not excluded should match the rule", func() {
+			_, p, err := c.GetMatchingAction(net.ParseIP("8.8.8.8").To4(), 443)
+			So(err, ShouldBeNil)
+			So(p.PolicyID, ShouldEqual, "internet")
+		})
+
+		Convey("The excluded addresses should not match the rule", func() {
+			_, _, err := c.GetMatchingAction(net.ParseIP("169.254.169.254").To4(), 443)
+			So(err, ShouldNotBeNil)
+
+			_, p, err := c.GetMatchingAction(net.ParseIP("10.2.0.1").To4(), 443)
+			So(err, ShouldBeNil)
+			So(p.PolicyID, ShouldEqual, "private")
+		})
+
+		Convey("The longest prefix of the rule should decide", func() {
+			_, p, err := c.GetMatchingAction(net.ParseIP("10.1.0.1").To4(), 443)
+			So(err, ShouldBeNil)
+			So(p.PolicyID, ShouldEqual, "internet")
+		})
+
+		Convey("When I remove the rule, the exclusions should be removed", func() {
+			So(c.RemoveRule(rules[0]), ShouldBeNil)
+
+			_, _, err := c.GetMatchingAction(net.ParseIP("8.8.8.8").To4(), 443)
+			So(err, ShouldNotBeNil)
+
+			_, p, err := c.GetMatchingAction(net.ParseIP("10.2.0.1").To4(), 443)
+			So(err, ShouldBeNil)
+			So(p.PolicyID, ShouldEqual, "private")
+		})
+	})
+
+	Convey("Given an ACL Cache with the exclusions of a rule added with a copy of its policy", t, func() {
+		c := NewACLCache()
+
+		exclusions := rules[0]
+		exclusions.Addresses = []string{"!8.8.8.0/24"}
+		policyCopy := *rules[0].Policy
+		exclusions.Policy = &policyCopy
+
+		So(c.AddRule(rules[0]), ShouldBeNil)
+		So(c.AddRule(exclusions), ShouldBeNil)
+
+		Convey("The excluded addresses should not match the rule", func() {
+			_, _, err := c.GetMatchingAction(net.ParseIP("8.8.8.8").To4(), 443)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -12,16 +12,42 @@ import (
 // ErrNoMatch is error returned when no match is found.
 var ErrNoMatch = errors.New("No Match")
 
-// portAction captures the minimum and maximum ports for an action
+// portAction captures the minimum and maximum ports for an action. A nomatch
+// port action excludes the addresses of its prefix from the policy.
 type portAction struct {
-	min    uint16
-	max    uint16
-	policy *policy.FlowPolicy
+	min     uint16
+	max     uint16
+	policy  *policy.FlowPolicy
+	nomatch bool
 }
 
 // portActionList is a list of Port Actions
 type portActionList []*portAction
 
+// ruleKey identifies the rule of a port action. The port actions of a rule
+// share it even if they hold different copies of its policy.
+type ruleKey struct {
+	policyID      string
+	serviceID     string
+	action        policy.ActionType
+	observeAction policy.ObserveActionType
+}
+
+// keyOf returns the key of the rule of the policy.
+func keyOf(f *policy.FlowPolicy) ruleKey {
+
+	if f == nil {
+		return ruleKey{}
+	}
+
+	return ruleKey{
+		policyID:      f.PolicyID,
+		serviceID:     f.ServiceID,
+		action:        f.Action,
+		observeAction: f.ObserveAction,
+	}
+}
+
 // newPortAction parses a port spec and creates the action
 func newPortAction(tcpport string, policy *policy.FlowPolicy) (*portAction, error) {
 
@@ -65,10 +91,29 @@ func newPortAction(tcpport string, policy *policy.FlowPolicy) (*portAction, erro
 
 func (p *portActionList) lookup(port uint16, preReported *policy.FlowPolicy) (report *policy.FlowPolicy, packet *policy.FlowPolicy, err error) {
 
+	return p.lookupExcluding(port, preReported, map[ruleKey]bool{})
+}
+
+// lookupExcluding looks up the port in the list and skips the excluded
+// rules. The nomatch port actions that match the port add their rule to the
+// excluded rules, so that the shorter prefixes evaluated next do not match
+// it.
+func (p *portActionList) lookupExcluding(port uint16, preReported *policy.FlowPolicy, excluded map[ruleKey]bool) (report *policy.FlowPolicy, packet *policy.FlowPolicy, err error) {
+
 	report = preReported
 
+	for _, pa := range *p {
+		if pa.nomatch && port >= pa.min && port <= pa.max {
+			excluded[keyOf(pa.policy)] = true
+		}
+	}
+
 	// Scan the ports - TODO: better algorithm needed here
 	for _, pa := range *p {
+		if pa.nomatch || excluded[keyOf(pa.policy)] {
+			continue
+		}
+
 		if port >= pa.min && port <= pa.max {
 
 			// Check observed policies.
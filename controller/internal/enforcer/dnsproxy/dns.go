@@ -13,6 +13,7 @@ import (
 	"github.com/miekg/dns"
 	"go.aporeto.io/trireme-lib/collector"
 	"go.aporeto.io/trireme-lib/controller/pkg/flowtracking"
+	"go.aporeto.io/trireme-lib/controller/pkg/packet"
 	"go.aporeto.io/trireme-lib/controller/pkg/pucontext"
 	"go.aporeto.io/trireme-lib/policy"
 	"go.aporeto.io/trireme-lib/utils/cache"
@@ -21,11 +22,17 @@ import (
 
 // Proxy struct represents the object for dns proxy
 type Proxy struct {
-	puFromID          cache.DataStore
-	conntrack         flowtracking.FlowClient
-	collector         collector.EventCollector
-	contextIDToServer map[string]*dns.Server
-	chreports         chan dnsReport
+	puFromID           cache.DataStore
+	conntrack          flowtracking.FlowClient
+	collector          collector.EventCollector
+	contextIDToServer  map[string][]*dns.Server
+	contextIDToACLs    map[string]map[string]*learnedACL
+	contextIDToAliases map[string]map[string]*learnedAlias
+	chreports          chan dnsReport
+	upstream           *policy.DNSUpstream
+	upstreams          map[policy.DNSUpstream]*upstreamClient
+	learnedACLsHandler func(contextID string, rules policy.IPRuleList) error
+	aclsLock           sync.Mutex
 	sync.RWMutex
 }
 
@@ -62,10 +69,31 @@ func listenUDP(network, addr string) (net.PacketConn, error) {
 	return lc.ListenPacket(context.Background(), network, addr)
 }
 
-func forwardDNSReq(r *dns.Msg, ip net.IP, port uint16) (*dns.Msg, []string, error) {
-	var ips []string
-	c := new(dns.Client)
-	c.Dialer = &net.Dialer{
+func listenTCP(network, addr string) (net.Listener, error) {
+	var lc net.ListenConfig
+
+	lc.Control = socketOptions
+
+	return lc.Listen(context.Background(), network, addr)
+}
+
+// addrInfo returns the ip, the port and the protocol number of the address
+// of a dns request received over UDP or TCP.
+func addrInfo(addr net.Addr) (net.IP, int, uint8) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port, packet.IPProtocolTCP
+	case *net.UDPAddr:
+		return a.IP, a.Port, packet.IPProtocolUDP
+	default:
+		return nil, 0, 0
+	}
+}
+
+// markedDialer returns a dialer that marks the connections of the proxy, so
+// that they are not redirected back to it.
+func markedDialer() *net.Dialer {
+	return &net.Dialer{
 		Control: func(_, _ string, c syscall.RawConn) error {
 			return c.Control(func(fd uintptr) {
 				if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, proxyMarkInt); err != nil {
@@ -75,42 +103,87 @@ func forwardDNSReq(r *dns.Msg, ip net.IP, port uint16) (*dns.Msg, []string, erro
 		},
 		Timeout: dnsRequestTimeout,
 	}
+}
 
-	in, _, err := c.Exchange(r, net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
-	if err != nil {
-		return nil, nil, err
+func forwardDNSReq(r *dns.Msg, upstream string, proto uint8) (*dns.Msg, time.Duration, error) {
+	c := new(dns.Client)
+	if proto == packet.IPProtocolTCP {
+		c.Net = "tcp"
 	}
+	c.Dialer = markedDialer()
 
-	for _, ans := range in.Answer {
-		if ans.Header().Rrtype == dns.TypeA {
-			t, _ := ans.(*dns.A)
-			ips = append(ips, t.A.String())
-		}
+	return c.Exchange(r, upstream)
+}
 
-		if ans.Header().Rrtype == dns.TypeAAAA {
-			t, _ := ans.(*dns.AAAA)
-			ips = append(ips, t.AAAA.String())
+// udpSize returns the size of the answers that the client of the request
+// accepts over UDP.
+func udpSize(r *dns.Msg) int {
+
+	if opt := r.IsEdns0(); opt != nil && int(opt.UDPSize()) > dns.MinMsgSize {
+		return int(opt.UDPSize())
+	}
+
+	return dns.MinMsgSize
+}
+
+// filterRcode returns the response code of the queries blocked by the filter
+// mode, and false if the queries are forwarded.
+func filterRcode(mode policy.DNSFilterMode) (int, bool) {
+
+	switch mode {
+	case policy.DNSFilterNXDomain:
+		return dns.RcodeNameError, true
+	case policy.DNSFilterRefused:
+		return dns.RcodeRefused, true
+	default:
+		return dns.RcodeSuccess, false
+	}
+}
+
+// enforced returns true if one of the DNS ACLs is enforced. The ACLs that
+// are only observed, like the ACLs of a candidate policy, do not allow the
+// queries of their names.
+func enforced(ps []policy.PortProtocolPolicy) bool {
+
+	for _, p := range ps {
+		if p.Policy == nil || !p.Policy.ObserveAction.ObserveContinue() {
+			return true
 		}
 	}
 
-	return in, ips, nil
+	return false
 }
 
 func (s *serveDNS) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 	var err error
-	lAddr := w.LocalAddr().(*net.UDPAddr)
-	rAddr := w.RemoteAddr().(*net.UDPAddr)
+	_, lPort, proto := addrInfo(w.LocalAddr())
+	rIP, rPort, _ := addrInfo(w.RemoteAddr())
+
+	// The queries with no question or more than one are malformed for the
+	// servers in practice, so they are rejected before any lookup.
+	if len(r.Question) != 1 {
+		reply := new(dns.Msg)
+		reply.SetRcodeFormatError(r)
+		if err = w.WriteMsg(reply); err != nil {
+			zap.L().Error("Writing dns format error back to the client returned error", zap.Error(err))
+		}
+		return
+	}
+
 	var puCtx *pucontext.PUContext
+	lookup := &dnsLookup{
+		nameLookup: r.Question[0].Name,
+		queryType:  dns.TypeToString[r.Question[0].Qtype],
+	}
 
 	defer func() {
 		if puCtx != nil {
-			s.reportDNSLookup(r.Question[0].Name, puCtx, rAddr.IP, "")
+			s.reportDNSLookup(lookup, puCtx, rIP)
 		}
 	}()
 
-	origIP, origPort, _, err := s.conntrack.GetOriginalDest(net.ParseIP("127.0.0.1"), rAddr.IP, uint16(lAddr.Port), uint16(rAddr.Port), 17)
-	if err != nil {
-		zap.L().Error("Failed to find flow for the redirected dns traffic", zap.Error(err))
+	if proto == 0 {
+		zap.L().Error("Unsupported transport for the redirected dns traffic", zap.String("addr", w.RemoteAddr().String()))
 		return
 	}
 
@@ -120,24 +193,78 @@ func (s *serveDNS) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 		return
 	}
 
-	dnsReply, ips, err := forwardDNSReq(r, origIP, origPort)
+	// The queries for the names without enforced DNS ACLs are answered
+	// locally if the PU filters them, so that they never leave the host.
+	// The aliases of the allowed names are allowed too.
+	ctx := data.(*pucontext.PUContext)
+	_, _, ps, perr := s.chainPolicies(s.contextID, ctx, []string{r.Question[0].Name})
+	if rcode, ok := filterRcode(ctx.DNSFilterMode()); ok && (perr != nil || !enforced(ps)) {
+		puCtx = ctx
+		lookup.rcode = dns.RcodeToString[rcode]
+		lookup.error = "blocked by policy: " + lookup.rcode
+
+		reply := new(dns.Msg)
+		reply.SetRcode(r, rcode)
+		if err = w.WriteMsg(reply); err != nil {
+			zap.L().Error("Writing blocked dns response back to the client returned error", zap.Error(err))
+		}
+		return
+	}
+
+	client, err := s.upstreamFor(ctx)
 	if err != nil {
-		zap.L().Debug("Forwarded dns request returned error", zap.Error(err))
+		zap.L().Error("Invalid dns upstream", zap.String("contextID", s.contextID), zap.Error(err))
 		return
 	}
 
-	puCtx = data.(*pucontext.PUContext)
-	ps, err1 := puCtx.GetPolicyFromFQDN(r.Question[0].Name)
-	if err1 == nil {
-		for _, p := range ps {
-			if err1 := puCtx.UpdateApplicationACLs(policy.IPRuleList{{Addresses: ips,
-				Ports:     p.Ports,
-				Protocols: p.Protocols,
-				Policy:    p.Policy,
-			}}); err1 != nil {
-				zap.L().Error("Adding IP rule returned error", zap.Error(err1))
-			}
+	var dnsReply *dns.Msg
+	var rtt time.Duration
+	var upstream string
+
+	if client != nil {
+		// The encrypted upstream resolves the request instead of the
+		// server it was sent to.
+		upstream = client.name
+		dnsReply, rtt, err = client.exchange(r)
+	} else {
+		origIP, origPort, _, err1 := s.conntrack.GetOriginalDest(net.ParseIP("127.0.0.1"), rIP, uint16(lPort), uint16(rPort), proto)
+		if err1 != nil {
+			zap.L().Error("Failed to find flow for the redirected dns traffic", zap.Error(err1))
+			return
 		}
+
+		upstream = net.JoinHostPort(origIP.String(), strconv.Itoa(int(origPort)))
+		dnsReply, rtt, err = forwardDNSReq(r, upstream, proto)
+	}
+
+	if err != nil {
+		zap.L().Debug("Forwarded dns request returned error", zap.String("upstream", upstream), zap.Error(err))
+		return
+	}
+
+	puCtx = ctx
+	lookup.rcode = dns.RcodeToString[dnsReply.Rcode]
+	lookup.upstream = upstream
+	lookup.latency = rtt
+
+	// The addresses reached through the aliases of a name with DNS ACLs get
+	// the ACLs of the name.
+	lookup.aliases, lookup.answers = followCNAMEs(r.Question[0].Name, dnsReply)
+	names := []string{policy.NormalizeDNSName(r.Question[0].Name)}
+	for _, a := range lookup.aliases {
+		names = append(names, a.target)
+	}
+
+	if i, root, ps, err1 := s.chainPolicies(s.contextID, puCtx, names); err1 == nil {
+		lookup.policyMatched = true
+		s.learnAliases(s.contextID, root, lookup.aliases[i:])
+		s.learnACLs(s.contextID, puCtx, ps, lookup.answers)
+	}
+
+	// The answers of the encrypted upstream are not truncated for the
+	// clients over UDP, which retry over TCP if they need the whole answer.
+	if client != nil && proto == packet.IPProtocolUDP {
+		dnsReply.Truncate(udpSize(r))
 	}
 
 	if err = w.WriteMsg(dnsReply); err != nil {
@@ -145,49 +272,79 @@ func (s *serveDNS) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 	}
 }
 
-// StartDNSServer starts the dns server on the port provided for contextID
+// StartDNSServer starts the dns server on the port provided for contextID.
+// The server listens on both UDP and TCP so that the requests retried over
+// TCP after a truncated answer are handled the same way.
 func (p *Proxy) StartDNSServer(contextID, port string) error {
 	netPacketConn, err := listenUDP("udp", "127.0.0.1:"+port)
 	if err != nil {
 		return err
 	}
 
-	var server *dns.Server
+	listener, err := listenTCP("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		netPacketConn.Close() // nolint
+		return err
+	}
+
+	handler := &serveDNS{contextID, p}
+	p.startServer(contextID, &dns.Server{PacketConn: netPacketConn, Handler: handler})
+	p.startServer(contextID, &dns.Server{Listener: listener, Handler: handler})
+
+	return nil
+}
 
-	storeInMap := func() {
+func (p *Proxy) startServer(contextID string, server *dns.Server) {
+
+	server.NotifyStartedFunc = func() {
 		p.Lock()
 		defer p.Unlock()
 
-		p.contextIDToServer[contextID] = server
+		p.contextIDToServer[contextID] = append(p.contextIDToServer[contextID], server)
 	}
 
-	server = &dns.Server{NotifyStartedFunc: storeInMap, PacketConn: netPacketConn, Handler: &serveDNS{contextID, p}}
-
 	go func() {
 		if err := server.ActivateAndServe(); err != nil {
 			zap.L().Error("Could not start DNS proxy server", zap.Error(err))
 		}
 	}()
-
-	return nil
 }
 
-// ShutdownDNS shuts down the dns server for contextID
+// ShutdownDNS shuts down the dns servers for contextID
 func (p *Proxy) ShutdownDNS(contextID string) {
 	p.Lock()
 	defer p.Unlock()
-	if s, ok := p.contextIDToServer[contextID]; ok {
-		if err := s.Shutdown(); err != nil {
-			zap.L().Error("shutdown of dns server returned error", zap.String("contextID", contextID), zap.Error(err))
+	if servers, ok := p.contextIDToServer[contextID]; ok {
+		for _, s := range servers {
+			if err := s.Shutdown(); err != nil {
+				zap.L().Error("shutdown of dns server returned error", zap.String("contextID", contextID), zap.Error(err))
+			}
 		}
 		delete(p.contextIDToServer, contextID)
 	}
+
+	// The ACLs are removed with the context of the PU.
+	delete(p.contextIDToACLs, contextID)
+	delete(p.contextIDToAliases, contextID)
 }
 
-// New creates an instance of the dns proxy
-func New(puFromID cache.DataStore, conntrack flowtracking.FlowClient, c collector.EventCollector) *Proxy {
+// New creates an instance of the dns proxy. The requests of the PUs without
+// their own upstream are resolved with the upstream if not nil. The learned
+// ACLs expire until the context is done.
+func New(ctx context.Context, puFromID cache.DataStore, conntrack flowtracking.FlowClient, c collector.EventCollector, upstream *policy.DNSUpstream) *Proxy {
 	ch := make(chan dnsReport)
-	p := &Proxy{chreports: ch, puFromID: puFromID, collector: c, conntrack: conntrack, contextIDToServer: map[string]*dns.Server{}}
-	go p.reportDNSRequests(ch)
+	p := &Proxy{
+		chreports:          ch,
+		puFromID:           puFromID,
+		collector:          c,
+		conntrack:          conntrack,
+		contextIDToServer:  map[string][]*dns.Server{},
+		contextIDToACLs:    map[string]map[string]*learnedACL{},
+		contextIDToAliases: map[string]map[string]*learnedAlias{},
+		upstream:           upstream.Copy(),
+		upstreams:          map[policy.DNSUpstream]*upstreamClient{},
+	}
+	go p.reportDNSRequests(ch, waitTimeBeforeReport)
+	go p.expireACLsPeriodically(ctx)
 	return p
 }
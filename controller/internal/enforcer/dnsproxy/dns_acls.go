@@ -0,0 +1,210 @@
+// +build linux !darwin
+
+package dnsproxy
+
+import (
+	"context"
+	"time"
+
+	"go.aporeto.io/trireme-lib/controller/pkg/pucontext"
+	"go.aporeto.io/trireme-lib/policy"
+	"go.uber.org/zap"
+)
+
+const (
+	// dnsACLGracePeriod is added to the TTL of the answers, so that the
+	// clients that resolved a name just before the TTL expired can still
+	// connect to its addresses.
+	dnsACLGracePeriod = 60 * time.Second
+)
+
+var (
+	expireACLsInterval = 10 * time.Second
+)
+
+// dnsAnswer is an address of a dns answer with its TTL.
+type dnsAnswer struct {
+	ip  string
+	ttl time.Duration
+}
+
+// learnedACL is an application ACL learned from a dns answer.
+type learnedACL struct {
+	puCtx  *pucontext.PUContext
+	rule   policy.IPRule
+	expiry time.Time
+}
+
+// learnACLs adds the application ACLs of the policies for the addresses of
+// the answers to the context of the PU and to its rules. The ACLs that were
+// already learned are refreshed instead, and expire with the longest TTL that
+// was received.
+func (p *Proxy) learnACLs(contextID string, puCtx *pucontext.PUContext, policies []policy.PortProtocolPolicy, answers []dnsAnswer) {
+
+	now := time.Now()
+
+	// The context of the PU is updated without holding the lock of the
+	// proxy. The updates are serialized so that an expiry cannot remove the
+	// rules of an ACL after it was learned again.
+	p.aclsLock.Lock()
+	defer p.aclsLock.Unlock()
+
+	p.Lock()
+
+	learned, ok := p.contextIDToACLs[contextID]
+	if !ok {
+		learned = map[string]*learnedACL{}
+		p.contextIDToACLs[contextID] = learned
+	}
+
+	added := map[string]*learnedACL{}
+	rules := policy.IPRuleList{}
+
+	for _, pp := range policies {
+		for _, a := range answers {
+			expiry := now.Add(a.ttl + dnsACLGracePeriod)
+			key := a.ip + "|" + pp.Key()
+
+			// The ACLs learned for a previous context of the PU are not
+			// in the ACLs of the current one.
+			if l, ok := learned[key]; ok && l.puCtx == puCtx {
+				if expiry.After(l.expiry) {
+					l.expiry = expiry
+				}
+				continue
+			}
+
+			rule := policy.IPRule{
+				Addresses: []string{a.ip},
+				Ports:     pp.Ports,
+				Protocols: pp.Protocols,
+				Policy:    pp.Policy,
+			}
+
+			l := &learnedACL{puCtx: puCtx, rule: rule, expiry: expiry}
+			learned[key] = l
+			added[key] = l
+			rules = append(rules, rule)
+		}
+	}
+
+	p.Unlock()
+
+	if len(rules) == 0 {
+		return
+	}
+
+	if err := puCtx.UpdateApplicationACLs(rules); err != nil {
+		zap.L().Error("Adding IP rules returned error", zap.String("contextID", contextID), zap.Error(err))
+
+		p.Lock()
+		for key, l := range added {
+			if learned[key] == l {
+				delete(learned, key)
+			}
+		}
+		p.Unlock()
+
+		return
+	}
+
+	p.updateLearnedACLs(contextID)
+}
+
+// updateLearnedACLs sends all the ACLs learned for the PU to the handler of
+// the learned ACLs, so that the rules of the PU are updated with them. The
+// caller must hold the lock of the ACLs.
+func (p *Proxy) updateLearnedACLs(contextID string) {
+
+	p.Lock()
+	handler := p.learnedACLsHandler
+	rules := policy.IPRuleList{}
+	for _, l := range p.contextIDToACLs[contextID] {
+		rules = append(rules, l.rule)
+	}
+	p.Unlock()
+
+	if handler == nil {
+		return
+	}
+
+	if err := handler(contextID, rules); err != nil {
+		zap.L().Error("Updating the rules with the learned ACLs returned error", zap.String("contextID", contextID), zap.Error(err))
+	}
+}
+
+// SetLearnedACLsHandler sets the handler that applies the learned ACLs of the
+// PUs to their rules.
+func (p *Proxy) SetLearnedACLsHandler(handler func(contextID string, rules policy.IPRuleList) error) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.learnedACLsHandler = handler
+}
+
+// expireACLs removes the learned ACLs and aliases that expired at the given
+// time.
+func (p *Proxy) expireACLs(now time.Time) {
+
+	p.aclsLock.Lock()
+	defer p.aclsLock.Unlock()
+
+	expired := map[*pucontext.PUContext]policy.IPRuleList{}
+	changed := []string{}
+
+	p.Lock()
+
+	p.expireAliases(now)
+
+	for contextID, learned := range p.contextIDToACLs {
+		n := len(learned)
+		for key, l := range learned {
+			if now.Before(l.expiry) {
+				continue
+			}
+
+			expired[l.puCtx] = append(expired[l.puCtx], l.rule)
+			delete(learned, key)
+		}
+
+		if len(learned) != n {
+			changed = append(changed, contextID)
+		}
+
+		if len(learned) == 0 {
+			delete(p.contextIDToACLs, contextID)
+		}
+	}
+
+	p.Unlock()
+
+	for puCtx, rules := range expired {
+		if err := puCtx.RemoveApplicationACLs(rules); err != nil {
+			zap.L().Error("Removing expired IP rules returned error",
+				zap.String("contextID", puCtx.ID()),
+				zap.Error(err),
+			)
+		}
+	}
+
+	for _, contextID := range changed {
+		p.updateLearnedACLs(contextID)
+	}
+}
+
+// expireACLsPeriodically expires the learned ACLs and aliases until the
+// context is done.
+func (p *Proxy) expireACLsPeriodically(ctx context.Context) {
+
+	ticker := time.NewTicker(expireACLsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			p.expireACLs(now)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// +build linux !darwin
+
+package dnsproxy
+
+import (
+	"errors"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.aporeto.io/trireme-lib/controller/pkg/pucontext"
+	"go.aporeto.io/trireme-lib/policy"
+)
+
+// maxCNAMEChain is the maximum number of aliases followed in an answer.
+const maxCNAMEChain = 16
+
+// dnsAlias is a CNAME record of a dns answer.
+type dnsAlias struct {
+	name   string
+	target string
+	ttl    time.Duration
+}
+
+// learnedAlias is a name learned as an alias of a name with DNS ACLs.
+type learnedAlias struct {
+	root   string
+	expiry time.Time
+}
+
+// followCNAMEs returns the chain of aliases of the name in the answers of the
+// reply, and the addresses of the names of the chain. The TTL of an address
+// is the lowest TTL of the records that lead to it.
+func followCNAMEs(name string, in *dns.Msg) ([]dnsAlias, []dnsAnswer) {
+
+	cnames := map[string]dnsAlias{}
+	for _, ans := range in.Answer {
+		if t, ok := ans.(*dns.CNAME); ok {
+			owner := policy.NormalizeDNSName(t.Hdr.Name)
+			cnames[owner] = dnsAlias{
+				name:   owner,
+				target: policy.NormalizeDNSName(t.Target),
+				ttl:    time.Duration(t.Hdr.Ttl) * time.Second,
+			}
+		}
+	}
+
+	current := policy.NormalizeDNSName(name)
+	chain := map[string]bool{current: true}
+	aliases := []dnsAlias{}
+
+	for len(aliases) < maxCNAMEChain {
+		alias, ok := cnames[current]
+		if !ok || chain[alias.target] {
+			break
+		}
+		aliases = append(aliases, alias)
+		chain[alias.target] = true
+		current = alias.target
+	}
+
+	var answers []dnsAnswer
+	for _, ans := range in.Answer {
+		if !chain[policy.NormalizeDNSName(ans.Header().Name)] {
+			continue
+		}
+
+		ttl := time.Duration(ans.Header().Ttl) * time.Second
+		for _, a := range aliases {
+			if a.ttl < ttl {
+				ttl = a.ttl
+			}
+		}
+
+		switch t := ans.(type) {
+		case *dns.A:
+			answers = append(answers, dnsAnswer{ip: t.A.String(), ttl: ttl})
+		case *dns.AAAA:
+			answers = append(answers, dnsAnswer{ip: t.AAAA.String(), ttl: ttl})
+		}
+	}
+
+	return aliases, answers
+}
+
+// chainPolicies returns the DNS ACLs of the first name of the chain that has
+// some, either directly or as a learned alias of a name that has some. It
+// returns the index of the name in the chain and the name with the ACLs.
+func (p *Proxy) chainPolicies(contextID string, puCtx *pucontext.PUContext, names []string) (int, string, []policy.PortProtocolPolicy, error) {
+
+	for i, name := range names {
+		if ps, err := puCtx.GetPolicyFromFQDN(name); err == nil {
+			return i, policy.NormalizeDNSName(name), ps, nil
+		}
+
+		if root, ok := p.aliasRoot(contextID, name); ok {
+			if ps, err := puCtx.GetPolicyFromFQDN(root); err == nil {
+				return i, root, ps, nil
+			}
+		}
+	}
+
+	return 0, "", nil, errors.New("no dns acls for the names")
+}
+
+// aliasRoot returns the name with DNS ACLs of which the name is a learned
+// alias.
+func (p *Proxy) aliasRoot(contextID string, name string) (string, bool) {
+
+	p.RLock()
+	defer p.RUnlock()
+
+	a, ok := p.contextIDToAliases[contextID][policy.NormalizeDNSName(name)]
+	if !ok || time.Now().After(a.expiry) {
+		return "", false
+	}
+
+	return a.root, true
+}
+
+// learnAliases records the targets of the aliases as aliases of the root
+// name, so that their own queries get the DNS ACLs of the root name. They
+// expire with the lowest TTL of the records that lead to them.
+func (p *Proxy) learnAliases(contextID string, root string, aliases []dnsAlias) {
+
+	if len(aliases) == 0 {
+		return
+	}
+
+	now := time.Now()
+
+	p.Lock()
+	defer p.Unlock()
+
+	learned, ok := p.contextIDToAliases[contextID]
+	if !ok {
+		learned = map[string]*learnedAlias{}
+		p.contextIDToAliases[contextID] = learned
+	}
+
+	var ttl time.Duration
+	for i, a := range aliases {
+		if i == 0 || a.ttl < ttl {
+			ttl = a.ttl
+		}
+
+		expiry := now.Add(ttl + dnsACLGracePeriod)
+		if l, ok := learned[a.target]; ok && l.root == root && l.expiry.After(expiry) {
+			continue
+		}
+
+		learned[a.target] = &learnedAlias{root: root, expiry: expiry}
+	}
+}
+
+// expireAliases removes the learned aliases that expired at the given time.
+// It must be called with the lock held.
+func (p *Proxy) expireAliases(now time.Time) {
+
+	for contextID, learned := range p.contextIDToAliases {
+		for name, a := range learned {
+			if !now.Before(a.expiry) {
+				delete(learned, name)
+			}
+		}
+
+		if len(learned) == 0 {
+			delete(p.contextIDToAliases, contextID)
+		}
+	}
+}
@@ -3,8 +3,11 @@
 package dnsproxy
 
 import (
+	"context"
+
 	"go.aporeto.io/trireme-lib/collector"
 	"go.aporeto.io/trireme-lib/controller/pkg/flowtracking"
+	"go.aporeto.io/trireme-lib/policy"
 	"go.aporeto.io/trireme-lib/utils/cache"
 )
 
@@ -13,7 +16,7 @@ type Proxy struct {
 }
 
 // New creates an instance of the dns proxy
-func New(puFromID cache.DataStore, conntrack flowtracking.FlowClient, c collector.EventCollector) *Proxy {
+func New(ctx context.Context, puFromID cache.DataStore, conntrack flowtracking.FlowClient, c collector.EventCollector, upstream *policy.DNSUpstream) *Proxy {
 	return &Proxy{}
 }
 
@@ -26,3 +29,8 @@ func (p *Proxy) ShutdownDNS(contextID string) {
 func (p *Proxy) StartDNSServer(contextID, port string) error {
 	return nil
 }
+
+// SetLearnedACLsHandler sets the handler of the learned ACLs
+func (p *Proxy) SetLearnedACLsHandler(handler func(contextID string, rules policy.IPRuleList) error) {
+
+}
@@ -14,66 +14,124 @@ var (
 	waitTimeBeforeReport = 30 * time.Second
 )
 
+// dnsLookup holds the details of a dns request that are reported.
+type dnsLookup struct {
+	nameLookup    string
+	queryType     string
+	rcode         string
+	aliases       []dnsAlias
+	answers       []dnsAnswer
+	upstream      string
+	latency       time.Duration
+	policyMatched bool
+	error         string
+}
+
 type dnsReport struct {
+	dnsLookup
+	contextID string
+	endpoint  collector.EndPoint
+	namespace string
+}
+
+// dnsReportKey is the key the dns requests are aggregated by.
+type dnsReportKey struct {
 	contextID  string
 	nameLookup string
-	error      string
-	endpoint   collector.EndPoint
-	namespace  string
+	rcode      string
+}
+
+// dnsAggregate holds the requests of a key that are not reported yet.
+type dnsAggregate struct {
+	last    dnsReport
+	count   int
+	latency time.Duration
+}
+
+func (r *dnsReport) key() dnsReportKey {
+	return dnsReportKey{contextID: r.contextID, nameLookup: r.nameLookup, rcode: r.rcode}
 }
 
-func (p *Proxy) sendToCollector(report dnsReport, count int) {
+func (p *Proxy) sendToCollector(report dnsReport, count int, latency time.Duration) {
+
+	cnames := make([]string, 0, len(report.aliases))
+	for _, a := range report.aliases {
+		cnames = append(cnames, a.target)
+	}
+
+	answers := make([]collector.DNSAnswer, 0, len(report.answers))
+	for _, a := range report.answers {
+		answers = append(answers, collector.DNSAnswer{IP: a.ip, TTL: uint32(a.ttl / time.Second)})
+	}
+
 	r := &collector.DNSRequestReport{
-		NameLookup: report.nameLookup,
-		Source:     &report.endpoint,
-		Namespace:  report.namespace,
-		Error:      report.error,
-		Count:      count,
-		Ts:         time.Now(),
+		NameLookup:    report.nameLookup,
+		CNAMEs:        cnames,
+		QueryType:     report.queryType,
+		ResponseCode:  report.rcode,
+		Answers:       answers,
+		Upstream:      report.upstream,
+		Latency:       latency,
+		PolicyMatched: report.policyMatched,
+		Source:        &report.endpoint,
+		Namespace:     report.namespace,
+		Error:         report.error,
+		Count:         count,
+		Ts:            time.Now(),
 	}
 	p.collector.CollectDNSRequests(r)
 }
 
-func (p *Proxy) reportDNSRequests(chreport chan dnsReport) {
-	dnsReports := map[dnsReport]int{}
-	sendReport := make(chan dnsReport)
-	deleteReport := make(chan dnsReport)
+func (p *Proxy) reportDNSRequests(chreport chan dnsReport, wait time.Duration) {
+	dnsReports := map[dnsReportKey]*dnsAggregate{}
+	sendReport := make(chan dnsReportKey)
+	deleteReport := make(chan dnsReportKey)
 
 	for {
 		select {
 		case r := <-chreport:
-			dnsReports[r]++
-			switch dnsReports[r] {
-			case 1:
+			k := r.key()
+			agg, ok := dnsReports[k]
+			if !ok {
+				agg = &dnsAggregate{}
+				dnsReports[k] = agg
+			}
+			agg.count++
+			agg.last = r
+			if agg.count == 1 {
 				// dispatch immediately
-				p.sendToCollector(r, 1)
-				go func(r dnsReport) {
-					<-time.After(waitTimeBeforeReport)
-					deleteReport <- r
-				}(r)
-			case 2:
-				go func(r dnsReport) {
-					<-time.After(waitTimeBeforeReport)
-					sendReport <- r
-				}(r)
+				p.sendToCollector(r, 1, r.latency)
+				go func(k dnsReportKey) {
+					<-time.After(wait)
+					deleteReport <- k
+				}(k)
+				continue
+			}
+			agg.latency += r.latency
+			if agg.count == 2 {
+				go func(k dnsReportKey) {
+					<-time.After(wait)
+					sendReport <- k
+				}(k)
 			}
-		case r := <-sendReport:
-			p.sendToCollector(r, dnsReports[r]-1)
-			delete(dnsReports, r)
-		case r := <-deleteReport:
-			if dnsReports[r] == 1 {
-				delete(dnsReports, r)
+		case k := <-sendReport:
+			agg := dnsReports[k]
+			count := agg.count - 1
+			p.sendToCollector(agg.last, count, agg.latency/time.Duration(count))
+			delete(dnsReports, k)
+		case k := <-deleteReport:
+			if agg, ok := dnsReports[k]; ok && agg.count == 1 {
+				delete(dnsReports, k)
 			}
 		}
 	}
 }
 
-func (p *Proxy) reportDNSLookup(name string, pucontext *pucontext.PUContext, srcIP net.IP, err string) {
+func (p *Proxy) reportDNSLookup(lookup *dnsLookup, pucontext *pucontext.PUContext, srcIP net.IP) {
 	p.chreports <- dnsReport{
-		contextID:  pucontext.ID(),
-		nameLookup: name,
-		error:      err,
-		namespace:  pucontext.ManagementNamespace(),
+		dnsLookup: *lookup,
+		contextID: pucontext.ID(),
+		namespace: pucontext.ManagementNamespace(),
 		endpoint: collector.EndPoint{
 			IP:   srcIP.String(),
 			ID:   pucontext.ManagementID(),
@@ -4,13 +4,27 @@ package dnsproxy
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/magiconair/properties/assert"
+	"github.com/miekg/dns"
 	"go.aporeto.io/trireme-lib/collector"
+	"go.aporeto.io/trireme-lib/controller/pkg/packet"
 	"go.aporeto.io/trireme-lib/controller/pkg/pucontext"
 	"go.aporeto.io/trireme-lib/policy"
 	"go.aporeto.io/trireme-lib/utils/cache"
@@ -39,6 +53,62 @@ func (c *flowClientDummy) GetOriginalDest(ipSrc, ipDst net.IP, srcport, dstport
 	return net.ParseIP("8.8.8.8"), 53, 100, nil
 }
 
+type flowClientUpstream struct {
+	flowClientDummy
+	protonum uint8
+	sync.Mutex
+}
+
+func (c *flowClientUpstream) GetOriginalDest(ipSrc, ipDst net.IP, srcport, dstport uint16, protonum uint8) (net.IP, uint16, uint32, error) {
+	c.Lock()
+	c.protonum = protonum
+	c.Unlock()
+	return net.ParseIP("127.0.0.1"), 53003, 100, nil
+}
+
+func (c *flowClientUpstream) lastProtonum() uint8 {
+	c.Lock()
+	defer c.Unlock()
+	return c.protonum
+}
+
+func upstreamAnswer(r *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Answer = append(m.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP("1.2.3.4"),
+	})
+	return m
+}
+
+func startUpstream(t *testing.T, network, addr string, config *tls.Config) *dns.Server {
+	started := make(chan struct{})
+	upstream := &dns.Server{
+		Addr:              addr,
+		Net:               network,
+		TLSConfig:         config,
+		NotifyStartedFunc: func() { close(started) },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			w.WriteMsg(upstreamAnswer(r)) // nolint
+		}),
+	}
+
+	go func() {
+		if err := upstream.ListenAndServe(); err != nil {
+			t.Log(err)
+		}
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(2 * time.Second):
+		t.Fatal("upstream dns server did not start")
+	}
+
+	return upstream
+}
+
 func addDNSNamePolicy(context *pucontext.PUContext) {
 	context.DNSACLs = policy.DNSRuleList{
 		"www.google.com": []policy.PortProtocolPolicy{
@@ -57,10 +127,15 @@ func CustomDialer(ctx context.Context, network, address string) (net.Conn, error
 	return d.DialContext(ctx, "udp", "127.0.0.1:53001")
 }
 
-func createCustomResolver() *net.Resolver {
+func CustomTCPDialer(ctx context.Context, network, address string) (net.Conn, error) {
+	d := net.Dialer{}
+	return d.DialContext(ctx, "tcp", "127.0.0.1:53002")
+}
+
+func createCustomResolver(dialer func(context.Context, string, string) (net.Conn, error)) *net.Resolver {
 	r := &net.Resolver{
 		PreferGo: true,
-		Dial:     CustomDialer,
+		Dial:     dialer,
 	}
 
 	return r
@@ -112,14 +187,16 @@ func TestDNS(t *testing.T) {
 	conntrack := &flowClientDummy{}
 	collector := &DNSCollector{}
 
-	proxy := New(puIDcache, conntrack, collector)
+	waitTimeBeforeReport = 3 * time.Second
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := New(ctx, puIDcache, conntrack, collector, nil)
 
 	err := proxy.StartDNSServer("pu1", "53001")
 	assert.Equal(t, err == nil, true, "start dns server")
 
-	resolver := createCustomResolver()
-	ctx := context.Background()
-	waitTimeBeforeReport = 3 * time.Second
+	resolver := createCustomResolver(CustomDialer)
 	resolver.LookupIPAddr(ctx, "www.google.com") //nolint
 	resolver.LookupIPAddr(ctx, "www.google.com") //nolint
 
@@ -132,3 +209,555 @@ func TestDNS(t *testing.T) {
 	l.Unlock()
 	proxy.ShutdownDNS("pu1")
 }
+
+func TestDNSOverTCP(t *testing.T) {
+	puIDcache := cache.NewCache("puFromContextID")
+
+	fp := &policy.PUInfo{
+		Runtime: policy.NewPURuntimeWithDefaults(),
+		Policy:  policy.NewPUPolicyWithDefaults(),
+	}
+	pu, _ := pucontext.NewPU("pu1", fp, 24*time.Hour) // nolint
+
+	addDNSNamePolicy(pu)
+
+	puIDcache.AddOrUpdate("pu1", pu)
+	conntrack := &flowClientUpstream{}
+	collector := &DNSCollector{}
+
+	upstream := startUpstream(t, "tcp", "127.0.0.1:53003", nil)
+	defer upstream.Shutdown() // nolint
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := New(ctx, puIDcache, conntrack, collector, nil)
+
+	err := proxy.StartDNSServer("pu1", "53002")
+	assert.Equal(t, err == nil, true, "start dns server")
+
+	resolver := createCustomResolver(CustomTCPDialer)
+	addrs, err := resolver.LookupIPAddr(ctx, "www.google.com")
+	assert.Equal(t, err == nil, true, "lookup over tcp should succeed")
+	assert.Equal(t, len(addrs) == 1 && addrs[0].IP.String() == "1.2.3.4", true, "answer should be forwarded")
+	assert.Equal(t, conntrack.lastProtonum() == packet.IPProtocolTCP, true, "original destination should be looked up for tcp")
+
+	proxy.ShutdownDNS("pu1")
+}
+
+func TestLearnedACLsExpiry(t *testing.T) {
+	puIDcache := cache.NewCache("puFromContextID")
+
+	fp := &policy.PUInfo{
+		Runtime: policy.NewPURuntimeWithDefaults(),
+		Policy:  policy.NewPUPolicyWithDefaults(),
+	}
+	pu, _ := pucontext.NewPU("pu1", fp, 24*time.Hour) // nolint
+
+	ps := []policy.PortProtocolPolicy{
+		{Ports: []string{"80"},
+			Protocols: []string{"6"},
+			Policy: &policy.FlowPolicy{
+				Action:   policy.Accept,
+				PolicyID: "2",
+			}},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := New(ctx, puIDcache, &flowClientDummy{}, &DNSCollector{}, nil)
+
+	var handled policy.IPRuleList
+	updates := 0
+	proxy.SetLearnedACLsHandler(func(contextID string, rules policy.IPRuleList) error {
+		assert.Equal(t, contextID, "pu1")
+		handled = rules
+		updates++
+		return nil
+	})
+
+	now := time.Now()
+	proxy.learnACLs("pu1", pu, ps, []dnsAnswer{{ip: "1.2.3.4", ttl: 60 * time.Second}})
+
+	_, _, err := pu.ApplicationACLPolicyFromAddr(net.ParseIP("1.2.3.4"), 80)
+	assert.Equal(t, err == nil, true, "learned ACL should be programmed")
+	assert.Equal(t, len(handled), 1, "learned ACL should be added to the rules")
+	assert.Equal(t, handled[0].Addresses, []string{"1.2.3.4"})
+
+	proxy.expireACLs(now.Add(60*time.Second + dnsACLGracePeriod - time.Second))
+	_, _, err = pu.ApplicationACLPolicyFromAddr(net.ParseIP("1.2.3.4"), 80)
+	assert.Equal(t, err == nil, true, "learned ACL should not expire before its TTL and grace period")
+
+	// A new resolution refreshes the expiry of the ACL.
+	proxy.learnACLs("pu1", pu, ps, []dnsAnswer{{ip: "1.2.3.4", ttl: 300 * time.Second}})
+
+	proxy.expireACLs(now.Add(120*time.Second + dnsACLGracePeriod))
+	_, _, err = pu.ApplicationACLPolicyFromAddr(net.ParseIP("1.2.3.4"), 80)
+	assert.Equal(t, err == nil, true, "learned ACL should be refreshed")
+	assert.Equal(t, updates, 1, "refreshed ACL should not update the rules")
+
+	proxy.expireACLs(now.Add(300*time.Second + dnsACLGracePeriod + time.Second))
+	_, _, err = pu.ApplicationACLPolicyFromAddr(net.ParseIP("1.2.3.4"), 80)
+	assert.Equal(t, err != nil, true, "learned ACL should expire")
+	assert.Equal(t, len(proxy.contextIDToACLs), 0, "expired ACLs should not be tracked")
+	assert.Equal(t, updates, 2, "expired ACL should update the rules")
+	assert.Equal(t, len(handled), 0, "expired ACL should be removed from the rules")
+}
+
+func TestDNSFilter(t *testing.T) {
+	puIDcache := cache.NewCache("puFromContextID")
+
+	puPolicy := policy.NewPUPolicyWithDefaults()
+	puPolicy.SetDNSFilterMode(policy.DNSFilterNXDomain)
+
+	fp := &policy.PUInfo{
+		Runtime: policy.NewPURuntimeWithDefaults(),
+		Policy:  puPolicy,
+	}
+	pu, _ := pucontext.NewPU("pu1", fp, 24*time.Hour) // nolint
+
+	addDNSNamePolicy(pu)
+	pu.DNSACLs["www.observed.com"] = []policy.PortProtocolPolicy{
+		{Ports: []string{"80"},
+			Protocols: []string{"tcp"},
+			Policy: &policy.FlowPolicy{
+				Action:        policy.Accept | policy.Observe,
+				ObserveAction: policy.ObserveContinue,
+				PolicyID:      "3",
+			}},
+	}
+
+	puIDcache.AddOrUpdate("pu1", pu)
+	conntrack := &flowClientUpstream{}
+	dnsCollector := &DNSCollector{}
+
+	upstream := startUpstream(t, "udp", "127.0.0.1:53003", nil)
+	defer upstream.Shutdown() // nolint
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := New(ctx, puIDcache, conntrack, dnsCollector, nil)
+
+	err := proxy.StartDNSServer("pu1", "53004")
+	assert.Equal(t, err == nil, true, "start dns server")
+	time.Sleep(100 * time.Millisecond)
+
+	c := new(dns.Client)
+
+	m := new(dns.Msg)
+	m.SetQuestion("www.blocked.com.", dns.TypeA)
+	in, _, err := c.Exchange(m, "127.0.0.1:53004")
+	assert.Equal(t, err == nil, true, "blocked query should be answered")
+	assert.Equal(t, in.Rcode, dns.RcodeNameError, "blocked query should be answered with nxdomain")
+	assert.Equal(t, conntrack.lastProtonum() == 0, true, "blocked query should not be forwarded")
+
+	time.Sleep(100 * time.Millisecond)
+	l.Lock()
+	assert.Equal(t, r.NameLookup, "www.blocked.com.", "blocked lookup should be reported")
+	assert.Equal(t, r.Error, "blocked by policy: NXDOMAIN", "blocked lookup should be reported as an error")
+	assert.Equal(t, r.ResponseCode, "NXDOMAIN", "blocked lookup should be reported with its response code")
+	assert.Equal(t, r.PolicyMatched, false, "blocked lookup should not match a policy")
+	assert.Equal(t, r.Upstream, "", "blocked lookup should not be forwarded")
+	l.Unlock()
+
+	m = new(dns.Msg)
+	m.SetQuestion("www.observed.com.", dns.TypeA)
+	in, _, err = c.Exchange(m, "127.0.0.1:53004")
+	assert.Equal(t, err == nil, true, "query with observed acls should be answered")
+	assert.Equal(t, in.Rcode, dns.RcodeNameError, "query with observed acls only should be answered with nxdomain")
+	assert.Equal(t, conntrack.lastProtonum() == 0, true, "query with observed acls only should not be forwarded")
+
+	m = new(dns.Msg)
+	m.SetQuestion("www.google.com.", dns.TypeA)
+	in, _, err = c.Exchange(m, "127.0.0.1:53004")
+	assert.Equal(t, err == nil, true, "allowed query should be answered")
+	assert.Equal(t, in.Rcode, dns.RcodeSuccess, "allowed query should be forwarded")
+	assert.Equal(t, len(in.Answer), 1, "allowed query should be forwarded")
+
+	time.Sleep(100 * time.Millisecond)
+	l.Lock()
+	assert.Equal(t, r.NameLookup, "www.google.com.", "allowed lookup should be reported")
+	assert.Equal(t, r.QueryType, "A", "query type should be reported")
+	assert.Equal(t, r.ResponseCode, "NOERROR", "response code should be reported")
+	assert.Equal(t, r.Answers, []collector.DNSAnswer{{IP: "1.2.3.4", TTL: 60}}, "answers should be reported")
+	assert.Equal(t, r.Upstream, "127.0.0.1:53003", "upstream should be reported")
+	assert.Equal(t, r.PolicyMatched, true, "matched policy should be reported")
+	l.Unlock()
+
+	proxy.ShutdownDNS("pu1")
+}
+
+// recordingWriter records the replies of the proxy to a udp client.
+type recordingWriter struct {
+	dns.ResponseWriter
+	replies []*dns.Msg
+}
+
+func (w *recordingWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+}
+
+func (w *recordingWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000}
+}
+
+func (w *recordingWriter) WriteMsg(m *dns.Msg) error {
+	w.replies = append(w.replies, m)
+	return nil
+}
+
+func TestDNSFormatError(t *testing.T) {
+	puIDcache := cache.NewCache("puFromContextID")
+	conntrack := &flowClientUpstream{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := New(ctx, puIDcache, conntrack, &DNSCollector{}, nil)
+	handler := &serveDNS{contextID: "pu1", Proxy: proxy}
+
+	noQuestion := new(dns.Msg)
+	noQuestion.Id = 1
+
+	twoQuestions := new(dns.Msg)
+	twoQuestions.SetQuestion("www.google.com.", dns.TypeA)
+	twoQuestions.Question = append(twoQuestions.Question, dns.Question{Name: "www.blocked.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+
+	for _, m := range []*dns.Msg{noQuestion, twoQuestions} {
+		w := &recordingWriter{}
+		handler.ServeDNS(w, m)
+
+		assert.Equal(t, len(w.replies), 1, "malformed query should be answered")
+		assert.Equal(t, w.replies[0].Rcode, dns.RcodeFormatError, "malformed query should be answered with formerr")
+		assert.Equal(t, w.replies[0].Id, m.Id, "reply should have the id of the query")
+	}
+
+	assert.Equal(t, conntrack.lastProtonum() == 0, true, "malformed query should not be forwarded")
+}
+
+func TestFollowCNAMEs(t *testing.T) {
+	in := new(dns.Msg)
+	in.SetQuestion("www.example.com.", dns.TypeA)
+	in.Answer = []dns.RR{
+		&dns.CNAME{Hdr: dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300}, Target: "www.example.com.cdn.net."},
+		&dns.CNAME{Hdr: dns.RR_Header{Name: "www.example.com.cdn.net.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 30}, Target: "edge1.cdn.net."},
+		&dns.A{Hdr: dns.RR_Header{Name: "edge1.cdn.net.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("1.2.3.4")},
+		&dns.A{Hdr: dns.RR_Header{Name: "other.net.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("5.6.7.8")},
+	}
+
+	aliases, answers := followCNAMEs("WWW.example.com.", in)
+	assert.Equal(t, aliases, []dnsAlias{
+		{name: "www.example.com", target: "www.example.com.cdn.net", ttl: 300 * time.Second},
+		{name: "www.example.com.cdn.net", target: "edge1.cdn.net", ttl: 30 * time.Second},
+	}, "the chain should be followed")
+	assert.Equal(t, answers, []dnsAnswer{{ip: "1.2.3.4", ttl: 30 * time.Second}}, "only the addresses of the chain should be returned")
+
+	// Loops end the chain.
+	in.Answer = []dns.RR{
+		&dns.CNAME{Hdr: dns.RR_Header{Name: "a.net.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300}, Target: "b.net."},
+		&dns.CNAME{Hdr: dns.RR_Header{Name: "b.net.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300}, Target: "a.net."},
+	}
+	aliases, answers = followCNAMEs("a.net.", in)
+	assert.Equal(t, len(aliases), 1, "loops should not be followed")
+	assert.Equal(t, len(answers), 0, "there should be no addresses")
+}
+
+func TestCNAMEPolicies(t *testing.T) {
+	puIDcache := cache.NewCache("puFromContextID")
+
+	fp := &policy.PUInfo{
+		Runtime: policy.NewPURuntimeWithDefaults(),
+		Policy:  policy.NewPUPolicyWithDefaults(),
+	}
+	pu, _ := pucontext.NewPU("pu1", fp, 24*time.Hour) // nolint
+
+	addDNSNamePolicy(pu)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := New(ctx, puIDcache, &flowClientDummy{}, &DNSCollector{}, nil)
+
+	aliases := []dnsAlias{
+		{name: "www.google.com", target: "www.google.com.cdn.net", ttl: 300 * time.Second},
+		{name: "www.google.com.cdn.net", target: "edge1.cdn.net", ttl: 30 * time.Second},
+	}
+
+	i, root, ps, err := proxy.chainPolicies("pu1", pu, []string{"www.google.com.", "www.google.com.cdn.net", "edge1.cdn.net"})
+	assert.Equal(t, err == nil, true, "the question should have dns acls")
+	assert.Equal(t, i, 0, "the question should have dns acls")
+	assert.Equal(t, root, "www.google.com", "the question should have dns acls")
+	assert.Equal(t, ps[0].Policy.PolicyID, "2", "the policy of the question should apply")
+
+	_, _, _, err = proxy.chainPolicies("pu1", pu, []string{"edge1.cdn.net."})
+	assert.Equal(t, err != nil, true, "the alias should not have dns acls before it is learned")
+
+	proxy.learnAliases("pu1", root, aliases[i:])
+
+	i, root, ps, err = proxy.chainPolicies("pu1", pu, []string{"edge1.cdn.net."})
+	assert.Equal(t, err == nil, true, "the alias should get the dns acls of the allowed name")
+	assert.Equal(t, i, 0, "the alias should get the dns acls of the allowed name")
+	assert.Equal(t, root, "www.google.com", "the alias should get the dns acls of the allowed name")
+	assert.Equal(t, ps[0].Policy.PolicyID, "2", "the alias should get the dns acls of the allowed name")
+
+	proxy.expireACLs(time.Now().Add(30*time.Second + dnsACLGracePeriod))
+	_, _, _, err = proxy.chainPolicies("pu1", pu, []string{"edge1.cdn.net."})
+	assert.Equal(t, err != nil, true, "the alias should expire with the lowest ttl of the chain")
+
+	_, root, _, err = proxy.chainPolicies("pu1", pu, []string{"www.google.com.cdn.net."})
+	assert.Equal(t, err == nil, true, "the first alias should not expire yet")
+	assert.Equal(t, root, "www.google.com", "the first alias should not expire yet")
+}
+
+type recordingCollector struct {
+	DNSCollector
+	reports []collector.DNSRequestReport
+	sync.Mutex
+}
+
+func (c *recordingCollector) CollectDNSRequests(report *collector.DNSRequestReport) {
+	c.Lock()
+	c.reports = append(c.reports, *report)
+	c.Unlock()
+}
+
+func TestDNSReportAggregation(t *testing.T) {
+	waitTimeBeforeReport = 200 * time.Millisecond
+
+	rc := &recordingCollector{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := New(ctx, cache.NewCache("puFromContextID"), &flowClientDummy{}, rc, nil)
+
+	fp := &policy.PUInfo{
+		Runtime: policy.NewPURuntimeWithDefaults(),
+		Policy:  policy.NewPUPolicyWithDefaults(),
+	}
+	pu, _ := pucontext.NewPU("pu1", fp, 24*time.Hour) // nolint
+
+	src := net.ParseIP("10.0.0.1")
+
+	proxy.reportDNSLookup(&dnsLookup{nameLookup: "a.com.", rcode: "NOERROR", latency: 10 * time.Millisecond}, pu, src)
+	proxy.reportDNSLookup(&dnsLookup{nameLookup: "a.com.", rcode: "NOERROR", latency: 20 * time.Millisecond}, pu, src)
+	proxy.reportDNSLookup(&dnsLookup{nameLookup: "a.com.", rcode: "NOERROR", latency: 40 * time.Millisecond, answers: []dnsAnswer{{ip: "1.2.3.4", ttl: 30 * time.Second}}}, pu, src)
+	proxy.reportDNSLookup(&dnsLookup{nameLookup: "a.com.", rcode: "NXDOMAIN"}, pu, src)
+
+	time.Sleep(500 * time.Millisecond)
+
+	rc.Lock()
+	defer rc.Unlock()
+
+	assert.Equal(t, len(rc.reports), 3, "the requests should be aggregated per name and response code")
+	assert.Equal(t, rc.reports[0].Count, 1, "the first request should be reported immediately")
+	assert.Equal(t, rc.reports[0].Latency, 10*time.Millisecond, "the first request should be reported immediately")
+	assert.Equal(t, rc.reports[1].ResponseCode, "NXDOMAIN", "the other response codes should be reported apart")
+	assert.Equal(t, rc.reports[2].Count, 2, "the next requests should be aggregated")
+	assert.Equal(t, rc.reports[2].Latency, 30*time.Millisecond, "the latency should be averaged")
+	assert.Equal(t, rc.reports[2].Answers, []collector.DNSAnswer{{IP: "1.2.3.4", TTL: 30}}, "the last answers should be reported")
+}
+
+// testCA returns a CA and the tls configuration of a server with a
+// certificate for dns.test signed by the CA.
+func testCA(t *testing.T) (string, *tls.Config) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "dns.test"},
+		DNSNames:     []string{"dns.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caTemplate, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}))
+
+	return ca, &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+}
+
+func startDoHUpstream(t *testing.T, config *tls.Config) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		r := new(dns.Msg)
+		if req.Header.Get("Content-Type") != dohMediaType || r.Unpack(data) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		data, err = upstreamAnswer(r).Pack()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", dohMediaType)
+		w.Write(data) // nolint
+	}))
+	server.TLS = config
+	server.StartTLS()
+
+	return server
+}
+
+func TestEncryptedUpstreams(t *testing.T) {
+	ca, serverConfig := testCA(t)
+	otherCA, _ := testCA(t)
+
+	dot := startUpstream(t, "tcp-tls", "127.0.0.1:53006", serverConfig)
+	defer dot.Shutdown() // nolint
+
+	doh := startDoHUpstream(t, serverConfig)
+	defer doh.Close()
+
+	// The stand-ins are reached by address, so the names of the
+	// certificates are given.
+	dotUpstream := &policy.DNSUpstream{Address: "tls://127.0.0.1:53006", ServerName: "dns.test", CACertificates: ca}
+	dohUpstream := &policy.DNSUpstream{Address: doh.URL + "/dns-query", ServerName: "dns.test", CACertificates: ca}
+	unpinnedUpstream := &policy.DNSUpstream{Address: doh.URL + "/dns-query", ServerName: "dns.test", CACertificates: otherCA}
+
+	puIDcache := cache.NewCache("puFromContextID")
+	for id, upstream := range map[string]*policy.DNSUpstream{"pu1": dotUpstream, "pu2": nil, "pu3": unpinnedUpstream} {
+		puPolicy := policy.NewPUPolicyWithDefaults()
+		puPolicy.SetDNSUpstream(upstream)
+
+		pu, _ := pucontext.NewPU(id, &policy.PUInfo{Runtime: policy.NewPURuntimeWithDefaults(), Policy: puPolicy}, 24*time.Hour) // nolint
+		addDNSNamePolicy(pu)
+		puIDcache.AddOrUpdate(id, pu)
+	}
+
+	conntrack := &flowClientUpstream{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := New(ctx, puIDcache, conntrack, &DNSCollector{}, dohUpstream)
+
+	for id, port := range map[string]string{"pu1": "53007", "pu2": "53008", "pu3": "53009"} {
+		err := proxy.StartDNSServer(id, port)
+		assert.Equal(t, err == nil, true, "start dns server")
+		defer proxy.ShutdownDNS(id)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	c := &dns.Client{Timeout: time.Second}
+
+	tests := []struct {
+		port     string
+		upstream string
+	}{
+		{port: "53007", upstream: dotUpstream.Address},
+		{port: "53008", upstream: dohUpstream.Address},
+	}
+
+	for _, tt := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion("www.google.com.", dns.TypeA)
+		in, _, err := c.Exchange(m, "127.0.0.1:"+tt.port)
+		assert.Equal(t, err == nil, true, "query should be resolved by "+tt.upstream)
+		assert.Equal(t, in.Id, m.Id, "answer should match the query")
+		assert.Equal(t, len(in.Answer), 1, "query should be resolved by "+tt.upstream)
+
+		time.Sleep(100 * time.Millisecond)
+		l.Lock()
+		assert.Equal(t, r.Upstream, tt.upstream, "encrypted upstream should be reported")
+		l.Unlock()
+	}
+
+	assert.Equal(t, conntrack.lastProtonum() == 0, true, "queries should not be forwarded to their original destination")
+
+	m := new(dns.Msg)
+	m.SetQuestion("www.google.com.", dns.TypeA)
+	_, _, err := c.Exchange(m, "127.0.0.1:53009")
+	assert.Equal(t, err != nil, true, "upstream signed by another ca should not be trusted")
+}
+
+func TestDoTConnectionReuse(t *testing.T) {
+	ca, serverConfig := testCA(t)
+
+	var remotes sync.Map
+	var count int32
+	started := make(chan struct{})
+	upstream := &dns.Server{
+		Addr:              "127.0.0.1:53010",
+		Net:               "tcp-tls",
+		TLSConfig:         serverConfig,
+		NotifyStartedFunc: func() { close(started) },
+		IdleTimeout:       func() time.Duration { return 200 * time.Millisecond },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			if _, loaded := remotes.LoadOrStore(w.RemoteAddr().String(), true); !loaded {
+				atomic.AddInt32(&count, 1)
+			}
+			w.WriteMsg(upstreamAnswer(r)) // nolint
+		}),
+	}
+
+	go func() {
+		if err := upstream.ListenAndServe(); err != nil {
+			t.Log(err)
+		}
+	}()
+	defer upstream.Shutdown() // nolint
+
+	select {
+	case <-started:
+	case <-time.After(2 * time.Second):
+		t.Fatal("upstream dns server did not start")
+	}
+
+	client, err := newUpstreamClient(&policy.DNSUpstream{Address: "tls://127.0.0.1:53010", ServerName: "dns.test", CACertificates: ca})
+	assert.Equal(t, err == nil, true, "create upstream client")
+
+	exchange := func() {
+		m := new(dns.Msg)
+		m.SetQuestion("www.google.com.", dns.TypeA)
+		in, _, err := client.exchange(m)
+		assert.Equal(t, err == nil, true, "query should be resolved")
+		assert.Equal(t, in.Id, m.Id, "answer should match the query")
+	}
+
+	for i := 0; i < 3; i++ {
+		exchange()
+	}
+	assert.Equal(t, atomic.LoadInt32(&count), int32(1), "queries should reuse the connection")
+
+	// The connection closed by the server is replaced.
+	time.Sleep(500 * time.Millisecond)
+	exchange()
+	assert.Equal(t, atomic.LoadInt32(&count), int32(2), "closed connection should be replaced")
+}
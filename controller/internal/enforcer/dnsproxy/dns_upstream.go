@@ -0,0 +1,269 @@
+// +build linux !darwin
+
+package dnsproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.aporeto.io/trireme-lib/controller/pkg/pucontext"
+	"go.aporeto.io/trireme-lib/policy"
+)
+
+const (
+	// defaultDoTPort is the port of the DNS over TLS servers.
+	defaultDoTPort = "853"
+	// dohMediaType is the media type of the dns messages sent over HTTPS.
+	dohMediaType = "application/dns-message"
+	// maxIdleDoTConns is the number of idle connections kept for each DNS
+	// over TLS server.
+	maxIdleDoTConns = 4
+	// dotIdleTimeout is the time an idle connection to a DNS over TLS server
+	// is kept. The servers close the idle connections after a few seconds.
+	dotIdleTimeout = 10 * time.Second
+)
+
+// idleConn is an idle connection to a DNS over TLS server.
+type idleConn struct {
+	conn  *dns.Conn
+	since time.Time
+}
+
+// upstreamClient resolves the dns requests with an encrypted upstream
+// server. The connections to the server are reused between the requests, so
+// that the requests do not pay for a TLS handshake each.
+type upstreamClient struct {
+	// name is the address of the server in the dns reports.
+	name string
+	// address is host:port for DNS over TLS and the URL of the server for
+	// DNS over HTTPS.
+	address string
+	dot     *dns.Client
+	doh     *http.Client
+	// idle holds the idle connections to the DNS over TLS server.
+	idle chan idleConn
+}
+
+// upstreamDialer returns a marked dialer that resolves the name of the server
+// with marked connections too. The queries of the system resolver would be
+// redirected to the proxy and resolved with the server again.
+func upstreamDialer() *net.Dialer {
+
+	d := markedDialer()
+	d.Resolver = &net.Resolver{
+		PreferGo: true,
+		Dial:     markedDialer().DialContext,
+	}
+
+	return d
+}
+
+func newUpstreamClient(u *policy.DNSUpstream) (*upstreamClient, error) {
+
+	if err := u.Validate(); err != nil {
+		return nil, err
+	}
+
+	addr, err := url.Parse(u.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address: %s", err)
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: addr.Hostname(),
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if u.ServerName != "" {
+		tlsConfig.ServerName = u.ServerName
+	}
+
+	// The certificate of the server is only verified with the pinned CAs, so
+	// that the other CAs of the system cannot impersonate it.
+	if u.CACertificates != "" {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		tlsConfig.RootCAs.AppendCertsFromPEM([]byte(u.CACertificates))
+	}
+
+	if addr.Scheme == policy.DNSUpstreamTLS {
+		port := addr.Port()
+		if port == "" {
+			port = defaultDoTPort
+		}
+
+		return &upstreamClient{
+			name:    u.Address,
+			address: net.JoinHostPort(addr.Hostname(), port),
+			dot: &dns.Client{
+				Net:       "tcp-tls",
+				TLSConfig: tlsConfig,
+				Dialer:    upstreamDialer(),
+			},
+			idle: make(chan idleConn, maxIdleDoTConns),
+		}, nil
+	}
+
+	return &upstreamClient{
+		name:    u.Address,
+		address: u.Address,
+		doh: &http.Client{
+			Timeout: dnsRequestTimeout,
+			Transport: &http.Transport{
+				DialContext:         upstreamDialer().DialContext,
+				TLSClientConfig:     tlsConfig,
+				TLSHandshakeTimeout: dnsRequestTimeout,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		},
+	}, nil
+}
+
+// exchange resolves the request with the upstream server. It returns the
+// answer and the time it took.
+func (c *upstreamClient) exchange(r *dns.Msg) (*dns.Msg, time.Duration, error) {
+
+	if c.dot != nil {
+		return c.exchangeTLS(r)
+	}
+
+	// The requests are sent with the id 0 so that the answers can be cached
+	// by the HTTP caches (RFC 8484).
+	q := r.Copy()
+	q.Id = 0
+
+	data, err := q.Pack()
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to pack dns request: %s", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.address, bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to create https request: %s", err)
+	}
+	req.Header.Set("Content-Type", dohMediaType)
+	req.Header.Set("Accept", dohMediaType)
+
+	start := time.Now()
+
+	resp, err := c.doh.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close() // nolint
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("unexpected https response: %s", resp.Status)
+	}
+
+	data, err = ioutil.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to read https response: %s", err)
+	}
+
+	rtt := time.Since(start)
+
+	reply := new(dns.Msg)
+	if err := reply.Unpack(data); err != nil {
+		return nil, 0, fmt.Errorf("unable to unpack dns response: %s", err)
+	}
+	reply.Id = r.Id
+
+	return reply, rtt, nil
+}
+
+// exchangeTLS resolves the request with the DNS over TLS server on an idle
+// connection, or on a new one if there is none. The server may have closed an
+// idle connection, so the request is sent again on another connection if it
+// fails on an idle one.
+func (c *upstreamClient) exchangeTLS(r *dns.Msg) (*dns.Msg, time.Duration, error) {
+
+	for {
+		conn, reused := c.idleConn()
+		if conn == nil {
+			var err error
+			if conn, err = c.dot.Dial(c.address); err != nil {
+				return nil, 0, err
+			}
+		}
+
+		reply, rtt, err := c.dot.ExchangeWithConn(r, conn)
+		if err != nil {
+			conn.Close() // nolint
+			if reused {
+				continue
+			}
+			return nil, 0, err
+		}
+
+		c.releaseConn(conn)
+
+		return reply, rtt, nil
+	}
+}
+
+// idleConn returns an idle connection to the DNS over TLS server, or nil if
+// there is none. The connections that were idle for too long are closed.
+func (c *upstreamClient) idleConn() (*dns.Conn, bool) {
+
+	for {
+		select {
+		case i := <-c.idle:
+			if time.Since(i.since) < dotIdleTimeout {
+				return i.conn, true
+			}
+			i.conn.Close() // nolint
+		default:
+			return nil, false
+		}
+	}
+}
+
+// releaseConn keeps the connection for the next requests, or closes it if
+// there are enough idle connections.
+func (c *upstreamClient) releaseConn(conn *dns.Conn) {
+
+	select {
+	case c.idle <- idleConn{conn: conn, since: time.Now()}:
+	default:
+		conn.Close() // nolint
+	}
+}
+
+// upstreamFor returns the client of the encrypted upstream of the PU, the
+// global one if the PU has none, or nil if the requests of the PU are
+// forwarded to their original destination. The PUs with the same upstream
+// share its client.
+func (p *Proxy) upstreamFor(puCtx *pucontext.PUContext) (*upstreamClient, error) {
+
+	u := puCtx.DNSUpstream()
+	if u == nil {
+		u = p.upstream
+	}
+
+	if u == nil {
+		return nil, nil
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	c, ok := p.upstreams[*u]
+	if !ok {
+		var err error
+		if c, err = newUpstreamClient(u); err != nil {
+			return nil, err
+		}
+		p.upstreams[*u] = c
+	}
+
+	return c, nil
+}
@@ -9,6 +9,7 @@ import (
 	"go.aporeto.io/trireme-lib/common"
 	"go.aporeto.io/trireme-lib/controller/constants"
 	"go.aporeto.io/trireme-lib/controller/internal/enforcer/applicationproxy"
+	"go.aporeto.io/trireme-lib/controller/internal/enforcer/envoyauthorizer"
 	"go.aporeto.io/trireme-lib/controller/internal/enforcer/nfqdatapath"
 	"go.aporeto.io/trireme-lib/controller/internal/enforcer/nfqdatapath/tokenaccessor"
 	"go.aporeto.io/trireme-lib/controller/internal/enforcer/secretsproxy"
@@ -53,6 +54,15 @@ type Enforcer interface {
 	DebugInfo
 }
 
+// ACLLearner is implemented by the enforcers that learn application ACLs for
+// the PUs, like the ACLs of the addresses of the DNS answers.
+type ACLLearner interface {
+
+	// SetLearnedACLsHandler sets the handler that applies the learned ACLs of
+	// a PU to its rules. The rules replace the ACLs learned before.
+	SetLearnedACLsHandler(handler func(contextID string, rules policy.IPRuleList) error)
+}
+
 // DebugInfo is interface to implement methods to configure datapath packet tracing in the nfqdatapath
 type DebugInfo interface {
 	//  EnableDatapathPacketTracing will enable tracing of packets received by the datapath for a particular PU. Setting Disabled as tracing direction will stop tracing for the contextID
@@ -67,6 +77,7 @@ type enforcer struct {
 	proxy     *applicationproxy.AppProxy
 	transport *nfqdatapath.Datapath
 	secrets   *secretsproxy.SecretsProxy
+	envoy     *envoyauthorizer.EnvoyAuthorizer
 }
 
 // Run implements the run interfaces and runs the individual data paths
@@ -90,6 +101,12 @@ func (e *enforcer) Run(ctx context.Context) error {
 		}
 	}
 
+	if e.envoy != nil {
+		if err := e.envoy.Run(ctx); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -113,13 +130,19 @@ func (e *enforcer) Enforce(contextID string, puInfo *policy.PUInfo) error {
 		}
 	}
 
+	if e.envoy != nil {
+		if err := e.envoy.Enforce(context.Background(), contextID, puInfo); err != nil {
+			return fmt.Errorf("unable to enforce in envoy authorizer: %s", err)
+		}
+	}
+
 	return nil
 }
 
 // Unenforce implements the Unenforce interface by sending the event to all the enforcers.
 func (e *enforcer) Unenforce(contextID string) error {
 
-	var perr, nerr, serr error
+	var perr, nerr, serr, eerr error
 	if e.proxy != nil {
 		if perr = e.proxy.Unenforce(context.Background(), contextID); perr != nil {
 			zap.L().Error("Failed to unenforce contextID in proxy",
@@ -139,16 +162,25 @@ func (e *enforcer) Unenforce(contextID string) error {
 	}
 
 	if e.secrets != nil {
-		if serr = e.secrets.Unenforce(contextID); nerr != nil {
-			zap.L().Error("Failed to unenforce contextID in transport",
+		if serr = e.secrets.Unenforce(contextID); serr != nil {
+			zap.L().Error("Failed to unenforce contextID in secrets proxy",
 				zap.String("ContextID", contextID),
-				zap.Error(nerr),
+				zap.Error(serr),
 			)
 		}
 	}
 
-	if perr != nil || nerr != nil || serr != nil {
-		return fmt.Errorf("Failed to unenforce %s %s", perr, nerr)
+	if e.envoy != nil {
+		if eerr = e.envoy.Unenforce(context.Background(), contextID); eerr != nil {
+			zap.L().Error("Failed to unenforce contextID in envoy authorizer",
+				zap.String("ContextID", contextID),
+				zap.Error(eerr),
+			)
+		}
+	}
+
+	if perr != nil || nerr != nil || serr != nil || eerr != nil {
+		return fmt.Errorf("Failed to unenforce: proxy: %v, transport: %v, secrets proxy: %v, envoy: %v", perr, nerr, serr, eerr)
 	}
 
 	return nil
@@ -178,6 +210,12 @@ func (e *enforcer) UpdateSecrets(secrets secrets.Secrets) error {
 		}
 	}
 
+	if e.envoy != nil {
+		if err := e.envoy.UpdateSecrets(secrets); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -198,6 +236,13 @@ func (e *enforcer) CleanUp() error {
 	return nil
 }
 
+// SetLearnedACLsHandler sets the handler of the ACLs learned by the transport path.
+func (e *enforcer) SetLearnedACLsHandler(handler func(contextID string, rules policy.IPRuleList) error) {
+	if e.transport != nil {
+		e.transport.SetLearnedACLsHandler(handler)
+	}
+}
+
 // GetFilterQueue returns the current FilterQueueConfig of the transport path.
 func (e *enforcer) GetFilterQueue() *fqconfig.FilterQueue {
 	return e.transport.GetFilterQueue()
@@ -265,6 +310,7 @@ func New(
 		proxy:     tcpProxy,
 		transport: transport,
 		secrets:   secretsproxy.NewSecretsProxy(),
+		envoy:     envoyauthorizer.NewEnvoyAuthorizer(collector, puFromContextID, secrets),
 	}, nil
 }
 
@@ -0,0 +1,211 @@
+package envoyauthorizer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"go.aporeto.io/trireme-lib/collector"
+	"go.aporeto.io/trireme-lib/controller/constants"
+	"go.aporeto.io/trireme-lib/controller/internal/enforcer/applicationproxy/serviceregistry"
+	"go.aporeto.io/trireme-lib/controller/pkg/pucontext"
+	"go.aporeto.io/trireme-lib/controller/pkg/secrets"
+	"go.aporeto.io/trireme-lib/policy"
+	ext "go.aporeto.io/trireme-lib/third_party/generated/envoyproxy/data-plane-api/envoy/service/auth/v2"
+	sds "go.aporeto.io/trireme-lib/third_party/generated/envoyproxy/data-plane-api/envoy/service/discovery/v2"
+	"go.aporeto.io/trireme-lib/utils/cache"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+// clientData holds the state of the servers of a PU.
+type clientData struct {
+	server *grpc.Server
+	authz  *extAuthzServer
+	sds    *sdsServer
+	puInfo *policy.PUInfo
+	// done is closed when the server is stopped by unenforce.
+	done chan struct{}
+}
+
+// EnvoyAuthorizer maintains the gRPC servers that Envoy sidecars of the PUs
+// use for external authorization and secret discovery. There is one server
+// for every PU that has services or service certificates. The server listens
+// on an abstract unix socket named after the PU. Abstract sockets belong to
+// the network namespace of the enforcer, so only the sidecars that share this
+// namespace can reach them.
+type EnvoyAuthorizer struct {
+	collector  collector.EventCollector
+	puFromID   cache.DataStore
+	secrets    secrets.Secrets
+	registry   *serviceregistry.Registry
+	socketPath string
+
+	clients cache.DataStore
+	ctx     context.Context
+	sync.RWMutex
+}
+
+// NewEnvoyAuthorizer creates a new Envoy authorizer.
+func NewEnvoyAuthorizer(c collector.EventCollector, puFromID cache.DataStore, s secrets.Secrets) *EnvoyAuthorizer {
+
+	return &EnvoyAuthorizer{
+		collector:  c,
+		puFromID:   puFromID,
+		secrets:    s,
+		registry:   serviceregistry.NewServiceRegistry(),
+		socketPath: constants.DefaultEnvoyAuthorizerPath,
+		clients:    cache.NewCache("envoy authorizer clients"),
+		ctx:        context.Background(),
+	}
+}
+
+// Run implements the run method of the enforcers. The servers are started
+// during enforce and they are stopped when the context is cancelled.
+func (e *EnvoyAuthorizer) Run(ctx context.Context) error {
+	e.Lock()
+	defer e.Unlock()
+
+	e.ctx = ctx
+
+	return nil
+}
+
+// Enforce implements the enforce interface. It registers the services of the
+// PU, starts the server of the PU if it is not running and pushes any
+// certificate updates to the secret discovery clients.
+func (e *EnvoyAuthorizer) Enforce(ctx context.Context, puID string, puInfo *policy.PUInfo) error {
+	e.Lock()
+	defer e.Unlock()
+
+	certPEM, keyPEM, _ := puInfo.Policy.ServiceCertificates()
+	hasServices := len(puInfo.Policy.ExposedServices()) > 0 || len(puInfo.Policy.DependentServices()) > 0
+	if !hasServices && (certPEM == "" || keyPEM == "") {
+		return nil
+	}
+
+	data, err := e.puFromID.Get(puID)
+	if err != nil || data == nil {
+		return fmt.Errorf("undefined PU - Context not found: %s", puID)
+	}
+
+	puContext, ok := data.(*pucontext.PUContext)
+	if !ok {
+		return fmt.Errorf("bad data types for puContext")
+	}
+
+	if _, err := e.registry.Register(puID, puInfo, puContext, e.secrets); err != nil {
+		return fmt.Errorf("policy conflicts detected: %s", err)
+	}
+
+	// Policy updates only need to update the registry and the secrets.
+	if c, err := e.clients.Get(puID); err == nil {
+		client := c.(*clientData)
+		client.puInfo = puInfo
+		e.updateServiceSecrets(client)
+		return nil
+	}
+
+	l, err := net.Listen("unix", e.socketPath+puID)
+	if err != nil {
+		return fmt.Errorf("unable to start envoy authorizer listener: %s", err)
+	}
+
+	client := &clientData{
+		server: grpc.NewServer(),
+		authz:  newExtAuthzServer(puID, e.registry, e.secrets, e.collector),
+		sds:    newSDSServer(puID),
+		puInfo: puInfo,
+		done:   make(chan struct{}),
+	}
+	ext.RegisterAuthorizationServer(client.server, client.authz)
+	sds.RegisterSecretDiscoveryServiceServer(client.server, client.sds)
+	e.updateServiceSecrets(client)
+
+	e.clients.AddOrUpdate(puID, client)
+
+	go func() {
+		if err := client.server.Serve(l); err != nil {
+			zap.L().Debug("Envoy authorizer server terminated",
+				zap.String("puID", puID),
+				zap.Error(err),
+			)
+		}
+	}()
+
+	// The context is read under the lock, since Run can replace it.
+	go func(ctx context.Context, client *clientData) {
+		select {
+		case <-ctx.Done():
+			client.server.Stop()
+		case <-client.done:
+		}
+	}(e.ctx, client)
+
+	return nil
+}
+
+// Unenforce implements the unenforce interface. It stops the servers of the PU.
+func (e *EnvoyAuthorizer) Unenforce(ctx context.Context, puID string) error {
+	e.Lock()
+	defer e.Unlock()
+
+	c, err := e.clients.Get(puID)
+	if err != nil {
+		// PUs without services or certificates do not have a server.
+		return nil
+	}
+
+	if err := e.registry.Unregister(puID); err != nil {
+		zap.L().Debug("Unable to unregister PU from the envoy authorizer", zap.Error(err))
+	}
+
+	client := c.(*clientData)
+	client.server.Stop()
+	close(client.done)
+
+	return e.clients.Remove(puID)
+}
+
+// UpdateSecrets updates the secrets of all the servers. The secret discovery
+// clients will receive the new trusted CAs.
+func (e *EnvoyAuthorizer) UpdateSecrets(s secrets.Secrets) error {
+	e.Lock()
+	defer e.Unlock()
+
+	e.secrets = s
+
+	for _, puID := range e.clients.KeyList() {
+		c, err := e.clients.Get(puID)
+		if err != nil {
+			continue
+		}
+		client := c.(*clientData)
+		client.authz.updateSecrets(puID.(string), e.registry, s)
+		e.updateServiceSecrets(client)
+	}
+
+	return nil
+}
+
+// updateServiceSecrets updates the secret discovery server of the PU with the
+// service certificates of the policy. The trusted CAs include the CA of the
+// services and the CA of the enforcer secrets, so that the PU trusts all the
+// other PUs.
+func (e *EnvoyAuthorizer) updateServiceSecrets(client *clientData) {
+
+	certPEM, keyPEM, caPEM := client.puInfo.Policy.ServiceCertificates()
+
+	if e.secrets != nil && e.secrets.PublicSecrets() != nil {
+		if ca := e.secrets.PublicSecrets().CertAuthority(); len(ca) > 0 {
+			if caPEM != "" && !strings.HasSuffix(caPEM, "\n") {
+				caPEM = caPEM + "\n"
+			}
+			caPEM = caPEM + string(ca)
+		}
+	}
+
+	client.sds.update(certPEM, keyPEM, caPEM)
+}
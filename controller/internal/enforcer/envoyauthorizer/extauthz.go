@@ -0,0 +1,387 @@
+package envoyauthorizer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	rpc "github.com/gogo/googleapis/google/rpc"
+	"github.com/gogo/protobuf/types"
+	"go.aporeto.io/trireme-lib/collector"
+	"go.aporeto.io/trireme-lib/controller/internal/enforcer/apiauth"
+	"go.aporeto.io/trireme-lib/controller/internal/enforcer/applicationproxy/serviceregistry"
+	"go.aporeto.io/trireme-lib/controller/pkg/packet"
+	"go.aporeto.io/trireme-lib/controller/pkg/secrets"
+	"go.aporeto.io/trireme-lib/policy"
+	"go.aporeto.io/trireme-lib/third_party/generated/envoyproxy/data-plane-api/envoy/api/v2/core"
+	ext "go.aporeto.io/trireme-lib/third_party/generated/envoyproxy/data-plane-api/envoy/service/auth/v2"
+	envoytype "go.aporeto.io/trireme-lib/third_party/generated/envoyproxy/data-plane-api/envoy/type"
+	"go.uber.org/zap"
+)
+
+const (
+	// DirectionExtension is the key of the context extension that Envoy must
+	// provide in order to select the direction of the request. The ingress
+	// listener of the sidecar should not set it or set it to DirectionIngress.
+	// The egress listener must set it to DirectionEgress.
+	DirectionExtension = "aporeto-direction"
+
+	// DirectionIngress marks requests that are received from the network.
+	DirectionIngress = "ingress"
+
+	// DirectionEgress marks requests that are initiated by the application.
+	DirectionEgress = "egress"
+)
+
+// extAuthzServer implements the Envoy external authorization API for a
+// single PU. Every check request is converted to an apiauth.Request and
+// processed by the same API authorization processor that is used by the
+// HTTP proxy.
+type extAuthzServer struct {
+	puID      string
+	auth      *apiauth.Processor
+	secrets   secrets.Secrets
+	collector collector.EventCollector
+	sync.RWMutex
+}
+
+// newExtAuthzServer creates a new external authorization server for the PU.
+func newExtAuthzServer(puID string, r *serviceregistry.Registry, s secrets.Secrets, c collector.EventCollector) *extAuthzServer {
+	return &extAuthzServer{
+		puID:      puID,
+		auth:      apiauth.New(puID, r, s),
+		secrets:   s,
+		collector: c,
+	}
+}
+
+// updateSecrets updates the secrets of the server. The API authorization
+// processor is re-created with the new secrets.
+func (s *extAuthzServer) updateSecrets(puID string, r *serviceregistry.Registry, sec secrets.Secrets) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.auth = apiauth.New(puID, r, sec)
+	s.secrets = sec
+}
+
+// Check implements the AuthorizationServer interface of Envoy.
+func (s *extAuthzServer) Check(ctx context.Context, checkRequest *ext.CheckRequest) (*ext.CheckResponse, error) {
+
+	zap.L().Debug("Processing envoy check request",
+		zap.String("puID", s.puID),
+		zap.String("request", checkRequest.String()),
+	)
+
+	attrs := checkRequest.GetAttributes()
+	if attrs == nil || attrs.GetRequest().GetHttp() == nil {
+		return deniedResponse(http.StatusBadRequest, "invalid check request: no http attributes", nil), nil
+	}
+
+	request, err := requestFromAttributes(attrs)
+	if err != nil {
+		return deniedResponse(http.StatusBadRequest, err.Error(), nil), nil
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+
+	if attrs.GetContextExtensions()[DirectionExtension] == DirectionEgress {
+		return s.checkApplicationRequest(request), nil
+	}
+
+	return s.checkNetworkRequest(ctx, request), nil
+}
+
+// checkNetworkRequest authorizes a request that is arriving from the network.
+func (s *extAuthzServer) checkNetworkRequest(ctx context.Context, request *apiauth.Request) *ext.CheckResponse {
+
+	response, err := s.auth.NetworkRequest(ctx, request)
+
+	var userID string
+	if response != nil && len(response.UserAttributes) > 0 {
+		userData := &collector.UserRecord{
+			Namespace: response.Namespace,
+			Claims:    response.UserAttributes,
+		}
+		s.collector.CollectUserEvent(userData)
+		userID = userData.ID
+	}
+
+	defer s.collector.CollectFlowEvent(networkFlowRecord(s.puID, userID, request, response))
+
+	if err != nil {
+		authError, ok := err.(*apiauth.AuthError)
+		if !ok {
+			return deniedResponse(http.StatusInternalServerError, "internal type error", nil)
+		}
+
+		if response == nil || !response.Redirect {
+			return deniedResponse(authError.Status(), authError.Message(), nil)
+		}
+
+		// Redirects are returned as denied responses with the location
+		// header set, so that Envoy sends them directly to the client.
+		headers := []*core.HeaderValueOption{
+			headerOption("Location", response.RedirectURI),
+		}
+		if response.Cookie != nil {
+			headers = append(headers, headerOption("Set-Cookie", response.Cookie.String()))
+		}
+
+		return deniedResponse(authError.Status(), response.Data, headers)
+	}
+
+	// The headers of the response include the user attributes as defined by
+	// the UserTokenToHTTPMappings of the service. We pass all of them upstream
+	// and we clear the Aporeto headers since the v2 API cannot remove them.
+	headers := []*core.HeaderValueOption{
+		headerOption("X-APORETO-AUTH", ""),
+		headerOption("X-APORETO-KEY", ""),
+	}
+	for key, values := range response.Header {
+		for _, value := range values {
+			headers = append(headers, headerOption(key, value))
+		}
+	}
+
+	return okResponse(headers)
+}
+
+// checkApplicationRequest authorizes a request that is initiated by the
+// application and adds the identity token of the PU to the request.
+func (s *extAuthzServer) checkApplicationRequest(request *apiauth.Request) *ext.CheckResponse {
+
+	response, err := s.auth.ApplicationRequest(request)
+	if err != nil {
+		if response.PUContext != nil {
+			record := applicationFlowRecord(s.puID, request, response)
+			record.Action = response.Action
+			s.collector.CollectFlowEvent(record)
+		}
+		authError, ok := err.(*apiauth.AuthError)
+		if !ok {
+			return deniedResponse(http.StatusInternalServerError, "internal type error", nil)
+		}
+		return deniedResponse(authError.Status(), authError.Message(), nil)
+	}
+
+	// External services are not reported by the remote side, so we report
+	// them here.
+	if response.External {
+		s.collector.CollectFlowEvent(applicationFlowRecord(s.puID, request, response))
+		return okResponse(nil)
+	}
+
+	return okResponse([]*core.HeaderValueOption{
+		headerOption("X-APORETO-KEY", string(s.secrets.TransmittedKey())),
+		headerOption("X-APORETO-AUTH", response.Token),
+	})
+}
+
+// requestFromAttributes converts the Envoy attributes to an authorization request.
+func requestFromAttributes(attrs *ext.AttributeContext) (*apiauth.Request, error) {
+
+	httpAttrs := attrs.GetRequest().GetHttp()
+
+	sourceAddress, err := tcpAddrFromPeer(attrs.GetSource())
+	if err != nil {
+		return nil, fmt.Errorf("invalid source address: %s", err)
+	}
+
+	originalDestination, err := tcpAddrFromPeer(attrs.GetDestination())
+	if err != nil {
+		return nil, fmt.Errorf("invalid destination address: %s", err)
+	}
+
+	u, err := url.ParseRequestURI(httpAttrs.GetPath())
+	if err != nil {
+		return nil, fmt.Errorf("invalid request uri: %s", err)
+	}
+
+	header := http.Header{}
+	for key, value := range httpAttrs.GetHeaders() {
+		// Pseudo headers of HTTP2 are not part of the request headers.
+		if strings.HasPrefix(key, ":") {
+			continue
+		}
+		header.Add(key, value)
+	}
+
+	request := &apiauth.Request{
+		SourceAddress:       sourceAddress,
+		OriginalDestination: originalDestination,
+		Method:              httpAttrs.GetMethod(),
+		URL:                 u,
+		RequestURI:          httpAttrs.GetPath(),
+		Header:              header,
+	}
+
+	r := &http.Request{Header: header}
+	if cookie, err := r.Cookie("X-APORETO-AUTH"); err == nil {
+		request.Cookie = cookie
+	}
+
+	return request, nil
+}
+
+// tcpAddrFromPeer extracts the socket address of an Envoy peer.
+func tcpAddrFromPeer(peer *ext.AttributeContext_Peer) (*net.TCPAddr, error) {
+
+	socketAddress := peer.GetAddress().GetSocketAddress()
+	if socketAddress == nil {
+		return nil, fmt.Errorf("no socket address")
+	}
+
+	ip := net.ParseIP(socketAddress.GetAddress())
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip %s", socketAddress.GetAddress())
+	}
+
+	return &net.TCPAddr{
+		IP:   ip,
+		Port: int(socketAddress.GetPortValue()),
+	}, nil
+}
+
+// headerOption creates an Envoy header that replaces any existing value.
+func headerOption(key, value string) *core.HeaderValueOption {
+	return &core.HeaderValueOption{
+		Header: &core.HeaderValue{
+			Key:   key,
+			Value: value,
+		},
+		Append: &types.BoolValue{Value: false},
+	}
+}
+
+// okResponse creates an accept response with the provided upstream headers.
+func okResponse(headers []*core.HeaderValueOption) *ext.CheckResponse {
+	return &ext.CheckResponse{
+		Status: &rpc.Status{Code: int32(rpc.OK)},
+		HttpResponse: &ext.CheckResponse_OkResponse{
+			OkResponse: &ext.OkHttpResponse{
+				Headers: headers,
+			},
+		},
+	}
+}
+
+// deniedResponse creates a deny response with the given HTTP status.
+func deniedResponse(status int, message string, headers []*core.HeaderValueOption) *ext.CheckResponse {
+
+	code := rpc.PERMISSION_DENIED
+	if status == http.StatusUnauthorized {
+		code = rpc.UNAUTHENTICATED
+	}
+
+	return &ext.CheckResponse{
+		Status: &rpc.Status{
+			Code:    int32(code),
+			Message: message,
+		},
+		HttpResponse: &ext.CheckResponse_DeniedResponse{
+			DeniedResponse: &ext.DeniedHttpResponse{
+				Status:  &envoytype.HttpStatus{Code: envoytype.StatusCode(status)},
+				Headers: headers,
+				Body:    message,
+			},
+		},
+	}
+}
+
+// networkFlowRecord creates the flow record of a network request.
+func networkFlowRecord(puID string, userID string, r *apiauth.Request, d *apiauth.NetworkAuthResponse) *collector.FlowRecord {
+
+	record := &collector.FlowRecord{
+		ContextID: puID,
+		Destination: &collector.EndPoint{
+			ID:         collector.DefaultEndPoint,
+			Type:       collector.EnpointTypePU,
+			IP:         r.OriginalDestination.IP.String(),
+			Port:       uint16(r.OriginalDestination.Port),
+			URI:        r.Method + " " + r.RequestURI,
+			HTTPMethod: r.Method,
+			UserID:     userID,
+		},
+		Source: &collector.EndPoint{
+			ID:     collector.DefaultEndPoint,
+			Type:   collector.EndPointTypeExternalIP,
+			IP:     r.SourceAddress.IP.String(),
+			Port:   uint16(r.SourceAddress.Port),
+			UserID: userID,
+		},
+		Action:      policy.Reject,
+		L4Protocol:  packet.IPProtocolTCP,
+		ServiceType: policy.ServiceHTTP,
+		PolicyID:    collector.DefaultEndPoint,
+		ServiceID:   collector.DefaultEndPoint,
+		Namespace:   collector.DefaultEndPoint,
+		Tags:        policy.NewTagStore(),
+		Count:       1,
+	}
+
+	if d == nil {
+		return record
+	}
+
+	if d.PUContext != nil {
+		record.Destination.ID = d.PUContext.ManagementID()
+		record.Namespace = d.PUContext.ManagementNamespace()
+		record.Tags = d.PUContext.Annotations()
+		record.ServiceID = d.ServiceID
+	}
+
+	record.Source.ID = d.NetworkServiceID
+	if d.SourceType == collector.EnpointTypePU {
+		record.Source.ID = d.SourcePUID
+		record.Source.Type = collector.EnpointTypePU
+	}
+
+	if d.NetworkPolicyID != "" {
+		record.PolicyID = d.NetworkPolicyID
+	}
+
+	record.Action = d.Action
+	if d.Action.Rejected() {
+		record.DropReason = d.DropReason
+	}
+
+	return record
+}
+
+// applicationFlowRecord creates the flow record of an application request.
+func applicationFlowRecord(puID string, r *apiauth.Request, d *apiauth.AppAuthResponse) *collector.FlowRecord {
+
+	return &collector.FlowRecord{
+		ContextID: puID,
+		Destination: &collector.EndPoint{
+			URI:        r.Method + " " + r.RequestURI,
+			HTTPMethod: r.Method,
+			Type:       collector.EndPointTypeExternalIP,
+			Port:       uint16(r.OriginalDestination.Port),
+			IP:         r.OriginalDestination.IP.String(),
+			ID:         d.NetworkServiceID,
+		},
+		Source: &collector.EndPoint{
+			Type:       collector.EnpointTypePU,
+			ID:         d.PUContext.ManagementID(),
+			IP:         r.SourceAddress.IP.String(),
+			Port:       uint16(r.SourceAddress.Port),
+			HTTPMethod: r.Method,
+			URI:        r.Method + " " + r.RequestURI,
+		},
+		Action:      d.Action,
+		L4Protocol:  packet.IPProtocolTCP,
+		ServiceType: policy.ServiceHTTP,
+		ServiceID:   d.ServiceID,
+		Tags:        d.PUContext.Annotations(),
+		Namespace:   d.PUContext.ManagementNamespace(),
+		PolicyID:    d.NetworkPolicyID,
+		Count:       1,
+	}
+}
@@ -0,0 +1,127 @@
+package envoyauthorizer
+
+import (
+	"net/http"
+	"testing"
+
+	rpc "github.com/gogo/googleapis/google/rpc"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/trireme-lib/third_party/generated/envoyproxy/data-plane-api/envoy/api/v2/core"
+	ext "go.aporeto.io/trireme-lib/third_party/generated/envoyproxy/data-plane-api/envoy/service/auth/v2"
+)
+
+func newPeer(ip string, port uint32) *ext.AttributeContext_Peer {
+	return &ext.AttributeContext_Peer{
+		Address: &core.Address{
+			Address: &core.Address_SocketAddress{
+				SocketAddress: &core.SocketAddress{
+					Address: ip,
+					PortSpecifier: &core.SocketAddress_PortValue{
+						PortValue: port,
+					},
+				},
+			},
+		},
+	}
+}
+
+func newAttributes(path string, headers map[string]string) *ext.AttributeContext {
+	return &ext.AttributeContext{
+		Source:      newPeer("10.1.1.1", 40000),
+		Destination: newPeer("10.1.1.2", 8080),
+		Request: &ext.AttributeContext_Request{
+			Http: &ext.AttributeContext_HttpRequest{
+				Method:  "GET",
+				Path:    path,
+				Headers: headers,
+			},
+		},
+	}
+}
+
+func TestRequestFromAttributes(t *testing.T) {
+	Convey("Given valid envoy attributes", t, func() {
+		attrs := newAttributes("/admin?user=1", map[string]string{
+			":authority":     "example.com",
+			"authorization":  "Bearer token",
+			"cookie":         "X-APORETO-AUTH=usertoken",
+			"x-aporeto-auth": "sometoken",
+		})
+
+		Convey("When I convert them to a request", func() {
+			r, err := requestFromAttributes(attrs)
+
+			Convey("Then the request should be correct", func() {
+				So(err, ShouldBeNil)
+				So(r.Method, ShouldEqual, "GET")
+				So(r.URL.Path, ShouldEqual, "/admin")
+				So(r.RequestURI, ShouldEqual, "/admin?user=1")
+				So(r.SourceAddress.String(), ShouldEqual, "10.1.1.1:40000")
+				So(r.OriginalDestination.String(), ShouldEqual, "10.1.1.2:8080")
+				So(r.Header.Get("Authorization"), ShouldEqual, "Bearer token")
+				So(r.Header.Get("X-APORETO-AUTH"), ShouldEqual, "sometoken")
+				So(r.Header.Get(":authority"), ShouldBeEmpty)
+				So(r.Cookie, ShouldNotBeNil)
+				So(r.Cookie.Value, ShouldEqual, "usertoken")
+			})
+		})
+	})
+
+	Convey("Given envoy attributes without a socket address", t, func() {
+		attrs := newAttributes("/admin", nil)
+		attrs.Source = &ext.AttributeContext_Peer{}
+
+		Convey("When I convert them to a request", func() {
+			_, err := requestFromAttributes(attrs)
+
+			Convey("Then I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+
+	Convey("Given envoy attributes with an invalid path", t, func() {
+		attrs := newAttributes("admin", nil)
+
+		Convey("When I convert them to a request", func() {
+			_, err := requestFromAttributes(attrs)
+
+			Convey("Then I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestResponses(t *testing.T) {
+	Convey("When I create a denied response", t, func() {
+		resp := deniedResponse(http.StatusUnauthorized, "unauthorized", []*core.HeaderValueOption{
+			headerOption("Location", "https://redirect"),
+		})
+
+		Convey("Then the status and headers should be correct", func() {
+			So(resp.GetStatus().GetCode(), ShouldEqual, int32(rpc.UNAUTHENTICATED))
+			denied := resp.GetDeniedResponse()
+			So(denied, ShouldNotBeNil)
+			So(int(denied.GetStatus().GetCode()), ShouldEqual, http.StatusUnauthorized)
+			So(denied.GetBody(), ShouldEqual, "unauthorized")
+			So(len(denied.GetHeaders()), ShouldEqual, 1)
+			So(denied.GetHeaders()[0].GetHeader().GetKey(), ShouldEqual, "Location")
+		})
+	})
+
+	Convey("When I create an ok response", t, func() {
+		resp := okResponse([]*core.HeaderValueOption{
+			headerOption("X-APORETO-AUTH", "token"),
+		})
+
+		Convey("Then the status and headers should be correct", func() {
+			So(resp.GetStatus().GetCode(), ShouldEqual, int32(rpc.OK))
+			ok := resp.GetOkResponse()
+			So(ok, ShouldNotBeNil)
+			So(len(ok.GetHeaders()), ShouldEqual, 1)
+			So(ok.GetHeaders()[0].GetHeader().GetValue(), ShouldEqual, "token")
+			So(ok.GetHeaders()[0].GetAppend().GetValue(), ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,317 @@
+package envoyauthorizer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/types"
+	v2 "go.aporeto.io/trireme-lib/third_party/generated/envoyproxy/data-plane-api/envoy/api/v2"
+	"go.aporeto.io/trireme-lib/third_party/generated/envoyproxy/data-plane-api/envoy/api/v2/core"
+	sds "go.aporeto.io/trireme-lib/third_party/generated/envoyproxy/data-plane-api/envoy/service/discovery/v2"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// SDSCertificateName is the name of the SDS resource that holds the
+	// service certificate and private key of the PU.
+	SDSCertificateName = "default"
+
+	// SDSRootCAName is the name of the SDS resource that holds the CAs
+	// that the PU must trust.
+	SDSRootCAName = "ROOTCA"
+
+	// secretTypeURL is the type of the envoy.api.v2.auth.Secret resources.
+	secretTypeURL = "type.googleapis.com/envoy.api.v2.auth.Secret"
+)
+
+// Field numbers of the envoy.api.v2.auth messages. The messages are not part
+// of the generated envoy APIs, so we encode them directly.
+const (
+	secretNameField              = 1
+	secretTLSCertificateField    = 2
+	secretValidationContextField = 4
+
+	tlsCertificateChainField = 1
+	tlsPrivateKeyField       = 2
+
+	validationTrustedCAField = 1
+)
+
+// sdsServer implements the Envoy secret discovery service for a single PU.
+// It serves the service certificate of the PU and the trusted CAs and it
+// pushes updates to all active streams every time they change.
+type sdsServer struct {
+	puID        string
+	certPEM     string
+	keyPEM      string
+	caPEM       string
+	version     uint64
+	subscribers map[chan struct{}]struct{}
+	sync.RWMutex
+}
+
+// newSDSServer creates a new secret discovery server for the PU.
+func newSDSServer(puID string) *sdsServer {
+	return &sdsServer{
+		puID:        puID,
+		subscribers: map[chan struct{}]struct{}{},
+	}
+}
+
+// update updates the secrets of the server. If the secrets have changed all
+// the active streams are notified.
+func (s *sdsServer) update(certPEM, keyPEM, caPEM string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.certPEM == certPEM && s.keyPEM == keyPEM && s.caPEM == caPEM {
+		return
+	}
+
+	s.certPEM = certPEM
+	s.keyPEM = keyPEM
+	s.caPEM = caPEM
+	s.version++
+
+	for c := range s.subscribers {
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// subscribe registers a new stream for updates.
+func (s *sdsServer) subscribe() chan struct{} {
+	s.Lock()
+	defer s.Unlock()
+
+	c := make(chan struct{}, 1)
+	s.subscribers[c] = struct{}{}
+
+	return c
+}
+
+// unsubscribe removes a stream from the updates.
+func (s *sdsServer) unsubscribe(c chan struct{}) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.subscribers, c)
+}
+
+// currentVersion returns the version of the secrets.
+func (s *sdsServer) currentVersion() string {
+	s.RLock()
+	defer s.RUnlock()
+
+	return strconv.FormatUint(s.version, 10)
+}
+
+// DeltaSecrets implements the SecretDiscoveryServiceServer interface. Incremental
+// updates are not supported.
+func (s *sdsServer) DeltaSecrets(stream sds.SecretDiscoveryService_DeltaSecretsServer) error {
+	return status.Errorf(codes.Unimplemented, "delta secrets are not supported")
+}
+
+// StreamSecrets implements the SecretDiscoveryServiceServer interface. It sends
+// the requested secrets and a new response every time the secrets change.
+func (s *sdsServer) StreamSecrets(stream sds.SecretDiscoveryService_StreamSecretsServer) error {
+
+	requests := make(chan *v2.DiscoveryRequest)
+	errCh := make(chan error, 1)
+
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			select {
+			case requests <- req:
+			case <-stream.Context().Done():
+				return
+			}
+		}
+	}()
+
+	updates := s.subscribe()
+	defer s.unsubscribe(updates)
+
+	var resourceNames []string
+	var lastNonce string
+	var nonce uint64
+
+	send := func() error {
+		resp, err := s.discoveryResponse(resourceNames)
+		if err != nil {
+			return err
+		}
+		nonce++
+		resp.Nonce = strconv.FormatUint(nonce, 10)
+		lastNonce = resp.Nonce
+		return stream.Send(resp)
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+
+		case err := <-errCh:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+
+		case req := <-requests:
+			if req.GetErrorDetail() != nil {
+				zap.L().Warn("Envoy rejected the secrets of the PU",
+					zap.String("puID", s.puID),
+					zap.String("error", req.GetErrorDetail().GetMessage()),
+				)
+			}
+			resourceNames = req.GetResourceNames()
+			// Acknowledgements of the current version do not need a response.
+			if req.GetResponseNonce() != "" && req.GetResponseNonce() == lastNonce && req.GetVersionInfo() == s.currentVersion() {
+				continue
+			}
+			if err := send(); err != nil {
+				return err
+			}
+
+		case <-updates:
+			if len(resourceNames) == 0 {
+				continue
+			}
+			if err := send(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// FetchSecrets implements the SecretDiscoveryServiceServer interface.
+func (s *sdsServer) FetchSecrets(ctx context.Context, req *v2.DiscoveryRequest) (*v2.DiscoveryResponse, error) {
+	return s.discoveryResponse(req.GetResourceNames())
+}
+
+// discoveryResponse creates a response with the requested secrets.
+func (s *sdsServer) discoveryResponse(resourceNames []string) (*v2.DiscoveryResponse, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	resp := &v2.DiscoveryResponse{
+		VersionInfo: strconv.FormatUint(s.version, 10),
+		TypeUrl:     secretTypeURL,
+		Resources:   []*types.Any{},
+	}
+
+	for _, name := range resourceNames {
+		var secret []byte
+		var err error
+
+		switch name {
+		case SDSRootCAName:
+			if s.caPEM == "" {
+				continue
+			}
+			secret, err = encodeValidationContextSecret(name, s.caPEM)
+		default:
+			if s.certPEM == "" || s.keyPEM == "" {
+				continue
+			}
+			secret, err = encodeTLSCertificateSecret(name, s.certPEM, s.keyPEM)
+		}
+
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "unable to encode secret %s: %s", name, err)
+		}
+
+		resp.Resources = append(resp.Resources, &types.Any{
+			TypeUrl: secretTypeURL,
+			Value:   secret,
+		})
+	}
+
+	return resp, nil
+}
+
+// encodeTLSCertificateSecret encodes a secret with a TLS certificate.
+func encodeTLSCertificateSecret(name, certPEM, keyPEM string) ([]byte, error) {
+
+	chain, err := encodeInlineDataSource(certPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := encodeInlineDataSource(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	certificate := proto.NewBuffer(nil)
+	if err := encodeField(certificate, tlsCertificateChainField, chain); err != nil {
+		return nil, err
+	}
+	if err := encodeField(certificate, tlsPrivateKeyField, key); err != nil {
+		return nil, err
+	}
+
+	return encodeSecret(name, secretTLSCertificateField, certificate.Bytes())
+}
+
+// encodeValidationContextSecret encodes a secret with a validation context.
+func encodeValidationContextSecret(name, caPEM string) ([]byte, error) {
+
+	ca, err := encodeInlineDataSource(caPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	validation := proto.NewBuffer(nil)
+	if err := encodeField(validation, validationTrustedCAField, ca); err != nil {
+		return nil, err
+	}
+
+	return encodeSecret(name, secretValidationContextField, validation.Bytes())
+}
+
+// encodeSecret encodes a secret with the given name and type.
+func encodeSecret(name string, field int, data []byte) ([]byte, error) {
+
+	secret := proto.NewBuffer(nil)
+	if err := encodeField(secret, secretNameField, []byte(name)); err != nil {
+		return nil, err
+	}
+	if err := encodeField(secret, field, data); err != nil {
+		return nil, err
+	}
+
+	return secret.Bytes(), nil
+}
+
+// encodeInlineDataSource encodes a data source with inline bytes.
+func encodeInlineDataSource(data string) ([]byte, error) {
+	source := &core.DataSource{
+		Specifier: &core.DataSource_InlineBytes{
+			InlineBytes: []byte(data),
+		},
+	}
+	return source.Marshal()
+}
+
+// encodeField encodes a length delimited field.
+func encodeField(b *proto.Buffer, field int, data []byte) error {
+	if err := b.EncodeVarint(uint64(field)<<3 | proto.WireBytes); err != nil {
+		return fmt.Errorf("unable to encode field %d: %s", field, err)
+	}
+	return b.EncodeRawBytes(data)
+}
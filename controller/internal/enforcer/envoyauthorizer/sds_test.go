@@ -0,0 +1,109 @@
+package envoyauthorizer
+
+import (
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/trireme-lib/third_party/generated/envoyproxy/data-plane-api/envoy/api/v2/core"
+)
+
+// decodeFields decodes the length delimited fields of a message.
+func decodeFields(data []byte) map[uint64][]byte {
+	fields := map[uint64][]byte{}
+	b := proto.NewBuffer(data)
+	for {
+		key, err := b.DecodeVarint()
+		if err != nil || key == 0 {
+			return fields
+		}
+		value, err := b.DecodeRawBytes(true)
+		So(err, ShouldBeNil)
+		fields[key>>3] = value
+	}
+}
+
+func TestSDSUpdates(t *testing.T) {
+	Convey("Given an sds server", t, func() {
+		s := newSDSServer("pu1")
+		updates := s.subscribe()
+
+		Convey("When I update the secrets", func() {
+			s.update("cert", "key", "ca")
+
+			Convey("Then the version should change and the subscribers should be notified", func() {
+				So(s.currentVersion(), ShouldEqual, "1")
+				So(len(updates), ShouldEqual, 1)
+			})
+
+			Convey("When I update the secrets with the same values", func() {
+				<-updates
+				s.update("cert", "key", "ca")
+
+				Convey("Then the version should not change", func() {
+					So(s.currentVersion(), ShouldEqual, "1")
+					So(len(updates), ShouldEqual, 0)
+				})
+			})
+
+			Convey("When I unsubscribe and update the secrets", func() {
+				<-updates
+				s.unsubscribe(updates)
+				s.update("newcert", "key", "ca")
+
+				Convey("Then I should not be notified", func() {
+					So(s.currentVersion(), ShouldEqual, "2")
+					So(len(updates), ShouldEqual, 0)
+				})
+			})
+		})
+	})
+}
+
+func TestSDSDiscoveryResponse(t *testing.T) {
+	Convey("Given an sds server with secrets", t, func() {
+		s := newSDSServer("pu1")
+		s.update("cert", "key", "ca")
+
+		Convey("When I request the certificate and the CA", func() {
+			resp, err := s.discoveryResponse([]string{SDSCertificateName, SDSRootCAName})
+
+			Convey("Then I should get both secrets", func() {
+				So(err, ShouldBeNil)
+				So(resp.VersionInfo, ShouldEqual, "1")
+				So(resp.TypeUrl, ShouldEqual, secretTypeURL)
+				So(len(resp.Resources), ShouldEqual, 2)
+
+				secret := decodeFields(resp.Resources[0].Value)
+				So(string(secret[secretNameField]), ShouldEqual, SDSCertificateName)
+				certificate := decodeFields(secret[secretTLSCertificateField])
+				chain := &core.DataSource{}
+				So(chain.Unmarshal(certificate[tlsCertificateChainField]), ShouldBeNil)
+				So(string(chain.GetInlineBytes()), ShouldEqual, "cert")
+				key := &core.DataSource{}
+				So(key.Unmarshal(certificate[tlsPrivateKeyField]), ShouldBeNil)
+				So(string(key.GetInlineBytes()), ShouldEqual, "key")
+
+				secret = decodeFields(resp.Resources[1].Value)
+				So(string(secret[secretNameField]), ShouldEqual, SDSRootCAName)
+				validation := decodeFields(secret[secretValidationContextField])
+				ca := &core.DataSource{}
+				So(ca.Unmarshal(validation[validationTrustedCAField]), ShouldBeNil)
+				So(string(ca.GetInlineBytes()), ShouldEqual, "ca")
+			})
+		})
+	})
+
+	Convey("Given an sds server without secrets", t, func() {
+		s := newSDSServer("pu1")
+
+		Convey("When I request the certificate", func() {
+			resp, err := s.discoveryResponse([]string{SDSCertificateName})
+
+			Convey("Then I should get no resources", func() {
+				So(err, ShouldBeNil)
+				So(len(resp.Resources), ShouldEqual, 0)
+			})
+		})
+	})
+}
@@ -3,8 +3,13 @@ package lookup
 import (
 	"errors"
 	"fmt"
+	"reflect"
+	"regexp"
 	"sort"
+	"strconv"
+	"strings"
 
+	version "github.com/hashicorp/go-version"
 	"go.aporeto.io/trireme-lib/policy"
 	"go.uber.org/zap"
 )
@@ -20,6 +25,44 @@ type ForwardingPolicy struct {
 // intList is a list of integeres
 type intList []int
 
+// indexedClause is a prefix, suffix, regex or comparison clause of a policy.
+// A clause is counted once for a policy, even if several of its values match.
+type indexedClause struct {
+	id     int
+	policy *ForwardingPolicy
+}
+
+// affixTable indexes the prefix or suffix clauses by key and value. The
+// lengths of the values of a key are kept so that a search only looks up
+// the prefixes or suffixes of the tag that can match.
+type affixTable struct {
+	lengths map[string][]int
+	values  map[string]map[string][]*indexedClause
+}
+
+// regexClause is a clause with the anchored regular expression of its values.
+type regexClause struct {
+	re     *regexp.Regexp
+	clause *indexedClause
+}
+
+// operand is a value that is compared as a version, or as a number when
+// one of the compared values is not a version.
+type operand struct {
+	version  *version.Version
+	number   float64
+	isNumber bool
+}
+
+// comparisonClause is a clause that compares the values of a key with its
+// operands or checks them against version constraints.
+type comparisonClause struct {
+	operator    policy.Operator
+	operands    []*operand
+	constraints []version.Constraints
+	clause      *indexedClause
+}
+
 //PolicyDB is the structure of a policy
 type PolicyDB struct {
 	// rules    []policy
@@ -30,6 +73,12 @@ type PolicyDB struct {
 	notEqualMapTable       map[string]map[string][]*ForwardingPolicy
 	notStarTable           map[string][]*ForwardingPolicy
 	defaultNotExistsPolicy *ForwardingPolicy
+	prefixTable            *affixTable
+	suffixTable            *affixTable
+	regexTable             map[string][]*regexClause
+	comparisonTable        map[string][]*comparisonClause
+	numberOfClauses        int
+	policies               map[interface{}][]*ForwardingPolicy
 }
 
 //NewPolicyDB creates a new PolicyDB for efficient search of policies
@@ -43,11 +92,191 @@ func NewPolicyDB() (m *PolicyDB) {
 		notEqualMapTable:       map[string]map[string][]*ForwardingPolicy{},
 		notStarTable:           map[string][]*ForwardingPolicy{},
 		defaultNotExistsPolicy: nil,
+		prefixTable:            newAffixTable(),
+		suffixTable:            newAffixTable(),
+		regexTable:             map[string][]*regexClause{},
+		comparisonTable:        map[string][]*comparisonClause{},
+		policies:               map[interface{}][]*ForwardingPolicy{},
 	}
 
 	return m
 }
 
+func newAffixTable() *affixTable {
+	return &affixTable{
+		lengths: map[string][]int{},
+		values:  map[string]map[string][]*indexedClause{},
+	}
+}
+
+// add adds a value of a clause to the table.
+func (t *affixTable) add(key string, value string, c *indexedClause) {
+
+	if _, ok := t.values[key]; !ok {
+		t.values[key] = map[string][]*indexedClause{}
+	}
+	t.values[key][value] = append(t.values[key][value], c)
+
+	lengths := t.lengths[key]
+	i := sort.SearchInts(lengths, len(value))
+	if i < len(lengths) && lengths[i] == len(value) {
+		return
+	}
+	lengths = append(lengths, 0)
+	copy(lengths[i+1:], lengths[i:])
+	lengths[i] = len(value)
+	t.lengths[key] = lengths
+}
+
+// remove removes the values of a clause of the policy from the table.
+func (t *affixTable) remove(key string, values []string, e *ForwardingPolicy) {
+
+	for _, v := range values {
+		clauses := []*indexedClause{}
+		for _, c := range t.values[key][v] {
+			if c.policy != e {
+				clauses = append(clauses, c)
+			}
+		}
+
+		if len(clauses) == 0 {
+			delete(t.values[key], v)
+		} else {
+			t.values[key][v] = clauses
+		}
+	}
+}
+
+// compileRegex compiles the values of a regex clause to a single expression
+// that must match the whole value.
+func compileRegex(values []string) (*regexp.Regexp, error) {
+
+	exprs := make([]string, 0, len(values))
+	for _, v := range values {
+		if _, err := regexp.Compile(v); err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, "(?:"+v+")")
+	}
+
+	return regexp.Compile("^(?:" + strings.Join(exprs, "|") + ")$")
+}
+
+// newOperand parses a value as a version and as a number. It returns nil if
+// the value is neither.
+func newOperand(value string) *operand {
+
+	o := &operand{}
+
+	if v, err := version.NewVersion(value); err == nil {
+		o.version = v
+	}
+
+	if n, err := strconv.ParseFloat(value, 64); err == nil {
+		o.number = n
+		o.isNumber = true
+	}
+
+	if o.version == nil && !o.isNumber {
+		return nil
+	}
+
+	return o
+}
+
+// compare compares two operands. The second result is false if the operands
+// cannot be compared.
+func (o *operand) compare(other *operand) (int, bool) {
+
+	if o.version != nil && other.version != nil {
+		return o.version.Compare(other.version), true
+	}
+
+	if o.isNumber && other.isNumber {
+		switch {
+		case o.number < other.number:
+			return -1, true
+		case o.number > other.number:
+			return 1, true
+		default:
+			return 0, true
+		}
+	}
+
+	return 0, false
+}
+
+// newComparisonClause parses the values of a comparison clause. Values that
+// cannot be parsed never match.
+func newComparisonClause(keyValueOp policy.KeyValueOperator, c *indexedClause) *comparisonClause {
+
+	cc := &comparisonClause{
+		operator: keyValueOp.Operator,
+		clause:   c,
+	}
+
+	for _, v := range keyValueOp.Value {
+
+		if keyValueOp.Operator == policy.SemverRange {
+			constraints, err := version.NewConstraint(v)
+			if err != nil {
+				zap.L().Error("Invalid version constraint in tag selector", zap.String("key", keyValueOp.Key), zap.String("value", v), zap.Error(err))
+				continue
+			}
+			cc.constraints = append(cc.constraints, constraints)
+			continue
+		}
+
+		o := newOperand(v)
+		if o == nil {
+			zap.L().Error("Invalid operand in tag selector", zap.String("key", keyValueOp.Key), zap.String("value", v))
+			continue
+		}
+		cc.operands = append(cc.operands, o)
+	}
+
+	return cc
+}
+
+// matches returns true if the value matches one of the operands or satisfies
+// one of the constraints of the clause.
+func (cc *comparisonClause) matches(value *operand) bool {
+
+	for _, constraints := range cc.constraints {
+		if value.version != nil && constraints.Check(value.version) {
+			return true
+		}
+	}
+
+	for _, o := range cc.operands {
+		r, ok := value.compare(o)
+		if !ok {
+			continue
+		}
+
+		switch cc.operator {
+		case policy.LessThan:
+			if r < 0 {
+				return true
+			}
+		case policy.LessOrEqual:
+			if r <= 0 {
+				return true
+			}
+		case policy.GreaterThan:
+			if r > 0 {
+				return true
+			}
+		case policy.GreaterOrEqual:
+			if r >= 0 {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
 func (array intList) sortedInsert(value int) intList {
 	l := len(array)
 	if l == 0 {
@@ -125,6 +354,41 @@ func (m *PolicyDB) AddPolicy(selector policy.TagSelector) (policyID int) {
 			}
 			e.count++
 
+		case policy.Prefix, policy.Suffix:
+			m.numberOfClauses++
+			c := &indexedClause{id: m.numberOfClauses, policy: &e}
+			table := m.prefixTable
+			if keyValueOp.Operator == policy.Suffix {
+				table = m.suffixTable
+			}
+			for _, v := range keyValueOp.Value {
+				table.add(keyValueOp.Key, v, c)
+			}
+			e.count++
+
+		case policy.Regex:
+			m.numberOfClauses++
+			c := &indexedClause{id: m.numberOfClauses, policy: &e}
+			// A clause with an invalid expression is still counted, so
+			// that the policy never matches instead of matching more.
+			re, err := compileRegex(keyValueOp.Value)
+			if err != nil {
+				zap.L().Error("Invalid regular expression in tag selector",
+					zap.String("key", keyValueOp.Key),
+					zap.Strings("values", keyValueOp.Value),
+					zap.Error(err),
+				)
+			} else {
+				m.regexTable[keyValueOp.Key] = append(m.regexTable[keyValueOp.Key], &regexClause{re: re, clause: c})
+			}
+			e.count++
+
+		case policy.LessThan, policy.LessOrEqual, policy.GreaterThan, policy.GreaterOrEqual, policy.SemverRange:
+			m.numberOfClauses++
+			c := &indexedClause{id: m.numberOfClauses, policy: &e}
+			m.comparisonTable[keyValueOp.Key] = append(m.comparisonTable[keyValueOp.Key], newComparisonClause(keyValueOp, c))
+			e.count++
+
 		default: // policy.NotEqual
 			if _, ok := m.notEqualMapTable[keyValueOp.Key]; !ok {
 				m.notEqualMapTable[keyValueOp.Key] = map[string][]*ForwardingPolicy{}
@@ -142,11 +406,152 @@ func (m *PolicyDB) AddPolicy(selector policy.TagSelector) (policyID int) {
 	// Give the policy an index
 	e.index = m.numberOfPolicies
 
+	// Keep the policy so that it can be removed
+	m.policies[selector.Policy] = append(m.policies[selector.Policy], &e)
+
 	// Return the ID
 	return e.index
 
 }
 
+// RemovePolicy removes a policy that was added with the same selector. The
+// policy is found by the action of the selector. It returns false if the
+// policy is not in the database.
+func (m *PolicyDB) RemovePolicy(selector policy.TagSelector) bool {
+
+	candidates := m.policies[selector.Policy]
+
+	for i, e := range candidates {
+		if !reflect.DeepEqual(e.tags, selector.Clause) {
+			continue
+		}
+
+		if len(candidates) == 1 {
+			delete(m.policies, selector.Policy)
+		} else {
+			m.policies[selector.Policy] = append(candidates[:i:i], candidates[i+1:]...)
+		}
+
+		m.removeFromTables(e)
+
+		return true
+	}
+
+	return false
+}
+
+// removeFromTables removes all the references of the tables to the policy.
+// The indexes of the policies do not change, and the lengths of the prefixes
+// are kept since they only cost an extra lookup.
+func (m *PolicyDB) removeFromTables(e *ForwardingPolicy) {
+
+	for _, keyValueOp := range e.tags {
+
+		k := keyValueOp.Key
+
+		switch keyValueOp.Operator {
+
+		case policy.KeyExists:
+			removeFromMapTable(m.equalMapTable[k], "", e)
+
+		case policy.KeyNotExists:
+			m.notStarTable[k] = removeForwardingPolicy(m.notStarTable[k], e)
+			if len(m.notStarTable[k]) == 0 {
+				delete(m.notStarTable, k)
+			}
+			if m.defaultNotExistsPolicy == e {
+				m.defaultNotExistsPolicy = m.lastNotExistsPolicy()
+			}
+
+		case policy.Equal:
+			for _, v := range keyValueOp.Value {
+				if end := len(v) - 1; v[end] == '*' {
+					v = v[:end]
+				}
+				removeFromMapTable(m.equalMapTable[k], v, e)
+			}
+			if keyValueOp.ID != "" {
+				m.equalIDMapTable[keyValueOp.ID] = removeForwardingPolicy(m.equalIDMapTable[keyValueOp.ID], e)
+				if len(m.equalIDMapTable[keyValueOp.ID]) == 0 {
+					delete(m.equalIDMapTable, keyValueOp.ID)
+				}
+			}
+
+		case policy.Prefix:
+			m.prefixTable.remove(k, keyValueOp.Value, e)
+
+		case policy.Suffix:
+			m.suffixTable.remove(k, keyValueOp.Value, e)
+
+		case policy.Regex:
+			regexes := []*regexClause{}
+			for _, r := range m.regexTable[k] {
+				if r.clause.policy != e {
+					regexes = append(regexes, r)
+				}
+			}
+			m.regexTable[k] = regexes
+
+		case policy.LessThan, policy.LessOrEqual, policy.GreaterThan, policy.GreaterOrEqual, policy.SemverRange:
+			comparisons := []*comparisonClause{}
+			for _, cc := range m.comparisonTable[k] {
+				if cc.clause.policy != e {
+					comparisons = append(comparisons, cc)
+				}
+			}
+			m.comparisonTable[k] = comparisons
+
+		default: // policy.NotEqual
+			for _, v := range keyValueOp.Value {
+				removeFromMapTable(m.notEqualMapTable[k], v, e)
+			}
+		}
+	}
+}
+
+// lastNotExistsPolicy returns the last added policy with a single not exists
+// clause, which is the default policy when no tag key is excluded.
+func (m *PolicyDB) lastNotExistsPolicy() *ForwardingPolicy {
+
+	var last *ForwardingPolicy
+
+	for _, policies := range m.notStarTable {
+		for _, e := range policies {
+			if len(e.tags) == 1 && (last == nil || e.index > last.index) {
+				last = e
+			}
+		}
+	}
+
+	return last
+}
+
+// removeFromMapTable removes the policy from the policies of a value.
+func removeFromMapTable(table map[string][]*ForwardingPolicy, value string, e *ForwardingPolicy) {
+
+	if table == nil {
+		return
+	}
+
+	table[value] = removeForwardingPolicy(table[value], e)
+	if len(table[value]) == 0 {
+		delete(table, value)
+	}
+}
+
+// removeForwardingPolicy returns a copy of the list without the policy.
+func removeForwardingPolicy(list []*ForwardingPolicy, e *ForwardingPolicy) []*ForwardingPolicy {
+
+	policies := make([]*ForwardingPolicy, 0, len(list))
+	for _, p := range list {
+		if p != e {
+			policies = append(policies, p)
+		}
+	}
+
+	return policies
+}
+
 var (
 	errInvalidTag = errors.New("tag must be k=v")
 )
@@ -184,6 +589,11 @@ func (m *PolicyDB) Search(tags *policy.TagStore) (int, interface{}) {
 
 	skip := make([]bool, m.numberOfPolicies+1)
 
+	var matched map[int]bool
+	if m.numberOfClauses > 0 {
+		matched = map[int]bool{}
+	}
+
 	// Disable all policies that fail the not key exists
 	copiedTags := tags.GetSlice()
 	var k, v string
@@ -223,6 +633,11 @@ func (m *PolicyDB) Search(tags *policy.TagStore) (int, interface{}) {
 			}
 		}
 
+		// Search for matches of the prefix, suffix, regex and comparison clauses
+		if index, action := m.searchAffixes(k, v, count, skip, matched); index >= 0 {
+			return index, action
+		}
+
 		// Parse all of the policies that have a key that matches the incoming tag key
 		// and a not equal operator and that has a not match rule
 		for value, policies := range m.notEqualMapTable[k] {
@@ -264,6 +679,84 @@ func searchInMapTable(table []*ForwardingPolicy, count []int, skip []bool) (int,
 	return -1, nil
 }
 
+// searchAffixes searches the prefix, suffix, regex and comparison clauses of
+// a key for matches of the value.
+func (m *PolicyDB) searchAffixes(k string, v string, count []int, skip []bool, matched map[int]bool) (int, interface{}) {
+
+	if values, ok := m.prefixTable.values[k]; ok {
+		for _, i := range m.prefixTable.lengths[k] {
+			if i > len(v) {
+				break
+			}
+			if index, action := searchInClauses(values[v[:i]], count, skip, matched); index >= 0 {
+				return index, action
+			}
+		}
+	}
+
+	if values, ok := m.suffixTable.values[k]; ok {
+		for _, i := range m.suffixTable.lengths[k] {
+			if i > len(v) {
+				break
+			}
+			if index, action := searchInClauses(values[v[len(v)-i:]], count, skip, matched); index >= 0 {
+				return index, action
+			}
+		}
+	}
+
+	for _, r := range m.regexTable[k] {
+		if !r.re.MatchString(v) {
+			continue
+		}
+		if index, action := searchInClauses([]*indexedClause{r.clause}, count, skip, matched); index >= 0 {
+			return index, action
+		}
+	}
+
+	comparisons := m.comparisonTable[k]
+	if len(comparisons) == 0 {
+		return -1, nil
+	}
+
+	// The value is parsed once for all the comparisons of the key.
+	value := newOperand(v)
+	if value == nil {
+		return -1, nil
+	}
+
+	for _, cc := range comparisons {
+		if !cc.matches(value) {
+			continue
+		}
+		if index, action := searchInClauses([]*indexedClause{cc.clause}, count, skip, matched); index >= 0 {
+			return index, action
+		}
+	}
+
+	return -1, nil
+}
+
+func searchInClauses(clauses []*indexedClause, count []int, skip []bool, matched map[int]bool) (int, interface{}) {
+	for _, c := range clauses {
+
+		// Skip the policy if we have marked it or if the clause is already hit
+		if skip[c.policy.index] || matched[c.id] {
+			continue
+		}
+
+		matched[c.id] = true
+		count[c.policy.index]++
+
+		// If all tags of the policy have been hit, there is a match
+		if count[c.policy.index] == c.policy.count {
+			return c.policy.index, c.policy.actions
+		}
+	}
+
+	return -1, nil
+}
+
 // PrintPolicyDB is a debugging function to dump the map
 func (m *PolicyDB) PrintPolicyDB() {
 
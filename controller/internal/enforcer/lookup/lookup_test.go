@@ -428,3 +428,291 @@ func TestFuncDumpDB(t *testing.T) {
 		})
 	})
 }
+
+// TestFuncSearchAffixes tests the prefix, suffix and regex operators
+func TestFuncSearchAffixes(t *testing.T) {
+	// policy1: app prefix frontend-
+	// policy2: image suffix :latest and env=prod
+	// policy3: version regex v1\.[0-9]+
+	// policy4: ns prefix /a/ and ns suffix /web
+	// policy5: app regex with an invalid expression
+	// policy6: image suffix (:latest, latest) and tier=gold
+
+	appPrefix := policy.TagSelector{
+		Clause: []policy.KeyValueOperator{
+			{Key: "app", Value: []string{"frontend-", "front"}, Operator: policy.Prefix},
+		},
+		Policy: &policy.FlowPolicy{Action: policy.Accept, PolicyID: "1"},
+	}
+
+	imageSuffixAndEnvProd := policy.TagSelector{
+		Clause: []policy.KeyValueOperator{
+			{Key: "image", Value: []string{":latest"}, Operator: policy.Suffix},
+			{Key: "env", Value: []string{"prod"}, Operator: policy.Equal},
+		},
+		Policy: &policy.FlowPolicy{Action: policy.Accept, PolicyID: "2"},
+	}
+
+	versionRegex := policy.TagSelector{
+		Clause: []policy.KeyValueOperator{
+			{Key: "version", Value: []string{`v1\.[0-9]+`, `v2`}, Operator: policy.Regex},
+		},
+		Policy: &policy.FlowPolicy{Action: policy.Accept, PolicyID: "3"},
+	}
+
+	nsPrefixAndSuffix := policy.TagSelector{
+		Clause: []policy.KeyValueOperator{
+			{Key: "ns", Value: []string{"/a/"}, Operator: policy.Prefix},
+			{Key: "ns", Value: []string{"/web"}, Operator: policy.Suffix},
+		},
+		Policy: &policy.FlowPolicy{Action: policy.Accept, PolicyID: "4"},
+	}
+
+	invalidRegex := policy.TagSelector{
+		Clause: []policy.KeyValueOperator{
+			{Key: "app", Value: []string{"front(end"}, Operator: policy.Regex},
+		},
+		Policy: &policy.FlowPolicy{Action: policy.Reject, PolicyID: "5"},
+	}
+
+	imageSuffixesAndTierGold := policy.TagSelector{
+		Clause: []policy.KeyValueOperator{
+			{Key: "image", Value: []string{":latest", "latest"}, Operator: policy.Suffix},
+			{Key: "tier", Value: []string{"gold"}, Operator: policy.Equal},
+		},
+		Policy: &policy.FlowPolicy{Action: policy.Accept, PolicyID: "6"},
+	}
+
+	Convey("Given a policyDB with prefix, suffix and regex policies", t, func() {
+		policyDB := NewPolicyDB()
+
+		index1 := policyDB.AddPolicy(appPrefix)
+		index2 := policyDB.AddPolicy(imageSuffixAndEnvProd)
+		index3 := policyDB.AddPolicy(versionRegex)
+		index4 := policyDB.AddPolicy(nsPrefixAndSuffix)
+		policyDB.AddPolicy(invalidRegex)
+		index6 := policyDB.AddPolicy(imageSuffixesAndTierGold)
+
+		So(policyDB.prefixTable.lengths["app"], ShouldResemble, []int{5, 9})
+		So(policyDB.regexTable["app"], ShouldBeEmpty)
+
+		search := func(tags ...string) int {
+			index, _ := policyDB.Search(policy.NewTagStoreFromSlice(tags))
+			return index
+		}
+
+		Convey("A value with a prefix should match the prefix policy", func() {
+			So(search("app=frontend-v2"), ShouldEqual, index1)
+			So(search("app=front"), ShouldEqual, index1)
+			So(search("app=back"), ShouldEqual, -1)
+		})
+
+		Convey("A clause should only be counted once when several values match", func() {
+			So(search("image=web:latest"), ShouldEqual, -1)
+			So(search("image=web:latest", "tier=gold"), ShouldEqual, index6)
+		})
+
+		Convey("A value with a suffix should match only with the other clauses", func() {
+			So(search("image=web:latest", "env=prod"), ShouldEqual, index2)
+			So(search("image=web:latest", "env=dev"), ShouldEqual, -1)
+		})
+
+		Convey("A value should match the regex only if the whole value matches", func() {
+			So(search("version=v1.12"), ShouldEqual, index3)
+			So(search("version=v2"), ShouldEqual, index3)
+			So(search("version=v1.x"), ShouldEqual, -1)
+			So(search("version=xv2"), ShouldEqual, -1)
+			So(search("version=v22"), ShouldEqual, -1)
+		})
+
+		Convey("A value should match the prefix and the suffix clauses of the same key", func() {
+			So(search("ns=/a/b/web"), ShouldEqual, index4)
+			So(search("ns=/a/b/db"), ShouldEqual, -1)
+			So(search("ns=/b/web"), ShouldEqual, -1)
+		})
+	})
+}
+
+// TestFuncSearchComparisons tests the comparison and version range operators
+func TestFuncSearchComparisons(t *testing.T) {
+	// policy1: @app:version >= 2.3
+	// policy2: tier < 3 and env=prod
+	// policy3: release in range ">= 1.0, < 1.4" or "~> 2.1.0"
+	// policy4: temperature <= -5
+
+	versionAtLeast := policy.TagSelector{
+		Clause: []policy.KeyValueOperator{
+			{Key: "@app:version", Value: []string{"2.3"}, Operator: policy.GreaterOrEqual},
+		},
+		Policy: &policy.FlowPolicy{Action: policy.Accept, PolicyID: "1"},
+	}
+
+	tierBelowAndProd := policy.TagSelector{
+		Clause: []policy.KeyValueOperator{
+			{Key: "tier", Value: []string{"3"}, Operator: policy.LessThan},
+			{Key: "env", Value: []string{"prod"}, Operator: policy.Equal},
+		},
+		Policy: &policy.FlowPolicy{Action: policy.Accept, PolicyID: "2"},
+	}
+
+	releaseRange := policy.TagSelector{
+		Clause: []policy.KeyValueOperator{
+			{Key: "release", Value: []string{">= 1.0, < 1.4", "~> 2.1.0", "invalid"}, Operator: policy.SemverRange},
+		},
+		Policy: &policy.FlowPolicy{Action: policy.Accept, PolicyID: "3"},
+	}
+
+	temperatureAtMost := policy.TagSelector{
+		Clause: []policy.KeyValueOperator{
+			{Key: "temperature", Value: []string{"-5"}, Operator: policy.LessOrEqual},
+		},
+		Policy: &policy.FlowPolicy{Action: policy.Accept, PolicyID: "4"},
+	}
+
+	Convey("Given a policyDB with comparison policies", t, func() {
+		policyDB := NewPolicyDB()
+
+		index1 := policyDB.AddPolicy(versionAtLeast)
+		index2 := policyDB.AddPolicy(tierBelowAndProd)
+		index3 := policyDB.AddPolicy(releaseRange)
+		index4 := policyDB.AddPolicy(temperatureAtMost)
+
+		So(policyDB.comparisonTable["release"][0].constraints, ShouldHaveLength, 2)
+
+		search := func(tags ...string) int {
+			index, _ := policyDB.Search(policy.NewTagStoreFromSlice(tags))
+			return index
+		}
+
+		Convey("Versions should be compared as versions", func() {
+			So(search("@app:version=2.3"), ShouldEqual, index1)
+			So(search("@app:version=2.10"), ShouldEqual, index1)
+			So(search("@app:version=v3.0.1"), ShouldEqual, index1)
+			So(search("@app:version=2.2.9"), ShouldEqual, -1)
+			So(search("@app:version=latest"), ShouldEqual, -1)
+		})
+
+		Convey("Numbers should be compared with all the clauses of the policy", func() {
+			So(search("tier=2", "env=prod"), ShouldEqual, index2)
+			So(search("tier=3", "env=prod"), ShouldEqual, -1)
+			So(search("tier=2", "env=dev"), ShouldEqual, -1)
+		})
+
+		Convey("Versions should match any of the constraints of the range", func() {
+			So(search("release=1.3.7"), ShouldEqual, index3)
+			So(search("release=2.1.5"), ShouldEqual, index3)
+			So(search("release=1.4"), ShouldEqual, -1)
+			So(search("release=2.2.0"), ShouldEqual, -1)
+		})
+
+		Convey("Values that are not versions should be compared as numbers", func() {
+			So(search("temperature=-10"), ShouldEqual, index4)
+			So(search("temperature=-5"), ShouldEqual, index4)
+			So(search("temperature=-1.5"), ShouldEqual, -1)
+		})
+	})
+}
+
+func TestFuncRemovePolicy(t *testing.T) {
+	// policy1: app=web and env!=dev
+	// policy2: app=web and app:name^=front
+	// policy3: @sys:image exists and tier < 3
+	// policy4: not exists lang
+	// policy5: svc=we* or id=abc
+
+	webNotDev := policy.TagSelector{
+		Clause: []policy.KeyValueOperator{
+			{Key: "app", Value: []string{"web"}, Operator: policy.Equal},
+			{Key: "env", Value: []string{"dev"}, Operator: policy.NotEqual},
+		},
+		Policy: &policy.FlowPolicy{Action: policy.Accept, PolicyID: "1"},
+	}
+
+	webFront := policy.TagSelector{
+		Clause: []policy.KeyValueOperator{
+			{Key: "app", Value: []string{"web"}, Operator: policy.Equal},
+			{Key: "app:name", Value: []string{"front"}, Operator: policy.Prefix},
+		},
+		Policy: &policy.FlowPolicy{Action: policy.Accept, PolicyID: "2"},
+	}
+
+	imageTier := policy.TagSelector{
+		Clause: []policy.KeyValueOperator{
+			{Key: "@sys:image", Operator: policy.KeyExists},
+			{Key: "tier", Value: []string{"3"}, Operator: policy.LessThan},
+		},
+		Policy: &policy.FlowPolicy{Action: policy.Accept, PolicyID: "3"},
+	}
+
+	noLang := policy.TagSelector{
+		Clause: []policy.KeyValueOperator{
+			{Key: "lang", Operator: policy.KeyNotExists},
+		},
+		Policy: &policy.FlowPolicy{Action: policy.Accept, PolicyID: "4"},
+	}
+
+	wildcardID := policy.TagSelector{
+		Clause: []policy.KeyValueOperator{
+			{Key: "svc", Value: []string{"we*"}, Operator: policy.Equal, ID: "abc"},
+		},
+		Policy: &policy.FlowPolicy{Action: policy.Accept, PolicyID: "5"},
+	}
+
+	Convey("Given a policyDB with several policies", t, func() {
+		policyDB := NewPolicyDB()
+
+		index1 := policyDB.AddPolicy(webNotDev)
+		index2 := policyDB.AddPolicy(webFront)
+		index3 := policyDB.AddPolicy(imageTier)
+		policyDB.AddPolicy(noLang)
+		index5 := policyDB.AddPolicy(wildcardID)
+
+		search := func(tags ...string) int {
+			index, _ := policyDB.Search(policy.NewTagStoreFromSlice(tags))
+			return index
+		}
+
+		So(search("app=web", "env=prod", "lang=go"), ShouldEqual, index1)
+		So(search("app:name=frontend", "app=web", "lang=go"), ShouldEqual, index2)
+		So(search("@sys:image=nginx", "tier=1", "lang=go"), ShouldEqual, index3)
+		So(search("abc", "lang=go"), ShouldEqual, index5)
+		So(search("svc=west", "lang=go"), ShouldEqual, index5)
+
+		Convey("When I remove policies, they should not match any more", func() {
+			So(policyDB.RemovePolicy(webNotDev), ShouldBeTrue)
+			So(policyDB.RemovePolicy(imageTier), ShouldBeTrue)
+			So(policyDB.RemovePolicy(wildcardID), ShouldBeTrue)
+
+			So(search("app=web", "env=prod", "lang=go"), ShouldEqual, -1)
+			So(search("@sys:image=nginx", "tier=1", "lang=go"), ShouldEqual, -1)
+			So(search("abc", "lang=go"), ShouldEqual, -1)
+			So(search("svc=west", "lang=go"), ShouldEqual, -1)
+			So(policyDB.equalIDMapTable, ShouldBeEmpty)
+			So(policyDB.notEqualMapTable["env"], ShouldBeEmpty)
+
+			Convey("The other policies should still match", func() {
+				So(search("app:name=frontend", "app=web", "lang=go"), ShouldEqual, index2)
+			})
+
+			Convey("Removing them again should fail", func() {
+				So(policyDB.RemovePolicy(webNotDev), ShouldBeFalse)
+			})
+
+			Convey("Adding them again should give them a new index", func() {
+				So(policyDB.AddPolicy(webNotDev), ShouldBeGreaterThan, index5)
+				So(search("app=web", "env=prod", "lang=go"), ShouldBeGreaterThan, index5)
+			})
+		})
+
+		Convey("When I remove the default not exists policy, there should be no default", func() {
+			So(search("app=other"), ShouldBeGreaterThan, 0)
+			So(policyDB.RemovePolicy(noLang), ShouldBeTrue)
+			So(search("app=other"), ShouldEqual, -1)
+		})
+
+		Convey("When I remove a policy with the same action but different clauses, it should fail", func() {
+			So(policyDB.RemovePolicy(policy.TagSelector{Clause: webFront.Clause[:1], Policy: webFront.Policy}), ShouldBeFalse)
+			So(search("app:name=frontend", "app=web", "lang=go"), ShouldEqual, index2)
+		})
+	})
+}
@@ -12,12 +12,32 @@ import (
 	"time"
 
 	"go.aporeto.io/trireme-lib/controller/internal/supervisor/iptablesctrl"
+	"go.aporeto.io/trireme-lib/controller/internal/supervisor/nftctrl"
 	"go.aporeto.io/trireme-lib/controller/pkg/pucontext"
 	"go.aporeto.io/trireme-lib/utils/cgnetcls"
 	"go.aporeto.io/trireme-lib/utils/portspec"
 	"go.uber.org/zap"
 )
 
+// portSets are the port sets of the supervisor implementation.
+type portSets interface {
+	AddPortToPortSet(contextID string, port string) error
+	DeletePortFromPortSet(contextID string, port string) error
+}
+
+// getPortSets returns the port sets of the running supervisor implementation.
+func getPortSets() portSets {
+	if i := nftctrl.GetInstance(); i != nil {
+		return i
+	}
+
+	if i := iptablesctrl.GetInstance(); i != nil {
+		return i
+	}
+
+	return nil
+}
+
 type readSystemFiles interface {
 	readOpenSockFD(pid string) []string
 	readProcNetTCP() (inodeMap map[string]string, userMap map[string]map[string]bool, err error)
@@ -69,8 +89,8 @@ func (d *Datapath) autoPortDiscovery() {
 
 // resync adds new port for the PU and removes the stale ports
 func (d *Datapath) resync(newPortMap map[string]map[string]bool) {
-	iptablesInstance := iptablesctrl.GetInstance()
-	if iptablesInstance == nil {
+	portSetInstance := getPortSets()
+	if portSetInstance == nil {
 		return
 	}
 
@@ -79,7 +99,7 @@ func (d *Datapath) resync(newPortMap map[string]map[string]bool) {
 
 		for v := range vs {
 			if m == nil || !m[v] {
-				err := iptablesInstance.DeletePortFromPortSet(k, v)
+				err := portSetInstance.DeletePortFromPortSet(k, v)
 				if err != nil {
 					zap.L().Debug("autoPortDiscovery: Delete port set returned error", zap.Error(err))
 				}
@@ -101,7 +121,7 @@ func (d *Datapath) resync(newPortMap map[string]map[string]bool) {
 					continue
 				}
 				d.contextIDFromTCPPort.AddPortSpec(portSpec)
-				err = iptablesInstance.AddPortToPortSet(k, v)
+				err = portSetInstance.AddPortToPortSet(k, v)
 				if err != nil {
 					zap.L().Error("autoPortDiscovery: Failed to add port to portset", zap.String("context", k), zap.String("port", v))
 				}
@@ -0,0 +1,133 @@
+package nfqdatapath
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"go.aporeto.io/trireme-lib/controller/pkg/connection"
+	"go.aporeto.io/trireme-lib/controller/pkg/flowtracking"
+	"go.aporeto.io/trireme-lib/controller/pkg/packet"
+	"go.aporeto.io/trireme-lib/controller/pkg/pucontext"
+	"go.aporeto.io/trireme-lib/utils/cache"
+	"go.uber.org/zap"
+)
+
+// closedFlowsRetryInterval is the time to wait before watching the destroyed
+// flows again after the watch failed or stopped.
+var closedFlowsRetryInterval = 30 * time.Second
+
+// connectionID returns the key of a connection held by the network or the
+// application origin connection tracker in the connection limiter.
+func connectionID(inbound bool, hash string) string {
+
+	if inbound {
+		return "net:" + hash
+	}
+
+	return "app:" + hash
+}
+
+// admitConnection returns true if the new connection identified by the
+// tracker hash is within the connection limits of the PU. The peer is the
+// remote PU if it is known or the remote address otherwise. The admitted
+// connections are counted until conntrack destroys their flow.
+func (d *Datapath) admitConnection(context *pucontext.PUContext, inbound bool, hash string, remoteID string, remoteIP net.IP) bool {
+
+	max, maxPerPeer := context.ConnectionLimits().Limits(inbound)
+	if max <= 0 && maxPerPeer <= 0 {
+		return true
+	}
+
+	group := context.ID() + "/out"
+	if inbound {
+		group = context.ID() + "/in"
+	}
+
+	peer := remoteID
+	if peer == "" {
+		peer = remoteIP.String()
+	}
+
+	return d.connLimiter.Admit(connectionID(inbound, hash), group, peer, max, maxPerPeer)
+}
+
+// releaseConnection stops counting the connection identified by the tracker hash.
+func (d *Datapath) releaseConnection(inbound bool, hash string) {
+	d.connLimiter.Release(connectionID(inbound, hash))
+}
+
+// connectionClosed releases the connection of a flow destroyed by conntrack.
+// The flow is released for both origins, since a connection between two PUs
+// of the enforcer is counted by both of them.
+func (d *Datapath) connectionClosed(ipSrc, ipDst net.IP, protonum uint8, srcport, dstport uint16) {
+
+	if protonum != packet.IPProtocolTCP {
+		return
+	}
+
+	hash := ipSrc.String() + ":" + ipDst.String() + ":" + strconv.Itoa(int(srcport)) + ":" + strconv.Itoa(int(dstport))
+
+	d.releaseConnection(true, hash)
+	d.releaseConnection(false, hash)
+}
+
+// watchClosedFlows releases the connections of the flows destroyed by
+// conntrack until the context is done. The watch is started again after it
+// fails, for example when events were lost, and the connections are released
+// by the origin trackers in the meantime. It never fails the enforcer, since
+// the PUs without connection limits do not need it.
+func (d *Datapath) watchClosedFlows(ctx context.Context) {
+
+	for {
+		stopped, err := flowtracking.WatchClosedFlows(ctx, d.connectionClosed)
+		if err == nil {
+			atomic.StoreInt32(&d.closedFlowsWatched, 1)
+			err = <-stopped
+			atomic.StoreInt32(&d.closedFlowsWatched, 0)
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		zap.L().Warn("Unable to watch the closed flows, the connection limits are released when the connections expire",
+			zap.Duration("retry", closedFlowsRetryInterval),
+			zap.Error(err),
+		)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(closedFlowsRetryInterval):
+		}
+	}
+}
+
+// releaseOnExpiry returns true if an expired connection in the given state
+// must be released. The connections whose Syn was never answered may never
+// have entered conntrack, and no connection is released by conntrack while
+// the destroyed flows are not watched.
+func (d *Datapath) releaseOnExpiry(state connection.TCPFlowState, synState connection.TCPFlowState) bool {
+	return state == synState || atomic.LoadInt32(&d.closedFlowsWatched) == 0
+}
+
+// netOrigConnectionExpired releases the expired network connections that
+// conntrack does not release.
+func (d *Datapath) netOrigConnectionExpired(c cache.DataStore, id interface{}, item interface{}) {
+
+	if conn, ok := item.(*connection.TCPConnection); ok && d.releaseOnExpiry(conn.GetState(), connection.TCPSynReceived) {
+		d.releaseConnection(true, id.(string))
+	}
+}
+
+// appOrigConnectionExpired releases the expired application connections that
+// conntrack does not release.
+func (d *Datapath) appOrigConnectionExpired(c cache.DataStore, id interface{}, item interface{}) {
+
+	if conn, ok := item.(*connection.TCPConnection); ok && d.releaseOnExpiry(conn.GetState(), connection.TCPSynSend) {
+		d.releaseConnection(false, id.(string))
+	}
+}
@@ -19,12 +19,14 @@ import (
 	"go.aporeto.io/trireme-lib/controller/internal/enforcer/nfqdatapath/nflog"
 	"go.aporeto.io/trireme-lib/controller/internal/enforcer/nfqdatapath/tokenaccessor"
 	"go.aporeto.io/trireme-lib/controller/pkg/connection"
+	"go.aporeto.io/trireme-lib/controller/pkg/connlimiter"
 	"go.aporeto.io/trireme-lib/controller/pkg/flowtracking"
 	"go.aporeto.io/trireme-lib/controller/pkg/fqconfig"
 	"go.aporeto.io/trireme-lib/controller/pkg/packet"
 	"go.aporeto.io/trireme-lib/controller/pkg/packetprocessor"
 	"go.aporeto.io/trireme-lib/controller/pkg/packettracing"
 	"go.aporeto.io/trireme-lib/controller/pkg/pucontext"
+	"go.aporeto.io/trireme-lib/controller/pkg/ratelimiter"
 	"go.aporeto.io/trireme-lib/controller/pkg/secrets"
 	"go.aporeto.io/trireme-lib/controller/runtime"
 	"go.aporeto.io/trireme-lib/policy"
@@ -39,6 +41,9 @@ const DefaultExternalIPTimeout = "500ms"
 
 var collectCounterInterval = 30 * time.Second
 
+// rateLimiterIdleTimeout is the time after which the unused rate limit budgets are released.
+var rateLimiterIdleTimeout = 5 * time.Minute
+
 // GetUDPRawSocket is placeholder for createSocket function. It is useful to mock tcp unit tests.
 var GetUDPRawSocket = afinetrawsocket.CreateSocket
 
@@ -106,6 +111,15 @@ type Datapath struct {
 	// Packettracing Cache :: We don't mark this in pucontext since it gets recreated on every policy update and we need to persist across them
 	packetTracingCache cache.DataStore
 
+	// rateLimiter holds the budgets of the rate limited policies. Like the packet tracing cache it persists across policy updates.
+	rateLimiter *ratelimiter.Limiter
+
+	// connLimiter counts the connections of the PUs until conntrack destroys their flows
+	connLimiter *connlimiter.Limiter
+
+	// closedFlowsWatched is 1 while the destroyed flows are received from conntrack
+	closedFlowsWatched int32
+
 	// mode captures the mode of the enforcer
 	mode constants.ModeType
 
@@ -116,6 +130,9 @@ type Datapath struct {
 	conntrack flowtracking.FlowClient
 	dnsProxy  *dnsproxy.Proxy
 
+	// learnedACLsHandler applies the ACLs learned by the dns proxy to the rules of the PUs
+	learnedACLsHandler func(contextID string, rules policy.IPRuleList) error
+
 	mutualAuthorization bool
 	packetLogs          bool
 
@@ -222,9 +239,7 @@ func New(
 		puFromContextID: puFromContextID,
 
 		sourcePortConnectionCache: cache.NewCacheWithExpiration("sourcePortConnectionCache", time.Second*24),
-		appOrigConnectionTracker:  cache.NewCacheWithExpiration("appOrigConnectionTracker", time.Second*24),
 		appReplyConnectionTracker: cache.NewCacheWithExpiration("appReplyConnectionTracker", time.Second*24),
-		netOrigConnectionTracker:  cache.NewCacheWithExpiration("netOrigConnectionTracker", time.Second*24),
 		netReplyConnectionTracker: cache.NewCacheWithExpiration("netReplyConnectionTracker", time.Second*24),
 
 		udpSourcePortConnectionCache: cache.NewCacheWithExpiration("udpSourcePortConnectionCache", time.Second*60),
@@ -235,6 +250,8 @@ func New(
 		udpNatConnectionTracker:      cache.NewCacheWithExpiration("udpNatConnectionTracker", time.Second*60),
 		udpFinPacketTracker:          cache.NewCacheWithExpiration("udpFinPacketTracker", time.Second*60),
 		packetTracingCache:           cache.NewCache("PacketTracingCache"),
+		rateLimiter:                  ratelimiter.New(rateLimiterIdleTimeout),
+		connLimiter:                  connlimiter.New(),
 		targetNetworks:               acls.NewACLCache(),
 		ExternalIPCacheTimeout:       ExternalIPCacheTimeout,
 		filterQueue:                  filterQueue,
@@ -252,6 +269,12 @@ func New(
 		puCountersChannel:            make(chan *pucontext.PUContext, 220),
 	}
 
+	// The connections whose Syn was never answered, or all of them while the
+	// destroyed flows are not watched, are released from the connection
+	// limits when they leave the origin trackers.
+	d.appOrigConnectionTracker = cache.NewCacheWithExpirationNotifier("appOrigConnectionTracker", time.Second*24, d.appOrigConnectionExpired)
+	d.netOrigConnectionTracker = cache.NewCacheWithExpirationNotifier("netOrigConnectionTracker", time.Second*24, d.netOrigConnectionExpired)
+
 	if err = d.SetTargetNetworks(cfg); err != nil {
 		zap.L().Error("Error adding target networks to the ACLs", zap.Error(err))
 	}
@@ -319,7 +342,7 @@ func NewWithDefaults(
 	}
 	e.conntrack = conntrackClient
 
-	e.dnsProxy = dnsproxy.New(puFromContextID, conntrackClient, collector)
+	e.dnsProxy = dnsproxy.New(context.Background(), puFromContextID, conntrackClient, collector, defaultFQConfig.DNSUpstream)
 
 	return e
 }
@@ -335,9 +358,10 @@ func (d *Datapath) collectCounters() {
 		counters := val.(*pucontext.PUContext).GetErrorCounters()
 		d.collector.CollectCounterEvent(
 			&collector.CounterReport{
-				ContextID: keys.(string),
-				Counters:  counters,
-				Namespace: val.(*pucontext.PUContext).ManagementNamespace(),
+				ContextID:    keys.(string),
+				Counters:     counters,
+				RuleCounters: val.(*pucontext.PUContext).GetRuleCounters(),
+				Namespace:    val.(*pucontext.PUContext).ManagementNamespace(),
 			})
 	}
 	counters := pucontext.GetErrorCounters()
@@ -356,9 +380,10 @@ func (d *Datapath) counterCollector(ctx context.Context) {
 		case pu := <-d.puCountersChannel:
 			counters := pu.GetErrorCounters()
 			d.collector.CollectCounterEvent(&collector.CounterReport{
-				ContextID: pu.ManagementID(),
-				Counters:  counters,
-				Namespace: pu.ManagementNamespace(),
+				ContextID:    pu.ManagementID(),
+				Counters:     counters,
+				RuleCounters: pu.GetRuleCounters(),
+				Namespace:    pu.ManagementNamespace(),
 			})
 
 		case <-ctx.Done():
@@ -375,7 +400,21 @@ func (d *Datapath) counterCollector(ctx context.Context) {
 // Enforce implements the Enforce interface method and configures the data path for a new PU
 func (d *Datapath) Enforce(contextID string, puInfo *policy.PUInfo) error {
 
-	// Always create a new PU context
+	// If only the rules of an enforced PU change, apply the changes to its
+	// context instead of rebuilding all its rule databases.
+	if data, err := d.puFromContextID.Get(contextID); err == nil {
+		updated, err := data.(*pucontext.PUContext).UpdatePolicy(puInfo)
+		if err != nil {
+			zap.L().Warn("Unable to update the rules of the pu, creating a new context",
+				zap.String("contextID", contextID),
+				zap.Error(err),
+			)
+		} else if updated {
+			return nil
+		}
+	}
+
+	// Create a new PU context
 	pu, err := pucontext.NewPU(contextID, puInfo, d.ExternalIPCacheTimeout)
 	if err != nil {
 		return fmt.Errorf("error creating new pu: %s", err)
@@ -387,9 +426,10 @@ func (d *Datapath) Enforce(contextID string, puInfo *policy.PUInfo) error {
 		zap.L().Debug("Failed to enqueue pu to counters channel")
 		counters := pu.GetErrorCounters()
 		d.collector.CollectCounterEvent(&collector.CounterReport{
-			ContextID: pu.ID(),
-			Counters:  counters,
-			Namespace: pu.ManagementNamespace(),
+			ContextID:    pu.ID(),
+			Counters:     counters,
+			RuleCounters: pu.GetRuleCounters(),
+			Namespace:    pu.ManagementNamespace(),
 		})
 
 	}
@@ -476,9 +516,10 @@ func (d *Datapath) Unenforce(contextID string) error {
 		zap.L().Debug("Failed to enqueue pu to counters channel")
 		counters := pu.GetErrorCounters()
 		d.collector.CollectCounterEvent(&collector.CounterReport{
-			ContextID: pu.ID(),
-			Counters:  counters,
-			Namespace: pu.ManagementNamespace(),
+			ContextID:    pu.ID(),
+			Counters:     counters,
+			RuleCounters: pu.GetRuleCounters(),
+			Namespace:    pu.ManagementNamespace(),
 		})
 
 	}
@@ -554,6 +595,17 @@ func (d *Datapath) SetTargetNetworks(cfg *runtime.Configuration) error {
 	return d.targetNetworks.AddRuleList(targetacl)
 }
 
+// SetLearnedACLsHandler sets the handler of the application ACLs that the dns
+// proxy learns for the PUs.
+func (d *Datapath) SetLearnedACLsHandler(handler func(contextID string, rules policy.IPRuleList) error) {
+
+	d.learnedACLsHandler = handler
+
+	if d.dnsProxy != nil {
+		d.dnsProxy.SetLearnedACLsHandler(handler)
+	}
+}
+
 // GetFilterQueue returns the filter queues used by the data path
 func (d *Datapath) GetFilterQueue() *fqconfig.FilterQueue {
 
@@ -573,8 +625,11 @@ func (d *Datapath) Run(ctx context.Context) error {
 		d.conntrack = conntrackClient
 	}
 
+	go d.watchClosedFlows(ctx)
+
 	if d.dnsProxy == nil {
-		d.dnsProxy = dnsproxy.New(d.puFromContextID, d.conntrack, d.collector)
+		d.dnsProxy = dnsproxy.New(ctx, d.puFromContextID, d.conntrack, d.collector, d.filterQueue.DNSUpstream)
+		d.dnsProxy.SetLearnedACLsHandler(d.learnedACLsHandler)
 	}
 
 	d.startApplicationInterceptor(ctx)
@@ -650,6 +705,8 @@ func (d *Datapath) reportFlow(p *packet.Packet, src, dst *collector.EndPoint, co
 		c.ObservedPolicyID = report.PolicyID
 	}
 
+	countRuleHits(context, report, actual)
+
 	d.collector.CollectFlowEvent(c)
 }
 
@@ -0,0 +1,162 @@
+package nfqdatapath
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"go.aporeto.io/trireme-lib/controller/pkg/connection"
+	"go.aporeto.io/trireme-lib/controller/pkg/flowcrypto"
+	"go.aporeto.io/trireme-lib/controller/pkg/packet"
+	"go.aporeto.io/trireme-lib/controller/pkg/pucontext"
+)
+
+const (
+	// encryptedFlowTimeout is the idle timeout of the state of encrypted
+	// flows. Their packets are never released to the kernel, so their state
+	// must survive longer idle periods than the handshake.
+	encryptedFlowTimeout = time.Hour
+
+	// maxTCPHeaderLen is the maximum length of a TCP header with options.
+	maxTCPHeaderLen = 60
+
+	// minTCPHeaderLen is the length of a TCP header without options.
+	minTCPHeaderLen = 20
+)
+
+// newFlowCipher derives the keys of an encrypted flow from the ephemeral keys
+// and the nonces exchanged during the handshake.
+func newFlowCipher(context *pucontext.PUContext, auth *connection.AuthInfo, client bool) (*flowcrypto.Cipher, error) {
+
+	key, _ := context.EncryptionKey()
+	if key == nil {
+		return nil, errors.New("no local encryption key")
+	}
+
+	if len(auth.RemoteServiceContext) == 0 {
+		return nil, errors.New("no remote encryption key")
+	}
+
+	if client {
+		return flowcrypto.NewCipher(key, auth.RemoteServiceContext, auth.LocalContext, auth.RemoteContext, true)
+	}
+
+	return flowcrypto.NewCipher(key, auth.RemoteServiceContext, auth.RemoteContext, auth.LocalContext, false)
+}
+
+// enableTCPEncryption derives the keys of an encrypted TCP connection. The
+// MSS of the Syn or SynAck packet is decreased so that the segments of the
+// PU leave room for the encryption option.
+func enableTCPEncryption(context *pucontext.PUContext, conn *connection.TCPConnection, tcpPacket *packet.Packet, client bool) error {
+
+	cipher, err := newFlowCipher(context, &conn.Auth, client)
+	if err != nil {
+		return err
+	}
+
+	conn.FlowCipher = cipher
+	conn.TimeOut = encryptedFlowTimeout
+
+	tcpPacket.DecreaseTCPMSS(flowcrypto.TCPOptionLength)
+
+	return nil
+}
+
+// enableUDPEncryption derives the keys of an encrypted UDP connection.
+func enableUDPEncryption(context *pucontext.PUContext, conn *connection.UDPConnection, client bool) error {
+
+	cipher, err := newFlowCipher(context, &conn.Auth, client)
+	if err != nil {
+		return err
+	}
+
+	conn.FlowCipher = cipher
+
+	return nil
+}
+
+// encryptTCPPacket encrypts the payload of an application packet and appends
+// the encryption option to the TCP header.
+func encryptTCPPacket(tcpPacket *packet.Packet, conn *connection.TCPConnection) error {
+
+	if conn.FlowCipher == nil || tcpPacket.IsEmptyTCPPayload() {
+		return nil
+	}
+
+	if int(tcpPacket.TCPDataStartBytes())+flowcrypto.TCPOptionLength > maxTCPHeaderLen {
+		return conn.Context.PuContextError(pucontext.ErrEncryptionFailed, fmt.Sprintf("no room for the encryption option %s", tcpPacket.L4FlowHash()))
+	}
+
+	if err := tcpPacket.TCPDataDetach(0); err != nil {
+		return conn.Context.PuContextError(pucontext.ErrEncryptionFailed, fmt.Sprintf("unable to detach data: %s", err))
+	}
+
+	data := tcpPacket.GetTCPData()
+	option := conn.FlowCipher.EncryptTCP(tcpPacket.TCPSequenceNumber(), data)
+
+	if err := tcpPacket.TCPDataAttach(option, data); err != nil {
+		return conn.Context.PuContextError(pucontext.ErrEncryptionFailed, fmt.Sprintf("unable to attach encryption option: %s", err))
+	}
+
+	return nil
+}
+
+// decryptTCPPacket authenticates and decrypts the payload of a network packet
+// and removes the encryption option from the TCP header. Packets with payload
+// that are not authenticated are dropped.
+func decryptTCPPacket(tcpPacket *packet.Packet, conn *connection.TCPConnection) error {
+
+	if conn.FlowCipher == nil || tcpPacket.IsEmptyTCPPayload() {
+		return nil
+	}
+
+	dataStart := int(tcpPacket.TCPDataStartBytes())
+	if dataStart < minTCPHeaderLen+flowcrypto.TCPOptionLength {
+		return conn.Context.PuContextError(pucontext.ErrDecryptionFailed, fmt.Sprintf("no encryption option %s", tcpPacket.L4FlowHash()))
+	}
+
+	if err := tcpPacket.TCPDataDetach(flowcrypto.TCPOptionLength); err != nil {
+		return conn.Context.PuContextError(pucontext.ErrDecryptionFailed, fmt.Sprintf("unable to detach data: %s", err))
+	}
+
+	data := tcpPacket.GetTCPData()
+	if err := conn.FlowCipher.DecryptTCP(tcpPacket.TCPSequenceNumber(), data, tcpPacket.GetTCPOptions()); err != nil {
+		return conn.Context.PuContextError(pucontext.ErrDecryptionFailed, fmt.Sprintf("%s %s", err, tcpPacket.L4FlowHash()))
+	}
+
+	// Drop the encryption option and put back the plain payload.
+	tcpPacket.DropTCPDetachedBytes()
+
+	return tcpPacket.TCPDataAttach(nil, data)
+}
+
+// encryptUDPPacket encrypts the payload of an application packet.
+func encryptUDPPacket(udpPacket *packet.Packet, conn *connection.UDPConnection) {
+
+	if conn.FlowCipher == nil {
+		return
+	}
+
+	data := conn.FlowCipher.EncryptUDP(udpPacket.GetUDPData())
+
+	udpPacket.UDPDataDetach()
+	udpPacket.UDPDataAttach(nil, data)
+}
+
+// decryptUDPPacket authenticates and decrypts the payload of a network packet.
+func decryptUDPPacket(udpPacket *packet.Packet, conn *connection.UDPConnection) error {
+
+	if conn.FlowCipher == nil {
+		return nil
+	}
+
+	data, err := conn.FlowCipher.DecryptUDP(udpPacket.GetUDPData())
+	if err != nil {
+		return conn.Context.PuContextError(pucontext.ErrDecryptionFailed, fmt.Sprintf("%s %s", err, udpPacket.L4FlowHash()))
+	}
+
+	udpPacket.UDPDataDetach()
+	udpPacket.UDPDataAttach(nil, data)
+
+	return nil
+}
@@ -89,6 +89,11 @@ func (d *Datapath) processNetworkTCPPackets(p *packet.Packet) (conn *connection.
 	conn.Lock()
 	defer conn.Unlock()
 
+	// Packets of connections already decided are limited by their rule.
+	if d.rateLimited(conn.Context, conn.PacketFlowPolicy, conn.Auth.RemoteContextID, p.SourceAddress(), false) {
+		return conn, conn.Context.PuContextError(pucontext.ErrRateLimited, fmt.Sprintf("rate limited network packet %s", p.L4FlowHash()))
+	}
+
 	p.Print(packet.PacketStageIncoming, d.PacketLogsEnabled())
 
 	if d.service != nil {
@@ -225,6 +230,11 @@ func (d *Datapath) processApplicationTCPPackets(p *packet.Packet) (conn *connect
 	conn.Lock()
 	defer conn.Unlock()
 
+	// Packets of connections already decided are limited by their rule.
+	if d.rateLimited(conn.Context, conn.PacketFlowPolicy, conn.Auth.RemoteContextID, p.DestinationAddress(), false) {
+		return conn, conn.Context.PuContextError(pucontext.ErrRateLimited, fmt.Sprintf("rate limited application packet %s", p.L4FlowHash()))
+	}
+
 	p.Print(packet.PacketStageIncoming, d.PacketLogsEnabled())
 
 	if d.service != nil {
@@ -267,6 +277,7 @@ func (d *Datapath) processApplicationTCPPackets(p *packet.Packet) (conn *connect
 	// Accept the packet
 	p.UpdateTCPChecksum()
 	p.Print(packet.PacketStageOutgoing, d.PacketLogsEnabled())
+
 	return conn, nil
 }
 
@@ -306,6 +317,10 @@ func (d *Datapath) processApplicationSynPacket(tcpPacket *packet.Packet, context
 		report, policy, perr := context.ApplicationACLPolicyFromAddr(dstAddr, dstPort)
 
 		if perr == nil && policy.Action.Accepted() {
+			if d.rateLimited(context, policy, "", dstAddr, true) {
+				d.reportExternalServiceFlow(context, report, rateLimitedPolicy(policy), true, tcpPacket)
+				return nil, conn.Context.PuContextError(pucontext.ErrRateLimited, fmt.Sprintf("Rate limited external service application syn packet %s:%d", dstAddr.String(), int(dstPort)))
+			}
 			return nil, nil
 		}
 
@@ -315,6 +330,11 @@ func (d *Datapath) processApplicationSynPacket(tcpPacket *packet.Packet, context
 	}
 
 	if policy, err := context.RetrieveCachedExternalFlowPolicy(tcpPacket.DestinationAddress().String() + ":" + strconv.Itoa(int(tcpPacket.DestPort()))); err == nil {
+		if !d.admitConnection(context, false, tcpPacket.L4FlowHash(), "", tcpPacket.DestinationAddress()) {
+			plc := policy.(*policyPair)
+			d.reportDroppedExternalServiceFlow(context, plc.report, plc.packet, true, tcpPacket, collector.ConnectionLimitDrop)
+			return nil, conn.Context.PuContextError(pucontext.ErrConnectionLimit, fmt.Sprintf("Connection limit reached for external service application syn packet %s:%d", tcpPacket.DestinationAddress().String(), int(tcpPacket.DestPort())))
+		}
 		d.appOrigConnectionTracker.AddOrUpdate(tcpPacket.L4FlowHash(), conn)
 		d.sourcePortConnectionCache.AddOrUpdate(tcpPacket.SourcePortHash(packet.PacketTypeApplication), conn)
 		return policy, nil
@@ -324,6 +344,9 @@ func (d *Datapath) processApplicationSynPacket(tcpPacket *packet.Packet, context
 	// Create TCP Option
 	tcpOptions := d.createTCPAuthenticationOption([]byte{})
 
+	// Send the ephemeral key of the PU in case the flow must be encrypted
+	_, conn.Auth.LocalServiceContext = context.EncryptionKey()
+
 	// Create a token
 	tcpData, err := d.tokenAccessor.CreateSynPacketToken(context, &conn.Auth)
 
@@ -331,6 +354,11 @@ func (d *Datapath) processApplicationSynPacket(tcpPacket *packet.Packet, context
 		return nil, err
 	}
 
+	if !d.admitConnection(context, false, tcpPacket.L4FlowHash(), "", tcpPacket.DestinationAddress()) {
+		d.reportRejectedFlow(tcpPacket, conn, context.ManagementID(), collector.DefaultEndPoint, context, collector.ConnectionLimitDrop, nil, nil, false)
+		return nil, conn.Context.PuContextError(pucontext.ErrConnectionLimit, fmt.Sprintf("contextID %s DestinationAddress %s DestPort %d", context.ManagementID(), tcpPacket.DestinationAddress().String(), int(tcpPacket.DestPort())))
+	}
+
 	// Set the state indicating that we send out a Syn packet
 	conn.SetState(connection.TCPSynSend)
 
@@ -353,7 +381,7 @@ func (d *Datapath) processApplicationSynAckPacket(tcpPacket *packet.Packet, cont
 	// At this point we can release the flow to the kernel by updating conntrack
 	// We can also clean up the state since we are not going to see any more
 	// packets from this connection.
-	if conn.GetState() == connection.TCPData && !conn.ServiceConnection {
+	if conn.GetState() == connection.TCPData && !conn.ServiceConnection && conn.FlowCipher == nil {
 		err1 := d.netOrigConnectionTracker.Remove(tcpPacket.L4ReverseFlowHash())
 		err2 := d.appReplyConnectionTracker.Remove(tcpPacket.L4FlowHash())
 
@@ -439,7 +467,7 @@ func (d *Datapath) processApplicationAckPacket(tcpPacket *packet.Packet, context
 
 	// If we are already in the connection.TCPData connection just forward the packet
 	if conn.GetState() == connection.TCPData {
-		return nil
+		return encryptTCPPacket(tcpPacket, conn)
 	}
 
 	if conn.GetState() == connection.UnknownState {
@@ -500,6 +528,14 @@ func (d *Datapath) processApplicationAckPacket(tcpPacket *packet.Packet, context
 	// state. We will not release the caches though to deal with re-transmissions.
 	// We will let the caches expire.
 	if conn.GetState() == connection.TCPAckSend {
+		// Encrypted flows are never released to the kernel, since every
+		// packet must go through the datapath.
+		if conn.FlowCipher != nil {
+			conn.SetState(connection.TCPData)
+			context.PuContextError(pucontext.ErrEncrConnectionsProcessed, "") // nolint
+			return encryptTCPPacket(tcpPacket, conn)
+		}
+
 		if !conn.ServiceConnection && tcpPacket.SourceAddress().String() != tcpPacket.DestinationAddress().String() &&
 			!(tcpPacket.SourceAddress().IsLoopback() && tcpPacket.DestinationAddress().IsLoopback()) {
 			go func() {
@@ -559,6 +595,16 @@ func (d *Datapath) processNetworkSynPacket(context *pucontext.PUContext, conn *c
 
 		// If there is no auth option, attempt the ACLs
 		report, pkt, perr := context.NetworkACLPolicy(tcpPacket)
+		if perr == nil && d.rateLimited(context, pkt, "", tcpPacket.SourceAddress(), true) {
+			d.reportExternalServiceFlow(context, report, rateLimitedPolicy(pkt), false, tcpPacket)
+			return nil, nil, conn.Context.PuContextError(pucontext.ErrRateLimited, fmt.Sprintf("contextID %s SourceAddress %s DestPort %d PolicyID %s", context.ManagementID(), tcpPacket.SourceAddress().String(), int(tcpPacket.DestPort()), pkt.PolicyID))
+		}
+
+		if perr == nil && pkt.Action.Accepted() && !d.admitConnection(context, true, tcpPacket.L4FlowHash(), "", tcpPacket.SourceAddress()) {
+			d.reportDroppedExternalServiceFlow(context, report, pkt, false, tcpPacket, collector.ConnectionLimitDrop)
+			return nil, nil, conn.Context.PuContextError(pucontext.ErrConnectionLimit, fmt.Sprintf("contextID %s SourceAddress %s DestPort %d PolicyID %s", context.ManagementID(), tcpPacket.SourceAddress().String(), int(tcpPacket.DestPort()), pkt.PolicyID))
+		}
+
 		d.reportExternalServiceFlow(context, report, pkt, false, tcpPacket)
 		if perr != nil || pkt.Action.Rejected() {
 			return nil, nil, fmt.Errorf("no auth or acls: outgoing connection dropped: %s", perr)
@@ -614,7 +660,17 @@ func (d *Datapath) processNetworkSynPacket(context *pucontext.PUContext, conn *c
 		return nil, nil, conn.Context.PuContextError(pucontext.ErrSynRejectPacket, fmt.Sprintf("contextID %s SourceAddress %s DestPort %d PolicyID %s", context.ManagementID(), tcpPacket.SourceAddress().String(), int(tcpPacket.DestPort()), pkt.PolicyID))
 	}
 
+	if txLabel != context.ManagementID() && d.rateLimited(context, pkt, txLabel, tcpPacket.SourceAddress(), true) {
+		d.reportRejectedFlow(tcpPacket, conn, txLabel, context.ManagementID(), context, collector.RateLimitDrop, report, rateLimitedPolicy(pkt), false)
+		return nil, nil, conn.Context.PuContextError(pucontext.ErrRateLimited, fmt.Sprintf("contextID %s SourceAddress %s DestPort %d PolicyID %s", context.ManagementID(), tcpPacket.SourceAddress().String(), int(tcpPacket.DestPort()), pkt.PolicyID))
+	}
+
 	hash := tcpPacket.L4FlowHash()
+	if txLabel != context.ManagementID() && !d.admitConnection(context, true, hash, txLabel, tcpPacket.SourceAddress()) {
+		d.reportRejectedFlow(tcpPacket, conn, txLabel, context.ManagementID(), context, collector.ConnectionLimitDrop, report, pkt, false)
+		return nil, nil, conn.Context.PuContextError(pucontext.ErrConnectionLimit, fmt.Sprintf("contextID %s SourceAddress %s DestPort %d PolicyID %s", context.ManagementID(), tcpPacket.SourceAddress().String(), int(tcpPacket.DestPort()), pkt.PolicyID))
+	}
+
 	// Update the connection state and store the Nonse send to us by the host.
 	// We use the nonse in the subsequent packets to achieve randomization.
 	conn.SetState(connection.TCPSynReceived)
@@ -630,6 +686,13 @@ func (d *Datapath) processNetworkSynPacket(context *pucontext.PUContext, conn *c
 	if txLabel == context.ManagementID() {
 		zap.L().Debug("Traffic to the same pu", zap.String("flow", tcpPacket.L4FlowHash()))
 		conn.SetLoopbackConnection(true)
+	} else if pkt.Action.Encrypted() {
+		if err := enableTCPEncryption(context, conn, tcpPacket, false); err != nil {
+			d.reportRejectedFlow(tcpPacket, conn, txLabel, context.ManagementID(), context, collector.EncryptionMismatch, report, pkt, false)
+			return nil, nil, conn.Context.PuContextError(pucontext.ErrEncryptionFailed, fmt.Sprintf("contextID %s SourceAddress %s DestPort %d: %s", context.ManagementID(), tcpPacket.SourceAddress().String(), int(tcpPacket.DestPort()), err))
+		}
+		// Send our ephemeral key back in the SynAck
+		_, conn.Auth.LocalServiceContext = context.EncryptionKey()
 	}
 
 	// Accept the connection
@@ -656,6 +719,10 @@ func (d *Datapath) processNetworkSynAckPacket(context *pucontext.PUContext, conn
 		flowHash := tcpPacket.SourceAddress().String() + ":" + strconv.Itoa(int(tcpPacket.SourcePort()))
 		if plci, plerr := context.RetrieveCachedExternalFlowPolicy(flowHash); plerr == nil {
 			plc := plci.(*policyPair)
+			if d.rateLimited(context, plc.packet, "", tcpPacket.SourceAddress(), true) {
+				d.reportReverseExternalServiceFlow(context, plc.report, rateLimitedPolicy(plc.packet), true, tcpPacket)
+				return nil, nil, conn.Context.PuContextError(pucontext.ErrRateLimited, fmt.Sprintf("rate limited external service synack Source %s:%d", tcpPacket.SourceAddress().String(), int(tcpPacket.SourcePort())))
+			}
 			d.releaseFlow(context, plc.report, plc.packet, tcpPacket)
 			return plc.packet, nil, nil
 		}
@@ -667,6 +734,11 @@ func (d *Datapath) processNetworkSynAckPacket(context *pucontext.PUContext, conn
 			return nil, nil, conn.Context.PuContextError(pucontext.ErrSynAckDroppedExternalService, fmt.Sprintf("drop external service synack Source %s:%d:%s", tcpPacket.SourceAddress().String(), int(tcpPacket.SourcePort()), pkt.Action.ActionString()))
 		}
 
+		if d.rateLimited(context, pkt, "", tcpPacket.SourceAddress(), true) {
+			d.reportReverseExternalServiceFlow(context, report, rateLimitedPolicy(pkt), true, tcpPacket)
+			return nil, nil, conn.Context.PuContextError(pucontext.ErrRateLimited, fmt.Sprintf("rate limited external service synack Source %s:%d", tcpPacket.SourceAddress().String(), int(tcpPacket.SourcePort())))
+		}
+
 		// Added to the cache if we can accept it
 		context.CacheExternalFlowPolicy(
 			tcpPacket,
@@ -743,7 +815,15 @@ func (d *Datapath) processNetworkSynAckPacket(context *pucontext.PUContext, conn
 	tcpPacket.DropTCPDetachedBytes()
 
 	if !d.mutualAuthorization {
-		// If we dont do mutual authorization, dont lookup txt rules.
+		// If we dont do mutual authorization, dont lookup txt rules. The
+		// receiver decides if the flow is encrypted.
+		if claims.H != nil && claims.H.ToClaimsHeader().Encrypt() && conn.Auth.RemoteContextID != context.ManagementID() {
+			if err := enableTCPEncryption(context, conn, tcpPacket, true); err != nil {
+				d.reportRejectedFlow(tcpPacket, conn, conn.Auth.RemoteContextID, context.ManagementID(), context, collector.EncryptionMismatch, nil, nil, true)
+				return nil, nil, conn.Context.PuContextError(pucontext.ErrEncryptionFailed, fmt.Sprintf("contextID %s SourceAddress %s: %s", context.ManagementID(), tcpPacket.SourceAddress().String(), err))
+			}
+		}
+
 		conn.SetState(connection.TCPSynAckReceived)
 
 		// conntrack
@@ -776,7 +856,21 @@ func (d *Datapath) processNetworkSynAckPacket(context *pucontext.PUContext, conn
 		return nil, nil, conn.Context.PuContextError(pucontext.ErrSynAckRejected, fmt.Sprintf("contextID %s Claims %s", context.ManagementID(), claims.T.String()))
 	}
 
+	if d.rateLimited(context, pkt, conn.Auth.RemoteContextID, tcpPacket.SourceAddress(), true) {
+		d.reportRejectedFlow(tcpPacket, conn, conn.Auth.RemoteContextID, context.ManagementID(), context, collector.RateLimitDrop, report, rateLimitedPolicy(pkt), true)
+		return nil, nil, conn.Context.PuContextError(pucontext.ErrRateLimited, fmt.Sprintf("contextID %s Claims %s PolicyID %s", context.ManagementID(), claims.T.String(), pkt.PolicyID))
+	}
+
+	if pkt.Action.Encrypted() {
+		if err := enableTCPEncryption(context, conn, tcpPacket, true); err != nil {
+			d.reportRejectedFlow(tcpPacket, conn, conn.Auth.RemoteContextID, context.ManagementID(), context, collector.EncryptionMismatch, report, pkt, true)
+			return nil, nil, conn.Context.PuContextError(pucontext.ErrEncryptionFailed, fmt.Sprintf("contextID %s SourceAddress %s: %s", context.ManagementID(), tcpPacket.SourceAddress().String(), err))
+		}
+	}
+
 	conn.SetState(connection.TCPSynAckReceived)
+	conn.ReportFlowPolicy = report
+	conn.PacketFlowPolicy = pkt
 
 	// conntrack
 	d.netReplyConnectionTracker.AddOrUpdate(tcpPacket.L4FlowHash(), conn)
@@ -788,7 +882,7 @@ func (d *Datapath) processNetworkSynAckPacket(context *pucontext.PUContext, conn
 func (d *Datapath) processNetworkAckPacket(context *pucontext.PUContext, conn *connection.TCPConnection, tcpPacket *packet.Packet) (action interface{}, claims *tokens.ConnectionClaims, err error) {
 
 	if conn.GetState() == connection.TCPData || conn.GetState() == connection.TCPAckSend {
-		return nil, nil, nil
+		return nil, nil, decryptTCPPacket(tcpPacket, conn)
 	}
 
 	if conn.IsLoopbackConnection() {
@@ -872,7 +966,8 @@ func (d *Datapath) processNetworkAckPacket(context *pucontext.PUContext, conn *c
 
 		conn.SetState(connection.TCPData)
 
-		if !conn.ServiceConnection {
+		// Encrypted flows are never released to the kernel.
+		if !conn.ServiceConnection && conn.FlowCipher == nil {
 			go func() {
 				if err := d.conntrack.UpdateNetworkFlowMark(
 					tcpPacket.SourceAddress(),
@@ -1098,7 +1193,7 @@ func updateTimer(c cache.DataStore, hash string, conn *connection.TCPConnection)
 	conn.RLock()
 	defer conn.RUnlock()
 
-	if conn.ServiceConnection && conn.TimeOut > 0 {
+	if (conn.ServiceConnection || conn.FlowCipher != nil) && conn.TimeOut > 0 {
 		return c.SetTimeOut(hash, conn.TimeOut)
 	}
 	return nil
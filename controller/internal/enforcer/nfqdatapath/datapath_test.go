@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"reflect"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -4891,6 +4892,186 @@ func TestCheckConnectionDeletion(t *testing.T) {
 	})
 }
 
+func TestConnectionLimits(t *testing.T) {
+	Convey("Given i setup a valid enforcer and a processing unit limited to one outbound connection", t, func() {
+		puInfo1, _, enforcer, err1, err2, _, _ := setupProcessingUnitsInDatapathAndEnforce(nil, "container", false)
+		So(err1, ShouldBeNil)
+		So(err2, ShouldBeNil)
+
+		puInfo1.Policy.SetConnectionLimits(&policy.ConnectionLimits{MaxOutbound: 1})
+		So(enforcer.Enforce(puInfo1.ContextID, puInfo1), ShouldBeNil)
+
+		data, err := enforcer.puFromContextID.Get(puInfo1.ContextID)
+		So(err, ShouldBeNil)
+		context := data.(*pucontext.PUContext)
+
+		PacketFlow := packetgen.NewTemplateFlow()
+		_, err = PacketFlow.GenerateTCPFlow(packetgen.PacketFlowTypeGoodFlowTemplate)
+		So(err, ShouldBeNil)
+		synPacket, err := PacketFlow.GetFirstSynPacket().ToBytes()
+		So(err, ShouldBeNil)
+		tcpPacket, err := packet.New(0, synPacket, "0", true)
+		So(err, ShouldBeNil)
+		tcpPacket.UpdateIPv4Checksum()
+		tcpPacket.UpdateTCPChecksum()
+
+		group := puInfo1.ContextID + "/out"
+		peer := tcpPacket.DestinationAddress().String()
+		hash := tcpPacket.L4FlowHash()
+
+		Convey("When the processing unit sends a Syn, the connection should be admitted", func() {
+			_, err := enforcer.processApplicationTCPPackets(tcpPacket)
+			So(err, ShouldBeNil)
+
+			total, _ := enforcer.connLimiter.Count(group, peer)
+			So(total, ShouldEqual, 1)
+
+			Convey("Then the other connections should be rejected", func() {
+				So(enforcer.admitConnection(context, false, "other", "", tcpPacket.DestinationAddress()), ShouldBeFalse)
+			})
+
+			Convey("When the Syn expires unanswered, the connection should be released", func() {
+				conn, err := enforcer.appOrigConnectionTracker.Get(hash)
+				So(err, ShouldBeNil)
+				enforcer.appOrigConnectionExpired(enforcer.appOrigConnectionTracker, hash, conn)
+
+				total, _ := enforcer.connLimiter.Count(group, peer)
+				So(total, ShouldEqual, 0)
+			})
+
+			Convey("When an established connection expires while the closed flows are not watched, the connection should be released", func() {
+				conn, err := enforcer.appOrigConnectionTracker.Get(hash)
+				So(err, ShouldBeNil)
+				conn.(*connection.TCPConnection).SetState(connection.TCPData)
+				enforcer.appOrigConnectionExpired(enforcer.appOrigConnectionTracker, hash, conn)
+
+				total, _ := enforcer.connLimiter.Count(group, peer)
+				So(total, ShouldEqual, 0)
+			})
+
+			Convey("When an established connection expires while the closed flows are watched, it should still be counted", func() {
+				atomic.StoreInt32(&enforcer.closedFlowsWatched, 1)
+
+				conn, err := enforcer.appOrigConnectionTracker.Get(hash)
+				So(err, ShouldBeNil)
+				conn.(*connection.TCPConnection).SetState(connection.TCPData)
+				enforcer.appOrigConnectionExpired(enforcer.appOrigConnectionTracker, hash, conn)
+
+				total, _ := enforcer.connLimiter.Count(group, peer)
+				So(total, ShouldEqual, 1)
+
+				Convey("When conntrack destroys its flow, the connection should be released", func() {
+					enforcer.connectionClosed(tcpPacket.SourceAddress(), tcpPacket.DestinationAddress(), packet.IPProtocolTCP, tcpPacket.SourcePort(), tcpPacket.DestPort())
+
+					total, _ := enforcer.connLimiter.Count(group, peer)
+					So(total, ShouldEqual, 0)
+				})
+			})
+		})
+
+		Convey("When the limit is reached, the Syn of the processing unit should be rejected", func() {
+			So(enforcer.admitConnection(context, false, "other", "", tcpPacket.DestinationAddress()), ShouldBeTrue)
+
+			_, err := enforcer.processApplicationTCPPackets(tcpPacket)
+			So(err, ShouldNotBeNil)
+
+			total, _ := enforcer.connLimiter.Count(group, peer)
+			So(total, ShouldEqual, 1)
+		})
+	})
+}
+
+// setupEncryptionDatapath creates an enforcer with a single container
+// processing unit that accepts the flows from the processing units with the
+// transmitter label with the given action.
+func setupEncryptionDatapath(puID, puIP string, action policy.ActionType) *Datapath {
+
+	puInfo := policy.NewPUInfo(puID, "/ns", common.ContainerPU)
+	puInfo.Runtime.SetIPAddresses(policy.ExtendedMap{"bridge": puIP})
+	puInfo.Policy.SetIPAddresses(policy.ExtendedMap{policy.DefaultNamespace: puIP})
+	puInfo.Policy.AddIdentityTag(enforcerconstants.TransmitterLabel, "value")
+	puInfo.Policy.AddReceiverRules(policy.TagSelector{
+		Clause: []policy.KeyValueOperator{
+			{
+				Key:      enforcerconstants.TransmitterLabel,
+				Value:    []string{"value"},
+				Operator: policy.Equal,
+			},
+		},
+		Policy: &policy.FlowPolicy{Action: action, PolicyID: puID},
+	})
+
+	secret, err := secrets.NewCompactPKI([]byte(secrets.PrivateKeyPEM), []byte(secrets.PublicPEM), []byte(secrets.CAPEM), secrets.CreateTxtToken(), claimsheader.CompressionTypeNone)
+	So(err, ShouldBeNil)
+
+	prevRawSocket := GetUDPRawSocket
+	defer func() {
+		GetUDPRawSocket = prevRawSocket
+	}()
+	GetUDPRawSocket = func(mark int, device string) (afinetrawsocket.SocketWriter, error) {
+		return nil, nil
+	}
+
+	enforcer := NewWithDefaults(testServerID, &collector.DefaultCollector{}, nil, secret, constants.RemoteContainer, "/proc", []string{"0.0.0.0/0"})
+	So(enforcer.Enforce(puID, puInfo), ShouldBeNil)
+
+	return enforcer
+}
+
+func TestEncryptionDecidedByReceiver(t *testing.T) {
+	Convey("Given a client without encrypt rules and a server that encrypts the flows it receives", t, func() {
+		PacketFlow := packetgen.NewTemplateFlow()
+		_, err := PacketFlow.GenerateTCPFlow(packetgen.PacketFlowTypeGoodFlowTemplate)
+		So(err, ShouldBeNil)
+
+		clientIP := PacketFlow.GetNthPacket(0).GetIPPacket().SrcIP
+		serverIP := PacketFlow.GetNthPacket(0).GetIPPacket().DstIP
+
+		client := setupEncryptionDatapath("client", clientIP.String(), policy.Accept)
+		server := setupEncryptionDatapath("server", serverIP.String(), policy.Accept|policy.Encrypt)
+
+		Convey("When the handshake goes through both enforcers, the flow should be encrypted on both ends", func() {
+			var clientConn, serverConn *connection.TCPConnection
+
+			for i := 0; i < 3; i++ {
+				data, err := PacketFlow.GetNthPacket(i).ToBytes()
+				So(err, ShouldBeNil)
+				tcpPacket, err := packet.New(0, data, "0", true)
+				So(err, ShouldBeNil)
+				tcpPacket.UpdateIPv4Checksum()
+				tcpPacket.UpdateTCPChecksum()
+
+				sender, receiver := client, server
+				if tcpPacket.SourceAddress().Equal(serverIP) {
+					sender, receiver = server, client
+				}
+
+				_, err = sender.processApplicationTCPPackets(tcpPacket)
+				So(err, ShouldBeNil)
+
+				output := make([]byte, len(tcpPacket.GetTCPBytes()))
+				copy(output, tcpPacket.GetTCPBytes())
+				outPacket, err := packet.New(0, output, "0", true)
+				So(err, ShouldBeNil)
+
+				conn, err := receiver.processNetworkTCPPackets(outPacket)
+				So(err, ShouldBeNil)
+
+				if receiver == server {
+					serverConn = conn
+				} else {
+					clientConn = conn
+				}
+			}
+
+			So(serverConn, ShouldNotBeNil)
+			So(serverConn.FlowCipher, ShouldNotBeNil)
+			So(clientConn, ShouldNotBeNil)
+			So(clientConn.FlowCipher, ShouldNotBeNil)
+		})
+	})
+}
+
 type testFiles struct{}
 
 var mockfiles *testFiles
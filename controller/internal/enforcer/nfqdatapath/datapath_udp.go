@@ -122,6 +122,7 @@ func (d *Datapath) ProcessNetworkUDPPacket(p *packet.Packet) (conn *connection.U
 		conn.SetState(connection.UDPData)
 		zap.L().Debug("Draining the queue of application packets")
 		for udpPacket := conn.ReadPacket(); udpPacket != nil; udpPacket = conn.ReadPacket() {
+			encryptUDPPacket(udpPacket, conn)
 			if d.service != nil {
 				// PostProcessServiceInterface
 				// We call it for all outgoing packets.
@@ -143,6 +144,10 @@ func (d *Datapath) ProcessNetworkUDPPacket(p *packet.Packet) (conn *connection.U
 		return conn, fmt.Errorf("Drop net hanshake packets (udp)")
 	}
 
+	if d.rateLimited(conn.Context, conn.PacketFlowPolicy, conn.Auth.RemoteContextID, p.SourceAddress(), false) {
+		return conn, conn.Context.PuContextError(pucontext.ErrRateLimited, fmt.Sprintf("rate limited network packet %s", p.L4FlowHash()))
+	}
+
 	return conn, nil
 }
 
@@ -257,7 +262,7 @@ func (d *Datapath) processNetUDPPacket(udpPacket *packet.Packet, context *pucont
 		state := conn.GetState()
 		if state == connection.UDPReceiverProcessedAck || state == connection.UDPClientSendAck || state == connection.UDPData {
 			conn.SetState(connection.UDPData)
-			return nil, nil, nil
+			return nil, nil, decryptUDPPacket(udpPacket, conn)
 		}
 		return nil, nil, fmt.Errorf("invalid packet at state: %d", state)
 	}
@@ -313,6 +318,7 @@ func (d *Datapath) ProcessApplicationUDPPacket(p *packet.Packet) (conn *connecti
 
 	case connection.UDPReceiverProcessedAck, connection.UDPClientSendAck, connection.UDPData:
 		conn.SetState(connection.UDPData)
+		encryptUDPPacket(p, conn)
 
 	default:
 		zap.L().Debug("Packet is added to the queue", zap.String("flow", p.L4FlowHash()))
@@ -338,6 +344,10 @@ func (d *Datapath) ProcessApplicationUDPPacket(p *packet.Packet) (conn *connecti
 		return conn, conn.Context.PuContextError(pucontext.ErrUDPDropInNfQueue, "Drop in nfq - buffered")
 	}
 
+	if d.rateLimited(conn.Context, conn.PacketFlowPolicy, conn.Auth.RemoteContextID, p.DestinationAddress(), false) {
+		return conn, conn.Context.PuContextError(pucontext.ErrRateLimited, fmt.Sprintf("rate limited application packet %s", p.L4FlowHash()))
+	}
+
 	return conn, nil
 }
 
@@ -366,6 +376,9 @@ func (d *Datapath) triggerNegotiation(udpPacket *packet.Packet, context *puconte
 
 	udpOptions := packet.CreateUDPAuthMarker(packet.UDPSynMask)
 
+	// Send the ephemeral key of the PU in case the flow must be encrypted
+	_, conn.Auth.LocalServiceContext = context.EncryptionKey()
+
 	udpData, err := d.tokenAccessor.CreateSynPacketToken(context, &conn.Auth)
 	if err != nil {
 		return err
@@ -443,7 +456,11 @@ func (d *Datapath) sendUDPSynAckPacket(udpPacket *packet.Packet, context *pucont
 	// Create UDP Option
 	udpOptions := packet.CreateUDPAuthMarker(packet.UDPSynAckMask)
 
-	udpData, err := d.tokenAccessor.CreateSynAckPacketToken(context, &conn.Auth, claimsheader.NewClaimsHeader())
+	claimsHeader := claimsheader.NewClaimsHeader(
+		claimsheader.OptionEncrypt(conn.PacketFlowPolicy != nil && conn.PacketFlowPolicy.Action.Encrypted()),
+	)
+
+	udpData, err := d.tokenAccessor.CreateSynAckPacketToken(context, &conn.Auth, claimsHeader)
 	if err != nil {
 		return err
 	}
@@ -492,7 +509,8 @@ func (d *Datapath) sendUDPAckPacket(udpPacket *packet.Packet, context *pucontext
 		return err
 	}
 
-	if !conn.ServiceConnection {
+	// Encrypted flows are never released to the kernel.
+	if !conn.ServiceConnection && conn.FlowCipher == nil {
 		zap.L().Debug("Plumbing the conntrack (app) rule for flow", zap.String("flow", udpPacket.L4FlowHash()))
 		if err = d.conntrack.UpdateApplicationFlowMark(
 			udpPacket.SourceAddress(),
@@ -547,6 +565,20 @@ func (d *Datapath) processNetworkUDPSynPacket(context *pucontext.PUContext, conn
 		return nil, nil, conn.Context.PuContextError(pucontext.ErrUDPSynDroppedPolicy, fmt.Sprintf("connection rejected because of policy: %s", claims.T.String()))
 	}
 
+	if d.rateLimited(context, pkt, txLabel, udpPacket.SourceAddress(), true) {
+		d.reportUDPRejectedFlow(udpPacket, conn, txLabel, context.ManagementID(), context, collector.RateLimitDrop, report, rateLimitedPolicy(pkt), false)
+		return nil, nil, conn.Context.PuContextError(pucontext.ErrRateLimited, fmt.Sprintf("connection rate limited by policy %s: %s", pkt.PolicyID, claims.T.String()))
+	}
+
+	if pkt.Action.Encrypted() {
+		if err := enableUDPEncryption(context, conn, false); err != nil {
+			d.reportUDPRejectedFlow(udpPacket, conn, txLabel, context.ManagementID(), context, collector.EncryptionMismatch, report, pkt, false)
+			return nil, nil, conn.Context.PuContextError(pucontext.ErrEncryptionFailed, fmt.Sprintf("UDP Syn packet dropped: %s", err))
+		}
+		// Send our ephemeral key back in the SynAck
+		_, conn.Auth.LocalServiceContext = context.EncryptionKey()
+	}
+
 	hash := udpPacket.L4FlowHash()
 
 	// conntrack
@@ -583,6 +615,29 @@ func (d *Datapath) processNetworkUDPSynAckPacket(udpPacket *packet.Packet, conte
 		return nil, nil, conn.Context.PuContextError(pucontext.ErrUDPSynAckPolicy, fmt.Sprintf("dropping because of reject rule on transmitter: %s", claims.T.String()))
 	}
 
+	if d.rateLimited(context, pkt, conn.Auth.RemoteContextID, udpPacket.SourceAddress(), true) {
+		d.reportUDPRejectedFlow(udpPacket, conn, conn.Auth.RemoteContextID, context.ManagementID(), context, collector.RateLimitDrop, report, rateLimitedPolicy(pkt), true)
+		return nil, nil, conn.Context.PuContextError(pucontext.ErrRateLimited, fmt.Sprintf("connection rate limited by policy %s: %s", pkt.PolicyID, claims.T.String()))
+	}
+
+	// The receiver decides if the flow is encrypted. With mutual authorization
+	// both sides must agree.
+	encrypt := claims.H != nil && claims.H.ToClaimsHeader().Encrypt()
+	if d.mutualAuthorization && encrypt != pkt.Action.Encrypted() {
+		d.reportUDPRejectedFlow(udpPacket, conn, conn.Auth.RemoteContextID, context.ManagementID(), context, collector.EncryptionMismatch, nil, nil, true)
+		return nil, nil, conn.Context.PuContextError(pucontext.ErrSynAckClaimsMisMatch, fmt.Sprintf("encryption mismatch: %s", claims.T.String()))
+	}
+
+	if encrypt {
+		if err := enableUDPEncryption(context, conn, true); err != nil {
+			d.reportUDPRejectedFlow(udpPacket, conn, conn.Auth.RemoteContextID, context.ManagementID(), context, collector.EncryptionMismatch, report, pkt, true)
+			return nil, nil, conn.Context.PuContextError(pucontext.ErrEncryptionFailed, fmt.Sprintf("UDP SynAck packet dropped: %s", err))
+		}
+	}
+
+	conn.ReportFlowPolicy = report
+	conn.PacketFlowPolicy = pkt
+
 	// conntrack
 	d.udpNetReplyConnectionTracker.AddOrUpdate(udpPacket.L4FlowHash(), conn)
 
@@ -600,7 +655,8 @@ func (d *Datapath) processNetworkUDPAckPacket(udpPacket *packet.Packet, context
 
 	}
 
-	if !conn.ServiceConnection {
+	// Encrypted flows are never released to the kernel.
+	if !conn.ServiceConnection && conn.FlowCipher == nil {
 		zap.L().Debug("Plumb conntrack rule for flow:", zap.String("flow", udpPacket.L4FlowHash()))
 		// Plumb connmark rule here.
 		if err := d.conntrack.UpdateNetworkFlowMark(
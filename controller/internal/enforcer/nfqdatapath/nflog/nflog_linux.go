@@ -196,6 +196,12 @@ func (a *nfLog) recordFromNFLogBuffer(buf *nflog.NfPacket, puIsSource bool) (*co
 		Count:       1,
 	}
 
+	if buf.Protocol == packet.IPProtocolICMP || buf.Protocol == packet.IPProtocolICMPv6 {
+		if ipPacket, err := packet.New(packet.PacketTypeNetwork, buf.Payload, "", false); err == nil {
+			record.ICMPType, record.ICMPCode, _ = ipPacket.ICMPTypeCode()
+		}
+	}
+
 	if action.Observed() {
 		record.ObservedAction = action
 		record.ObservedPolicyID = policyID
@@ -0,0 +1,38 @@
+package nfqdatapath
+
+import (
+	"net"
+
+	"go.aporeto.io/trireme-lib/controller/pkg/pucontext"
+	"go.aporeto.io/trireme-lib/policy"
+)
+
+// rateLimited returns true if the flow exceeds the rate limit of the flow
+// policy. New connections are charged to both the connection and the packet
+// budgets of the remote endpoint.
+func (d *Datapath) rateLimited(context *pucontext.PUContext, flowPolicy *policy.FlowPolicy, remoteID string, remoteIP net.IP, newConnection bool) bool {
+
+	if flowPolicy == nil || flowPolicy.RateLimit == nil || !flowPolicy.Action.RateLimited() || flowPolicy.Action.Rejected() {
+		return false
+	}
+
+	limit := flowPolicy.RateLimit
+	key := context.ID() + "/" + flowPolicy.PolicyID + "/" + limit.RemoteKey(remoteID, remoteIP.String())
+
+	if newConnection && !d.rateLimiter.Allow(key+"/connections", limit.ConnectionsPerSecond, limit.BurstFor(limit.ConnectionsPerSecond)) {
+		return true
+	}
+
+	return !d.rateLimiter.Allow(key+"/packets", limit.PacketsPerSecond, limit.BurstFor(limit.PacketsPerSecond))
+}
+
+// rateLimitedPolicy returns the policy reported for the flows dropped by the
+// rate limit of the given policy.
+func rateLimitedPolicy(flowPolicy *policy.FlowPolicy) *policy.FlowPolicy {
+
+	limited := *flowPolicy
+	limited.Action = policy.Reject | policy.RateLimit | (flowPolicy.Action & policy.Log)
+	limited.ObserveAction = policy.ObserveNone
+
+	return &limited
+}
@@ -76,7 +76,7 @@ func (d *Datapath) reportUDPRejectedFlow(p *packet.Packet, conn *connection.UDPC
 	d.reportFlow(p, src, dst, context, mode, report, packet)
 }
 
-func (d *Datapath) reportExternalServiceFlowCommon(context *pucontext.PUContext, report *policy.FlowPolicy, actual *policy.FlowPolicy, app bool, p *packet.Packet, src, dst *collector.EndPoint) {
+func (d *Datapath) reportExternalServiceFlowCommon(context *pucontext.PUContext, report *policy.FlowPolicy, actual *policy.FlowPolicy, app bool, p *packet.Packet, src, dst *collector.EndPoint, mode string) {
 
 	if app {
 		// TODO: report.ServiceID ????
@@ -91,10 +91,13 @@ func (d *Datapath) reportExternalServiceFlowCommon(context *pucontext.PUContext,
 		dst.Type = collector.EnpointTypePU
 	}
 
-	dropReason := ""
-	if report.Action.Rejected() || actual.Action.Rejected() {
+	dropReason := mode
+	if dropReason == "" && (report.Action.Rejected() || actual.Action.Rejected()) {
 		dropReason = collector.PolicyDrop
 	}
+	if mode == "" && actual.Action.Rejected() && actual.Action.RateLimited() {
+		dropReason = collector.RateLimitDrop
+	}
 
 	record := &collector.FlowRecord{
 		ContextID:   context.ID(),
@@ -114,6 +117,8 @@ func (d *Datapath) reportExternalServiceFlowCommon(context *pucontext.PUContext,
 		record.ObservedPolicyID = report.PolicyID
 	}
 
+	countRuleHits(context, report, actual)
+
 	d.collector.CollectFlowEvent(record)
 }
 
@@ -129,7 +134,24 @@ func (d *Datapath) reportExternalServiceFlow(context *pucontext.PUContext, repor
 		Port: p.DestPort(),
 	}
 
-	d.reportExternalServiceFlowCommon(context, report, packet, app, p, src, dst)
+	d.reportExternalServiceFlowCommon(context, report, packet, app, p, src, dst, "")
+}
+
+// reportDroppedExternalServiceFlow reports an external service flow accepted
+// by the policy but dropped for the given reason.
+func (d *Datapath) reportDroppedExternalServiceFlow(context *pucontext.PUContext, report *policy.FlowPolicy, packet *policy.FlowPolicy, app bool, p *packet.Packet, mode string) {
+
+	src := &collector.EndPoint{
+		IP:   p.SourceAddress().String(),
+		Port: p.SourcePort(),
+	}
+
+	dst := &collector.EndPoint{
+		IP:   p.DestinationAddress().String(),
+		Port: p.DestPort(),
+	}
+
+	d.reportExternalServiceFlowCommon(context, report, packet, app, p, src, dst, mode)
 }
 
 func (d *Datapath) reportReverseExternalServiceFlow(context *pucontext.PUContext, report *policy.FlowPolicy, packet *policy.FlowPolicy, app bool, p *packet.Packet) {
@@ -144,7 +166,18 @@ func (d *Datapath) reportReverseExternalServiceFlow(context *pucontext.PUContext
 		Port: p.SourcePort(),
 	}
 
-	d.reportExternalServiceFlowCommon(context, report, packet, app, p, src, dst)
+	d.reportExternalServiceFlowCommon(context, report, packet, app, p, src, dst, "")
+}
+
+// countRuleHits records a new connection on the rule that decided the flow and
+// on the observed rule, if any.
+func countRuleHits(context *pucontext.PUContext, report *policy.FlowPolicy, actual *policy.FlowPolicy) {
+
+	context.CountRuleConnection(actual)
+
+	if report.ObserveAction.Observed() && report.PolicyID != actual.PolicyID {
+		context.CountRuleConnection(report)
+	}
 }
 
 func (d *Datapath) generateEndpoints(p *packet.Packet, sourceID string, destID string, reverse bool) (*collector.EndPoint, *collector.EndPoint) {
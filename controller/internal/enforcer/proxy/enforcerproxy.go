@@ -44,6 +44,7 @@ type ProxyInfo struct {
 	cfg                    *runtime.Configuration
 	tokenIssuer            common.ServiceTokenIssuer
 	binaryTokens           bool
+	captureType            rpcwrapper.CaptureType
 
 	sync.RWMutex
 }
@@ -289,6 +290,7 @@ func (s *ProxyInfo) initRemoteEnforcer(contextID string) error {
 			Secrets:                s.Secrets.PublicSecrets(),
 			Configuration:          s.cfg,
 			BinaryTokens:           s.binaryTokens,
+			CaptureType:            s.captureType,
 		},
 	}
 
@@ -312,6 +314,7 @@ func NewProxyEnforcer(
 	remoteParameters *env.RemoteParameters,
 	tokenIssuer common.ServiceTokenIssuer,
 	binaryTokens bool,
+	captureType rpcwrapper.CaptureType,
 ) enforcer.Enforcer {
 
 	statsServersecret, err := crypto.GenerateRandomString(32)
@@ -341,5 +344,6 @@ func NewProxyEnforcer(
 		cfg:                    cfg,
 		tokenIssuer:            tokenIssuer,
 		binaryTokens:           binaryTokens,
+		captureType:            captureType,
 	}
 }
@@ -21,6 +21,8 @@ const (
 	IPTables CaptureType = iota
 	// IPSets forces an IPSet implementation
 	IPSets
+	// NFTables forces an nftables implementation
+	NFTables
 )
 
 //Request exported
@@ -52,6 +54,7 @@ type InitRequestPayload struct {
 	Secrets                secrets.PublicSecrets  `json:",omitempty"`
 	Configuration          *runtime.Configuration `json:",omitempty"`
 	BinaryTokens           bool                   `json:",omitempty"`
+	CaptureType            CaptureType            `json:",omitempty"`
 }
 
 // UpdateSecretsPayload payload for the update secrets to remote enforcers
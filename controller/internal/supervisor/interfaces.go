@@ -41,6 +41,10 @@ type Implementor interface {
 	// UpdateRules updates the rules with a new version
 	UpdateRules(version int, contextID string, containerInfo *policy.PUInfo, oldContainerInfo *policy.PUInfo) error
 
+	// UpdateACLs applies the changes of the ACL addresses to the ipsets of the
+	// current rules. It returns false if the rules must be updated instead.
+	UpdateACLs(contextID string, containerInfo *policy.PUInfo, oldContainerInfo *policy.PUInfo) (bool, error)
+
 	// DeleteRules
 	DeleteRules(version int, context string, tcpPorts, udpPorts string, mark string, uid string, proxyPort string, dnsProxyPort string, puType common.PUType) error
 
@@ -3,6 +3,7 @@ package iptablesctrl
 import (
 	"errors"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 	"text/template"
@@ -134,6 +135,10 @@ func (i *iptables) trapRules(cfg *ACLInfo, isHostPU bool) [][]string {
 		"needDnsRules": func() bool {
 			return i.mode == constants.Sidecar || isHostPU || i.isLegacyKernel
 		},
+		// Only the TCP flows redirected to the DNS proxy bypass the datapath.
+		"enableDNSProxy": func() bool {
+			return cfg.DNSServerIP != ""
+		},
 		"isUIDProcess": func() bool {
 			return cfg.UID != ""
 		},
@@ -243,9 +248,9 @@ func (i *iptables) generateACLRules(cfg *ACLInfo, rule *aclIPset, chain string,
 		iptRule := []string{
 			appPacketIPTableContext,
 			chain,
-			"-p", proto,
-			"-m", "set", "--match-set", rule.ipset, ipMatchDirection,
 		}
+		iptRule = append(iptRule, protocolMatch(proto)...)
+		iptRule = append(iptRule, "-m", "set", "--match-set", rule.ipset, ipMatchDirection)
 
 		if proto == constants.TCPProtoNum || proto == constants.TCPProtoString {
 			stateMatch := []string{"-m", "state", "--state", "NEW"}
@@ -283,6 +288,11 @@ func (i *iptables) generateACLRules(cfg *ACLInfo, rule *aclIPset, chain string,
 
 	if !observeContinue {
 		if (rule.policy.Action & policy.Accept) != 0 {
+			if limit := rateLimitMatch(contextID, rule, proto, ipMatchDirection); limit != nil {
+				rateLimitRule := append(baseRule(proto), limit...)
+				iptRules = append(iptRules, append(rateLimitRule, "-j", "DROP"))
+			}
+
 			acceptRule := append(baseRule(proto), []string{"-j", "ACCEPT"}...)
 			iptRules = append(iptRules, acceptRule)
 		}
@@ -293,11 +303,19 @@ func (i *iptables) generateACLRules(cfg *ACLInfo, rule *aclIPset, chain string,
 			iptRules = append(iptRules, rejectRule)
 		}
 
-		if rule.policy.Action&policy.Accept != 0 && (proto == constants.UDPProtoNum || proto == constants.UDPProtoString) {
+		// The replies of the accepted ICMP requests are established like
+		// the replies of the UDP flows. They do not have the type of the
+		// request, so they are matched on the protocol only.
+		if rule.policy.Action&policy.Accept != 0 && (proto == constants.UDPProtoNum || proto == constants.UDPProtoString || policy.IsICMPProtocol(proto)) {
+			reverseProto := proto
+			if policy.IsICMPProtocol(proto) {
+				reverseProto = policy.BaseProtocol(proto)
+			}
+
 			reverseRules = append(reverseRules, []string{
 				appPacketIPTableContext,
 				reverseChain,
-				"-p", proto,
+				"-p", reverseProto,
 				"-m", "set", "--match-set", rule.ipset, reverseDirection,
 				"-m", "state", "--state", "ESTABLISHED",
 				"-j", "ACCEPT",
@@ -308,13 +326,105 @@ func (i *iptables) generateACLRules(cfg *ACLInfo, rule *aclIPset, chain string,
 	return iptRules, reverseRules
 }
 
+// rateLimitMatch returns the match of the new connections that exceed the
+// rate limit of the rule, grouped by remote address. It returns nil if the
+// connections of the rule are not rate limited.
+func rateLimitMatch(contextID string, rule *aclIPset, proto, ipMatchDirection string) []string {
+
+	limit := rule.policy.RateLimit
+	if !rule.policy.Action.RateLimited() || limit == nil || limit.ConnectionsPerSecond <= 0 {
+		return nil
+	}
+
+	name, err := policy.Fnv32Hash(contextID, rule.ipset, proto, ipMatchDirection, strings.Join(rule.ports, ","))
+	if err != nil {
+		return nil
+	}
+
+	match := []string{}
+
+	// tcp rules only match new connections already
+	if proto != constants.TCPProtoNum && proto != constants.TCPProtoString {
+		match = append(match, "-m", "state", "--state", "NEW")
+	}
+
+	return append(match,
+		"-m", "hashlimit",
+		"--hashlimit-above", hashlimitRate(limit.ConnectionsPerSecond),
+		"--hashlimit-burst", strconv.Itoa(limit.BurstFor(limit.ConnectionsPerSecond)),
+		"--hashlimit-mode", ipMatchDirection+"ip",
+		"--hashlimit-name", "RL"+name,
+	)
+}
+
+// hashlimitRate converts a rate per second to the largest unit hashlimit
+// accepts with an integer rate.
+func hashlimitRate(rate float64) string {
+
+	switch {
+	case rate >= 1:
+		return strconv.Itoa(int(math.Round(rate))) + "/second"
+	case rate*60 >= 1:
+		return strconv.Itoa(int(math.Round(rate*60))) + "/minute"
+	default:
+		return strconv.Itoa(int(math.Max(1, math.Round(rate*3600)))) + "/hour"
+	}
+}
+
+// protocolMatch returns the match of the protocol of an ACL rule. The ICMP
+// protocols are matched on their type and code if they have one.
+func protocolMatch(proto string) []string {
+
+	if !policy.IsICMPProtocol(proto) {
+		return []string{"-p", proto}
+	}
+
+	base := policy.BaseProtocol(proto)
+	match := []string{"-p", base}
+
+	parts := strings.SplitN(proto, "/", 2)
+	if len(parts) == 1 {
+		return match
+	}
+
+	if base == policy.ICMPv6ProtoString {
+		return append(match, "-m", "icmp6", "--icmpv6-type", parts[1])
+	}
+
+	return append(match, "-m", "icmp", "--icmp-type", parts[1])
+}
+
+// icmpProtocols expands an ICMP protocol of an ACL rule in one protocol per
+// type and code, since iptables matches a single ICMP code per rule. The other
+// protocols are returned as is.
+func icmpProtocols(proto string) ([]string, error) {
+
+	if !policy.IsICMPProtocol(proto) {
+		return []string{proto}, nil
+	}
+
+	m, err := policy.ParseICMPMatch(proto)
+	if err != nil {
+		return nil, fmt.Errorf("invalid icmp protocol %s: %s", proto, err)
+	}
+
+	typeCodes := m.TypeCodes()
+	if len(typeCodes) == 0 {
+		return []string{m.Protocol()}, nil
+	}
+
+	protocols := make([]string, len(typeCodes))
+	for i, tc := range typeCodes {
+		protocols[i] = m.Protocol() + "/" + tc
+	}
+
+	return protocols, nil
+}
+
 // programExtensionsRules programs iptable rules for the given extensions
 func (i *iptables) programExtensionsRules(contextID string, rule *aclIPset, chain, proto, ipMatchDirection, nfLogGroup string) error {
 
-	rulesspec := []string{
-		"-p", proto,
-		"-m", "set", "--match-set", rule.ipset, ipMatchDirection,
-	}
+	rulesspec := append(protocolMatch(proto), "-m", "set", "--match-set", rule.ipset, ipMatchDirection)
 
 	for _, ext := range rule.extensions {
 		if rule.policy.Action&policy.Log > 0 {
@@ -374,7 +484,7 @@ func (i *iptables) programNflogExtensionRule(contextID string, rule *aclIPset, r
 // in order to support observation only of ACL actions. The parameters
 // must provide the chain and whether it is App or Net ACLs so that the rules
 // can be created accordingly.
-func (i *iptables) sortACLsInBuckets(cfg *ACLInfo, chain string, reverseChain string, rules []aclIPset, isAppACLs bool) *rulesInfo {
+func (i *iptables) sortACLsInBuckets(cfg *ACLInfo, chain string, reverseChain string, rules []aclIPset, isAppACLs bool) (*rulesInfo, error) {
 
 	rulesBucket := &rulesInfo{
 		RejectObserveApply:    [][]string{},
@@ -397,14 +507,30 @@ func (i *iptables) sortACLsInBuckets(cfg *ACLInfo, chain string, reverseChain st
 
 	for _, rule := range rules {
 
-		for _, proto := range rule.protocols {
+		for _, ruleProto := range rule.protocols {
 
-			if !i.impl.ProtocolAllowed(proto) {
+			if !i.impl.ProtocolAllowed(ruleProto) {
 				continue
 			}
 
-			acls, r := i.generateACLRules(cfg, &rule, chain, reverseChain, nflogGroup, proto, direction, reverse)
-			rulesBucket.ReverseRules = append(rulesBucket.ReverseRules, r...)
+			protocols, err := icmpProtocols(ruleProto)
+			if err != nil {
+				return nil, err
+			}
+
+			// The types of an ICMP protocol share their reverse rule.
+			acls := [][]string{}
+			reverseRules := map[string]bool{}
+			for _, proto := range protocols {
+				a, r := i.generateACLRules(cfg, &rule, chain, reverseChain, nflogGroup, proto, direction, reverse)
+				acls = append(acls, a...)
+				for _, rr := range r {
+					if key := strings.Join(rr, " "); !reverseRules[key] {
+						reverseRules[key] = true
+						rulesBucket.ReverseRules = append(rulesBucket.ReverseRules, rr)
+					}
+				}
+			}
 
 			if testReject(rule.policy) && testObserveApply(rule.policy) {
 				rulesBucket.RejectObserveApply = append(rulesBucket.RejectObserveApply, acls...)
@@ -432,14 +558,17 @@ func (i *iptables) sortACLsInBuckets(cfg *ACLInfo, chain string, reverseChain st
 		}
 	}
 
-	return rulesBucket
+	return rulesBucket, nil
 }
 
 // addExternalACLs adds a set of rules to the external services that are initiated
 // by an application. The allow rules are inserted with highest priority.
 func (i *iptables) addExternalACLs(cfg *ACLInfo, chain string, reverseChain string, rules []aclIPset, isAppAcls bool) error {
 
-	rulesBucket := i.sortACLsInBuckets(cfg, chain, reverseChain, rules, isAppAcls)
+	rulesBucket, err := i.sortACLsInBuckets(cfg, chain, reverseChain, rules, isAppAcls)
+	if err != nil {
+		return err
+	}
 
 	tmpl := template.Must(template.New(acls).Funcs(template.FuncMap{
 		"joinRule": func(rule []string) string {
@@ -0,0 +1,171 @@
+package iptablesctrl
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	provider "go.aporeto.io/trireme-lib/controller/pkg/aclprovider"
+	"go.aporeto.io/trireme-lib/policy"
+)
+
+func TestRateLimitMatch(t *testing.T) {
+	Convey("Given ACL rules", t, func() {
+
+		rule := &aclIPset{
+			ipset: "TRI-v4-ext-abcd",
+			ports: []string{"80", "443"},
+			policy: &policy.FlowPolicy{
+				Action:    policy.Accept | policy.RateLimit,
+				RateLimit: &policy.RateLimitSpec{ConnectionsPerSecond: 10},
+			},
+		}
+
+		Convey("Rules without rate limit should have no match", func() {
+			So(rateLimitMatch("pu1", &aclIPset{policy: &policy.FlowPolicy{Action: policy.Accept}}, "6", "src"), ShouldBeNil)
+
+			packets := &aclIPset{
+				policy: &policy.FlowPolicy{
+					Action:    policy.Accept | policy.RateLimit,
+					RateLimit: &policy.RateLimitSpec{PacketsPerSecond: 10},
+				},
+			}
+			So(rateLimitMatch("pu1", packets, "6", "src"), ShouldBeNil)
+		})
+
+		Convey("TCP rules should limit the connections by remote address", func() {
+			match := rateLimitMatch("pu1", rule, "6", "src")
+			So(match, ShouldNotBeNil)
+			So(match[:8], ShouldResemble, []string{
+				"-m", "hashlimit",
+				"--hashlimit-above", "10/second",
+				"--hashlimit-burst", "10",
+				"--hashlimit-mode", "srcip",
+			})
+			So(match[9], ShouldStartWith, "RL")
+			So(len(match[9]), ShouldBeLessThanOrEqualTo, 15)
+
+			So(rateLimitMatch("pu1", rule, "6", "dst")[9], ShouldNotEqual, match[9])
+		})
+
+		Convey("UDP rules should only limit the new flows", func() {
+			match := rateLimitMatch("pu1", rule, "17", "dst")
+			So(match[:4], ShouldResemble, []string{"-m", "state", "--state", "NEW"})
+			So(match, ShouldContain, "dstip")
+		})
+	})
+}
+
+func TestHashlimitRate(t *testing.T) {
+	Convey("Rates should be converted to integer rates", t, func() {
+		So(hashlimitRate(2.4), ShouldEqual, "2/second")
+		So(hashlimitRate(0.5), ShouldEqual, "30/minute")
+		So(hashlimitRate(0.001), ShouldEqual, "4/hour")
+		So(hashlimitRate(0.00001), ShouldEqual, "1/hour")
+	})
+}
+
+func TestICMPProtocols(t *testing.T) {
+	Convey("Given ICMP protocols", t, func() {
+
+		Convey("The codes should be expanded in one protocol each", func() {
+			for proto, expected := range map[string][]string{
+				"tcp":         {"tcp"},
+				"1":           {"icmp"},
+				"icmp/8":      {"icmp/8"},
+				"icmp/3/4,13": {"icmp/3/4", "icmp/3/13"},
+			} {
+				protocols, err := icmpProtocols(proto)
+				So(err, ShouldBeNil)
+				So(protocols, ShouldResemble, expected)
+			}
+		})
+
+		Convey("The invalid protocols should be refused", func() {
+			protocols, err := icmpProtocols("icmp/echo")
+			So(err, ShouldNotBeNil)
+			So(protocols, ShouldBeNil)
+		})
+
+		Convey("The protocols should be matched on their type and code", func() {
+			So(protocolMatch("6"), ShouldResemble, []string{"-p", "6"})
+			So(protocolMatch("icmp"), ShouldResemble, []string{"-p", "icmp"})
+			So(protocolMatch("icmp/3/4"), ShouldResemble, []string{"-p", "icmp", "-m", "icmp", "--icmp-type", "3/4"})
+			So(protocolMatch("icmpv6/128"), ShouldResemble, []string{"-p", "icmpv6", "-m", "icmp6", "--icmpv6-type", "128"})
+		})
+	})
+}
+
+func TestACLAddresses(t *testing.T) {
+	Convey("Given an ipset of ACL addresses", t, func() {
+
+		entries := map[string]string{}
+		set := provider.NewTestIpset()
+		set.MockAdd(t, func(entry string, timeout int) error {
+			entries[entry] = ""
+			return nil
+		})
+		set.MockAddOption(t, func(entry string, option string, timeout int) error {
+			entries[entry] = option
+			return nil
+		})
+		set.MockDel(t, func(entry string) error {
+			delete(entries, entry)
+			return nil
+		})
+
+		Convey("The excluded addresses should be added as nomatch entries", func() {
+			So(addACLAddress(set, "0.0.0.0/0"), ShouldBeNil)
+			So(addACLAddress(set, "!10.0.0.0/8"), ShouldBeNil)
+			So(entries, ShouldResemble, map[string]string{
+				"0.0.0.0/1":   "",
+				"128.0.0.0/1": "",
+				"10.0.0.0/8":  "nomatch",
+			})
+
+			So(delACLAddress(set, "!10.0.0.0/8"), ShouldBeNil)
+			So(entries, ShouldNotContainKey, "10.0.0.0/8")
+		})
+
+		Convey("The exclusion of the addresses should be toggled", func() {
+			So(toggledAddress("10.0.0.0/8"), ShouldEqual, "!10.0.0.0/8")
+			So(toggledAddress("!10.0.0.0/8"), ShouldEqual, "10.0.0.0/8")
+		})
+	})
+}
+
+func TestDNSTrapRules(t *testing.T) {
+	Convey("Given the trap rules of a host PU", t, func() {
+
+		i := &iptables{}
+		cfg := &ACLInfo{
+			MangleTable: "mangle",
+			AppChain:    "TRI-App-pu1",
+			NetChain:    "TRI-Net-pu1",
+		}
+
+		rules := func() []string {
+			joined := []string{}
+			for _, rule := range i.trapRules(cfg, true) {
+				joined = append(joined, strings.Join(rule, " "))
+			}
+			return joined
+		}
+
+		Convey("The TCP flows of the DNS server should bypass the datapath", func() {
+			cfg.DNSServerIP = "10.0.0.2"
+
+			So(rules(), ShouldContain, "mangle TRI-App-pu1 -d 10.0.0.2 -p tcp -m tcp --dport 53 -j ACCEPT")
+			So(rules(), ShouldContain, "mangle TRI-Net-pu1 -s 10.0.0.2 -p tcp -m tcp --sport 53 -j ACCEPT")
+			So(rules(), ShouldNotContain, "mangle TRI-App-pu1 -p tcp -m tcp --dport 53 -j ACCEPT")
+		})
+
+		Convey("Without DNS server, the TCP flows of port 53 should not bypass the datapath", func() {
+			for _, rule := range rules() {
+				So(rule, ShouldNotContainSubstring, "tcp -m tcp --dport 53")
+				So(rule, ShouldNotContainSubstring, "tcp -m tcp --sport 53")
+			}
+			So(rules(), ShouldContain, "mangle TRI-App-pu1 -p udp -m udp --dport 53 -j ACCEPT")
+		})
+	})
+}
@@ -114,6 +114,26 @@ func (i *Instance) UpdateRules(version int, contextID string, containerInfo *pol
 	return nil
 }
 
+// UpdateACLs implements the supervisor interface. The ipsets of both families
+// are updated only if the rules of both of them can be kept. Otherwise the
+// rules must be updated with UpdateRules.
+func (i *Instance) UpdateACLs(contextID string, containerInfo *policy.PUInfo, oldContainerInfo *policy.PUInfo) (bool, error) {
+
+	if !i.iptv4.canUpdateACLs(contextID, containerInfo, oldContainerInfo) || !i.iptv6.canUpdateACLs(contextID, containerInfo, oldContainerInfo) {
+		return false, nil
+	}
+
+	if err := i.iptv4.updateACLs(contextID, containerInfo, oldContainerInfo); err != nil {
+		return false, err
+	}
+
+	if err := i.iptv6.updateACLs(contextID, containerInfo, oldContainerInfo); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
 // CleanUp requires the implementor to clean up all ACLs and destroy all
 // the IP sets.
 func (i *Instance) CleanUp() error {
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"reflect"
 	"text/template"
 
 	"github.com/aporeto-inc/go-ipset/ipset"
@@ -361,6 +362,123 @@ func (i *iptables) UpdateRules(version int, contextID string, containerInfo *pol
 	return nil
 }
 
+// canUpdateACLs returns true if the rules of the new policy are the rules of
+// the old policy, so that only the ipsets of the ACLs must be updated.
+func (i *iptables) canUpdateACLs(contextID string, containerInfo *policy.PUInfo, oldContainerInfo *policy.PUInfo) bool {
+
+	if oldContainerInfo == nil || containerInfo.Policy == nil || oldContainerInfo.Policy == nil {
+		return false
+	}
+
+	newCfg, err := i.newACLInfo(0, contextID, containerInfo, containerInfo.Runtime.PUType())
+	if err != nil {
+		return false
+	}
+
+	oldCfg, err := i.newACLInfo(0, contextID, oldContainerInfo, containerInfo.Runtime.PUType())
+	if err != nil {
+		return false
+	}
+
+	if !reflect.DeepEqual(newCfg, oldCfg) {
+		return false
+	}
+
+	if extractors.IsHostPU(containerInfo.Runtime, i.mode) != extractors.IsHostPU(oldContainerInfo.Runtime, i.mode) {
+		return false
+	}
+
+	newPolicy := containerInfo.Policy
+	oldPolicy := oldContainerInfo.Policy
+
+	if !equalACLShapes(newPolicy.ApplicationACLs(), oldPolicy.ApplicationACLs()) || !equalACLShapes(newPolicy.NetworkACLs(), oldPolicy.NetworkACLs()) {
+		return false
+	}
+
+	for _, rules := range []policy.IPRuleList{newPolicy.ApplicationACLs(), newPolicy.NetworkACLs()} {
+		for _, rule := range rules {
+			if i.serviceIDToIPsets[rule.Policy.ServiceID] == nil {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// updateACLs updates the ipsets of the ACLs of the PU with the addresses of
+// the ACLs that changed in the new policy. The rules are not modified, the
+// caller must check that they can be kept with canUpdateACLs.
+func (i *iptables) updateACLs(contextID string, containerInfo *policy.PUInfo, oldContainerInfo *policy.PUInfo) error {
+
+	cfg, err := i.newACLInfo(0, contextID, containerInfo, containerInfo.Runtime.PUType())
+	if err != nil {
+		return err
+	}
+
+	if err := i.updateProxySet(containerInfo.Policy, cfg.ProxySetName); err != nil {
+		return err
+	}
+
+	diff := policy.NewPolicyDiff(oldContainerInfo.Policy, containerInfo.Policy)
+
+	changed := map[string]bool{}
+	for _, rules := range []policy.IPRuleList{
+		diff.ApplicationACLs.Added,
+		diff.ApplicationACLs.Removed,
+		diff.NetworkACLs.Added,
+		diff.NetworkACLs.Removed,
+	} {
+		for _, rule := range rules {
+			changed[rule.Policy.ServiceID] = true
+		}
+	}
+
+	if len(changed) == 0 {
+		return nil
+	}
+
+	// The ipset of a service holds the addresses of the last rule of the
+	// service, as when the ipsets are created with the rules.
+	addresses := map[string][]string{}
+	for _, rules := range []policy.IPRuleList{containerInfo.Policy.ApplicationACLs(), containerInfo.Policy.NetworkACLs()} {
+		for _, rule := range rules {
+			if changed[rule.Policy.ServiceID] {
+				addresses[rule.Policy.ServiceID] = rule.Addresses
+			}
+		}
+	}
+
+	for serviceID, serviceAddresses := range addresses {
+		if err := i.syncACLIPSet(i.serviceIDToIPsets[serviceID], serviceAddresses); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// equalACLShapes returns true if the rules only differ by their addresses.
+// The addresses are in the ipsets of the rules, so the rules do not change.
+func equalACLShapes(a, b policy.IPRuleList) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+
+	shape := func(r policy.IPRule) string {
+		return fmt.Sprintf("%q|%q|%q|%s", r.Ports, r.Protocols, r.Extensions, r.Policy.Key())
+	}
+
+	for i := range a {
+		if shape(a[i]) != shape(b[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
 func (i *iptables) CleanUp() error {
 	if err := i.cleanACLs(); err != nil {
 		zap.L().Error("Failed to clean acls while stopping the supervisor", zap.Error(err))
@@ -558,6 +676,36 @@ func delFromIPset(set provider.Ipset, data string) error {
 	return set.Del(data)
 }
 
+// addACLAddress adds an address of an ACL rule to the ipset of the rule. The
+// excluded addresses are added as nomatch entries, so that the longest prefix
+// of the ipset that contains an address decides if it matches.
+func addACLAddress(set provider.Ipset, address string) error {
+
+	if network, excluded := policy.ExcludedAddress(address); excluded {
+		return set.AddOption(network, "nomatch", 0)
+	}
+
+	return addToIPset(set, address)
+}
+
+// delACLAddress removes an address of an ACL rule from the ipset of the rule.
+func delACLAddress(set provider.Ipset, address string) error {
+
+	network, _ := policy.ExcludedAddress(address)
+
+	return delFromIPset(set, network)
+}
+
+// toggledAddress returns the address with the opposite exclusion.
+func toggledAddress(address string) string {
+
+	if network, excluded := policy.ExcludedAddress(address); excluded {
+		return network
+	}
+
+	return policy.AddressExclusionPrefix + address
+}
+
 func (i *iptables) removePUFromExternalNetworks(contextID string, serviceID string) {
 
 	info := i.serviceIDToIPsets[serviceID]
@@ -629,6 +777,12 @@ func (i *iptables) createACLIPSets(contextID string, rules policy.IPRuleList) ([
 
 	for _, rule := range rules {
 
+		// The ipsets cannot hold an entry that is both a match and a nomatch,
+		// nor a nomatch of all the addresses.
+		if err := policy.ValidateExclusions(rule.Addresses); err != nil {
+			return nil, fmt.Errorf("invalid addresses of acl %s: %s", rule.Policy.ServiceID, err)
+		}
+
 		if i.serviceIDToIPsets[rule.Policy.ServiceID] == nil {
 			ips := map[string]bool{}
 
@@ -639,16 +793,17 @@ func (i *iptables) createACLIPSets(contextID string, rules policy.IPRuleList) ([
 			}
 
 			for _, address := range rule.Addresses {
-				netIP := net.ParseIP(address)
+				network, _ := policy.ExcludedAddress(address)
+				netIP := net.ParseIP(network)
 				if netIP == nil {
-					netIP, _, _ = net.ParseCIDR(address)
+					netIP, _, _ = net.ParseCIDR(network)
 				}
 
 				if !ipFilter(netIP) {
 					continue
 				}
 
-				if err := addToIPset(set, address); err != nil {
+				if err := addACLAddress(set, address); err != nil {
 					return nil, err
 				}
 				ips[address] = true
@@ -665,40 +820,9 @@ func (i *iptables) createACLIPSets(contextID string, rules policy.IPRuleList) ([
 			i.serviceIDToIPsets[rule.Policy.ServiceID] = info
 		} else {
 			info = i.serviceIDToIPsets[rule.Policy.ServiceID]
-			newips := map[string]bool{}
-
-			for _, address := range rule.Addresses {
-
-				netIP := net.ParseIP(address)
-				if netIP == nil {
-					netIP, _, _ = net.ParseCIDR(address)
-				}
-
-				if !ipFilter(netIP) {
-					continue
-				}
-
-				// add new entries
-				if !info.ips[address] {
-					if err := addToIPset(i.ipset.GetIpset(info.ipset), address); err != nil {
-						return nil, err
-					}
-					newips[address] = true
-				} else {
-					newips[address] = true
-					info.ips[address] = false
-				}
-			}
-			// Remove the old entries
-			for address, val := range info.ips {
-				if val {
-					if err := delFromIPset(i.ipset.GetIpset(info.ipset), address); err != nil {
-						return nil, err
-					}
-				}
+			if err := i.syncACLIPSet(info, rule.Addresses); err != nil {
+				return nil, err
 			}
-
-			info.ips = newips
 			info.contextIDs[contextID] = true
 		}
 
@@ -714,6 +838,59 @@ func (i *iptables) createACLIPSets(contextID string, rules policy.IPRuleList) ([
 	return acls, nil
 }
 
+// syncACLIPSet updates the ipset of an ACL with the addresses of a rule. Only
+// the addresses that changed are added to or removed from the ipset.
+func (i *iptables) syncACLIPSet(info *ipsetInfo, addresses []string) error {
+
+	ipFilter := i.impl.IPFilter()
+	newips := map[string]bool{}
+
+	for _, address := range addresses {
+
+		network, _ := policy.ExcludedAddress(address)
+		netIP := net.ParseIP(network)
+		if netIP == nil {
+			netIP, _, _ = net.ParseCIDR(network)
+		}
+
+		if !ipFilter(netIP) {
+			continue
+		}
+
+		// add new entries
+		if !info.ips[address] {
+			// the ipset holds a single entry per network, remove the
+			// entry with the opposite exclusion first.
+			if toggled := toggledAddress(address); info.ips[toggled] {
+				if err := delACLAddress(i.ipset.GetIpset(info.ipset), toggled); err != nil {
+					return err
+				}
+				info.ips[toggled] = false
+			}
+
+			if err := addACLAddress(i.ipset.GetIpset(info.ipset), address); err != nil {
+				return err
+			}
+			newips[address] = true
+		} else {
+			newips[address] = true
+			info.ips[address] = false
+		}
+	}
+	// Remove the old entries
+	for address, val := range info.ips {
+		if val {
+			if err := delACLAddress(i.ipset.GetIpset(info.ipset), address); err != nil {
+				return err
+			}
+		}
+	}
+
+	info.ips = newips
+
+	return nil
+}
+
 // Install rules will install all the rules and update the port sets.
 func (i *iptables) installRules(cfg *ACLInfo, containerInfo *policy.PUInfo) error {
 	var err error
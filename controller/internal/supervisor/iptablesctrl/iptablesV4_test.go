@@ -248,6 +248,21 @@ func Test_NegativeConfigureRulesV4(t *testing.T) {
 			err := i.iptv4.ConfigureRules(1, "ID", containerinfo)
 			So(err, ShouldNotBeNil)
 		})
+
+		Convey("When I configure the rules with an acl that includes and excludes a network, it should error", func() {
+			appACLs := policy.IPRuleList{
+				policy.IPRule{
+					Addresses: []string{"10.0.0.0/8", "!10.0.0.0/8"},
+					Ports:     []string{"80"},
+					Protocols: []string{constants.TCPProtoNum},
+					Policy:    &policy.FlowPolicy{Action: policy.Reject, ServiceID: "s1"},
+				},
+			}
+			containerinfo.Policy = policy.NewPUPolicy("Context", "/ns1", policy.Police, appACLs, nil, nil, nil, nil, nil, nil, nil, ipl, 0, 0, nil, nil, []string{})
+
+			err := i.iptv4.ConfigureRules(1, "ID", containerinfo)
+			So(err, ShouldNotBeNil)
+		})
 	})
 }
 
@@ -358,6 +373,7 @@ var (
 			"-m mark --mark 0x40 -j ACCEPT",
 			"-p tcp -m tcp --sport 0 -j ACCEPT",
 			"-p udp -m udp --sport 0 -j ACCEPT",
+			"-p tcp -m tcp --sport 0 -j ACCEPT",
 			"-p tcp -m set --match-set TRI-v4-Proxy-pu19gtV-srv src -j ACCEPT",
 			"-p tcp -m set --match-set TRI-v4-Proxy-pu19gtV-dst dst,dst -m mark ! --mark 0x40 -j ACCEPT",
 		},
@@ -367,6 +383,7 @@ var (
 			"-p tcp -m set --match-set TRI-v4-Proxy-pu19gtV-srv src -m addrtype --src-type LOCAL -j ACCEPT",
 			"-p tcp -m tcp --dport 0 -j ACCEPT",
 			"-p udp -m udp --dport 0 -j ACCEPT",
+			"-p tcp -m tcp --dport 0 -j ACCEPT",
 		},
 		"TRI-Hst-App": {},
 		"TRI-Hst-Net": {},
@@ -377,6 +394,7 @@ var (
 
 		"TRI-Net-pu1N7uS6--0": {
 			"-p UDP -m set --match-set TRI-v4-ext-6zlJIpu19gtV src -m state --state ESTABLISHED -j ACCEPT",
+			"-p icmp -m set --match-set TRI-v4-ext-w5frVpu19gtV src -m state --state ESTABLISHED -j ACCEPT",
 			"-p TCP -m set --match-set TRI-v4-ext-w5frVpu19gtV src -m state --state NEW -m set ! --match-set TRI-v4-TargetTCP src --match multiport --dports 80 -j DROP",
 			"-p UDP -m set --match-set TRI-v4-ext-IuSLspu19gtV src --match multiport --dports 443 -j ACCEPT",
 			"-p tcp -m set --match-set TRI-v4-TargetTCP src -m tcp --tcp-flags SYN,ACK SYN -j NFQUEUE --queue-balance 16:19",
@@ -444,6 +462,7 @@ var (
 			"-m mark --mark 0x40 -j ACCEPT",
 			"-p tcp -m tcp --sport 0 -j ACCEPT",
 			"-p udp -m udp --sport 0 -j ACCEPT",
+			"-p tcp -m tcp --sport 0 -j ACCEPT",
 			"-p tcp -m set --match-set TRI-v4-Proxy-pu19gtV-srv src -j ACCEPT",
 			"-p tcp -m set --match-set TRI-v4-Proxy-pu19gtV-dst dst,dst -m mark ! --mark 0x40 -j ACCEPT",
 		},
@@ -453,6 +472,7 @@ var (
 			"-p tcp -m set --match-set TRI-v4-Proxy-pu19gtV-srv src -m addrtype --src-type LOCAL -j ACCEPT",
 			"-p tcp -m tcp --dport 0 -j ACCEPT",
 			"-p udp -m udp --dport 0 -j ACCEPT",
+			"-p tcp -m tcp --dport 0 -j ACCEPT",
 		},
 		"TRI-Hst-App": {},
 		"TRI-Hst-Net": {},
@@ -463,6 +483,7 @@ var (
 
 		"TRI-Net-pu1N7uS6--0": {
 			"-p UDP -m set --match-set TRI-v4-ext-6zlJIpu19gtV src -m state --state ESTABLISHED -j ACCEPT",
+			"-p icmp -m set --match-set TRI-v4-ext-w5frVpu19gtV src -m state --state ESTABLISHED -j ACCEPT",
 			"-p TCP -m set --match-set TRI-v4-ext-w5frVpu19gtV src -m state --state NEW -m set ! --match-set TRI-v4-TargetTCP src --match multiport --dports 80 -j DROP",
 			"-p UDP -m set --match-set TRI-v4-ext-IuSLspu19gtV src --match multiport --dports 443 -j ACCEPT",
 			"-p tcp -m set --match-set TRI-v4-TargetTCP src -m tcp --tcp-flags SYN,ACK SYN -j NFQUEUE --queue-balance 16:19",
@@ -531,6 +552,7 @@ var (
 			"-m mark --mark 0x40 -j ACCEPT",
 			"-p tcp -m tcp --sport 0 -j ACCEPT",
 			"-p udp -m udp --sport 0 -j ACCEPT",
+			"-p tcp -m tcp --sport 0 -j ACCEPT",
 			"-p tcp -m set --match-set TRI-v4-Proxy-pu19gtV-srv src -j ACCEPT",
 			"-p tcp -m set --match-set TRI-v4-Proxy-pu19gtV-dst dst,dst -m mark ! --mark 0x40 -j ACCEPT",
 		},
@@ -540,6 +562,7 @@ var (
 			"-p tcp -m set --match-set TRI-v4-Proxy-pu19gtV-srv src -m addrtype --src-type LOCAL -j ACCEPT",
 			"-p tcp -m tcp --dport 0 -j ACCEPT",
 			"-p udp -m udp --dport 0 -j ACCEPT",
+			"-p tcp -m tcp --dport 0 -j ACCEPT",
 		},
 		"TRI-Hst-App": {},
 		"TRI-Hst-Net": {},
@@ -550,6 +573,7 @@ var (
 
 		"TRI-Net-pu1N7uS6--0": {
 			"-p UDP -m set --match-set TRI-v4-ext-6zlJIpu19gtV src -m state --state ESTABLISHED -j ACCEPT",
+			"-p icmp -m set --match-set TRI-v4-ext-w5frVpu19gtV src -m state --state ESTABLISHED -j ACCEPT",
 			"-p TCP -m set --match-set TRI-v4-ext-w5frVpu19gtV src -m state --state NEW -m set ! --match-set TRI-v4-TargetTCP src --match multiport --dports 80 -j DROP",
 			"-p UDP -m set --match-set TRI-v4-ext-IuSLspu19gtV src --match multiport --dports 443 -j ACCEPT",
 			"-p tcp -m set --match-set TRI-v4-TargetTCP src -m tcp --tcp-flags SYN,ACK SYN -j NFQUEUE --queue-balance 16:19",
@@ -618,6 +642,7 @@ var (
 			"-m mark --mark 0x40 -j ACCEPT",
 			"-p tcp -m tcp --sport 0 -j ACCEPT",
 			"-p udp -m udp --sport 0 -j ACCEPT",
+			"-p tcp -m tcp --sport 0 -j ACCEPT",
 			"-p tcp -m set --match-set TRI-v4-Proxy-pu19gtV-srv src -j ACCEPT",
 			"-p tcp -m set --match-set TRI-v4-Proxy-pu19gtV-dst dst,dst -m mark ! --mark 0x40 -j ACCEPT",
 		},
@@ -627,6 +652,7 @@ var (
 			"-p tcp -m set --match-set TRI-v4-Proxy-pu19gtV-srv src -m addrtype --src-type LOCAL -j ACCEPT",
 			"-p tcp -m tcp --dport 0 -j ACCEPT",
 			"-p udp -m udp --dport 0 -j ACCEPT",
+			"-p tcp -m tcp --dport 0 -j ACCEPT",
 		},
 		"TRI-Hst-App": {},
 		"TRI-Hst-Net": {},
@@ -637,6 +663,7 @@ var (
 
 		"TRI-Net-pu1N7uS6--0": {
 			"-p UDP -m set --match-set TRI-v4-ext-6zlJIpu19gtV src -m state --state ESTABLISHED -j ACCEPT",
+			"-p icmp -m set --match-set TRI-v4-ext-w5frVpu19gtV src -m state --state ESTABLISHED -j ACCEPT",
 			"-p TCP -m set --match-set TRI-v4-ext-w5frVpu19gtV src -m state --state NEW -m set ! --match-set TRI-v4-TargetTCP src --match multiport --dports 80 -j DROP",
 			"-p UDP -m set --match-set TRI-v4-ext-IuSLspu19gtV src --match multiport --dports 443 -j ACCEPT",
 			"-p tcp -m set --match-set TRI-v4-TargetTCP src -m tcp --tcp-flags SYN,ACK SYN -j NFQUEUE --queue-balance 16:19",
@@ -679,6 +706,8 @@ var (
 			"-p tcp -m set --match-set TRI-v4-Proxy-pu19gtV-dst dst,dst -m mark ! --mark 0x40 -m cgroup --cgroup 10 -j REDIRECT --to-ports 0",
 			"-d 0.0.0.0/0 -p udp --dport 53 -m mark ! --mark 0x40 -m cgroup --cgroup 10 -j CONNMARK --save-mark",
 			"-d 0.0.0.0/0 -p udp --dport 53 -m mark ! --mark 0x40 -m cgroup --cgroup 10 -j REDIRECT --to-ports 0",
+			"-d 0.0.0.0/0 -p tcp --dport 53 -m mark ! --mark 0x40 -m cgroup --cgroup 10 -j CONNMARK --save-mark",
+			"-d 0.0.0.0/0 -p tcp --dport 53 -m mark ! --mark 0x40 -m cgroup --cgroup 10 -j REDIRECT --to-ports 0",
 		},
 		"TRI-Redir-Net": {
 			"-m mark --mark 0x40 -j ACCEPT",
@@ -742,6 +771,7 @@ var (
 			"-m mark --mark 0x40 -j ACCEPT",
 			"-p tcp -m tcp --sport 0 -j ACCEPT",
 			"-p udp -m udp --sport 0 -j ACCEPT",
+			"-p tcp -m tcp --sport 0 -j ACCEPT",
 			"-p tcp -m set --match-set TRI-v4-Proxy-pu19gtV-srv src -j ACCEPT",
 			"-p tcp -m set --match-set TRI-v4-Proxy-pu19gtV-dst dst,dst -m mark ! --mark 0x40 -j ACCEPT",
 		},
@@ -751,6 +781,7 @@ var (
 			"-p tcp -m set --match-set TRI-v4-Proxy-pu19gtV-srv src -m addrtype --src-type LOCAL -j ACCEPT",
 			"-p tcp -m tcp --dport 0 -j ACCEPT",
 			"-p udp -m udp --dport 0 -j ACCEPT",
+			"-p tcp -m tcp --dport 0 -j ACCEPT",
 		},
 		"TRI-Hst-App": {},
 		"TRI-Hst-Net": {},
@@ -959,6 +990,55 @@ func Test_OperationWithLinuxServicesV4(t *testing.T) {
 					}
 				}
 
+				Convey("When I only change the addresses of the ACLs, the ipsets must be updated without the rules", func() {
+					updatedACLs := func(address string, port string) *policy.PUInfo {
+						acls := appACLs.Copy()
+						acls[1].Addresses = []string{address}
+						acls[1].Ports = []string{port}
+						policyrules := policy.NewPUPolicy(
+							"Context",
+							"/ns1",
+							policy.Police,
+							acls,
+							netACLs,
+							nil,
+							nil,
+							nil,
+							nil,
+							nil,
+							nil,
+							ipl,
+							0,
+							0,
+							nil,
+							nil,
+							[]string{},
+						)
+						return &policy.PUInfo{
+							ContextID: puInfo.ContextID,
+							Runtime:   puInfo.Runtime,
+							Policy:    policyrules,
+						}
+					}
+
+					So(i.iptv4.canUpdateACLs("pu1", updatedACLs("60.0.0.0/24", "8443"), puInfo), ShouldBeFalse)
+
+					puInfoUpdated := updatedACLs("60.0.0.0/24", "443")
+					So(i.iptv4.canUpdateACLs("pu1", puInfoUpdated, puInfo), ShouldBeTrue)
+
+					err := i.iptv4.updateACLs("pu1", puInfoUpdated, puInfo)
+					So(err, ShouldBeNil)
+
+					So(ipsv4.sets[i.iptv4.serviceIDToIPsets["s2"].ipset].set, ShouldResemble, map[string]struct{}{"60.0.0.0/24": {}})
+					So(ipsv4.sets[i.iptv4.serviceIDToIPsets["s1"].ipset].set, ShouldResemble, map[string]struct{}{"30.0.0.0/24": {}})
+
+					t := i.iptv4.impl.RetrieveTable()
+					for chain, rules := range t["mangle"] {
+						So(expectedMangleAfterPUInsertV4, ShouldContainKey, chain)
+						So(rules, ShouldResemble, expectedMangleAfterPUInsertV4[chain])
+					}
+				})
+
 				Convey("When I update the policy, the update must result in correct state", func() {
 					appACLs := policy.IPRuleList{
 						policy.IPRule{
@@ -1669,6 +1749,7 @@ var (
 			"-m mark --mark 0x40 -j ACCEPT",
 			"-p tcp -m tcp --sport 0 -j ACCEPT",
 			"-p udp -m udp --sport 0 -j ACCEPT",
+			"-p tcp -m tcp --sport 0 -j ACCEPT",
 			"-p tcp -m set --match-set TRI-v4-Proxy-pu19gtV-srv src -j ACCEPT",
 			"-p tcp -m set --match-set TRI-v4-Proxy-pu19gtV-dst dst,dst -m mark ! --mark 0x40 -j ACCEPT",
 		},
@@ -1678,6 +1759,7 @@ var (
 			"-p tcp -m set --match-set TRI-v4-Proxy-pu19gtV-srv src -m addrtype --src-type LOCAL -j ACCEPT",
 			"-p tcp -m tcp --dport 0 -j ACCEPT",
 			"-p udp -m udp --dport 0 -j ACCEPT",
+			"-p tcp -m tcp --dport 0 -j ACCEPT",
 		},
 		"TRI-Net-pu1N7uS6--0": {
 			"-p UDP -m set --match-set TRI-v4-ext-6zlJIpu19gtV src -m state --state ESTABLISHED -j ACCEPT",
@@ -1719,6 +1801,8 @@ var (
 			"-p tcp -m set --match-set TRI-v4-Proxy-pu19gtV-dst dst,dst -m mark ! --mark 0x40 -m cgroup --cgroup 10 -j REDIRECT --to-ports 0",
 			"-d 0.0.0.0/0 -p udp --dport 53 -m mark ! --mark 0x40 -m cgroup --cgroup 10 -j CONNMARK --save-mark",
 			"-d 0.0.0.0/0 -p udp --dport 53 -m mark ! --mark 0x40 -m cgroup --cgroup 10 -j REDIRECT --to-ports 0",
+			"-d 0.0.0.0/0 -p tcp --dport 53 -m mark ! --mark 0x40 -m cgroup --cgroup 10 -j CONNMARK --save-mark",
+			"-d 0.0.0.0/0 -p tcp --dport 53 -m mark ! --mark 0x40 -m cgroup --cgroup 10 -j REDIRECT --to-ports 0",
 		},
 		"TRI-Redir-Net": {
 			"-m mark --mark 0x40 -j ACCEPT",
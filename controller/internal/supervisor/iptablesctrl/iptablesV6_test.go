@@ -234,6 +234,7 @@ var (
 			"-m mark --mark 0x40 -j ACCEPT",
 			"-p tcp -m tcp --sport 0 -j ACCEPT",
 			"-p udp -m udp --sport 0 -j ACCEPT",
+			"-p tcp -m tcp --sport 0 -j ACCEPT",
 			"-p tcp -m set --match-set TRI-v6-Proxy-pu19gtV-srv src -j ACCEPT",
 			"-p tcp -m set --match-set TRI-v6-Proxy-pu19gtV-dst dst,dst -m mark ! --mark 0x40 -j ACCEPT",
 		},
@@ -243,6 +244,7 @@ var (
 			"-p tcp -m set --match-set TRI-v6-Proxy-pu19gtV-srv src -m addrtype --src-type LOCAL -j ACCEPT",
 			"-p tcp -m tcp --dport 0 -j ACCEPT",
 			"-p udp -m udp --dport 0 -j ACCEPT",
+			"-p tcp -m tcp --dport 0 -j ACCEPT",
 		},
 		"TRI-Hst-App": {},
 		"TRI-Hst-Net": {},
@@ -253,6 +255,7 @@ var (
 
 		"TRI-Net-pu1N7uS6--0": {
 			"-p UDP -m set --match-set TRI-v6-ext-6zlJIpu19gtV src -m state --state ESTABLISHED -j ACCEPT",
+			"-p icmpv6 -m set --match-set TRI-v6-ext-w5frVpu19gtV src -m state --state ESTABLISHED -j ACCEPT",
 			"-p TCP -m set --match-set TRI-v6-ext-w5frVpu19gtV src -m state --state NEW -m set ! --match-set TRI-v6-TargetTCP src --match multiport --dports 80 -j DROP",
 			"-p UDP -m set --match-set TRI-v6-ext-IuSLspu19gtV src --match multiport --dports 443 -j ACCEPT",
 			"-p icmpv6 -j ACCEPT",
@@ -294,6 +297,8 @@ var (
 			"-p tcp -m set --match-set TRI-v6-Proxy-pu19gtV-dst dst,dst -m mark ! --mark 0x40 -m cgroup --cgroup 10 -j REDIRECT --to-ports 0",
 			"-d ::/0 -p udp --dport 53 -m mark ! --mark 0x40 -m cgroup --cgroup 10 -j CONNMARK --save-mark",
 			"-d ::/0 -p udp --dport 53 -m mark ! --mark 0x40 -m cgroup --cgroup 10 -j REDIRECT --to-ports 0",
+			"-d ::/0 -p tcp --dport 53 -m mark ! --mark 0x40 -m cgroup --cgroup 10 -j CONNMARK --save-mark",
+			"-d ::/0 -p tcp --dport 53 -m mark ! --mark 0x40 -m cgroup --cgroup 10 -j REDIRECT --to-ports 0",
 		},
 		"TRI-Redir-Net": {
 			"-m mark --mark 0x40 -j ACCEPT",
@@ -357,6 +362,7 @@ var (
 			"-m mark --mark 0x40 -j ACCEPT",
 			"-p tcp -m tcp --sport 0 -j ACCEPT",
 			"-p udp -m udp --sport 0 -j ACCEPT",
+			"-p tcp -m tcp --sport 0 -j ACCEPT",
 			"-p tcp -m set --match-set TRI-v6-Proxy-pu19gtV-srv src -j ACCEPT",
 			"-p tcp -m set --match-set TRI-v6-Proxy-pu19gtV-dst dst,dst -m mark ! --mark 0x40 -j ACCEPT",
 		},
@@ -366,6 +372,7 @@ var (
 			"-p tcp -m set --match-set TRI-v6-Proxy-pu19gtV-srv src -m addrtype --src-type LOCAL -j ACCEPT",
 			"-p tcp -m tcp --dport 0 -j ACCEPT",
 			"-p udp -m udp --dport 0 -j ACCEPT",
+			"-p tcp -m tcp --dport 0 -j ACCEPT",
 		},
 		"TRI-Hst-App": {},
 		"TRI-Hst-Net": {},
@@ -760,6 +767,7 @@ var (
 			"-m mark --mark 0x40 -j ACCEPT",
 			"-p tcp -m tcp --sport 0 -j ACCEPT",
 			"-p udp -m udp --sport 0 -j ACCEPT",
+			"-p tcp -m tcp --sport 0 -j ACCEPT",
 			"-p tcp -m set --match-set TRI-v6-Proxy-pu19gtV-srv src -j ACCEPT",
 			"-p tcp -m set --match-set TRI-v6-Proxy-pu19gtV-dst dst,dst -m mark ! --mark 0x40 -j ACCEPT",
 		},
@@ -769,6 +777,7 @@ var (
 			"-p tcp -m set --match-set TRI-v6-Proxy-pu19gtV-srv src -m addrtype --src-type LOCAL -j ACCEPT",
 			"-p tcp -m tcp --dport 0 -j ACCEPT",
 			"-p udp -m udp --dport 0 -j ACCEPT",
+			"-p tcp -m tcp --dport 0 -j ACCEPT",
 		},
 		"TRI-Net-pu1N7uS6--0": {
 			"-p UDP -m set --match-set TRI-v6-ext-6zlJIpu19gtV src -m state --state ESTABLISHED -j ACCEPT",
@@ -812,6 +821,8 @@ var (
 			"-p tcp -m set --match-set TRI-v6-Proxy-pu19gtV-dst dst,dst -m mark ! --mark 0x40 -m cgroup --cgroup 10 -j REDIRECT --to-ports 0",
 			"-d ::/0 -p udp --dport 53 -m mark ! --mark 0x40 -m cgroup --cgroup 10 -j CONNMARK --save-mark",
 			"-d ::/0 -p udp --dport 53 -m mark ! --mark 0x40 -m cgroup --cgroup 10 -j REDIRECT --to-ports 0",
+			"-d ::/0 -p tcp --dport 53 -m mark ! --mark 0x40 -m cgroup --cgroup 10 -j CONNMARK --save-mark",
+			"-d ::/0 -p tcp --dport 53 -m mark ! --mark 0x40 -m cgroup --cgroup 10 -j REDIRECT --to-ports 0",
 		},
 		"TRI-Redir-Net": {
 			"-m mark --mark 0x40 -j ACCEPT",
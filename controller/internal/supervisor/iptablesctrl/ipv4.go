@@ -3,10 +3,10 @@ package iptablesctrl
 import (
 	"fmt"
 	"net"
-	"strings"
 
 	"github.com/aporeto-inc/go-ipset/ipset"
 	provider "go.aporeto.io/trireme-lib/controller/pkg/aclprovider"
+	"go.aporeto.io/trireme-lib/policy"
 )
 
 const (
@@ -63,7 +63,7 @@ func (i *ipv4) NeedICMP() bool {
 
 func (i *ipv4) ProtocolAllowed(proto string) bool {
 
-	return !(strings.ToLower(proto) == "icmpv6")
+	return policy.BaseProtocol(proto) != policy.ICMPv6ProtoString
 }
 
 func (i *ipv4) Append(table, chain string, rulespec ...string) error {
@@ -2,10 +2,10 @@ package iptablesctrl
 
 import (
 	"net"
-	"strings"
 
 	"github.com/aporeto-inc/go-ipset/ipset"
 	provider "go.aporeto.io/trireme-lib/controller/pkg/aclprovider"
+	"go.aporeto.io/trireme-lib/policy"
 	"go.uber.org/zap"
 )
 
@@ -66,7 +66,7 @@ func (i *ipv6) NeedICMP() bool {
 }
 
 func (i *ipv6) ProtocolAllowed(proto string) bool {
-	return !(strings.ToLower(proto) == "icmp")
+	return policy.BaseProtocol(proto) != policy.ICMPProtoString
 }
 
 func (i *ipv6) Append(table, chain string, rulespec ...string) error {
@@ -128,6 +128,9 @@ var packetCaptureTemplate = `
 {{end}}
 {{if needDnsRules}}
 {{.MangleTable}} {{.AppChain}} -p udp -m udp --dport 53 -j ACCEPT
+{{if enableDNSProxy}}
+{{.MangleTable}} {{.AppChain}} -d {{.DNSServerIP}} -p tcp -m tcp --dport 53 -j ACCEPT
+{{end}}
 {{end}}
 {{.MangleTable}} {{.AppChain}} -p tcp -m tcp --tcp-flags SYN,ACK SYN -j NFQUEUE --queue-balance {{.QueueBalanceAppSyn}}
 {{.MangleTable}} {{.AppChain}} -p tcp -m tcp --tcp-flags SYN,ACK ACK -j NFQUEUE --queue-balance {{.QueueBalanceAppAck}}
@@ -146,6 +149,9 @@ var packetCaptureTemplate = `
 {{end}}
 {{if needDnsRules}}
 {{.MangleTable}} {{.NetChain}} -p udp -m udp --sport 53 -j ACCEPT
+{{if enableDNSProxy}}
+{{.MangleTable}} {{.NetChain}} -s {{.DNSServerIP}} -p tcp -m tcp --sport 53 -j ACCEPT
+{{end}}
 {{end}}
 {{.MangleTable}} {{.NetChain}} -p tcp -m set --match-set {{.TargetTCPNetSet}} src -m tcp --tcp-flags SYN,ACK SYN -j NFQUEUE --queue-balance {{.QueueBalanceNetSyn}}
 {{.MangleTable}} {{.NetChain}} -p tcp -m set --match-set {{.TargetTCPNetSet}} src -m tcp --tcp-flags SYN,ACK ACK -j NFQUEUE --queue-balance {{.QueueBalanceNetAck}}
@@ -163,6 +169,7 @@ var proxyChainTemplate = `
 {{.MangleTable}} {{.MangleProxyAppChain}} -p tcp -m tcp --sport {{.ProxyPort}} -j ACCEPT
 {{if enableDNSProxy}}
 {{.MangleTable}} {{.MangleProxyAppChain}} -p udp -m udp --sport {{.DNSProxyPort}} -j ACCEPT
+{{.MangleTable}} {{.MangleProxyAppChain}} -p tcp -m tcp --sport {{.DNSProxyPort}} -j ACCEPT
 {{end}}
 {{.MangleTable}} {{.MangleProxyAppChain}} -p tcp -m set --match-set {{.SrvIPSet}} src -j ACCEPT
 {{.MangleTable}} {{.MangleProxyAppChain}} -p tcp -m set --match-set {{.DestIPSet}} dst,dst -m mark ! --mark {{.ProxyMark}} -j ACCEPT
@@ -172,17 +179,21 @@ var proxyChainTemplate = `
 {{.MangleTable}} {{.MangleProxyNetChain}} -p tcp -m tcp --dport {{.ProxyPort}} -j ACCEPT
 {{if enableDNSProxy}}
 {{.MangleTable}} {{.MangleProxyNetChain}} -p udp -m udp --dport {{.DNSProxyPort}} -j ACCEPT
+{{.MangleTable}} {{.MangleProxyNetChain}} -p tcp -m tcp --dport {{.DNSProxyPort}} -j ACCEPT
 {{end}}
 {{if isCgroupSet}}
 {{.NatTable}} {{.NatProxyAppChain}} -p tcp -m set --match-set {{.DestIPSet}} dst,dst -m mark ! --mark {{.ProxyMark}} -m cgroup --cgroup {{.CgroupMark}} -j REDIRECT --to-ports {{.ProxyPort}}
 {{if enableDNSProxy}}
 {{.NatTable}} {{.NatProxyAppChain}} -d {{.DNSServerIP}} -p udp --dport 53 -m mark ! --mark {{.ProxyMark}} -m cgroup --cgroup {{.CgroupMark}} -j CONNMARK --save-mark
 {{.NatTable}} {{.NatProxyAppChain}} -d {{.DNSServerIP}} -p udp --dport 53 -m mark ! --mark {{.ProxyMark}} -m cgroup --cgroup {{.CgroupMark}} -j REDIRECT --to-ports {{.DNSProxyPort}}
+{{.NatTable}} {{.NatProxyAppChain}} -d {{.DNSServerIP}} -p tcp --dport 53 -m mark ! --mark {{.ProxyMark}} -m cgroup --cgroup {{.CgroupMark}} -j CONNMARK --save-mark
+{{.NatTable}} {{.NatProxyAppChain}} -d {{.DNSServerIP}} -p tcp --dport 53 -m mark ! --mark {{.ProxyMark}} -m cgroup --cgroup {{.CgroupMark}} -j REDIRECT --to-ports {{.DNSProxyPort}}
 {{end}}
 {{else}}
 {{.NatTable}} {{.NatProxyAppChain}} -p tcp -m set --match-set {{.DestIPSet}} dst,dst -m mark ! --mark {{.ProxyMark}} -j REDIRECT --to-ports {{.ProxyPort}}
 {{if enableDNSProxy}}
 {{.NatTable}} {{.NatProxyAppChain}} -d {{.DNSServerIP}} -p udp --dport 53 -m mark ! --mark {{.ProxyMark}} -j REDIRECT --to-ports {{.DNSProxyPort}}
+{{.NatTable}} {{.NatProxyAppChain}} -d {{.DNSServerIP}} -p tcp --dport 53 -m mark ! --mark {{.ProxyMark}} -j REDIRECT --to-ports {{.DNSProxyPort}}
 {{end}}
 {{end}}
 {{.NatTable}} {{.NatProxyNetChain}} -p tcp -m set --match-set {{.SrvIPSet}} dst -m mark ! --mark {{.ProxyMark}} -j REDIRECT --to-ports {{.ProxyPort}}`
@@ -243,6 +254,7 @@ var legacyProxyRules = `
 {{.MangleTable}} {{.MangleProxyAppChain}} -p tcp -m tcp --sport {{.ProxyPort}} -j ACCEPT
 {{if enableDNSProxy}}
 {{.MangleTable}} {{.MangleProxyAppChain}} -p udp -m udp --sport {{.DNSProxyPort}} -j ACCEPT
+{{.MangleTable}} {{.MangleProxyAppChain}} -p tcp -m tcp --sport {{.DNSProxyPort}} -j ACCEPT
 {{end}}
 {{.MangleTable}} {{.MangleProxyAppChain}} -p tcp -m set --match-set {{.SrvIPSet}} src -j ACCEPT
 {{.MangleTable}} {{.MangleProxyAppChain}} -p tcp -m set --match-set {{.DestIPSet}} dst,dst -m mark ! --mark {{.ProxyMark}} -j ACCEPT
@@ -252,6 +264,7 @@ var legacyProxyRules = `
 {{.MangleTable}} {{.MangleProxyNetChain}} -p tcp -m tcp --dport {{.ProxyPort}} -j ACCEPT
 {{if enableDNSProxy}}
 {{.MangleTable}} {{.MangleProxyNetChain}} -p udp -m udp --dport {{.DNSProxyPort}} -j ACCEPT
+{{.MangleTable}} {{.MangleProxyNetChain}} -p tcp -m tcp --dport {{.DNSProxyPort}} -j ACCEPT
 {{end}}
 
 {{if isCgroupSet}}
@@ -262,6 +275,7 @@ var legacyProxyRules = `
 
 {{if enableDNSProxy}}
 {{.NatTable}} {{.NatProxyAppChain}} -p udp --dport 53 -m mark ! --mark {{.ProxyMark}} -j REDIRECT --to-ports {{.DNSProxyPort}}
+{{.NatTable}} {{.NatProxyAppChain}} -p tcp --dport 53 -m mark ! --mark {{.ProxyMark}} -j REDIRECT --to-ports {{.DNSProxyPort}}
 {{end}}
 
 {{.NatTable}} {{.NatProxyNetChain}} -p tcp -m set --match-set {{.SrvIPSet}} dst -m mark ! --mark {{.ProxyMark}} -j REDIRECT --to-ports {{.ProxyPort}}`
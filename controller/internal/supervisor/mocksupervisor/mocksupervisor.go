@@ -182,6 +182,21 @@ func (mr *MockImplementorMockRecorder) UpdateRules(version, contextID, container
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateRules", reflect.TypeOf((*MockImplementor)(nil).UpdateRules), version, contextID, containerInfo, oldContainerInfo)
 }
 
+// UpdateACLs mocks base method
+// nolint
+func (m *MockImplementor) UpdateACLs(contextID string, containerInfo, oldContainerInfo *policy.PUInfo) (bool, error) {
+	ret := m.ctrl.Call(m, "UpdateACLs", contextID, containerInfo, oldContainerInfo)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UpdateACLs indicates an expected call of UpdateACLs
+// nolint
+func (mr *MockImplementorMockRecorder) UpdateACLs(contextID, containerInfo, oldContainerInfo interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateACLs", reflect.TypeOf((*MockImplementor)(nil).UpdateACLs), contextID, containerInfo, oldContainerInfo)
+}
+
 // DeleteRules mocks base method
 // nolint
 func (m *MockImplementor) DeleteRules(version int, context, tcpPorts, udpPorts, mark, uid, proxyPort string, dnsProxyPort string, puType common.PUType) error {
@@ -0,0 +1,470 @@
+package nftctrl
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"go.aporeto.io/trireme-lib/controller/constants"
+	"go.aporeto.io/trireme-lib/policy"
+	"go.uber.org/zap"
+)
+
+type rulesInfo struct {
+	RejectObserveApply    [][]string
+	RejectNotObserved     [][]string
+	RejectObserveContinue [][]string
+
+	AcceptObserveApply    [][]string
+	AcceptNotObserved     [][]string
+	AcceptObserveContinue [][]string
+
+	ReverseRules [][]string
+}
+
+// chainRules provides the rules that send the traffic of a PU to the PU
+// specific chains and the rules of the services of the PU.
+func (n *nftables) chainRules(cfg *ACLInfo) [][]string {
+
+	var tmpl *template.Template
+
+	switch {
+	case n.mode != constants.LocalServer:
+		tmpl = template.Must(template.New(containerChainTemplate).Parse(containerChainTemplate))
+
+	case cfg.UID != "":
+		tmpl = template.Must(template.New(uidChainTemplate).Parse(uidChainTemplate))
+
+	default:
+		tmpl = template.Must(template.New(cgroupCaptureTemplate).Funcs(template.FuncMap{
+			"isUDPPorts": func() bool {
+				return cfg.UDPPorts != "0"
+			},
+			"isTCPPorts": func() bool {
+				return cfg.TCPPorts != "0"
+			},
+			"isHostPU": func() bool {
+				return cfg.AppSection == hostModeOutput && cfg.NetSection == hostModeInput
+			},
+		}).Parse(cgroupCaptureTemplate))
+	}
+
+	rules, err := extractRulesFromTemplate(tmpl, cfg)
+	if err != nil {
+		zap.L().Warn("unable to extract rules", zap.Error(err))
+	}
+
+	return append(rules, n.proxyRules(cfg)...)
+}
+
+// proxyRules creates the rules that allow traffic to go through if it is handled
+// by the services.
+func (n *nftables) proxyRules(cfg *ACLInfo) [][]string {
+
+	// There are no services without a proxy port.
+	if cfg.ProxyPort == "" {
+		return nil
+	}
+
+	tmpl := template.Must(template.New(proxyChainTemplate).Funcs(template.FuncMap{
+		"isCgroupSet": func() bool {
+			return cfg.CgroupMark != ""
+		},
+		"enableDNSProxy": func() bool {
+			return cfg.DNSServerIP != "" && cfg.DNSProxyPort != ""
+		},
+	}).Parse(proxyChainTemplate))
+
+	rules, err := extractRulesFromTemplate(tmpl, cfg)
+	if err != nil {
+		zap.L().Warn("unable to extract rules", zap.Error(err))
+	}
+	return rules
+}
+
+// trapRules provides the packet capture rules that are defined for each processing unit.
+func (n *nftables) trapRules(cfg *ACLInfo, isHostPU bool) [][]string {
+
+	tmpl := template.Must(template.New(packetCaptureTemplate).Funcs(template.FuncMap{
+		"needDnsRules": func() bool {
+			return n.mode == constants.Sidecar || isHostPU
+		},
+		// Only the TCP flows redirected to the DNS proxy bypass the datapath.
+		"enableDNSProxy": func() bool {
+			return cfg.DNSServerIP != "" && cfg.DNSProxyPort != ""
+		},
+		"isUIDProcess": func() bool {
+			return cfg.UID != ""
+		},
+		"needICMP": func() bool {
+			return cfg.needICMPRules
+		},
+	}).Parse(packetCaptureTemplate))
+
+	rules, err := extractRulesFromTemplate(tmpl, cfg)
+	if err != nil {
+		zap.L().Warn("unable to extract rules", zap.Error(err))
+	}
+
+	return rules
+}
+
+// aclSetName returns the name of the set of the addresses of an external
+// service. The sets are shared by all the PUs that use the service.
+func aclSetName(serviceID string) string {
+	return aclSetPrefix + hashName(serviceID)
+}
+
+// addACLSetAddresses adds the addresses of the rules to the sets of the
+// external services. The nftables sets have no nomatch entries, so the
+// excluded addresses are removed from the networks of the rules instead.
+// The reject rules with invalid addresses are refused, since ignoring them
+// would accept their traffic. The exclusions that iptables refuses are
+// refused too.
+func (n *nftables) addACLSetAddresses(sets map[string]map[string]bool, rules policy.IPRuleList) error {
+
+	for _, rule := range rules {
+		name := aclSetName(rule.Policy.ServiceID)
+		if _, ok := sets[name]; !ok {
+			sets[name] = map[string]bool{}
+		}
+
+		if err := policy.ValidateExclusions(rule.Addresses); err != nil {
+			return fmt.Errorf("invalid addresses of acl %s: %s", rule.Policy.ServiceID, err)
+		}
+
+		addresses, err := policy.ExpandExclusions(rule.Addresses)
+		if err != nil {
+			if rule.Policy.Action.Rejected() {
+				return fmt.Errorf("invalid addresses of reject acl %s: %s", rule.Policy.ServiceID, err)
+			}
+			zap.L().Warn("ignoring invalid acl addresses", zap.String("serviceID", rule.Policy.ServiceID), zap.Error(err))
+			continue
+		}
+
+		for _, address := range addresses {
+			sets[name][address] = true
+		}
+	}
+
+	return nil
+}
+
+// protocolMatch returns the match of a protocol and the prefix of its
+// destination port match. Only TCP and UDP rules match ports.
+func protocolMatch(proto string) (string, string) {
+
+	if policy.IsICMPProtocol(proto) {
+		return icmpMatch(proto), ""
+	}
+
+	switch strings.ToLower(proto) {
+	case constants.TCPProtoNum, strings.ToLower(constants.TCPProtoString):
+		return "meta l4proto tcp", "tcp dport"
+	case constants.UDPProtoNum, strings.ToLower(constants.UDPProtoString):
+		return "meta l4proto udp", "udp dport"
+	case "all":
+		return "", ""
+	case "icmpv6":
+		return "meta l4proto ipv6-icmp", ""
+	default:
+		return "meta l4proto " + strings.ToLower(proto), ""
+	}
+}
+
+// icmpMatch returns the match of an ICMP protocol with its type and codes.
+func icmpMatch(proto string) string {
+
+	m, err := policy.ParseICMPMatch(proto)
+	if err != nil {
+		return ""
+	}
+
+	l4proto := "icmp"
+	if m.V6 {
+		l4proto = "ipv6-icmp"
+	}
+
+	match := "meta l4proto " + l4proto
+	if m.Type < 0 {
+		return match
+	}
+
+	match += " " + m.Protocol() + " type " + strconv.Itoa(m.Type)
+	if len(m.Codes) == 0 {
+		return match
+	}
+
+	codes := make([]string, len(m.Codes))
+	for i, r := range m.Codes {
+		codes[i] = strconv.Itoa(int(r.Min))
+		if r.Max != r.Min {
+			codes[i] += "-" + strconv.Itoa(int(r.Max))
+		}
+	}
+
+	return match + " " + m.Protocol() + " code { " + strings.Join(codes, ", ") + " }"
+}
+
+// protocolAllowed returns false for the protocols of the other family. It
+// returns an error for the invalid ICMP protocols.
+func (n *nftables) protocolAllowed(proto string) (bool, error) {
+
+	if policy.BaseProtocol(proto) == n.noProto {
+		return false, nil
+	}
+
+	if policy.IsICMPProtocol(proto) {
+		if _, err := policy.ParseICMPMatch(proto); err != nil {
+			return false, fmt.Errorf("invalid icmp protocol %s: %s", proto, err)
+		}
+	}
+
+	return true, nil
+}
+
+func (n *nftables) generateACLRules(cfg *ACLInfo, rule *policy.IPRule, chain string, reverseChain string, nfLogGroup, proto, ipMatchDirection string, reverseDirection string) ([][]string, [][]string, error) {
+	nftRules := [][]string{}
+	reverseRules := [][]string{}
+
+	observeContinue := rule.Policy.ObserveAction.ObserveContinue()
+	contextID := cfg.ContextID
+	setName := aclSetName(rule.Policy.ServiceID)
+	l4Match, portMatch := protocolMatch(proto)
+	isTCP := portMatch == "tcp dport"
+
+	baseRule := func() []string {
+		nftRule := []string{}
+		if l4Match != "" {
+			nftRule = append(nftRule, l4Match)
+		}
+		nftRule = append(nftRule, n.addr+" "+ipMatchDirection+" @"+setName)
+
+		// only tcp uses target networks
+		if isTCP {
+			nftRule = append(nftRule, "ct state new", n.addr+" "+ipMatchDirection+" != @"+targetTCPNetworkSet)
+		}
+
+		// port match is required only for tcp and udp protocols
+		if portMatch != "" && len(rule.Ports) > 0 {
+			nftRule = append(nftRule, portMatch+" { "+portList(strings.Join(rule.Ports, ","))+" }")
+		}
+
+		return nftRule
+	}
+
+	// The extensions are iptables matches. Ignoring them would widen the
+	// traffic of the rule.
+	if len(rule.Extensions) > 0 {
+		return nil, nil, fmt.Errorf("acl %s has extensions %v: extensions are not supported with nftables", rule.Policy.ServiceID, rule.Extensions)
+	}
+
+	if rule.Policy.Action&policy.Log > 0 || observeContinue {
+		nflog := baseRule()
+		if !isTCP {
+			nflog = append(nflog, "ct state new")
+		}
+		nflog = append(nflog, "log prefix \""+rule.Policy.LogPrefix(contextID)+"\" group "+nfLogGroup)
+		nftRules = append(nftRules, []string{chain, strings.Join(nflog, " ")})
+	}
+
+	if !observeContinue {
+		if (rule.Policy.Action & policy.Accept) != 0 {
+			if limit := rateLimitMeter(contextID, rule, proto, n.addr, ipMatchDirection); limit != "" {
+				rateLimitRule := baseRule()
+				if !isTCP {
+					rateLimitRule = append(rateLimitRule, "ct state new")
+				}
+				rateLimitRule = append(rateLimitRule, limit, "drop")
+				nftRules = append(nftRules, []string{chain, strings.Join(rateLimitRule, " ")})
+			}
+
+			acceptRule := append(baseRule(), "accept")
+			nftRules = append(nftRules, []string{chain, strings.Join(acceptRule, " ")})
+		}
+
+		if rule.Policy.Action&policy.Reject != 0 {
+			rejectRule := append(baseRule(), "drop")
+			nftRules = append(nftRules, []string{chain, strings.Join(rejectRule, " ")})
+		}
+
+		if rule.Policy.Action&policy.Accept != 0 && portMatch == "udp dport" {
+			reverseRules = append(reverseRules, []string{
+				reverseChain,
+				"meta l4proto udp " + n.addr + " " + reverseDirection + " @" + setName + " ct state established accept",
+			})
+		}
+
+		// The replies of the accepted ICMP requests are established like
+		// the replies of the UDP flows. They do not have the type of the
+		// request, so they are matched on the protocol only.
+		if rule.Policy.Action&policy.Accept != 0 && policy.IsICMPProtocol(proto) {
+			l4proto := "icmp"
+			if policy.BaseProtocol(proto) == policy.ICMPv6ProtoString {
+				l4proto = "ipv6-icmp"
+			}
+
+			reverseRules = append(reverseRules, []string{
+				reverseChain,
+				"meta l4proto " + l4proto + " " + n.addr + " " + reverseDirection + " @" + setName + " ct state established accept",
+			})
+		}
+	}
+
+	return nftRules, reverseRules, nil
+}
+
+// rateLimitMeter returns the meter of the new connections that exceed the
+// rate limit of the rule, grouped by remote address. It returns an empty
+// string if the connections of the rule are not rate limited.
+func rateLimitMeter(contextID string, rule *policy.IPRule, proto, addr, ipMatchDirection string) string {
+
+	limit := rule.Policy.RateLimit
+	if !rule.Policy.Action.RateLimited() || limit == nil || limit.ConnectionsPerSecond <= 0 {
+		return ""
+	}
+
+	name, err := policy.Fnv32Hash(contextID, rule.Policy.ServiceID, proto, ipMatchDirection, strings.Join(rule.Ports, ","))
+	if err != nil {
+		return ""
+	}
+
+	return "meter RL" + name + " { " + addr + " " + ipMatchDirection + " limit rate over " + limitRate(limit.ConnectionsPerSecond) +
+		" burst " + strconv.Itoa(limit.BurstFor(limit.ConnectionsPerSecond)) + " packets }"
+}
+
+// limitRate converts a rate per second to the largest unit of the limit
+// statement with an integer rate.
+func limitRate(rate float64) string {
+
+	switch {
+	case rate >= 1:
+		return strconv.Itoa(int(math.Round(rate))) + "/second"
+	case rate*60 >= 1:
+		return strconv.Itoa(int(math.Round(rate*60))) + "/minute"
+	default:
+		return strconv.Itoa(int(math.Max(1, math.Round(rate*3600)))) + "/hour"
+	}
+}
+
+// sortACLsInBuckets will process all the rules and add them in a list of buckets
+// based on their priority. We need an explicit order of these buckets
+// in order to support observation only of ACL actions. The parameters
+// must provide the chain and whether it is App or Net ACLs so that the rules
+// can be created accordingly.
+func (n *nftables) sortACLsInBuckets(cfg *ACLInfo, chain string, reverseChain string, rules policy.IPRuleList, isAppACLs bool) (*rulesInfo, error) {
+
+	rulesBucket := &rulesInfo{
+		RejectObserveApply:    [][]string{},
+		RejectNotObserved:     [][]string{},
+		RejectObserveContinue: [][]string{},
+		AcceptObserveApply:    [][]string{},
+		AcceptNotObserved:     [][]string{},
+		AcceptObserveContinue: [][]string{},
+		ReverseRules:          [][]string{},
+	}
+
+	direction := "saddr"
+	reverse := "daddr"
+	nflogGroup := "11"
+	if isAppACLs {
+		direction = "daddr"
+		reverse = "saddr"
+		nflogGroup = "10"
+	}
+
+	for i := range rules {
+		rule := &rules[i]
+
+		for _, proto := range rule.Protocols {
+
+			allowed, err := n.protocolAllowed(proto)
+			if err != nil {
+				return nil, err
+			}
+
+			if !allowed {
+				continue
+			}
+
+			acls, r, err := n.generateACLRules(cfg, rule, chain, reverseChain, nflogGroup, proto, direction, reverse)
+			if err != nil {
+				return nil, err
+			}
+			rulesBucket.ReverseRules = append(rulesBucket.ReverseRules, r...)
+
+			if testReject(rule.Policy) && testObserveApply(rule.Policy) {
+				rulesBucket.RejectObserveApply = append(rulesBucket.RejectObserveApply, acls...)
+			}
+
+			if testReject(rule.Policy) && testNotObserved(rule.Policy) {
+				rulesBucket.RejectNotObserved = append(rulesBucket.RejectNotObserved, acls...)
+			}
+
+			if testReject(rule.Policy) && testObserveContinue(rule.Policy) {
+				rulesBucket.RejectObserveContinue = append(rulesBucket.RejectObserveContinue, acls...)
+			}
+
+			if testAccept(rule.Policy) && testObserveContinue(rule.Policy) {
+				rulesBucket.AcceptObserveContinue = append(rulesBucket.AcceptObserveContinue, acls...)
+			}
+
+			if testAccept(rule.Policy) && testNotObserved(rule.Policy) {
+				rulesBucket.AcceptNotObserved = append(rulesBucket.AcceptNotObserved, acls...)
+			}
+
+			if testAccept(rule.Policy) && testObserveApply(rule.Policy) {
+				rulesBucket.AcceptObserveApply = append(rulesBucket.AcceptObserveApply, acls...)
+			}
+		}
+	}
+
+	return rulesBucket, nil
+}
+
+// aclRules returns the rules of the external services of a PU in the order
+// of their priority.
+func (n *nftables) aclRules(cfg *ACLInfo, chain string, reverseChain string, rules policy.IPRuleList, isAppACLs bool) ([][]string, error) {
+
+	b, err := n.sortACLsInBuckets(cfg, chain, reverseChain, rules, isAppACLs)
+	if err != nil {
+		return nil, err
+	}
+
+	aclRules := [][]string{}
+	for _, bucket := range [][][]string{
+		b.RejectObserveContinue,
+		b.RejectNotObserved,
+		b.RejectObserveApply,
+		b.AcceptObserveContinue,
+		b.AcceptNotObserved,
+		b.AcceptObserveApply,
+		b.ReverseRules,
+	} {
+		aclRules = append(aclRules, bucket...)
+	}
+
+	return aclRules, nil
+}
+
+func testObserveContinue(p *policy.FlowPolicy) bool {
+	return p.ObserveAction.ObserveContinue()
+}
+
+func testNotObserved(p *policy.FlowPolicy) bool {
+	return !p.ObserveAction.Observed()
+}
+
+func testObserveApply(p *policy.FlowPolicy) bool {
+	return p.ObserveAction.ObserveApply()
+}
+
+func testReject(p *policy.FlowPolicy) bool {
+	return (p.Action&policy.Reject != 0)
+}
+
+func testAccept(p *policy.FlowPolicy) bool {
+	return (p.Action&policy.Accept != 0)
+}
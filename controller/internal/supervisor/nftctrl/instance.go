@@ -0,0 +1,241 @@
+// Package nftctrl implements the supervisor with nftables. All the rules of a
+// family live in a dedicated trireme table, which is replaced in a single
+// nft batch every time the rules change. When only the addresses of the ACLs
+// change, the elements of their sets are replaced instead.
+package nftctrl
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"go.aporeto.io/trireme-lib/common"
+	"go.aporeto.io/trireme-lib/controller/constants"
+	provider "go.aporeto.io/trireme-lib/controller/pkg/aclprovider"
+	"go.aporeto.io/trireme-lib/controller/pkg/fqconfig"
+	"go.aporeto.io/trireme-lib/controller/runtime"
+	"go.aporeto.io/trireme-lib/policy"
+	"go.uber.org/zap"
+)
+
+const (
+	// IPv4DefaultIP is the default ip address of ipv4 subnets
+	IPv4DefaultIP = "0.0.0.0/0"
+	// IPv6DefaultIP is the default IP subnet of ipv6
+	IPv6DefaultIP = "::/0"
+
+	// ipv6Disabled disables the ipv6 table, like the iptables implementation.
+	ipv6Disabled = true
+)
+
+// Instance is the structure holding the ipv4 and ipv6 handles
+type Instance struct {
+	nftv4 *nftables
+	nftv6 *nftables
+}
+
+var instance *Instance
+var lock sync.RWMutex
+
+// GetInstance returns the instance of the nftables object.
+func GetInstance() *Instance {
+	lock.Lock()
+	defer lock.Unlock()
+	return instance
+}
+
+// SetTargetNetworks updates ths target networks. There are three different
+// types of target networks:
+//   - TCPTargetNetworks for TCP traffic (by default 0.0.0.0/0)
+//   - UDPTargetNetworks for UDP traffic (by default empty)
+//   - ExcludedNetworks that are always ignored (by default empty)
+func (i *Instance) SetTargetNetworks(c *runtime.Configuration) error {
+
+	if err := i.nftv4.SetTargetNetworks(c); err != nil {
+		return err
+	}
+
+	if err := i.nftv6.SetTargetNetworks(c); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Run starts the nftables controller
+func (i *Instance) Run(ctx context.Context) error {
+
+	if err := i.nftv4.Run(ctx); err != nil {
+		return err
+	}
+
+	if err := i.nftv6.Run(ctx); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ConfigureRules implments the ConfigureRules interface. It will create the
+// chains and the sets of the PU and it will install them with the rest of
+// the table.
+func (i *Instance) ConfigureRules(version int, contextID string, pu *policy.PUInfo) error {
+
+	if err := i.nftv4.ConfigureRules(version, contextID, pu); err != nil {
+		return err
+	}
+
+	if err := i.nftv6.ConfigureRules(version, contextID, pu); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteRules implements the DeleteRules interface. This is responsible
+// for cleaning all the chains and the sets of a processing unit. The
+// sets of external services are removed when no PU uses them.
+func (i *Instance) DeleteRules(version int, contextID string, tcpPorts, udpPorts string, mark string, username string, proxyPort string, dnsProxyPort string, puType common.PUType) error {
+
+	if err := i.nftv4.DeleteRules(version, contextID, tcpPorts, udpPorts, mark, username, proxyPort, dnsProxyPort, puType); err != nil {
+		zap.L().Warn("Delete rules for nftables v4 returned error", zap.Error(err))
+	}
+
+	if err := i.nftv6.DeleteRules(version, contextID, tcpPorts, udpPorts, mark, username, proxyPort, dnsProxyPort, puType); err != nil {
+		zap.L().Warn("Delete rules for nftables v6 returned error", zap.Error(err))
+	}
+
+	return nil
+}
+
+// UpdateRules implements the update part of the interface. The new rules
+// replace the old rules atomically, since the whole table is replaced in
+// a single transaction.
+func (i *Instance) UpdateRules(version int, contextID string, containerInfo *policy.PUInfo, oldContainerInfo *policy.PUInfo) error {
+
+	if err := i.nftv4.UpdateRules(version, contextID, containerInfo, oldContainerInfo); err != nil {
+		return err
+	}
+
+	if err := i.nftv6.UpdateRules(version, contextID, containerInfo, oldContainerInfo); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UpdateACLs implements the supervisor interface. If only the addresses of
+// the ACLs changed, it updates the sets of the ACLs without replacing the
+// table and returns true.
+func (i *Instance) UpdateACLs(contextID string, containerInfo *policy.PUInfo, oldContainerInfo *policy.PUInfo) (bool, error) {
+
+	updated, err := i.nftv4.UpdateACLs(contextID, containerInfo, oldContainerInfo)
+	if err != nil || !updated {
+		return false, err
+	}
+
+	return i.nftv6.UpdateACLs(contextID, containerInfo, oldContainerInfo)
+}
+
+// CleanUp requires the implementor to clean up all the rules and the sets.
+func (i *Instance) CleanUp() error {
+
+	if err := i.nftv4.CleanUp(); err != nil {
+		zap.L().Error("Failed to cleanup ipv4 rules")
+	}
+
+	if err := i.nftv6.CleanUp(); err != nil {
+		zap.L().Error("Failed to cleanup ipv6 rules")
+	}
+
+	return nil
+}
+
+// AddPortToPortSet adds ports to the portsets
+func (i *Instance) AddPortToPortSet(contextID string, port string) error {
+
+	if err := i.nftv4.AddPortToPortSet(contextID, port); err != nil {
+		zap.L().Warn("Failed to add port to ipv4 portset", zap.String("contextID", contextID), zap.String("port", port), zap.Error(err))
+	}
+
+	if err := i.nftv6.AddPortToPortSet(contextID, port); err != nil {
+		zap.L().Warn("Failed to add port to ipv6 portset", zap.String("contextID", contextID), zap.String("port", port), zap.Error(err))
+	}
+
+	return nil
+}
+
+// DeletePortFromPortSet deletes ports from port sets
+func (i *Instance) DeletePortFromPortSet(contextID string, port string) error {
+
+	if err := i.nftv4.DeletePortFromPortSet(contextID, port); err != nil {
+		zap.L().Warn("Failed to delete port from ipv4 portset ", zap.String("contextID", contextID), zap.String("port", port), zap.Error(err))
+	}
+
+	if err := i.nftv6.DeletePortFromPortSet(contextID, port); err != nil {
+		zap.L().Warn("Failed to delete port from ipv6 portset ", zap.String("port", port), zap.Error(err))
+	}
+
+	return nil
+}
+
+// ACLProvider returns the current ACL provider that can be re-used by other
+// entities. There are no iptables providers with nftables, so the supervisor
+// reports the features that need them as not supported.
+func (i *Instance) ACLProvider() []provider.IptablesProvider {
+	return []provider.IptablesProvider{}
+}
+
+// NewInstance creates a new nftables controller instance
+func NewInstance(fqc *fqconfig.FilterQueue, mode constants.ModeType) (*Instance, error) {
+
+	nft, err := provider.NewNftablesProvider()
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize nftables provider: %s", err)
+	}
+
+	return newInstanceWithProvider(nft, fqc, mode)
+}
+
+// newInstanceWithProvider is called after the provider has been created. This
+// helps with all the unit testing to be able to mock the provider.
+func newInstanceWithProvider(nft provider.NftablesProvider, fqc *fqconfig.FilterQueue, mode constants.ModeType) (*Instance, error) {
+
+	i := &Instance{
+		nftv4: &nftables{
+			family:   "ip",
+			addr:     "ip",
+			addrType: "ipv4_addr",
+			ipFilter: func(ip net.IP) bool {
+				return ip.To4() != nil
+			},
+			noProto: "icmpv6",
+			nft:     nft,
+			fqc:     fqc,
+			mode:    mode,
+			pus:     map[string]*puRules{},
+		},
+		nftv6: &nftables{
+			family:   "ip6",
+			addr:     "ip6",
+			addrType: "ipv6_addr",
+			ipFilter: func(ip net.IP) bool {
+				return ip != nil && ip.To4() == nil
+			},
+			needICMP: true,
+			noProto:  "icmp",
+			disabled: ipv6Disabled,
+			nft:      nft,
+			fqc:      fqc,
+			mode:     mode,
+			pus:      map[string]*puRules{},
+		},
+	}
+
+	lock.Lock()
+	instance = i
+	defer lock.Unlock()
+
+	return i, nil
+}
@@ -0,0 +1,789 @@
+package nftctrl
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+
+	"go.aporeto.io/trireme-lib/common"
+	"go.aporeto.io/trireme-lib/controller/constants"
+	provider "go.aporeto.io/trireme-lib/controller/pkg/aclprovider"
+	"go.aporeto.io/trireme-lib/controller/pkg/fqconfig"
+	"go.aporeto.io/trireme-lib/controller/runtime"
+	"go.aporeto.io/trireme-lib/monitor/extractors"
+	"go.aporeto.io/trireme-lib/policy"
+	"go.uber.org/zap"
+)
+
+const (
+	tableName = "trireme"
+
+	inputChain         = "input"
+	outputChain        = "output"
+	natPreRoutingChain = "nat-prerouting"
+	natOutputChain     = "nat-output"
+
+	mainAppChain        = "App"
+	mainNetChain        = "Net"
+	uidchain            = "UID-App"
+	uidInput            = "UID-Net"
+	appChainPrefix      = "App-"
+	netChainPrefix      = "Net-"
+	natProxyOutputChain = "Redir-App"
+	natProxyInputChain  = "Redir-Net"
+	proxyOutputChain    = "Prx-App"
+	proxyInputChain     = "Prx-Net"
+	triremeInput        = "Pid-Net"
+	triremeOutput       = "Pid-App"
+	networkSvcInput     = "Svc-Net"
+	networkSvcOutput    = "Svc-App"
+	hostModeInput       = "Hst-Net"
+	hostModeOutput      = "Hst-App"
+
+	targetTCPNetworkSet  = "TargetTCP"
+	targetUDPNetworkSet  = "TargetUDP"
+	excludedNetworkSet   = "Excluded"
+	uidPortSetPrefix     = "UID-Port-"
+	processPortSetPrefix = "ProcPort-"
+	proxyPortSetPrefix   = "Proxy-"
+	aclSetPrefix         = "ext-"
+
+	proxyMark = "0x40"
+)
+
+// nftSet is a named set of the table.
+type nftSet struct {
+	Name      string
+	Type      string
+	Flags     string
+	AutoMerge bool
+	Elements  []string
+}
+
+// nftChain is a chain of the table. Base chains have a hook.
+type nftChain struct {
+	Name  string
+	Hook  string
+	Rules []string
+}
+
+// nftTable is the complete table of a family.
+type nftTable struct {
+	Family string
+	Table  string
+	Sets   []*nftSet
+	Chains []*nftChain
+}
+
+// puRules holds the state of a PU that is needed to create its rules.
+type puRules struct {
+	cfg      *ACLInfo
+	pu       *policy.PUInfo
+	isHostPU bool
+	ports    map[string]bool
+}
+
+// nftables maintains the trireme table of a family. The table is kept in
+// memory and every change replaces the whole table in a single transaction,
+// so that the datapath never sees a partially programmed policy.
+type nftables struct {
+	family   string
+	addr     string
+	addrType string
+	ipFilter func(net.IP) bool
+	needICMP bool
+	noProto  string
+	disabled bool
+
+	nft     provider.NftablesProvider
+	fqc     *fqconfig.FilterQueue
+	mode    constants.ModeType
+	cfg     *runtime.Configuration
+	running bool
+
+	pus     map[string]*puRules
+	puOrder []string
+
+	sync.Mutex
+}
+
+func filterNetworks(c *runtime.Configuration, filter func(net.IP) bool) *runtime.Configuration {
+	filterIPs := func(ips []string) []string {
+		var filteredIPs []string
+
+		for _, ip := range ips {
+			netIP := net.ParseIP(ip)
+			if netIP == nil {
+				netIP, _, _ = net.ParseCIDR(ip)
+			}
+
+			if filter(netIP) {
+				filteredIPs = append(filteredIPs, ip)
+			}
+		}
+
+		return filteredIPs
+	}
+
+	return &runtime.Configuration{
+		TCPTargetNetworks: filterIPs(c.TCPTargetNetworks),
+		UDPTargetNetworks: filterIPs(c.UDPTargetNetworks),
+		ExcludedNetworks:  filterIPs(c.ExcludedNetworks),
+	}
+}
+
+func (n *nftables) SetTargetNetworks(c *runtime.Configuration) error {
+	if c == nil {
+		return nil
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	// If there are no target networks, capture all traffic
+	if len(c.TCPTargetNetworks) == 0 {
+		c.TCPTargetNetworks = []string{IPv4DefaultIP, IPv6DefaultIP}
+	}
+
+	old := n.cfg
+	n.cfg = filterNetworks(c, n.ipFilter)
+
+	if err := n.commit(); err != nil {
+		n.cfg = old
+		return fmt.Errorf("unable to update target networks: %s", err)
+	}
+
+	return nil
+}
+
+func (n *nftables) Run(ctx context.Context) error {
+
+	go func() {
+		<-ctx.Done()
+		zap.L().Debug("Cleaning the nftables rules")
+
+		n.CleanUp() // nolint
+	}()
+
+	n.Lock()
+	defer n.Unlock()
+
+	// Installing the table replaces any table left over by a previous
+	// instance, in case we crashed at some earlier point.
+	n.running = true
+	if err := n.commit(); err != nil {
+		n.running = false
+		return fmt.Errorf("unable to install the trireme table: %s", err)
+	}
+
+	return nil
+}
+
+func (n *nftables) ConfigureRules(version int, contextID string, pu *policy.PUInfo) error {
+
+	if pu == nil || pu.Policy == nil || pu.Runtime == nil {
+		return errors.New("policy rules cannot be nil")
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	cfg := n.newACLInfo(contextID, pu, pu.Runtime.PUType())
+
+	// These checks are for rather unusal error scenarios. We should
+	// never see errors here. But better safe than sorry.
+	if n.mode == constants.LocalServer && cfg.Mark == "" {
+		return errors.New("no mark value found")
+	}
+
+	if _, ok := n.pus[contextID]; !ok {
+		n.puOrder = append(n.puOrder, contextID)
+	}
+
+	n.pus[contextID] = &puRules{
+		cfg:      cfg,
+		pu:       pu,
+		isHostPU: extractors.IsHostPU(pu.Runtime, n.mode),
+		ports:    map[string]bool{},
+	}
+
+	if err := n.commit(); err != nil {
+		n.removePU(contextID)
+		zap.L().Error("unable to configure rules", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+func (n *nftables) UpdateRules(version int, contextID string, containerInfo *policy.PUInfo, oldContainerInfo *policy.PUInfo) error {
+
+	if containerInfo == nil || containerInfo.Policy == nil || containerInfo.Runtime == nil {
+		return errors.New("policy rules cannot be nil")
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	old, ok := n.pus[contextID]
+	if !ok {
+		return fmt.Errorf("unable to find rules of pu %s", contextID)
+	}
+
+	// The ports that were discovered for the PU remain in the port set.
+	n.pus[contextID] = &puRules{
+		cfg:      n.newACLInfo(contextID, containerInfo, containerInfo.Runtime.PUType()),
+		pu:       containerInfo,
+		isHostPU: extractors.IsHostPU(containerInfo.Runtime, n.mode),
+		ports:    old.ports,
+	}
+
+	if err := n.commit(); err != nil {
+		n.pus[contextID] = old
+		zap.L().Error("unable to update rules", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// UpdateACLs replaces the elements of the sets of the external services if
+// only the addresses of the ACLs of the PU changed, without replacing the
+// table. It returns false if the rules of the PU must be updated instead.
+func (n *nftables) UpdateACLs(contextID string, containerInfo *policy.PUInfo, oldContainerInfo *policy.PUInfo) (bool, error) {
+
+	if containerInfo == nil || containerInfo.Policy == nil || containerInfo.Runtime == nil {
+		return false, errors.New("policy rules cannot be nil")
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	old, ok := n.pus[contextID]
+	if !ok || !n.canUpdateACLs(contextID, old, containerInfo) {
+		return false, nil
+	}
+
+	oldSets, err := n.aclSets()
+	if err != nil {
+		return false, err
+	}
+
+	n.pus[contextID] = &puRules{
+		cfg:      old.cfg,
+		pu:       containerInfo,
+		isHostPU: old.isHostPU,
+		ports:    old.ports,
+	}
+
+	newSets, err := n.aclSets()
+	if err != nil {
+		n.pus[contextID] = old
+		return false, err
+	}
+
+	changes := &nftTable{Family: n.family, Table: tableName}
+	for _, name := range setNames(newSets) {
+		if !reflect.DeepEqual(newSets[name], oldSets[name]) {
+			changes.Sets = append(changes.Sets, n.aclSet(name, newSets[name]))
+		}
+	}
+
+	if len(changes.Sets) == 0 || n.disabled || !n.running {
+		return true, nil
+	}
+
+	ruleset, err := render(setElementsTemplate, changes)
+	if err != nil {
+		n.pus[contextID] = old
+		return false, err
+	}
+
+	if err := n.nft.Apply(ruleset); err != nil {
+		n.pus[contextID] = old
+		return false, fmt.Errorf("unable to update acl sets: %s", err)
+	}
+
+	return true, nil
+}
+
+// canUpdateACLs returns true if the rules of the PU are the same with the new
+// policy, so that only the elements of the sets of its ACLs change.
+func (n *nftables) canUpdateACLs(contextID string, old *puRules, containerInfo *policy.PUInfo) bool {
+
+	if !reflect.DeepEqual(old.cfg, n.newACLInfo(contextID, containerInfo, containerInfo.Runtime.PUType())) {
+		return false
+	}
+
+	if old.isHostPU != extractors.IsHostPU(containerInfo.Runtime, n.mode) {
+		return false
+	}
+
+	oldPolicy := old.pu.Policy
+	newPolicy := containerInfo.Policy
+
+	return equalACLShapes(newPolicy.ApplicationACLs(), oldPolicy.ApplicationACLs()) && equalACLShapes(newPolicy.NetworkACLs(), oldPolicy.NetworkACLs())
+}
+
+// equalACLShapes returns true if the rules only differ by their addresses.
+func equalACLShapes(a, b policy.IPRuleList) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+
+	shape := func(r policy.IPRule) string {
+		return fmt.Sprintf("%q|%q|%q|%s", r.Ports, r.Protocols, r.Extensions, r.Policy.Key())
+	}
+
+	for i := range a {
+		if shape(a[i]) != shape(b[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (n *nftables) DeleteRules(version int, contextID string, tcpPorts, udpPorts string, mark string, username string, proxyPort string, dnsProxyPort string, puType common.PUType) error {
+
+	n.Lock()
+	defer n.Unlock()
+
+	if _, ok := n.pus[contextID]; !ok {
+		return fmt.Errorf("unable to find rules of pu %s", contextID)
+	}
+
+	n.removePU(contextID)
+
+	return n.commit()
+}
+
+func (n *nftables) CleanUp() error {
+
+	n.Lock()
+	defer n.Unlock()
+
+	n.running = false
+
+	if n.disabled || n.nft == nil {
+		return nil
+	}
+
+	tmpl := template.Must(template.New(deleteTableTemplate).Parse(deleteTableTemplate))
+
+	buffer := bytes.NewBuffer([]byte{})
+	if err := tmpl.Execute(buffer, &nftTable{Family: n.family, Table: tableName}); err != nil {
+		return fmt.Errorf("unable to execute template:%s", err)
+	}
+
+	if err := n.nft.Apply(buffer.String()); err != nil {
+		zap.L().Error("Failed to delete the trireme table", zap.String("family", n.family), zap.Error(err))
+	}
+
+	return nil
+}
+
+// AddPortToPortSet adds a port to the port set of a Linux PU.
+func (n *nftables) AddPortToPortSet(contextID string, port string) error {
+
+	n.Lock()
+	defer n.Unlock()
+
+	pu, ok := n.pus[contextID]
+	if !ok || pu.cfg.PortSet == "" {
+		return fmt.Errorf("unable to get portset for contextID %s", contextID)
+	}
+
+	if pu.ports[port] {
+		return nil
+	}
+
+	pu.ports[port] = true
+	if err := n.commit(); err != nil {
+		delete(pu.ports, port)
+		return fmt.Errorf("unable to add port to portset: %s", err)
+	}
+
+	return nil
+}
+
+// DeletePortFromPortSet deletes a port from the port set of a Linux PU.
+func (n *nftables) DeletePortFromPortSet(contextID string, port string) error {
+
+	n.Lock()
+	defer n.Unlock()
+
+	pu, ok := n.pus[contextID]
+	if !ok || pu.cfg.PortSet == "" {
+		return fmt.Errorf("unable to get portset for contextID %s", contextID)
+	}
+
+	if !pu.ports[port] {
+		return nil
+	}
+
+	delete(pu.ports, port)
+	if err := n.commit(); err != nil {
+		pu.ports[port] = true
+		return fmt.Errorf("unable to delete port from portset: %s", err)
+	}
+
+	return nil
+}
+
+// removePU removes the state of a PU.
+func (n *nftables) removePU(contextID string) {
+
+	delete(n.pus, contextID)
+
+	for i, id := range n.puOrder {
+		if id == contextID {
+			n.puOrder = append(n.puOrder[:i], n.puOrder[i+1:]...)
+			break
+		}
+	}
+}
+
+// commit replaces the table with the current state. It must be called with
+// the lock held.
+func (n *nftables) commit() error {
+
+	if n.disabled || !n.running {
+		return nil
+	}
+
+	ruleset, err := n.ruleset()
+	if err != nil {
+		return err
+	}
+
+	return n.nft.Apply(ruleset)
+}
+
+// ruleset renders the complete table of the family.
+func (n *nftables) ruleset() (string, error) {
+
+	table, err := n.table()
+	if err != nil {
+		return "", err
+	}
+
+	return render(tableTemplate, table)
+}
+
+// render executes a template of the table.
+func render(text string, table *nftTable) (string, error) {
+
+	tmpl := template.Must(template.New(text).Funcs(template.FuncMap{
+		"join": func(elements []string) string {
+			return strings.Join(elements, ", ")
+		},
+	}).Parse(text))
+
+	buffer := bytes.NewBuffer([]byte{})
+	if err := tmpl.Execute(buffer, table); err != nil {
+		return "", fmt.Errorf("unable to execute template:%s", err)
+	}
+
+	return buffer.String(), nil
+}
+
+// table builds the sets and the chains of the table.
+func (n *nftables) table() (*nftTable, error) {
+
+	cfg := n.cfg
+	if cfg == nil {
+		cfg = &runtime.Configuration{}
+	}
+
+	table := &nftTable{
+		Family: n.family,
+		Table:  tableName,
+		Sets: []*nftSet{
+			n.networkSet(targetTCPNetworkSet, cfg.TCPTargetNetworks),
+			n.networkSet(targetUDPNetworkSet, cfg.UDPTargetNetworks),
+			n.networkSet(excludedNetworkSet, cfg.ExcludedNetworks),
+		},
+	}
+
+	// Chains are declared before the chains that jump to them.
+	chainNames := []string{}
+	for _, contextID := range n.puOrder {
+		pu := n.pus[contextID]
+		chainNames = append(chainNames, pu.cfg.AppChain, pu.cfg.NetChain)
+	}
+
+	if n.mode == constants.LocalServer {
+		chainNames = append(chainNames,
+			triremeInput, triremeOutput,
+			networkSvcInput, networkSvcOutput,
+			hostModeInput, hostModeOutput,
+			uidInput, uidchain,
+		)
+	}
+
+	chainNames = append(chainNames,
+		proxyOutputChain, proxyInputChain,
+		mainAppChain, mainNetChain,
+		natProxyOutputChain, natProxyInputChain,
+		inputChain, outputChain,
+		natPreRoutingChain, natOutputChain,
+	)
+
+	chains := map[string]*nftChain{}
+	for _, name := range chainNames {
+		chains[name] = &nftChain{Name: name}
+		table.Chains = append(table.Chains, chains[name])
+	}
+
+	addRules := func(rules [][]string) error {
+		for _, rule := range rules {
+			chain, ok := chains[rule[0]]
+			if !ok {
+				return fmt.Errorf("unknown chain %s", rule[0])
+			}
+			chain.Rules = append(chain.Rules, rule[1])
+		}
+		return nil
+	}
+
+	globalCfg := n.newACLInfo("", nil, 0)
+
+	hookRules, err := n.hookRules(globalCfg)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range hookRules {
+		chains[rule[0]].Hook = rule[1]
+	}
+
+	if err := addRules(n.globalRules(globalCfg)); err != nil {
+		return nil, fmt.Errorf("unable to install global rules: %s", err)
+	}
+
+	aclSets, err := n.aclSets()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, contextID := range n.puOrder {
+		pu := n.pus[contextID]
+
+		table.Sets = append(table.Sets, n.puSets(pu)...)
+
+		if err := addRules(n.chainRules(pu.cfg)); err != nil {
+			return nil, fmt.Errorf("unable to install rules of pu %s: %s", contextID, err)
+		}
+
+		appRules, err := n.aclRules(pu.cfg, pu.cfg.AppChain, pu.cfg.NetChain, pu.pu.Policy.ApplicationACLs(), true)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create application acls of pu %s: %s", contextID, err)
+		}
+
+		if err := addRules(appRules); err != nil {
+			return nil, fmt.Errorf("unable to install application acls of pu %s: %s", contextID, err)
+		}
+
+		netRules, err := n.aclRules(pu.cfg, pu.cfg.NetChain, pu.cfg.AppChain, pu.pu.Policy.NetworkACLs(), false)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create network acls of pu %s: %s", contextID, err)
+		}
+
+		if err := addRules(netRules); err != nil {
+			return nil, fmt.Errorf("unable to install network acls of pu %s: %s", contextID, err)
+		}
+
+		if err := addRules(n.trapRules(pu.cfg, pu.isHostPU)); err != nil {
+			return nil, fmt.Errorf("unable to install trap rules of pu %s: %s", contextID, err)
+		}
+	}
+
+	for _, name := range setNames(aclSets) {
+		table.Sets = append(table.Sets, n.aclSet(name, aclSets[name]))
+	}
+
+	return table, nil
+}
+
+// aclSets returns the addresses of the sets of the external services of all
+// the PUs.
+func (n *nftables) aclSets() (map[string]map[string]bool, error) {
+
+	sets := map[string]map[string]bool{}
+
+	for _, contextID := range n.puOrder {
+		pu := n.pus[contextID]
+
+		if err := n.addACLSetAddresses(sets, pu.pu.Policy.ApplicationACLs()); err != nil {
+			return nil, fmt.Errorf("unable to create application acl sets of pu %s: %s", contextID, err)
+		}
+
+		if err := n.addACLSetAddresses(sets, pu.pu.Policy.NetworkACLs()); err != nil {
+			return nil, fmt.Errorf("unable to create network acl sets of pu %s: %s", contextID, err)
+		}
+	}
+
+	return sets, nil
+}
+
+// aclSet creates the set of the addresses of an external service.
+func (n *nftables) aclSet(name string, addresses map[string]bool) *nftSet {
+	return &nftSet{
+		Name:      name,
+		Type:      n.addrType,
+		Flags:     "interval",
+		AutoMerge: true,
+		Elements:  n.networkElements(keys(addresses)),
+	}
+}
+
+// networkSet creates an interval set of networks.
+func (n *nftables) networkSet(name string, networks []string) *nftSet {
+	return &nftSet{
+		Name:      name,
+		Type:      n.addrType,
+		Flags:     "interval",
+		AutoMerge: true,
+		Elements:  n.networkElements(networks),
+	}
+}
+
+// networkElements returns the networks of the family as set elements.
+func (n *nftables) networkElements(networks []string) []string {
+
+	elements := map[string]bool{}
+
+	for _, network := range networks {
+		ip := net.ParseIP(network)
+		if ip == nil {
+			ip, _, _ = net.ParseCIDR(network)
+		}
+		if ip == nil || !n.ipFilter(ip) {
+			continue
+		}
+		elements[network] = true
+	}
+
+	return keys(elements)
+}
+
+// puSets creates the port set and the proxy sets of a PU.
+func (n *nftables) puSets(pu *puRules) []*nftSet {
+
+	sets := []*nftSet{}
+
+	// The port set applies to Linux PUs only.
+	if n.mode != constants.RemoteContainer {
+		ports := map[string]bool{}
+		for port := range pu.ports {
+			ports[strings.Replace(port, ":", "-", 1)] = true
+		}
+
+		sets = append(sets, &nftSet{
+			Name:      pu.cfg.PortSet,
+			Type:      "inet_service",
+			Flags:     "interval",
+			AutoMerge: true,
+			Elements:  keys(ports),
+		})
+	}
+
+	dstPairs := map[string]bool{}
+	for _, dependentService := range pu.pu.Policy.DependentServices() {
+		min, max := dependentService.NetworkInfo.Ports.Range()
+		for _, addr := range dependentService.NetworkInfo.Addresses {
+			if !n.ipFilter(addr.IP) {
+				continue
+			}
+			dstPairs[addr.String()+" . "+portRange(min, max)] = true
+		}
+	}
+
+	srvPorts := map[string]bool{}
+	for _, exposedService := range pu.pu.Policy.ExposedServices() {
+		min, max := exposedService.PrivateNetworkInfo.Ports.Range()
+		srvPorts[portRange(min, max)] = true
+		if exposedService.PublicNetworkInfo != nil {
+			min, max := exposedService.PublicNetworkInfo.Ports.Range()
+			srvPorts[portRange(min, max)] = true
+		}
+	}
+
+	return append(sets,
+		&nftSet{
+			Name:     pu.cfg.DestIPSet,
+			Type:     n.addrType + " . inet_service",
+			Flags:    "interval",
+			Elements: keys(dstPairs),
+		},
+		&nftSet{
+			Name:      pu.cfg.SrvIPSet,
+			Type:      "inet_service",
+			Flags:     "interval",
+			AutoMerge: true,
+			Elements:  keys(srvPorts),
+		},
+	)
+}
+
+// portRange formats a port range as a set element.
+func portRange(min, max uint16) string {
+	if min == max {
+		return strconv.Itoa(int(min))
+	}
+	return strconv.Itoa(int(min)) + "-" + strconv.Itoa(int(max))
+}
+
+// setNames returns the sorted names of the sets.
+func setNames(sets map[string]map[string]bool) []string {
+	list := make([]string, 0, len(sets))
+	for name := range sets {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// keys returns the sorted keys of a map.
+func keys(m map[string]bool) []string {
+	list := make([]string, 0, len(m))
+	for k := range m {
+		list = append(list, k)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// hookRules returns the hooks of the base chains.
+func (n *nftables) hookRules(cfg *ACLInfo) ([][]string, error) {
+
+	tmpl := template.Must(template.New(hooks).Parse(hooks))
+
+	return extractRulesFromTemplate(tmpl, cfg)
+}
+
+// globalRules returns the rules of the global chains.
+func (n *nftables) globalRules(cfg *ACLInfo) [][]string {
+
+	tmpl := template.Must(template.New(globalRules).Funcs(template.FuncMap{
+		"isLocalServer": func() bool {
+			return n.mode == constants.LocalServer
+		},
+	}).Parse(globalRules))
+
+	rules, err := extractRulesFromTemplate(tmpl, cfg)
+	if err != nil {
+		zap.L().Warn("unable to extract rules", zap.Error(err))
+	}
+
+	return rules
+}
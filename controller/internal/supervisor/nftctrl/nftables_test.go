@@ -0,0 +1,437 @@
+package nftctrl
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/trireme-lib/common"
+	"go.aporeto.io/trireme-lib/controller/constants"
+	provider "go.aporeto.io/trireme-lib/controller/pkg/aclprovider"
+	"go.aporeto.io/trireme-lib/controller/pkg/fqconfig"
+	"go.aporeto.io/trireme-lib/controller/runtime"
+	"go.aporeto.io/trireme-lib/policy"
+	"go.aporeto.io/trireme-lib/utils/portspec"
+)
+
+// memoryNft keeps the last ruleset that was applied.
+type memoryNft struct {
+	rulesets []string
+	err      error
+}
+
+func (m *memoryNft) apply(ruleset string) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.rulesets = append(m.rulesets, ruleset)
+	return nil
+}
+
+func (m *memoryNft) last() string {
+	if len(m.rulesets) == 0 {
+		return ""
+	}
+	return m.rulesets[len(m.rulesets)-1]
+}
+
+func createTestInstance(m *memoryNft, mode constants.ModeType) (*Instance, error) {
+
+	fq := fqconfig.NewFilterQueueWithDefaults()
+
+	return newInstanceWithProvider(provider.NewCustomNftablesProvider(m.apply), fq, mode)
+}
+
+func createTestPU(contextID string, puType common.PUType, appACLs, netACLs policy.IPRuleList) *policy.PUInfo {
+
+	policyrules := policy.NewPUPolicy(
+		contextID,
+		"/ns1",
+		policy.Police,
+		appACLs,
+		netACLs,
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+		policy.ExtendedMap{},
+		0,
+		0,
+		nil,
+		nil,
+		[]string{},
+	)
+
+	puInfo := policy.NewPUInfo(contextID, "/ns1", puType)
+	puInfo.Policy = policyrules
+	puInfo.Runtime.SetOptions(policy.OptionsType{
+		CgroupMark: "10",
+	})
+
+	tcpPortSpec, _ := portspec.NewPortSpecFromString("9000", nil) // nolint
+	puInfo.Runtime.SetServices([]common.Service{
+		{
+			Ports:    tcpPortSpec,
+			Protocol: 6,
+		},
+	})
+
+	return puInfo
+}
+
+func TestNewInstance(t *testing.T) {
+	Convey("When I create a new nftables instance with a custom provider", t, func() {
+		m := &memoryNft{}
+		i, err := createTestInstance(m, constants.LocalServer)
+		Convey("It should succeed and become the global instance", func() {
+			So(err, ShouldBeNil)
+			So(i, ShouldNotBeNil)
+			So(i.nftv4.family, ShouldEqual, "ip")
+			So(i.nftv6.family, ShouldEqual, "ip6")
+			So(GetInstance(), ShouldEqual, i)
+		})
+
+		Convey("No ruleset should be applied before the controller runs", func() {
+			So(i.SetTargetNetworks(&runtime.Configuration{}), ShouldBeNil)
+			So(m.rulesets, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestOperationWithLinuxServices(t *testing.T) {
+	Convey("Given an nftables controller with a memory backend", t, func() {
+		cfg := &runtime.Configuration{
+			TCPTargetNetworks: []string{"0.0.0.0/0"},
+			UDPTargetNetworks: []string{"10.0.0.0/8"},
+			ExcludedNetworks:  []string{"127.0.0.1"},
+		}
+
+		m := &memoryNft{}
+		i, err := createTestInstance(m, constants.LocalServer)
+		So(err, ShouldBeNil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		Convey("When I start the controller, I should get the global chains and sets", func() {
+			So(i.Run(ctx), ShouldBeNil)
+			So(i.SetTargetNetworks(cfg), ShouldBeNil)
+
+			ruleset := m.last()
+			So(ruleset, ShouldStartWith, "table ip trireme\ndelete table ip trireme\n")
+			So(ruleset, ShouldContainSubstring, "set TargetTCP {")
+			So(ruleset, ShouldContainSubstring, "elements = { 0.0.0.0/0 }")
+			So(ruleset, ShouldContainSubstring, "elements = { 10.0.0.0/8 }")
+			So(ruleset, ShouldContainSubstring, "elements = { 127.0.0.1 }")
+			So(ruleset, ShouldContainSubstring, "type filter hook input priority -150; policy accept;")
+			So(ruleset, ShouldContainSubstring, "ip saddr != @Excluded jump Net")
+			So(ruleset, ShouldContainSubstring, "jump Pid-Net")
+			So(ruleset, ShouldNotContainSubstring, "table ip6")
+
+			// Chains must be declared before the chains that jump to them.
+			So(strings.Index(ruleset, "chain Pid-Net {"), ShouldBeLessThan, strings.Index(ruleset, "chain Net {"))
+			So(strings.Index(ruleset, "chain Net {"), ShouldBeLessThan, strings.Index(ruleset, "chain input {"))
+
+			Convey("When I configure a PU, its chains, sets and ACLs must be installed", func() {
+				appACLs := policy.IPRuleList{
+					policy.IPRule{
+						Addresses: []string{"30.0.0.0/24"},
+						Ports:     []string{"80"},
+						Protocols: []string{"TCP"},
+						Policy: &policy.FlowPolicy{
+							Action:    policy.Reject,
+							ServiceID: "s1",
+							PolicyID:  "1",
+						},
+					},
+					policy.IPRule{
+						Addresses: []string{"30.0.0.0/24"},
+						Ports:     []string{"443"},
+						Protocols: []string{"UDP"},
+						Policy: &policy.FlowPolicy{
+							Action:    policy.Accept | policy.Log,
+							ServiceID: "s2",
+							PolicyID:  "2",
+						},
+					},
+				}
+
+				So(i.ConfigureRules(0, "pu1", createTestPU("pu1", common.LinuxProcessPU, appACLs, nil)), ShouldBeNil)
+
+				appChain, netChain := chainName("pu1")
+				rejectSet := aclSetName("s1")
+				acceptSet := aclSetName("s2")
+
+				ruleset := m.last()
+				So(ruleset, ShouldContainSubstring, "chain "+appChain+" {")
+				So(ruleset, ShouldContainSubstring, "chain "+netChain+" {")
+				So(ruleset, ShouldContainSubstring, "meta cgroup 10 meta mark set 10")
+				So(ruleset, ShouldContainSubstring, "tcp dport { 9000 } jump "+netChain)
+				So(ruleset, ShouldContainSubstring, "set "+rejectSet+" {")
+				So(ruleset, ShouldContainSubstring, "meta l4proto tcp ip daddr @"+rejectSet+" ct state new ip daddr != @TargetTCP tcp dport { 80 } drop")
+				So(ruleset, ShouldContainSubstring, "meta l4proto udp ip daddr @"+acceptSet+" udp dport { 443 } accept")
+				So(ruleset, ShouldContainSubstring, "meta l4proto udp ip saddr @"+acceptSet+" ct state established accept")
+				So(ruleset, ShouldContainSubstring, "group 10")
+
+				// Reject rules have priority over accept rules.
+				So(strings.Index(ruleset, "@"+rejectSet), ShouldBeLessThan, strings.Index(ruleset, "@"+acceptSet+" udp dport"))
+
+				Convey("When only the addresses of the ACLs change, only their sets must be updated", func() {
+					updatedACLs := policy.IPRuleList{appACLs[0], appACLs[1]}
+					updatedACLs[0].Addresses = []string{"40.0.0.0/24"}
+
+					count := len(m.rulesets)
+					updated, err := i.UpdateACLs("pu1", createTestPU("pu1", common.LinuxProcessPU, updatedACLs, nil), nil)
+					So(err, ShouldBeNil)
+					So(updated, ShouldBeTrue)
+					So(len(m.rulesets), ShouldEqual, count+1)
+					So(m.last(), ShouldEqual, "flush set ip trireme "+rejectSet+"\nadd element ip trireme "+rejectSet+" { 40.0.0.0/24 }\n")
+
+					Convey("And the table must keep the new addresses", func() {
+						So(i.AddPortToPortSet("pu1", "8080"), ShouldBeNil)
+						So(m.last(), ShouldContainSubstring, "elements = { 40.0.0.0/24 }")
+					})
+				})
+
+				Convey("When the ports of the ACLs change, the ACLs must not be updated alone", func() {
+					updatedACLs := policy.IPRuleList{appACLs[0], appACLs[1]}
+					updatedACLs[0].Ports = []string{"8080"}
+
+					count := len(m.rulesets)
+					updated, err := i.UpdateACLs("pu1", createTestPU("pu1", common.LinuxProcessPU, updatedACLs, nil), nil)
+					So(err, ShouldBeNil)
+					So(updated, ShouldBeFalse)
+					So(len(m.rulesets), ShouldEqual, count)
+				})
+
+				Convey("When I add a port to the port set, it must be in the set of the PU", func() {
+					So(i.AddPortToPortSet("pu1", "8080"), ShouldBeNil)
+					So(m.last(), ShouldContainSubstring, "elements = { 8080 }")
+
+					Convey("And the port must survive a policy update", func() {
+						So(i.UpdateRules(1, "pu1", createTestPU("pu1", common.LinuxProcessPU, nil, nil), nil), ShouldBeNil)
+						So(m.last(), ShouldContainSubstring, "elements = { 8080 }")
+						So(m.last(), ShouldNotContainSubstring, rejectSet)
+
+						Convey("When I delete the port, it must be removed", func() {
+							So(i.DeletePortFromPortSet("pu1", "8080"), ShouldBeNil)
+							So(m.last(), ShouldNotContainSubstring, "elements = { 8080 }")
+						})
+					})
+				})
+
+				Convey("When I delete the PU, its chains must be removed", func() {
+					So(i.DeleteRules(0, "pu1", "0", "0", "10", "", "", "", common.LinuxProcessPU), ShouldBeNil)
+					So(m.last(), ShouldNotContainSubstring, appChain)
+					So(m.last(), ShouldNotContainSubstring, rejectSet)
+				})
+
+				Convey("When I clean up, the table must be deleted", func() {
+					So(i.CleanUp(), ShouldBeNil)
+					So(m.last(), ShouldEqual, "table ip trireme\ndelete table ip trireme\n")
+				})
+			})
+
+			Convey("When I configure a PU with a rate limited ACL, the new connections must be metered", func() {
+				appACLs := policy.IPRuleList{
+					policy.IPRule{
+						Addresses: []string{"30.0.0.0/24"},
+						Ports:     []string{"53"},
+						Protocols: []string{"UDP"},
+						Policy: &policy.FlowPolicy{
+							Action:    policy.Accept | policy.RateLimit,
+							RateLimit: &policy.RateLimitSpec{ConnectionsPerSecond: 0.5},
+							ServiceID: "s1",
+							PolicyID:  "1",
+						},
+					},
+				}
+
+				So(i.ConfigureRules(0, "pu1", createTestPU("pu1", common.LinuxProcessPU, appACLs, nil)), ShouldBeNil)
+
+				set := aclSetName("s1")
+				ruleset := m.last()
+				So(ruleset, ShouldContainSubstring, "meta l4proto udp ip daddr @"+set+" udp dport { 53 } ct state new meter RL")
+				So(ruleset, ShouldContainSubstring, "{ ip daddr limit rate over 30/minute burst 1 packets } drop")
+
+				// The connections over the limit are dropped before they are accepted.
+				So(strings.Index(ruleset, "limit rate over"), ShouldBeLessThan, strings.Index(ruleset, "udp dport { 53 } accept"))
+			})
+
+			Convey("When I configure a PU with an ACL with extensions, it must be refused", func() {
+				appACLs := policy.IPRuleList{
+					policy.IPRule{
+						Addresses:  []string{"30.0.0.0/24"},
+						Ports:      []string{"80"},
+						Protocols:  []string{"TCP"},
+						Extensions: []string{"-m string --string foo --algo bm"},
+						Policy:     &policy.FlowPolicy{Action: policy.Accept, ServiceID: "s1"},
+					},
+				}
+
+				So(i.ConfigureRules(0, "pu1", createTestPU("pu1", common.LinuxProcessPU, appACLs, nil)), ShouldNotBeNil)
+				So(i.nftv4.pus, ShouldNotContainKey, "pu1")
+			})
+
+			Convey("When I configure a PU with a reject ACL with invalid addresses, it must be refused", func() {
+				appACLs := policy.IPRuleList{
+					policy.IPRule{
+						Addresses: []string{"30.0.0.300/24"},
+						Ports:     []string{"80"},
+						Protocols: []string{"TCP"},
+						Policy:    &policy.FlowPolicy{Action: policy.Reject, ServiceID: "s1"},
+					},
+				}
+
+				So(i.ConfigureRules(0, "pu1", createTestPU("pu1", common.LinuxProcessPU, appACLs, nil)), ShouldNotBeNil)
+
+				appACLs[0].Policy = &policy.FlowPolicy{Action: policy.Accept, ServiceID: "s1"}
+				So(i.ConfigureRules(0, "pu1", createTestPU("pu1", common.LinuxProcessPU, appACLs, nil)), ShouldBeNil)
+			})
+
+			Convey("When I configure a PU with an ACL that excludes all the addresses, it must be refused", func() {
+				appACLs := policy.IPRuleList{
+					policy.IPRule{
+						Addresses: []string{"30.0.0.0/24", "!0.0.0.0/0"},
+						Ports:     []string{"80"},
+						Protocols: []string{"TCP"},
+						Policy:    &policy.FlowPolicy{Action: policy.Accept, ServiceID: "s1"},
+					},
+				}
+
+				So(i.ConfigureRules(0, "pu1", createTestPU("pu1", common.LinuxProcessPU, appACLs, nil)), ShouldNotBeNil)
+				So(i.nftv4.pus, ShouldNotContainKey, "pu1")
+			})
+
+			Convey("When I configure a PU with an accepted ICMP ACL, the replies must be accepted", func() {
+				appACLs := policy.IPRuleList{
+					policy.IPRule{
+						Addresses: []string{"30.0.0.0/24"},
+						Protocols: []string{"icmp/8"},
+						Policy:    &policy.FlowPolicy{Action: policy.Accept, ServiceID: "s1"},
+					},
+				}
+
+				So(i.ConfigureRules(0, "pu1", createTestPU("pu1", common.LinuxProcessPU, appACLs, nil)), ShouldBeNil)
+
+				set := aclSetName("s1")
+				ruleset := m.last()
+				So(ruleset, ShouldContainSubstring, "meta l4proto icmp icmp type 8 ip daddr @"+set+" accept")
+				So(ruleset, ShouldContainSubstring, "meta l4proto icmp ip saddr @"+set+" ct state established accept")
+			})
+
+			Convey("When I configure a PU with an invalid ICMP ACL, it must be refused", func() {
+				appACLs := policy.IPRuleList{
+					policy.IPRule{
+						Addresses: []string{"30.0.0.0/24"},
+						Protocols: []string{"icmp/echo"},
+						Policy:    &policy.FlowPolicy{Action: policy.Reject, ServiceID: "s1"},
+					},
+				}
+
+				So(i.ConfigureRules(0, "pu1", createTestPU("pu1", common.LinuxProcessPU, appACLs, nil)), ShouldNotBeNil)
+				So(i.nftv4.pus, ShouldNotContainKey, "pu1")
+			})
+
+			Convey("When the ruleset fails to apply, the PU must not be configured", func() {
+				m.err = errors.New("failed")
+				So(i.ConfigureRules(0, "pu1", createTestPU("pu1", common.LinuxProcessPU, nil, nil)), ShouldNotBeNil)
+				So(i.nftv4.pus, ShouldNotContainKey, "pu1")
+				So(i.AddPortToPortSet("pu1", "8080"), ShouldBeNil)
+			})
+		})
+	})
+}
+
+func TestOperationWithContainers(t *testing.T) {
+	Convey("Given an nftables controller for containers", t, func() {
+		m := &memoryNft{}
+		i, err := createTestInstance(m, constants.RemoteContainer)
+		So(err, ShouldBeNil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		So(i.Run(ctx), ShouldBeNil)
+		So(i.SetTargetNetworks(&runtime.Configuration{}), ShouldBeNil)
+
+		Convey("When I configure a PU, the traffic must be sent to the PU chains", func() {
+			So(i.ConfigureRules(0, "pu1", createTestPU("pu1", common.ContainerPU, nil, nil)), ShouldBeNil)
+
+			appChain, netChain := chainName("pu1")
+			ruleset := m.last()
+			So(ruleset, ShouldContainSubstring, "jump "+appChain+" comment \"Container-specific-chain\"")
+			So(ruleset, ShouldContainSubstring, "jump "+netChain+" comment \"Container-specific-chain\"")
+			So(ruleset, ShouldNotContainSubstring, "chain Pid-Net")
+			So(ruleset, ShouldNotContainSubstring, processPortSetPrefix)
+		})
+	})
+}
+
+func TestHelpers(t *testing.T) {
+	Convey("When I convert the queue balance strings", t, func() {
+		So(queueRange("0:3"), ShouldEqual, "0-3")
+		So(queueRange("4:4"), ShouldEqual, "4")
+		So(queueRange("5"), ShouldEqual, "5")
+	})
+
+	Convey("When I convert port lists", t, func() {
+		So(portList("80,1000:2000"), ShouldEqual, "80, 1000-2000")
+	})
+
+	Convey("When I match the icmp protocols", t, func() {
+		l4Match, portMatch := protocolMatch("icmp/3/0:1,4")
+		So(l4Match, ShouldEqual, "meta l4proto icmp icmp type 3 icmp code { 0-1, 4 }")
+		So(portMatch, ShouldEqual, "")
+
+		l4Match, _ = protocolMatch("icmpv6/128")
+		So(l4Match, ShouldEqual, "meta l4proto ipv6-icmp icmpv6 type 128")
+
+		l4Match, _ = protocolMatch("ICMP")
+		So(l4Match, ShouldEqual, "meta l4proto icmp")
+	})
+
+	Convey("When I add acl addresses with exclusions", t, func() {
+		sets := map[string]map[string]bool{}
+		So((&nftables{}).addACLSetAddresses(sets, policy.IPRuleList{
+			{
+				Addresses: []string{"10.0.0.0/8", "!10.128.0.0/9"},
+				Policy:    &policy.FlowPolicy{ServiceID: "s1"},
+			},
+		}), ShouldBeNil)
+		So(sets[aclSetName("s1")], ShouldResemble, map[string]bool{"10.0.0.0/9": true})
+	})
+
+	Convey("When I convert the rates of the limits", t, func() {
+		So(limitRate(10.4), ShouldEqual, "10/second")
+		So(limitRate(0.5), ShouldEqual, "30/minute")
+		So(limitRate(0.001), ShouldEqual, "4/hour")
+	})
+
+	Convey("When I create the dns rules of a host PU", t, func() {
+		cfg := &ACLInfo{Addr: "ip", AppChain: "add rule ip trireme app", NetChain: "add rule ip trireme net"}
+		dnsRules := func() string {
+			s := []string{}
+			for _, r := range (&nftables{}).trapRules(cfg, true) {
+				s = append(s, strings.Join(r, " "))
+			}
+			return strings.Join(s, "\n")
+		}
+
+		So(dnsRules(), ShouldNotContainSubstring, "tcp dport 53")
+		So(dnsRules(), ShouldNotContainSubstring, "tcp sport 53")
+
+		cfg.DNSServerIP = "10.0.0.10"
+		cfg.DNSProxyPort = "5353"
+		So(dnsRules(), ShouldContainSubstring, "app ip daddr 10.0.0.10 tcp dport 53 accept")
+		So(dnsRules(), ShouldContainSubstring, "net ip saddr 10.0.0.10 tcp sport 53 accept")
+	})
+
+	Convey("When I match the udp signature", t, func() {
+		So(udpSignatureMatch(), ShouldStartWith, "@th,")
+	})
+}
@@ -0,0 +1,198 @@
+package nftctrl
+
+// tableTemplate is the complete trireme table of a family. The table is
+// replaced in a single transaction every time it changes. The first line
+// creates the table if it does not exist, so that the delete never fails.
+// Chains are declared before the chains that jump to them.
+var tableTemplate = `table {{.Family}} {{.Table}}
+delete table {{.Family}} {{.Table}}
+table {{.Family}} {{.Table}} {
+{{range .Sets}}	set {{.Name}} {
+		type {{.Type}}
+{{if .Flags}}		flags {{.Flags}}
+{{end}}{{if .AutoMerge}}		auto-merge
+{{end}}{{if .Elements}}		elements = { {{join .Elements}} }
+{{end}}	}
+{{end}}{{range .Chains}}	chain {{.Name}} {
+{{if .Hook}}		{{.Hook}}
+{{end}}{{range .Rules}}		{{.}}
+{{end}}	}
+{{end}}}
+`
+
+// deleteTableTemplate removes the trireme table of a family.
+var deleteTableTemplate = `table {{.Family}} {{.Table}}
+delete table {{.Family}} {{.Table}}
+`
+
+// setElementsTemplate replaces the elements of sets of the trireme table.
+var setElementsTemplate = `{{range .Sets}}flush set {{$.Family}} {{$.Table}} {{.Name}}
+{{if .Elements}}add element {{$.Family}} {{$.Table}} {{.Name}} { {{join .Elements}} }
+{{end}}{{end}}`
+
+// hooks are the base chains of the table. They hook traffic to the main
+// chains. The mangle and dstnat priorities are the priorities of the
+// iptables tables that the iptables implementation uses.
+var hooks = `
+{{.Input}} type filter hook input priority -150; policy accept;
+{{.Output}} type route hook output priority -150; policy accept;
+{{.NatPreRouting}} type nat hook prerouting priority -100; policy accept;
+{{.NatOutput}} type nat hook output priority -100; policy accept;
+`
+
+var globalRules = `
+{{.Input}} {{.Addr}} saddr != @{{.ExclusionsSet}} jump {{.MainNetChain}}
+{{.MainNetChain}} jump {{.MangleProxyNetChain}}
+{{.MainNetChain}} meta l4proto udp {{.Addr}} saddr @{{.TargetUDPNetSet}} {{.UDPSignature}} queue num {{.QueueBalanceNetSynAck}} bypass
+{{.MainNetChain}} ct mark {{.DefaultConnmark}} tcp flags & (syn|ack) != syn|ack accept
+{{if isLocalServer}}
+{{.MainNetChain}} jump {{.UIDInput}}
+{{end}}
+{{.MainNetChain}} {{.Addr}} saddr @{{.TargetTCPNetSet}} tcp flags & (syn|ack) == syn|ack queue num {{.QueueBalanceNetSynAck}} bypass
+{{.MainNetChain}} {{.Addr}} saddr @{{.TargetTCPNetSet}} tcp option @34,0,8 34 tcp flags & (syn|ack) == syn queue num {{.QueueBalanceNetSyn}} bypass
+{{if isLocalServer}}
+{{.MainNetChain}} jump {{.TriremeInput}}
+{{.MainNetChain}} jump {{.NetworkSvcInput}}
+{{.MainNetChain}} jump {{.HostInput}}
+{{end}}
+
+{{.Output}} {{.Addr}} daddr != @{{.ExclusionsSet}} jump {{.MainAppChain}}
+{{.MainAppChain}} jump {{.MangleProxyAppChain}}
+{{.MainAppChain}} meta mark {{.RawSocketMark}} accept
+{{.MainAppChain}} ct mark {{.DefaultConnmark}} tcp flags & (syn|ack) != syn|ack accept
+{{if isLocalServer}}
+{{.MainAppChain}} jump {{.UIDOutput}}
+{{end}}
+{{.MainAppChain}} {{.Addr}} daddr @{{.TargetTCPNetSet}} tcp flags & (syn|ack) == syn|ack meta mark set {{.InitialMarkVal}}
+{{.MainAppChain}} {{.Addr}} daddr @{{.TargetTCPNetSet}} tcp flags & (syn|ack) == syn|ack queue num {{.QueueBalanceAppSynAck}} bypass
+{{if isLocalServer}}
+{{.MainAppChain}} jump {{.TriremeOutput}}
+{{.MainAppChain}} jump {{.NetworkSvcOutput}}
+{{.MainAppChain}} jump {{.HostOutput}}
+{{end}}
+
+{{.MangleProxyAppChain}} meta mark {{.ProxyMark}} accept
+{{.MangleProxyNetChain}} meta mark {{.ProxyMark}} accept
+
+{{.NatPreRouting}} meta l4proto tcp fib daddr type local {{.Addr}} saddr != @{{.ExclusionsSet}} jump {{.NatProxyNetChain}}
+{{.NatOutput}} {{.Addr}} daddr != @{{.ExclusionsSet}} jump {{.NatProxyAppChain}}
+{{.NatProxyAppChain}} meta mark {{.ProxyMark}} accept
+{{.NatProxyNetChain}} meta mark {{.ProxyMark}} accept
+`
+
+// cgroupCaptureTemplate are the list of rules that will hook traffic and send it to a PU specific
+// chain. The hook method depends on the type of PU.
+var cgroupCaptureTemplate = `
+{{if isTCPPorts}}
+{{.NetSection}} tcp dport { {{.TCPPorts}} } jump {{.NetChain}} comment "PU-Chain"
+{{else}}
+{{.NetSection}} tcp dport @{{.TCPPortSet}} jump {{.NetChain}} comment "PU-Chain"
+{{end}}
+
+{{if isHostPU}}
+{{.NetSection}} meta l4proto udp meta mark {{.Mark}} fib saddr type local fib daddr type local accept comment "traffic-same-pu"
+{{.NetSection}} jump {{.NetChain}} comment "PU-Chain"
+{{end}}
+
+{{if isUDPPorts}}
+{{.NetSection}} udp dport { {{.UDPPorts}} } jump {{.NetChain}} comment "PU-Chain"
+{{end}}
+
+{{.AppSection}} meta cgroup {{.Mark}} meta mark set {{.Mark}} comment "PU-Chain"
+{{if isHostPU}}
+{{.AppSection}} meta l4proto udp meta mark {{.Mark}} fib saddr type local fib daddr type local ct state new log prefix "{{.NFLOGAcceptPrefix}}" group 10
+{{.AppSection}} meta l4proto udp meta mark {{.Mark}} fib saddr type local fib daddr type local accept comment "traffic-same-pu"
+{{end}}
+{{.AppSection}} meta mark {{.Mark}} jump {{.AppChain}} comment "PU-Chain"
+`
+
+// containerChainTemplate will hook traffic towards the container specific chains.
+var containerChainTemplate = `
+{{.AppSection}} jump {{.AppChain}} comment "Container-specific-chain"
+{{.NetSection}} jump {{.NetChain}} comment "Container-specific-chain"
+`
+
+var uidChainTemplate = `
+{{.UIDOutput}} meta skuid {{.UID}} meta mark set {{.Mark}}
+{{.UIDOutput}} meta mark {{.Mark}} jump {{.AppChain}} comment "Server-specific-chain"
+{{.UIDInput}} th dport @{{.PortSet}} meta mark set {{.Mark}}
+{{.UIDInput}} meta l4proto tcp meta mark {{.Mark}} jump {{.NetChain}} comment "Container-specific-chain"
+`
+
+// packetCaptureTemplate are the rules that trap traffic towards the user space.
+var packetCaptureTemplate = `
+{{if needICMP}}
+{{.AppChain}} meta l4proto ipv6-icmp accept
+{{end}}
+{{if needDnsRules}}
+{{.AppChain}} udp dport 53 accept
+{{if enableDNSProxy}}
+{{.AppChain}} {{.Addr}} daddr {{.DNSServerIP}} tcp dport 53 accept
+{{end}}
+{{end}}
+{{.AppChain}} tcp flags & (syn|ack) == syn queue num {{.QueueBalanceAppSyn}}
+{{.AppChain}} tcp flags & (syn|ack) == ack queue num {{.QueueBalanceAppAck}}
+{{if isUIDProcess}}
+{{.AppChain}} tcp flags & (syn|ack) == syn|ack queue num {{.QueueBalanceAppSynAck}}
+{{end}}
+{{.AppChain}} meta l4proto udp {{.Addr}} daddr @{{.TargetUDPNetSet}} queue num {{.QueueBalanceAppSyn}}
+{{.AppChain}} meta l4proto udp {{.Addr}} daddr @{{.TargetUDPNetSet}} ct state established accept comment "UDP-Established-Connections"
+{{.AppChain}} meta l4proto tcp ct state established accept comment "TCP-Established-Connections"
+{{.AppChain}} ct state new log prefix "{{.NFLOGPrefix}}" group 10
+{{.AppChain}} ct state != new log prefix "{{.DefaultNFLOGDropPrefix}}" group 10
+{{.AppChain}} drop
+
+{{if needICMP}}
+{{.NetChain}} meta l4proto ipv6-icmp accept
+{{end}}
+{{if needDnsRules}}
+{{.NetChain}} udp sport 53 accept
+{{if enableDNSProxy}}
+{{.NetChain}} {{.Addr}} saddr {{.DNSServerIP}} tcp sport 53 accept
+{{end}}
+{{end}}
+{{.NetChain}} {{.Addr}} saddr @{{.TargetTCPNetSet}} tcp flags & (syn|ack) == syn queue num {{.QueueBalanceNetSyn}}
+{{.NetChain}} {{.Addr}} saddr @{{.TargetTCPNetSet}} tcp flags & (syn|ack) == ack queue num {{.QueueBalanceNetAck}}
+{{if isUIDProcess}}
+{{.NetChain}} {{.Addr}} saddr @{{.TargetTCPNetSet}} tcp flags & (syn|ack) == syn|ack queue num {{.QueueBalanceNetSynAck}}
+{{end}}
+{{.NetChain}} meta l4proto udp {{.Addr}} saddr @{{.TargetUDPNetSet}} limit rate 1000/second queue num {{.QueueBalanceNetSyn}}
+{{.NetChain}} meta l4proto tcp ct state established accept comment "TCP-Established-Connections"
+{{.NetChain}} ct state new log prefix "{{.NFLOGPrefix}}" group 11
+{{.NetChain}} ct state != new log prefix "{{.DefaultNFLOGDropPrefix}}" group 11
+{{.NetChain}} drop
+`
+
+var proxyChainTemplate = `
+{{.MangleProxyAppChain}} tcp sport {{.ProxyPort}} accept
+{{if enableDNSProxy}}
+{{.MangleProxyAppChain}} udp sport {{.DNSProxyPort}} accept
+{{.MangleProxyAppChain}} tcp sport {{.DNSProxyPort}} accept
+{{end}}
+{{.MangleProxyAppChain}} tcp sport @{{.SrvIPSet}} accept
+{{.MangleProxyAppChain}} {{.Addr}} daddr . tcp dport @{{.DestIPSet}} meta mark != {{.ProxyMark}} accept
+
+{{.MangleProxyNetChain}} {{.Addr}} saddr . tcp sport @{{.DestIPSet}} accept
+{{.MangleProxyNetChain}} tcp sport @{{.SrvIPSet}} fib saddr type local accept
+{{.MangleProxyNetChain}} tcp dport {{.ProxyPort}} accept
+{{if enableDNSProxy}}
+{{.MangleProxyNetChain}} udp dport {{.DNSProxyPort}} accept
+{{.MangleProxyNetChain}} tcp dport {{.DNSProxyPort}} accept
+{{end}}
+{{if isCgroupSet}}
+{{.NatProxyAppChain}} {{.Addr}} daddr . tcp dport @{{.DestIPSet}} meta mark != {{.ProxyMark}} meta cgroup {{.CgroupMark}} redirect to :{{.ProxyPort}}
+{{if enableDNSProxy}}
+{{.NatProxyAppChain}} {{.Addr}} daddr {{.DNSServerIP}} udp dport 53 meta mark != {{.ProxyMark}} meta cgroup {{.CgroupMark}} ct mark set meta mark
+{{.NatProxyAppChain}} {{.Addr}} daddr {{.DNSServerIP}} udp dport 53 meta mark != {{.ProxyMark}} meta cgroup {{.CgroupMark}} redirect to :{{.DNSProxyPort}}
+{{.NatProxyAppChain}} {{.Addr}} daddr {{.DNSServerIP}} tcp dport 53 meta mark != {{.ProxyMark}} meta cgroup {{.CgroupMark}} ct mark set meta mark
+{{.NatProxyAppChain}} {{.Addr}} daddr {{.DNSServerIP}} tcp dport 53 meta mark != {{.ProxyMark}} meta cgroup {{.CgroupMark}} redirect to :{{.DNSProxyPort}}
+{{end}}
+{{else}}
+{{.NatProxyAppChain}} {{.Addr}} daddr . tcp dport @{{.DestIPSet}} meta mark != {{.ProxyMark}} redirect to :{{.ProxyPort}}
+{{if enableDNSProxy}}
+{{.NatProxyAppChain}} {{.Addr}} daddr {{.DNSServerIP}} udp dport 53 meta mark != {{.ProxyMark}} redirect to :{{.DNSProxyPort}}
+{{.NatProxyAppChain}} {{.Addr}} daddr {{.DNSServerIP}} tcp dport 53 meta mark != {{.ProxyMark}} redirect to :{{.DNSProxyPort}}
+{{end}}
+{{end}}
+{{.NatProxyNetChain}} tcp dport @{{.SrvIPSet}} meta mark != {{.ProxyMark}} redirect to :{{.ProxyPort}}
+`
@@ -0,0 +1,321 @@
+package nftctrl
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/spaolacci/murmur3"
+	"go.aporeto.io/trireme-lib/common"
+	"go.aporeto.io/trireme-lib/controller/constants"
+	"go.aporeto.io/trireme-lib/controller/internal/enforcer/nfqdatapath/afinetrawsocket"
+	"go.aporeto.io/trireme-lib/controller/pkg/packet"
+	"go.aporeto.io/trireme-lib/policy"
+	"go.aporeto.io/trireme-lib/utils/cgnetcls"
+)
+
+// extractRulesFromTemplate executes a template and returns the rules per
+// chain. Every line of the template is a rule, where the first field is the
+// chain of the rule. The order of the rules is preserved.
+func extractRulesFromTemplate(tmpl *template.Template, data interface{}) ([][]string, error) {
+
+	buffer := bytes.NewBuffer([]byte{})
+	if err := tmpl.Execute(buffer, data); err != nil {
+		return [][]string{}, fmt.Errorf("unable to execute template:%s", err)
+	}
+
+	rules := [][]string{}
+	for _, m := range strings.Split(buffer.String(), "\n") {
+		rule := strings.Fields(m)
+		// ignore empty lines in the buffer
+		if len(rule) <= 1 {
+			continue
+		}
+		rules = append(rules, []string{rule[0], strings.Join(rule[1:], " ")})
+	}
+	return rules, nil
+}
+
+// ACLInfo keeps track of all information to create the rules
+type ACLInfo struct {
+	ContextID string
+	PUType    common.PUType
+
+	// Family
+	Addr string
+
+	// Base chains
+	Input         string
+	Output        string
+	NatPreRouting string
+	NatOutput     string
+
+	// Chains
+	MainAppChain        string
+	MainNetChain        string
+	HostInput           string
+	HostOutput          string
+	NetworkSvcInput     string
+	NetworkSvcOutput    string
+	TriremeInput        string
+	TriremeOutput       string
+	UIDInput            string
+	UIDOutput           string
+	NatProxyNetChain    string
+	NatProxyAppChain    string
+	MangleProxyNetChain string
+	MangleProxyAppChain string
+
+	AppChain   string
+	NetChain   string
+	AppSection string
+	NetSection string
+
+	// common info
+	DefaultConnmark       string
+	QueueBalanceAppSyn    string
+	QueueBalanceAppSynAck string
+	QueueBalanceAppAck    string
+	QueueBalanceNetSyn    string
+	QueueBalanceNetSynAck string
+	QueueBalanceNetAck    string
+	InitialMarkVal        string
+	RawSocketMark         string
+	TargetTCPNetSet       string
+	TargetUDPNetSet       string
+	ExclusionsSet         string
+
+	// IPv4 IPv6
+	needICMPRules bool
+
+	// UDP rules
+	UDPSignature string
+
+	// Linux PUs
+	TCPPorts   string
+	UDPPorts   string
+	TCPPortSet string
+
+	// ProxyRules
+	DestIPSet    string
+	SrvIPSet     string
+	ProxyPort    string
+	DNSProxyPort string
+	DNSServerIP  string
+	CgroupMark   string
+	ProxyMark    string
+
+	// UID PUs
+	Mark    string
+	UID     string
+	PortSet string
+
+	NFLOGPrefix            string
+	NFLOGAcceptPrefix      string
+	DefaultNFLOGDropPrefix string
+}
+
+// hashName returns a short hash of the given value that can be used in set
+// and chain names.
+func hashName(value string) string {
+	hash := murmur3.New64()
+
+	if _, err := io.WriteString(hash, value); err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// chainName returns the names of the chains of a PU.
+func chainName(contextID string) (app, net string) {
+	hash := hashName(contextID)
+	return appChainPrefix + hash, netChainPrefix + hash
+}
+
+// puSetName returns the name of a set of a PU.
+func puSetName(contextID string, prefix string) string {
+	return prefix + hashName(contextID)
+}
+
+// queueRange converts the iptables queue balance format to a queue range.
+func queueRange(queues string) string {
+	parts := strings.SplitN(queues, ":", 2)
+	if len(parts) != 2 || parts[0] == parts[1] {
+		return parts[0]
+	}
+	return parts[0] + "-" + parts[1]
+}
+
+// portList converts a comma separated list of ports and port ranges to the
+// elements of an nftables set.
+func portList(ports string) string {
+	return strings.Join(strings.Split(strings.Replace(ports, ":", "-", -1), ","), ", ")
+}
+
+// udpSignatureMatch matches the marker of UDP control packets. The marker
+// follows the first two bytes of the UDP payload. It is longer than the
+// largest raw payload match, so it is matched in two parts.
+func udpSignatureMatch() string {
+	offset := (packet.UDPDataPos + 2) * 8
+	marker := []byte(packet.UDPAuthMarker)
+
+	return fmt.Sprintf("@th,%d,64 0x%s @th,%d,%d 0x%s",
+		offset, hex.EncodeToString(marker[:8]),
+		offset+64, (len(marker)-8)*8, hex.EncodeToString(marker[8:]),
+	)
+}
+
+func (n *nftables) newACLInfo(contextID string, p *policy.PUInfo, puType common.PUType) *ACLInfo {
+
+	var appChain, netChain string
+
+	if contextID != "" {
+		appChain, netChain = chainName(contextID)
+	}
+
+	parseDNSServerIP := func() string {
+		for _, ipString := range n.fqc.DNSServerAddress {
+			if ip := net.ParseIP(ipString); ip != nil {
+				if n.ipFilter(ip) {
+					return ipString
+				}
+
+				continue
+			}
+			// parseCIDR
+			if ip, _, err := net.ParseCIDR(ipString); err == nil {
+				if n.ipFilter(ip) {
+					return ipString
+				}
+			}
+		}
+		return ""
+	}
+
+	var tcpPorts, udpPorts string
+	var servicePort, mark, uid, dnsProxyPort string
+	if p != nil {
+		tcpPorts, udpPorts = common.ConvertServicesToProtocolPortList(p.Runtime.Options().Services)
+		puType = p.Runtime.PUType()
+		servicePort = p.Policy.ServicesListeningPort()
+		dnsProxyPort = p.Policy.DNSProxyPort()
+		mark = p.Runtime.Options().CgroupMark
+		uid = p.Runtime.Options().UserID
+	}
+
+	proxySetName := puSetName(contextID, proxyPortSetPrefix)
+	destSetName, srvSetName := getSetNames(proxySetName)
+
+	appSection := ""
+	netSection := ""
+	switch puType {
+	case common.LinuxProcessPU, common.SSHSessionPU:
+		appSection = triremeOutput
+		netSection = triremeInput
+	case common.HostNetworkPU:
+		appSection = networkSvcOutput
+		netSection = networkSvcInput
+	case common.HostPU:
+		appSection = hostModeOutput
+		netSection = hostModeInput
+	default:
+		appSection = mainAppChain
+		netSection = mainNetChain
+	}
+
+	portSetName := ""
+	if contextID != "" {
+		prefix := processPortSetPrefix
+		if uid != "" {
+			prefix = uidPortSetPrefix
+		}
+		portSetName = puSetName(contextID, prefix)
+	}
+
+	return &ACLInfo{
+		ContextID: contextID,
+		PUType:    puType,
+
+		Addr: n.addr,
+
+		Input:         inputChain,
+		Output:        outputChain,
+		NatPreRouting: natPreRoutingChain,
+		NatOutput:     natOutputChain,
+
+		// Chains
+		MainAppChain:        mainAppChain,
+		MainNetChain:        mainNetChain,
+		HostInput:           hostModeInput,
+		HostOutput:          hostModeOutput,
+		NetworkSvcInput:     networkSvcInput,
+		NetworkSvcOutput:    networkSvcOutput,
+		TriremeInput:        triremeInput,
+		TriremeOutput:       triremeOutput,
+		UIDInput:            uidInput,
+		UIDOutput:           uidchain,
+		NatProxyNetChain:    natProxyInputChain,
+		NatProxyAppChain:    natProxyOutputChain,
+		MangleProxyNetChain: proxyInputChain,
+		MangleProxyAppChain: proxyOutputChain,
+
+		AppChain:   appChain,
+		NetChain:   netChain,
+		AppSection: appSection,
+		NetSection: netSection,
+
+		// common info
+		DefaultConnmark:       strconv.Itoa(int(constants.DefaultConnMark)),
+		QueueBalanceAppSyn:    queueRange(n.fqc.GetApplicationQueueSynStr()),
+		QueueBalanceAppSynAck: queueRange(n.fqc.GetApplicationQueueSynAckStr()),
+		QueueBalanceAppAck:    queueRange(n.fqc.GetApplicationQueueAckStr()),
+		QueueBalanceNetSyn:    queueRange(n.fqc.GetNetworkQueueSynStr()),
+		QueueBalanceNetSynAck: queueRange(n.fqc.GetNetworkQueueSynAckStr()),
+		QueueBalanceNetAck:    queueRange(n.fqc.GetNetworkQueueAckStr()),
+		InitialMarkVal:        strconv.Itoa(cgnetcls.Initialmarkval - 1),
+		RawSocketMark:         strconv.Itoa(afinetrawsocket.ApplicationRawSocketMark),
+		TargetTCPNetSet:       targetTCPNetworkSet,
+		TargetUDPNetSet:       targetUDPNetworkSet,
+		ExclusionsSet:         excludedNetworkSet,
+
+		// IPv4 vs IPv6
+		needICMPRules: n.needICMP,
+
+		// UDP rules
+		UDPSignature: udpSignatureMatch(),
+
+		// Linux PUs
+		TCPPorts:   portList(tcpPorts),
+		UDPPorts:   portList(udpPorts),
+		TCPPortSet: portSetName,
+
+		// ProxyRules
+		DestIPSet:    destSetName,
+		SrvIPSet:     srvSetName,
+		ProxyPort:    servicePort,
+		DNSProxyPort: dnsProxyPort,
+		DNSServerIP:  parseDNSServerIP(),
+		CgroupMark:   mark,
+		ProxyMark:    proxyMark,
+
+		// UID PUs
+		UID:     uid,
+		Mark:    mark,
+		PortSet: portSetName,
+
+		NFLOGPrefix:            policy.DefaultLogPrefix(contextID),
+		NFLOGAcceptPrefix:      policy.DefaultAcceptLogPrefix(contextID),
+		DefaultNFLOGDropPrefix: policy.DefaultDroppedPacketLogPrefix(contextID),
+	}
+}
+
+// getSetNames returns the names of the proxy sets.
+func getSetNames(portSetName string) (string, string) {
+	return portSetName + "-dst", portSetName + "-srv"
+}
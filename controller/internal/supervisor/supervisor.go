@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -11,7 +12,9 @@ import (
 	"go.aporeto.io/trireme-lib/common"
 	"go.aporeto.io/trireme-lib/controller/constants"
 	"go.aporeto.io/trireme-lib/controller/internal/enforcer"
+	"go.aporeto.io/trireme-lib/controller/internal/enforcer/utils/rpcwrapper"
 	"go.aporeto.io/trireme-lib/controller/internal/supervisor/iptablesctrl"
+	"go.aporeto.io/trireme-lib/controller/internal/supervisor/nftctrl"
 	provider "go.aporeto.io/trireme-lib/controller/pkg/aclprovider"
 	"go.aporeto.io/trireme-lib/controller/pkg/fqconfig"
 	"go.aporeto.io/trireme-lib/controller/pkg/packetprocessor"
@@ -21,6 +24,10 @@ import (
 	"go.uber.org/zap"
 )
 
+// errIPTablesNotSupported is returned by the features that need iptables when
+// the implementor has no iptables providers, as with nftables.
+var errIPTablesNotSupported = errors.New("not supported without iptables")
+
 type cacheData struct {
 	version       int
 	ips           policy.ExtendedMap
@@ -29,6 +36,11 @@ type cacheData struct {
 	udpPorts      string
 	username      string
 	containerInfo *policy.PUInfo
+	// puPolicy is the policy of the PU without the learned ACLs.
+	puPolicy *policy.PUPolicy
+	// learnedACLs are the application ACLs that the enforcer learned for
+	// the PU, like the ACLs of the addresses of the DNS answers.
+	learnedACLs policy.IPRuleList
 }
 
 // Config is the structure holding all information about the supervisor
@@ -52,15 +64,17 @@ type Config struct {
 }
 
 // NewSupervisor will create a new connection supervisor that uses IPTables
-// to redirect specific packets to userspace. It instantiates multiple data stores
-// to maintain efficient mappings between contextID, policy and IP addresses. This
-// simplifies the lookup operations at the expense of memory.
+// or nftables, depending on the capture type, to redirect specific packets
+// to userspace. It instantiates multiple data stores to maintain efficient
+// mappings between contextID, policy and IP addresses. This simplifies the
+// lookup operations at the expense of memory.
 func NewSupervisor(
 	collector collector.EventCollector,
 	enforcerInstance enforcer.Enforcer,
 	mode constants.ModeType,
 	cfg *runtime.Configuration,
 	p packetprocessor.PacketProcessor,
+	captureType rpcwrapper.CaptureType,
 ) (Supervisor, error) {
 
 	if collector == nil || enforcerInstance == nil {
@@ -72,12 +86,12 @@ func NewSupervisor(
 		return nil, errors.New("enforcer filter queues cannot be nil")
 	}
 
-	impl, err := iptablesctrl.NewInstance(filterQueue, mode)
+	impl, err := newImplementor(captureType, filterQueue, mode)
 	if err != nil {
 		return nil, fmt.Errorf("unable to initialize supervisor controllers: %s", err)
 	}
 
-	return &Config{
+	s := &Config{
 		mode:           mode,
 		impl:           impl,
 		versionTracker: cache.NewCache("SupVersionTracker"),
@@ -85,7 +99,26 @@ func NewSupervisor(
 		filterQueue:    filterQueue,
 		service:        p,
 		cfg:            cfg,
-	}, nil
+	}
+
+	// The ACLs learned by the enforcer are only enforced for the flows that
+	// the rules capture, so they are added to the rules too.
+	if l, ok := enforcerInstance.(enforcer.ACLLearner); ok {
+		l.SetLearnedACLsHandler(s.updateLearnedACLs)
+	}
+
+	return s, nil
+}
+
+// newImplementor creates the packet filter implementation of the capture type.
+func newImplementor(captureType rpcwrapper.CaptureType, filterQueue *fqconfig.FilterQueue, mode constants.ModeType) (Implementor, error) {
+
+	switch captureType {
+	case rpcwrapper.NFTables:
+		return nftctrl.NewInstance(filterQueue, mode)
+	default:
+		return iptablesctrl.NewInstance(filterQueue, mode)
+	}
 }
 
 // Run starts the supervisor
@@ -103,7 +136,11 @@ func (s *Config) Run(ctx context.Context) error {
 	}
 
 	if s.service != nil {
-		s.service.Initialize(s.filterQueue, s.impl.ACLProvider())
+		ipts := s.impl.ACLProvider()
+		if len(ipts) == 0 {
+			return fmt.Errorf("unable to initialize the datapath service: %s", errIPTablesNotSupported)
+		}
+		s.service.Initialize(s.filterQueue, ipts)
 	}
 
 	return nil
@@ -194,7 +231,8 @@ func (s *Config) doCreatePU(contextID string, pu *policy.PUInfo) error {
 		tcpPorts:      tcpPorts,
 		udpPorts:      udpPorts,
 		username:      pu.Runtime.Options().UserID,
-		containerInfo: pu,
+		containerInfo: policy.PUInfoFromPolicyAndRuntime(pu.ContextID, pu.Policy, pu.Runtime),
+		puPolicy:      pu.Policy,
 	}
 
 	// Version the policy so that we can do hitless policy changes
@@ -228,23 +266,154 @@ func (s *Config) doUpdatePU(contextID string, pu *policy.PUInfo) error {
 
 	c := data.(*cacheData)
 
-	if err := s.impl.UpdateRules(c.version^1, contextID, pu, c.containerInfo); err != nil {
-		// Try to clean up, even though this is fatal and it will most likely fail
-		zap.L().Error("Update rules failed with error", zap.Error(err))
+	if err := s.applyPolicy(contextID, c, pu); err != nil {
+		s.Unlock()
+		s.Unsupervise(contextID) // nolint
+		return err
+	}
+
+	s.Unlock()
+	return nil
+}
+
+// updateLearnedACLs replaces the ACLs that the enforcer learned for the PU
+// and updates its rules with them.
+func (s *Config) updateLearnedACLs(contextID string, rules policy.IPRuleList) error {
+
+	s.Lock()
+
+	data, err := s.versionTracker.Get(contextID)
+	if err != nil {
+		s.Unlock()
+		return fmt.Errorf("unable to find pu %s in cache: %s", contextID, err)
+	}
+
+	c := data.(*cacheData)
+	c.learnedACLs = rules.Copy()
+
+	pu := policy.PUInfoFromPolicyAndRuntime(contextID, c.puPolicy, c.containerInfo.Runtime)
+	if err := s.applyPolicy(contextID, c, pu); err != nil {
 		s.Unlock()
 		s.Unsupervise(contextID) // nolint
 		return err
 	}
 
-	c.version ^= 1
+	s.Unlock()
+	return nil
+}
+
+// applyPolicy updates the rules of the PU with the policy and the learned
+// ACLs of the PU. The caller must hold the lock.
+func (s *Config) applyPolicy(contextID string, c *cacheData, pu *policy.PUInfo) error {
+
+	puPolicy := pu.Policy
+	if len(c.learnedACLs) > 0 {
+		pu = policy.PUInfoFromPolicyAndRuntime(pu.ContextID, puPolicy.Clone(), pu.Runtime)
+		pu.Policy.SetApplicationACLs(mergeLearnedACLs(puPolicy.ApplicationACLs(), c.learnedACLs))
+	}
+
+	// The chains are kept when only the addresses of the ACLs changed.
+	updated, err := s.impl.UpdateACLs(contextID, pu, c.containerInfo)
+	if err != nil {
+		zap.L().Warn("Unable to update the ACLs, updating the rules", zap.Error(err))
+	}
+
+	if !updated || err != nil {
+		if err := s.impl.UpdateRules(c.version^1, contextID, pu, c.containerInfo); err != nil {
+			// Try to clean up, even though this is fatal and it will most likely fail
+			zap.L().Error("Update rules failed with error", zap.Error(err))
+			return err
+		}
+
+		c.version ^= 1
+	}
 
 	// Updated the policy in the cached processing unit.
 	c.containerInfo.Policy = pu.Policy
+	c.puPolicy = puPolicy
 
-	s.Unlock()
 	return nil
 }
 
+// mergeLearnedACLs adds the learned ACLs to the application ACLs. The rules of
+// a service share the ipset of the service, so the learned addresses are
+// added to all the rules of their service. The learned rules are merged by
+// their ports, protocols and policy, in a stable order so that the rules do
+// not change when only the addresses change.
+func mergeLearnedACLs(acls, learned policy.IPRuleList) policy.IPRuleList {
+
+	shape := func(r policy.IPRule) string {
+		return fmt.Sprintf("%q|%q|%q|%s", r.Ports, r.Protocols, r.Extensions, r.Policy.Key())
+	}
+
+	learnedAddresses := map[string]map[string]bool{}
+	learnedRules := map[string]policy.IPRule{}
+	for _, r := range learned {
+		if learnedAddresses[r.Policy.ServiceID] == nil {
+			learnedAddresses[r.Policy.ServiceID] = map[string]bool{}
+		}
+		for _, a := range r.Addresses {
+			learnedAddresses[r.Policy.ServiceID][a] = true
+		}
+		learnedRules[shape(r)] = r
+	}
+
+	addresses := map[string][]string{}
+	known := map[string]map[string]bool{}
+	for _, r := range acls {
+		if learnedAddresses[r.Policy.ServiceID] == nil {
+			continue
+		}
+		if known[r.Policy.ServiceID] == nil {
+			known[r.Policy.ServiceID] = map[string]bool{}
+		}
+		for _, a := range r.Addresses {
+			if !known[r.Policy.ServiceID][a] {
+				known[r.Policy.ServiceID][a] = true
+				addresses[r.Policy.ServiceID] = append(addresses[r.Policy.ServiceID], a)
+			}
+		}
+	}
+
+	for serviceID, learned := range learnedAddresses {
+		sorted := []string{}
+		for a := range learned {
+			if !known[serviceID][a] {
+				sorted = append(sorted, a)
+			}
+		}
+		sort.Strings(sorted)
+		addresses[serviceID] = append(addresses[serviceID], sorted...)
+	}
+
+	merged := make(policy.IPRuleList, 0, len(acls)+len(learnedRules))
+	shapes := map[string]bool{}
+	for _, r := range acls {
+		if a, ok := addresses[r.Policy.ServiceID]; ok {
+			r.Addresses = a
+		}
+		shapes[shape(r)] = true
+		merged = append(merged, r)
+	}
+
+	keys := make([]string, 0, len(learnedRules))
+	for k := range learnedRules {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if shapes[k] {
+			continue
+		}
+		r := learnedRules[k]
+		r.Addresses = addresses[r.Policy.ServiceID]
+		merged = append(merged, r)
+	}
+
+	return merged
+}
+
 // EnableIPTablesPacketTracing enables ip tables packet tracing
 func (s *Config) EnableIPTablesPacketTracing(ctx context.Context, contextID string, interval time.Duration) error {
 
@@ -256,6 +425,9 @@ func (s *Config) EnableIPTablesPacketTracing(ctx context.Context, contextID stri
 	cfg := data.(*cacheData)
 	iptablesRules := debugRules(cfg, s.mode)
 	ipts := s.impl.ACLProvider()
+	if len(ipts) == 0 {
+		return fmt.Errorf("unable to enable packet tracing: %s", errIPTablesNotSupported)
+	}
 
 	for _, ipt := range ipts {
 		for _, rule := range iptablesRules {
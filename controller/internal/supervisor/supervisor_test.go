@@ -14,6 +14,7 @@ import (
 	"go.aporeto.io/trireme-lib/controller/internal/enforcer"
 	"go.aporeto.io/trireme-lib/controller/internal/enforcer/nfqdatapath"
 	"go.aporeto.io/trireme-lib/controller/internal/enforcer/nfqdatapath/afinetrawsocket"
+	"go.aporeto.io/trireme-lib/controller/internal/enforcer/utils/rpcwrapper"
 	"go.aporeto.io/trireme-lib/controller/internal/supervisor/mocksupervisor"
 	provider "go.aporeto.io/trireme-lib/controller/pkg/aclprovider"
 	"go.aporeto.io/trireme-lib/controller/pkg/secrets"
@@ -28,7 +29,7 @@ func newSupervisor(
 	cfg *runtime.Configuration,
 ) (*Config, error) {
 
-	s, err := NewSupervisor(collector, enforcerInstance, mode, cfg, nil)
+	s, err := NewSupervisor(collector, enforcerInstance, mode, cfg, nil, rpcwrapper.IPTables)
 	if err != nil {
 		return nil, err
 	}
@@ -177,6 +178,7 @@ func TestSupervise(t *testing.T) {
 
 		Convey("When I send supervise command for a second time, it should do an update", func() {
 			impl.EXPECT().ConfigureRules(0, "contextID", puInfo).Return(nil)
+			impl.EXPECT().UpdateACLs("contextID", gomock.Any(), gomock.Any()).Return(false, nil)
 			impl.EXPECT().UpdateRules(1, "contextID", gomock.Any(), gomock.Any()).Return(nil)
 			noerr := s.Supervise("contextID", puInfo)
 			So(noerr, ShouldBeNil)
@@ -186,8 +188,35 @@ func TestSupervise(t *testing.T) {
 			})
 		})
 
+		Convey("When I send supervise command for a second time, and only the ACLs changed", func() {
+			impl.EXPECT().ConfigureRules(0, "contextID", puInfo).Return(nil)
+			impl.EXPECT().UpdateACLs("contextID", gomock.Any(), gomock.Any()).Return(true, nil)
+			noerr := s.Supervise("contextID", puInfo)
+			So(noerr, ShouldBeNil)
+			err := s.Supervise("contextID", puInfo)
+			Convey("I should not get an error and the rules should keep their version", func() {
+				So(err, ShouldBeNil)
+				data, err := s.versionTracker.Get("contextID")
+				So(err, ShouldBeNil)
+				So(data.(*cacheData).version, ShouldEqual, 0)
+			})
+		})
+
+		Convey("When I send supervise command for a second time, and the ACL update fails", func() {
+			impl.EXPECT().ConfigureRules(0, "contextID", puInfo).Return(nil)
+			impl.EXPECT().UpdateACLs("contextID", gomock.Any(), gomock.Any()).Return(true, errors.New("error"))
+			impl.EXPECT().UpdateRules(1, "contextID", gomock.Any(), gomock.Any()).Return(nil)
+			noerr := s.Supervise("contextID", puInfo)
+			So(noerr, ShouldBeNil)
+			err := s.Supervise("contextID", puInfo)
+			Convey("I should not get an error, since the rules are updated", func() {
+				So(err, ShouldBeNil)
+			})
+		})
+
 		Convey("When I send supervise command for a second time, and the update fails", func() {
 			impl.EXPECT().ConfigureRules(0, "contextID", puInfo).Return(nil)
+			impl.EXPECT().UpdateACLs("contextID", gomock.Any(), gomock.Any()).Return(false, nil)
 			impl.EXPECT().UpdateRules(1, "contextID", gomock.Any(), gomock.Any()).Return(errors.New("error"))
 			impl.EXPECT().DeleteRules(0, "contextID", gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil)
 			serr := s.Supervise("contextID", puInfo)
@@ -198,6 +227,91 @@ func TestSupervise(t *testing.T) {
 			})
 		})
 
+		Convey("When the enforcer learns ACLs for a PU", func() {
+			learned := policy.IPRuleList{
+				{
+					Addresses: []string{"1.2.3.4"},
+					Ports:     []string{"443"},
+					Protocols: []string{"6"},
+					Policy:    &policy.FlowPolicy{Action: policy.Accept, ServiceID: "dns"},
+				},
+			}
+
+			var applied *policy.PUInfo
+			impl.EXPECT().ConfigureRules(0, "contextID", puInfo).Return(nil)
+			impl.EXPECT().UpdateACLs("contextID", gomock.Any(), gomock.Any()).Return(false, nil)
+			impl.EXPECT().UpdateRules(1, "contextID", gomock.Any(), gomock.Any()).Do(
+				func(_ int, _ string, pu *policy.PUInfo, _ *policy.PUInfo) {
+					applied = pu
+				}).Return(nil)
+			So(s.Supervise("contextID", puInfo), ShouldBeNil)
+			err := s.updateLearnedACLs("contextID", learned)
+
+			Convey("The rules should be updated with the learned ACLs", func() {
+				So(err, ShouldBeNil)
+				So(applied.Policy.ApplicationACLs(), ShouldHaveLength, 3)
+				So(applied.Policy.ApplicationACLs()[2].Addresses, ShouldResemble, []string{"1.2.3.4"})
+				So(puInfo.Policy.ApplicationACLs(), ShouldHaveLength, 2)
+			})
+
+			Convey("The learned ACLs should be kept by the policy updates", func() {
+				impl.EXPECT().UpdateACLs("contextID", gomock.Any(), gomock.Any()).Do(
+					func(_ string, pu *policy.PUInfo, _ *policy.PUInfo) {
+						applied = pu
+					}).Return(true, nil)
+				So(s.Supervise("contextID", createPUInfo()), ShouldBeNil)
+				So(applied.Policy.ApplicationACLs(), ShouldHaveLength, 3)
+			})
+		})
+
+		Convey("When the enforcer learns ACLs for an unknown PU", func() {
+			err := s.updateLearnedACLs("unknown", policy.IPRuleList{})
+			Convey("I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestMergeLearnedACLs(t *testing.T) {
+	Convey("Given application ACLs and learned ACLs", t, func() {
+		rule := func(serviceID string, port string, addresses ...string) policy.IPRule {
+			return policy.IPRule{
+				Addresses: addresses,
+				Ports:     []string{port},
+				Protocols: []string{"6"},
+				Policy:    &policy.FlowPolicy{Action: policy.Accept, ServiceID: serviceID},
+			}
+		}
+
+		acls := policy.IPRuleList{
+			rule("web", "80", "10.0.0.0/8"),
+			rule("s3", "443", "52.0.0.1"),
+		}
+
+		learned := policy.IPRuleList{
+			rule("dns", "443", "1.2.3.5"),
+			rule("dns", "80", "1.2.3.4"),
+			rule("dns", "443", "1.2.3.4"),
+			rule("s3", "443", "52.0.0.2"),
+		}
+
+		merged := mergeLearnedACLs(acls, learned)
+
+		Convey("The learned rules should be merged in a stable order", func() {
+			So(merged, ShouldHaveLength, 4)
+			So(merged[0], ShouldResemble, acls[0])
+			So(merged[2].Ports, ShouldResemble, []string{"443"})
+			So(merged[3].Ports, ShouldResemble, []string{"80"})
+			So(merged, ShouldResemble, mergeLearnedACLs(acls, policy.IPRuleList{learned[3], learned[2], learned[1], learned[0]}))
+		})
+
+		Convey("The rules of a service should have all its addresses", func() {
+			So(merged[1].Addresses, ShouldResemble, []string{"52.0.0.1", "52.0.0.2"})
+			So(merged[2].Addresses, ShouldResemble, []string{"1.2.3.4", "1.2.3.5"})
+			So(merged[3].Addresses, ShouldResemble, []string{"1.2.3.4", "1.2.3.5"})
+			So(acls[1].Addresses, ShouldResemble, []string{"52.0.0.1"})
+		})
 	})
 }
 
@@ -378,6 +492,16 @@ func TestEnableIPTablesPacketTracing(t *testing.T) {
 			err := s.EnableIPTablesPacketTracing(context.Background(), "contextID", 10*time.Second)
 			So(err, ShouldBeNil)
 		})
+		Convey("I setup EnableIPTablesTracing without iptables providers", func() {
+			puInfo := createPUInfo()
+			impl.EXPECT().ConfigureRules(0, "contextID", puInfo).Return(nil)
+
+			serr := s.Supervise("contextID", puInfo)
+			So(serr, ShouldBeNil)
+			impl.EXPECT().ACLProvider().Times(1).Return([]provider.IptablesProvider{})
+			err := s.EnableIPTablesPacketTracing(context.Background(), "contextID", 10*time.Second)
+			So(err, ShouldNotBeNil)
+		})
 	})
 }
 
@@ -11,7 +11,9 @@ import (
 
 	gomock "github.com/golang/mock/gomock"
 	common "go.aporeto.io/trireme-lib/common"
+	canary "go.aporeto.io/trireme-lib/controller/pkg/canary"
 	packettracing "go.aporeto.io/trireme-lib/controller/pkg/packettracing"
+	policyhistory "go.aporeto.io/trireme-lib/controller/pkg/policyhistory"
 	secrets "go.aporeto.io/trireme-lib/controller/pkg/secrets"
 	runtime "go.aporeto.io/trireme-lib/controller/runtime"
 	policy "go.aporeto.io/trireme-lib/policy"
@@ -170,6 +172,64 @@ func (mr *MockTriremeControllerMockRecorder) EnableIPTablesPacketTracing(ctx, co
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EnableIPTablesPacketTracing", reflect.TypeOf((*MockTriremeController)(nil).EnableIPTablesPacketTracing), ctx, contextID, interval, putype)
 }
 
+// PolicyVersions mocks base method
+// nolint
+func (m *MockTriremeController) PolicyVersions(puID string) ([]*policyhistory.Version, error) {
+	ret := m.ctrl.Call(m, "PolicyVersions", puID)
+	ret0, _ := ret[0].([]*policyhistory.Version)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PolicyVersions indicates an expected call of PolicyVersions
+// nolint
+func (mr *MockTriremeControllerMockRecorder) PolicyVersions(puID interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PolicyVersions", reflect.TypeOf((*MockTriremeController)(nil).PolicyVersions), puID)
+}
+
+// DiffPolicyVersions mocks base method
+// nolint
+func (m *MockTriremeController) DiffPolicyVersions(puID string, from, to int) (*policy.PolicyDiff, error) {
+	ret := m.ctrl.Call(m, "DiffPolicyVersions", puID, from, to)
+	ret0, _ := ret[0].(*policy.PolicyDiff)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DiffPolicyVersions indicates an expected call of DiffPolicyVersions
+// nolint
+func (mr *MockTriremeControllerMockRecorder) DiffPolicyVersions(puID, from, to interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DiffPolicyVersions", reflect.TypeOf((*MockTriremeController)(nil).DiffPolicyVersions), puID, from, to)
+}
+
+// RollbackPolicy mocks base method
+// nolint
+func (m *MockTriremeController) RollbackPolicy(ctx context.Context, puID string, version int) error {
+	ret := m.ctrl.Call(m, "RollbackPolicy", ctx, puID, version)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RollbackPolicy indicates an expected call of RollbackPolicy
+// nolint
+func (mr *MockTriremeControllerMockRecorder) RollbackPolicy(ctx, puID, version interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RollbackPolicy", reflect.TypeOf((*MockTriremeController)(nil).RollbackPolicy), ctx, puID, version)
+}
+
+// CanaryUpdatePolicy mocks base method
+// nolint
+func (m *MockTriremeController) CanaryUpdatePolicy(ctx context.Context, puID string, policy *policy.PUPolicy, runtime *policy.PURuntime, cfg *canary.Config) error {
+	ret := m.ctrl.Call(m, "CanaryUpdatePolicy", ctx, puID, policy, runtime, cfg)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CanaryUpdatePolicy indicates an expected call of CanaryUpdatePolicy
+// nolint
+func (mr *MockTriremeControllerMockRecorder) CanaryUpdatePolicy(ctx, puID, policy, runtime, cfg interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CanaryUpdatePolicy", reflect.TypeOf((*MockTriremeController)(nil).CanaryUpdatePolicy), ctx, puID, policy, runtime, cfg)
+}
+
 // MockDebugInfo is a mock of DebugInfo interface
 // nolint
 type MockDebugInfo struct {
@@ -224,3 +284,115 @@ func (m *MockDebugInfo) EnableIPTablesPacketTracing(ctx context.Context, context
 func (mr *MockDebugInfoMockRecorder) EnableIPTablesPacketTracing(ctx, contextID, interval, putype interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EnableIPTablesPacketTracing", reflect.TypeOf((*MockDebugInfo)(nil).EnableIPTablesPacketTracing), ctx, contextID, interval, putype)
 }
+
+// MockPolicyHistory is a mock of PolicyHistory interface
+// nolint
+type MockPolicyHistory struct {
+	ctrl     *gomock.Controller
+	recorder *MockPolicyHistoryMockRecorder
+}
+
+// MockPolicyHistoryMockRecorder is the mock recorder for MockPolicyHistory
+// nolint
+type MockPolicyHistoryMockRecorder struct {
+	mock *MockPolicyHistory
+}
+
+// NewMockPolicyHistory creates a new mock instance
+// nolint
+func NewMockPolicyHistory(ctrl *gomock.Controller) *MockPolicyHistory {
+	mock := &MockPolicyHistory{ctrl: ctrl}
+	mock.recorder = &MockPolicyHistoryMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+// nolint
+func (m *MockPolicyHistory) EXPECT() *MockPolicyHistoryMockRecorder {
+	return m.recorder
+}
+
+// PolicyVersions mocks base method
+// nolint
+func (m *MockPolicyHistory) PolicyVersions(puID string) ([]*policyhistory.Version, error) {
+	ret := m.ctrl.Call(m, "PolicyVersions", puID)
+	ret0, _ := ret[0].([]*policyhistory.Version)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PolicyVersions indicates an expected call of PolicyVersions
+// nolint
+func (mr *MockPolicyHistoryMockRecorder) PolicyVersions(puID interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PolicyVersions", reflect.TypeOf((*MockPolicyHistory)(nil).PolicyVersions), puID)
+}
+
+// DiffPolicyVersions mocks base method
+// nolint
+func (m *MockPolicyHistory) DiffPolicyVersions(puID string, from, to int) (*policy.PolicyDiff, error) {
+	ret := m.ctrl.Call(m, "DiffPolicyVersions", puID, from, to)
+	ret0, _ := ret[0].(*policy.PolicyDiff)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DiffPolicyVersions indicates an expected call of DiffPolicyVersions
+// nolint
+func (mr *MockPolicyHistoryMockRecorder) DiffPolicyVersions(puID, from, to interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DiffPolicyVersions", reflect.TypeOf((*MockPolicyHistory)(nil).DiffPolicyVersions), puID, from, to)
+}
+
+// RollbackPolicy mocks base method
+// nolint
+func (m *MockPolicyHistory) RollbackPolicy(ctx context.Context, puID string, version int) error {
+	ret := m.ctrl.Call(m, "RollbackPolicy", ctx, puID, version)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RollbackPolicy indicates an expected call of RollbackPolicy
+// nolint
+func (mr *MockPolicyHistoryMockRecorder) RollbackPolicy(ctx, puID, version interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RollbackPolicy", reflect.TypeOf((*MockPolicyHistory)(nil).RollbackPolicy), ctx, puID, version)
+}
+
+// MockPolicyCanary is a mock of PolicyCanary interface
+// nolint
+type MockPolicyCanary struct {
+	ctrl     *gomock.Controller
+	recorder *MockPolicyCanaryMockRecorder
+}
+
+// MockPolicyCanaryMockRecorder is the mock recorder for MockPolicyCanary
+// nolint
+type MockPolicyCanaryMockRecorder struct {
+	mock *MockPolicyCanary
+}
+
+// NewMockPolicyCanary creates a new mock instance
+// nolint
+func NewMockPolicyCanary(ctrl *gomock.Controller) *MockPolicyCanary {
+	mock := &MockPolicyCanary{ctrl: ctrl}
+	mock.recorder = &MockPolicyCanaryMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+// nolint
+func (m *MockPolicyCanary) EXPECT() *MockPolicyCanaryMockRecorder {
+	return m.recorder
+}
+
+// CanaryUpdatePolicy mocks base method
+// nolint
+func (m *MockPolicyCanary) CanaryUpdatePolicy(ctx context.Context, puID string, policy *policy.PUPolicy, runtime *policy.PURuntime, cfg *canary.Config) error {
+	ret := m.ctrl.Call(m, "CanaryUpdatePolicy", ctx, puID, policy, runtime, cfg)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CanaryUpdatePolicy indicates an expected call of CanaryUpdatePolicy
+// nolint
+func (mr *MockPolicyCanaryMockRecorder) CanaryUpdatePolicy(ctx, puID, policy, runtime, cfg interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CanaryUpdatePolicy", reflect.TypeOf((*MockPolicyCanary)(nil).CanaryUpdatePolicy), ctx, puID, policy, runtime, cfg)
+}
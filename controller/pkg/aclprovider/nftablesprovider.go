@@ -0,0 +1,77 @@
+package provider
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+const nftCmd = "nft"
+
+// NftablesProvider is an abstraction of the userspace nftables utility. The
+// rulesets are applied as a batch, so that all the changes of a ruleset are
+// committed to the kernel in a single transaction.
+type NftablesProvider interface {
+	// Apply applies the given ruleset.
+	Apply(ruleset string) error
+}
+
+// NftBatchProvider uses nft -f to program rulesets.
+type NftBatchProvider struct {
+	path string
+
+	// Allowing for custom apply functions for testing
+	applyFunc func(ruleset string) error
+	sync.Mutex
+}
+
+// NewNftablesProvider returns an NftablesProvider interface based on the
+// nft utility.
+func NewNftablesProvider() (*NftBatchProvider, error) {
+
+	path, err := exec.LookPath(nftCmd)
+	if err != nil {
+		return nil, fmt.Errorf("nft is not available: %s", err)
+	}
+
+	n := &NftBatchProvider{
+		path: path,
+	}
+
+	n.applyFunc = n.restore
+
+	return n, nil
+}
+
+// NewCustomNftablesProvider is a custom nftables provider where the apply
+// function is provided by the caller. Very useful for testing the rulesets
+// with a mock.
+func NewCustomNftablesProvider(apply func(ruleset string) error) *NftBatchProvider {
+	return &NftBatchProvider{
+		applyFunc: apply,
+	}
+}
+
+// Apply applies the ruleset in a single transaction.
+func (n *NftBatchProvider) Apply(ruleset string) error {
+	n.Lock()
+	defer n.Unlock()
+
+	return n.applyFunc(ruleset)
+}
+
+// restore feeds the ruleset to nft -f.
+func (n *NftBatchProvider) restore(ruleset string) error {
+
+	cmd := exec.Command(n.path, "-f", "-")
+	cmd.Stdin = bytes.NewBufferString(ruleset)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("unable to apply ruleset: %s: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
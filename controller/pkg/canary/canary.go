@@ -0,0 +1,146 @@
+package canary
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.aporeto.io/trireme-lib/collector"
+)
+
+// Config configures the canary rollout of a policy. The candidate policy is
+// observed during the window and promoted if the rate of the flows it would
+// drop stays under the threshold.
+type Config struct {
+	// Window is how long the candidate policy is observed.
+	Window time.Duration
+	// MaxDropRate is the highest rate of flows the candidate policy may drop,
+	// between 0 and 1.
+	MaxDropRate float64
+	// MinFlows is the number of flows that must be observed to promote the
+	// candidate policy.
+	MinFlows uint64
+	// Notify is called with the result of the rollout. It is optional.
+	Notify func(*Result)
+}
+
+// Validate validates the configuration.
+func (c *Config) Validate() error {
+
+	if c.Window <= 0 {
+		return errors.New("canary window must be positive")
+	}
+
+	if c.MaxDropRate < 0 || c.MaxDropRate > 1 {
+		return errors.New("canary drop rate must be between 0 and 1")
+	}
+
+	return nil
+}
+
+// Result is the outcome of the canary rollout of a policy.
+type Result struct {
+	ContextID string
+	// Flows is the number of flows observed.
+	Flows uint64
+	// Drops is the number of flows the candidate policy would drop.
+	Drops uint64
+	// Promoted is true if the candidate policy is enforced.
+	Promoted bool
+	// Error is the reason the rollout was aborted.
+	Error error
+}
+
+// DropRate returns the rate of the observed flows the candidate policy would drop.
+func (r *Result) DropRate() float64 {
+
+	if r.Flows == 0 {
+		return 0
+	}
+
+	return float64(r.Drops) / float64(r.Flows)
+}
+
+// Evaluate decides if the candidate policy can be promoted with the given configuration.
+func (r *Result) Evaluate(cfg *Config) {
+
+	switch {
+	case r.Flows < cfg.MinFlows:
+		r.Error = errors.New("not enough flows observed")
+	case r.DropRate() > cfg.MaxDropRate:
+		r.Error = errors.New("drop rate above threshold")
+	default:
+		r.Promoted = true
+	}
+}
+
+// counter counts the flows of a PU under observation.
+type counter struct {
+	flows       uint64
+	drops       uint64
+	defaultDrop bool
+}
+
+// observe counts the flow. A flow would be dropped by the candidate policy if
+// an observed rule rejects it, or if no observed rule matches it and the
+// candidate policy rejects the flows that match no rule.
+func (c *counter) observe(record *collector.FlowRecord) {
+
+	count := uint64(record.Count)
+	if count == 0 {
+		count = 1
+	}
+
+	atomic.AddUint64(&c.flows, count)
+
+	if record.ObservedAction.Rejected() || (record.ObservedPolicyID == "" && c.defaultDrop && !record.Action.Rejected()) {
+		atomic.AddUint64(&c.drops, count)
+	}
+}
+
+// Collector is an event collector that counts the flows of the PUs under
+// observation before forwarding all the events to the wrapped collector.
+type Collector struct {
+	collector.EventCollector
+
+	counters sync.Map
+}
+
+// NewCollector wraps the collector.
+func NewCollector(c collector.EventCollector) *Collector {
+
+	return &Collector{
+		EventCollector: c,
+	}
+}
+
+// CollectFlowEvent counts the flow if its PU is under observation and forwards it.
+func (c *Collector) CollectFlowEvent(record *collector.FlowRecord) {
+
+	if cnt, ok := c.counters.Load(record.ContextID); ok {
+		cnt.(*counter).observe(record)
+	}
+
+	c.EventCollector.CollectFlowEvent(record)
+}
+
+// Start starts counting the flows of the PU. If defaultDrop is true, the
+// flows that match no observed rule are counted as drops.
+func (c *Collector) Start(contextID string, defaultDrop bool) {
+	c.counters.Store(contextID, &counter{defaultDrop: defaultDrop})
+}
+
+// Stop stops counting the flows of the PU and returns the counts.
+func (c *Collector) Stop(contextID string) *Result {
+
+	r := &Result{ContextID: contextID}
+
+	if cnt, ok := c.counters.Load(contextID); ok {
+		c.counters.Delete(contextID)
+		r.Flows = atomic.LoadUint64(&cnt.(*counter).flows)
+		r.Drops = atomic.LoadUint64(&cnt.(*counter).drops)
+	}
+
+	return r
+}
@@ -0,0 +1,88 @@
+package canary
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/trireme-lib/collector"
+	"go.aporeto.io/trireme-lib/policy"
+)
+
+// flowCollector counts the flow events it receives
+type flowCollector struct {
+	collector.EventCollector
+	flows int
+}
+
+func (c *flowCollector) CollectFlowEvent(record *collector.FlowRecord) {
+	c.flows++
+}
+
+func TestCollector(t *testing.T) {
+	Convey("Given a canary collector", t, func() {
+
+		forwarded := &flowCollector{}
+		c := NewCollector(forwarded)
+
+		accepted := &collector.FlowRecord{ContextID: "pu1", Count: 1, Action: policy.Accept, ObservedPolicyID: "new", ObservedAction: policy.Accept | policy.Observe}
+		dropped := &collector.FlowRecord{ContextID: "pu1", Count: 2, Action: policy.Accept, ObservedPolicyID: "new", ObservedAction: policy.Reject | policy.Observe}
+		unmatched := &collector.FlowRecord{ContextID: "pu1", Count: 1, Action: policy.Accept}
+		rejected := &collector.FlowRecord{ContextID: "pu1", Count: 1, Action: policy.Reject}
+		other := &collector.FlowRecord{ContextID: "pu2", Count: 1, Action: policy.Accept}
+
+		Convey("All the flows should be forwarded and the flows of the observed PU counted", func() {
+			c.CollectFlowEvent(accepted)
+			c.Start("pu1", true)
+			for _, r := range []*collector.FlowRecord{accepted, dropped, unmatched, rejected, other} {
+				c.CollectFlowEvent(r)
+			}
+
+			r := c.Stop("pu1")
+			So(r.ContextID, ShouldEqual, "pu1")
+			So(r.Flows, ShouldEqual, 5)
+			So(r.Drops, ShouldEqual, 3)
+			So(r.DropRate(), ShouldAlmostEqual, 0.6)
+
+			So(c.Stop("pu1").Flows, ShouldEqual, 0)
+			So(forwarded.flows, ShouldEqual, 6)
+		})
+
+		Convey("Unmatched flows should not be drops if the candidate accepts them by default", func() {
+			c.Start("pu1", false)
+			c.CollectFlowEvent(unmatched)
+			So(c.Stop("pu1").Drops, ShouldEqual, 0)
+		})
+	})
+}
+
+func TestEvaluate(t *testing.T) {
+	Convey("Given a canary configuration", t, func() {
+
+		cfg := &Config{Window: time.Minute, MaxDropRate: 0.1, MinFlows: 10}
+		So(cfg.Validate(), ShouldBeNil)
+		So((&Config{MaxDropRate: 0.1}).Validate(), ShouldNotBeNil)
+		So((&Config{Window: time.Minute, MaxDropRate: 2}).Validate(), ShouldNotBeNil)
+
+		Convey("A low drop rate should be promoted", func() {
+			r := &Result{Flows: 100, Drops: 10}
+			r.Evaluate(cfg)
+			So(r.Promoted, ShouldBeTrue)
+			So(r.Error, ShouldBeNil)
+		})
+
+		Convey("A high drop rate should be aborted", func() {
+			r := &Result{Flows: 100, Drops: 11}
+			r.Evaluate(cfg)
+			So(r.Promoted, ShouldBeFalse)
+			So(r.Error, ShouldNotBeNil)
+		})
+
+		Convey("Too few flows should be aborted", func() {
+			r := &Result{Flows: 9}
+			r.Evaluate(cfg)
+			So(r.Promoted, ShouldBeFalse)
+			So(r.Error, ShouldNotBeNil)
+		})
+	})
+}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"go.aporeto.io/trireme-lib/controller/internal/enforcer/nfqdatapath/afinetrawsocket"
+	"go.aporeto.io/trireme-lib/controller/pkg/flowcrypto"
 	"go.aporeto.io/trireme-lib/controller/pkg/packet"
 	"go.aporeto.io/trireme-lib/controller/pkg/pucontext"
 	"go.aporeto.io/trireme-lib/policy"
@@ -149,6 +150,9 @@ type TCPConnection struct {
 	// PacketFlowPolicy holds the last matched actual policy
 	PacketFlowPolicy *policy.FlowPolicy
 
+	// FlowCipher encrypts the payloads of the connection if the policy requires encryption
+	FlowCipher *flowcrypto.Cipher
+
 	// MarkForDeletion -- this is is used only in conjunction with serviceconnection. Its a hint for us if we have a fin for an earlier connection
 	// and this is reused port flow.
 	MarkForDeletion bool
@@ -293,6 +297,8 @@ type UDPConnection struct {
 	PacketFlowPolicy *policy.FlowPolicy
 	// ServiceData allows services to associate state with a connection
 	ServiceData interface{}
+	// FlowCipher encrypts the payloads of the connection if the policy requires encryption
+	FlowCipher *flowcrypto.Cipher
 
 	// PacketQueue indicates app UDP packets queued while authorization is in progress.
 	PacketQueue chan *packet.Packet
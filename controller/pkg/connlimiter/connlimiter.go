@@ -0,0 +1,90 @@
+package connlimiter
+
+import "sync"
+
+// flow is a connection counted by the limiter
+type flow struct {
+	group string
+	peer  string
+}
+
+// Limiter counts the live connections of groups of connections and of the
+// peers in each group, and refuses the connections above the limits.
+type Limiter struct {
+	flows  map[string]flow
+	counts map[string]int
+
+	sync.Mutex
+}
+
+// New returns a new connection limiter.
+func New() *Limiter {
+
+	return &Limiter{
+		flows:  map[string]flow{},
+		counts: map[string]int{},
+	}
+}
+
+// Admit counts the connection identified by id in the group and returns true
+// if neither the group nor the peer have reached their limit. Connections
+// that are already counted are always admitted. A limit of zero means no limit.
+func (l *Limiter) Admit(id, group, peer string, max, maxPerPeer int) bool {
+
+	l.Lock()
+	defer l.Unlock()
+
+	if _, ok := l.flows[id]; ok {
+		return true
+	}
+
+	peerKey := peerKey(group, peer)
+
+	if max > 0 && l.counts[group] >= max {
+		return false
+	}
+
+	if maxPerPeer > 0 && l.counts[peerKey] >= maxPerPeer {
+		return false
+	}
+
+	l.flows[id] = flow{group: group, peer: peerKey}
+	l.counts[group]++
+	l.counts[peerKey]++
+
+	return true
+}
+
+// Release stops counting the connection identified by id.
+func (l *Limiter) Release(id string) {
+
+	l.Lock()
+	defer l.Unlock()
+
+	f, ok := l.flows[id]
+	if !ok {
+		return
+	}
+
+	delete(l.flows, id)
+
+	for _, k := range []string{f.group, f.peer} {
+		if l.counts[k]--; l.counts[k] <= 0 {
+			delete(l.counts, k)
+		}
+	}
+}
+
+// Count returns the number of connections of the group and of the peer in the group.
+func (l *Limiter) Count(group, peer string) (int, int) {
+
+	l.Lock()
+	defer l.Unlock()
+
+	return l.counts[group], l.counts[peerKey(group, peer)]
+}
+
+// peerKey returns the key of the peer counter of the group
+func peerKey(group, peer string) string {
+	return group + "/" + peer
+}
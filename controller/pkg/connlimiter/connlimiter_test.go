@@ -0,0 +1,57 @@
+package connlimiter
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAdmit(t *testing.T) {
+	Convey("Given a limiter", t, func() {
+
+		l := New()
+
+		Convey("When there is no limit, all the connections should be admitted", func() {
+			for i := 0; i < 100; i++ {
+				So(l.Admit(string(rune('a'+i)), "pu1", "peer", 0, 0), ShouldBeTrue)
+			}
+			total, peer := l.Count("pu1", "peer")
+			So(total, ShouldEqual, 100)
+			So(peer, ShouldEqual, 100)
+		})
+
+		Convey("When the group reaches its limit, the connections should be refused", func() {
+			So(l.Admit("f1", "pu1", "peer1", 2, 0), ShouldBeTrue)
+			So(l.Admit("f2", "pu1", "peer2", 2, 0), ShouldBeTrue)
+			So(l.Admit("f3", "pu1", "peer3", 2, 0), ShouldBeFalse)
+
+			Convey("Counted connections should still be admitted", func() {
+				So(l.Admit("f1", "pu1", "peer1", 2, 0), ShouldBeTrue)
+			})
+
+			Convey("Other groups should have their own limit", func() {
+				So(l.Admit("f3", "pu2", "peer3", 2, 0), ShouldBeTrue)
+			})
+
+			Convey("Released connections should free their slot", func() {
+				l.Release("f1")
+				l.Release("f1")
+				So(l.Admit("f3", "pu1", "peer3", 2, 0), ShouldBeTrue)
+				So(l.Admit("f4", "pu1", "peer3", 2, 0), ShouldBeFalse)
+			})
+		})
+
+		Convey("When a peer reaches its limit, only its connections should be refused", func() {
+			So(l.Admit("f1", "pu1", "peer1", 10, 1), ShouldBeTrue)
+			So(l.Admit("f2", "pu1", "peer1", 10, 1), ShouldBeFalse)
+			So(l.Admit("f3", "pu1", "peer2", 10, 1), ShouldBeTrue)
+
+			l.Release("f1")
+			l.Release("f3")
+			total, peer := l.Count("pu1", "peer1")
+			So(total, ShouldEqual, 0)
+			So(peer, ShouldEqual, 0)
+			So(l.counts, ShouldBeEmpty)
+		})
+	})
+}
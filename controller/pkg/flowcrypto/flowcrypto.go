@@ -0,0 +1,415 @@
+// Package flowcrypto implements the encryption of the payloads of flows whose
+// policy requires encryption. The keys of a flow are derived from the ephemeral
+// keys that the two enforcers exchange in the EK claim of the handshake tokens
+// and the nonces of the connection, so every flow has its own keys and every
+// direction of the flow has its own key.
+//
+// TCP payloads are encrypted with AES-CTR, indexed by the sequence number of the
+// segment, so that the size of the payload and the sequence space are not
+// modified. The authentication tag of the segment is carried in an experimental
+// TCP option. UDP payloads are sealed with AES-GCM and they grow by UDPOverhead
+// bytes. Replayed UDP payloads are rejected with a sliding window of counters.
+package flowcrypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const (
+	// TCPOptionKind is the experimental TCP option (RFC 6994) that carries the
+	// authentication tag of an encrypted segment.
+	TCPOptionKind = uint8(253)
+
+	// TCPOptionLength is the length of the TCP option. It is a multiple of 4
+	// so that it can be appended to the TCP header without padding.
+	TCPOptionLength = 12
+
+	// UDPOverhead is the number of bytes added to an encrypted UDP payload.
+	UDPOverhead = udpCounterLength + udpTagLength
+
+	// tcpOptionExID is the experiment identifier of the TCP option.
+	tcpOptionExID = uint16(0x4150)
+
+	// tcpTagLength is the length of the truncated authentication tag of TCP segments.
+	tcpTagLength = TCPOptionLength - 4
+
+	// udpCounterLength is the length of the explicit nonce of UDP payloads.
+	udpCounterLength = 8
+
+	// udpTagLength is the length of the authentication tag of UDP payloads.
+	udpTagLength = 16
+
+	// keyLength is the length of the AES and HMAC keys.
+	keyLength = 32
+
+	// saltLength is the length of the implicit part of the UDP nonces.
+	saltLength = 4
+
+	// udpReplayWindow is the number of counters below the highest received
+	// counter that are still accepted, so that reordered datagrams are not
+	// dropped.
+	udpReplayWindow = 64
+)
+
+var (
+	// ErrAuthenticationFailed is returned when a payload fails authentication.
+	ErrAuthenticationFailed = errors.New("payload authentication failed")
+
+	// ErrInvalidOption is returned when the TCP option of a segment is malformed.
+	ErrInvalidOption = errors.New("invalid encryption option")
+
+	// ErrShortPayload is returned when an encrypted UDP payload is too short.
+	ErrShortPayload = errors.New("encrypted payload too short")
+
+	// ErrReplayedPayload is returned when an encrypted UDP payload was already
+	// received or is too old to be checked.
+	ErrReplayedPayload = errors.New("replayed payload")
+)
+
+// GenerateKey generates an ephemeral key and returns the key with its public
+// part encoded for the EK claim.
+func GenerateKey() (*ecdsa.PrivateKey, []byte, error) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to generate ephemeral key: %s", err)
+	}
+
+	return key, elliptic.Marshal(key.Curve, key.PublicKey.X, key.PublicKey.Y), nil
+}
+
+// Cipher encrypts and decrypts the payloads of a single flow.
+type Cipher struct {
+	tx *direction
+	rx *direction
+}
+
+// direction holds the keys and the state of one direction of the flow.
+type direction struct {
+	block  cipher.Block
+	iv     []byte
+	macKey []byte
+	aead   cipher.AEAD
+	salt   []byte
+
+	// counter is the last UDP counter sent by the tx direction and the
+	// highest UDP counter received by the rx direction. The bit n of the
+	// window is set if the counter-n was received.
+	counter uint64
+	window  uint64
+	seq     uint64
+	seqSet  bool
+
+	sync.Mutex
+}
+
+// NewCipher derives the keys of a flow. The local key is the ephemeral key of
+// the PU and the remote key is the EK claim of the peer. The nonces are the
+// random contexts that the client and the server exchanged in the handshake.
+func NewCipher(local *ecdsa.PrivateKey, remote []byte, clientNonce, serverNonce []byte, client bool) (*Cipher, error) {
+
+	if local == nil {
+		return nil, errors.New("no local encryption key")
+	}
+
+	x, y := elliptic.Unmarshal(local.Curve, remote)
+	if x == nil {
+		return nil, errors.New("invalid remote encryption key")
+	}
+
+	shared, _ := local.Curve.ScalarMult(x, y, local.D.Bytes())
+	secret := make([]byte, (local.Curve.Params().BitSize+7)/8)
+	sb := shared.Bytes()
+	copy(secret[len(secret)-len(sb):], sb)
+
+	salt := make([]byte, 0, len(clientNonce)+len(serverNonce))
+	salt = append(salt, clientNonce...)
+	salt = append(salt, serverNonce...)
+	prk := hkdfExtract(salt, secret)
+
+	c2s, err := newDirection(prk, "client to server")
+	if err != nil {
+		return nil, err
+	}
+
+	s2c, err := newDirection(prk, "server to client")
+	if err != nil {
+		return nil, err
+	}
+
+	if client {
+		return &Cipher{tx: c2s, rx: s2c}, nil
+	}
+
+	return &Cipher{tx: s2c, rx: c2s}, nil
+}
+
+// newDirection derives the keys of one direction of the flow.
+func newDirection(prk []byte, label string) (*direction, error) {
+
+	material := hkdfExpand(prk, []byte("trireme flow encryption "+label), keyLength+aes.BlockSize+keyLength+saltLength)
+
+	block, err := aes.NewCipher(material[:keyLength])
+	if err != nil {
+		return nil, fmt.Errorf("unable to create cipher: %s", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create aead: %s", err)
+	}
+
+	material = material[keyLength:]
+
+	return &direction{
+		block:  block,
+		iv:     material[:aes.BlockSize],
+		macKey: material[aes.BlockSize : aes.BlockSize+keyLength],
+		aead:   aead,
+		salt:   material[aes.BlockSize+keyLength:],
+	}, nil
+}
+
+// EncryptTCP encrypts the payload of a segment in place and returns the TCP
+// option that must be appended to the segment.
+func (c *Cipher) EncryptTCP(seq uint32, payload []byte) []byte {
+
+	d := c.tx
+	d.Lock()
+	offset := d.extend(seq)
+	d.Unlock()
+
+	d.xorKeyStream(offset, payload)
+
+	option := make([]byte, TCPOptionLength)
+	option[0] = TCPOptionKind
+	option[1] = TCPOptionLength
+	binary.BigEndian.PutUint16(option[2:4], tcpOptionExID)
+	copy(option[4:], d.tcpTag(offset, payload))
+
+	return option
+}
+
+// DecryptTCP authenticates the payload of a segment with the TCP option of
+// the segment and decrypts the payload in place.
+func (c *Cipher) DecryptTCP(seq uint32, payload []byte, option []byte) error {
+
+	if len(option) != TCPOptionLength || option[0] != TCPOptionKind || option[1] != TCPOptionLength ||
+		binary.BigEndian.Uint16(option[2:4]) != tcpOptionExID {
+		return ErrInvalidOption
+	}
+
+	d := c.rx
+	d.Lock()
+	defer d.Unlock()
+
+	offset := d.candidate(seq)
+	if !hmac.Equal(option[4:], d.tcpTag(offset, payload)) {
+		return ErrAuthenticationFailed
+	}
+
+	// Only authenticated segments move the sequence space forward.
+	d.extend(seq)
+	d.xorKeyStream(offset, payload)
+
+	return nil
+}
+
+// EncryptUDP seals a UDP payload and returns the encrypted payload.
+func (c *Cipher) EncryptUDP(payload []byte) []byte {
+
+	d := c.tx
+	d.Lock()
+	d.counter++
+	counter := d.counter
+	d.Unlock()
+
+	data := make([]byte, udpCounterLength, udpCounterLength+len(payload)+udpTagLength)
+	binary.BigEndian.PutUint64(data, counter)
+
+	return d.aead.Seal(data, d.nonce(data[:udpCounterLength]), payload, nil)
+}
+
+// DecryptUDP opens an encrypted UDP payload and returns the plain payload.
+func (c *Cipher) DecryptUDP(data []byte) ([]byte, error) {
+
+	if len(data) < UDPOverhead {
+		return nil, ErrShortPayload
+	}
+
+	d := c.rx
+	d.Lock()
+	defer d.Unlock()
+
+	counter := binary.BigEndian.Uint64(data[:udpCounterLength])
+	if d.replayed(counter) {
+		return nil, ErrReplayedPayload
+	}
+
+	payload, err := d.aead.Open(nil, d.nonce(data[:udpCounterLength]), data[udpCounterLength:], nil)
+	if err != nil {
+		return nil, ErrAuthenticationFailed
+	}
+
+	// Only authenticated datagrams move the replay window.
+	d.received(counter)
+
+	return payload, nil
+}
+
+// replayed returns true if the UDP counter was already received or if it is
+// older than the replay window. The counters start at 1.
+func (d *direction) replayed(counter uint64) bool {
+
+	if counter == 0 {
+		return true
+	}
+
+	if counter > d.counter {
+		return false
+	}
+
+	n := d.counter - counter
+
+	return n >= udpReplayWindow || d.window&(1<<n) != 0
+}
+
+// received records a received UDP counter and slides the replay window.
+func (d *direction) received(counter uint64) {
+
+	if counter <= d.counter {
+		d.window |= 1 << (d.counter - counter)
+		return
+	}
+
+	if n := counter - d.counter; n < udpReplayWindow {
+		d.window = d.window<<n | 1
+	} else {
+		d.window = 1
+	}
+	d.counter = counter
+}
+
+// candidate returns the 64-bit offset of a sequence number, assuming that it is
+// within 2^31 bytes of the highest sequence number seen in this direction.
+func (d *direction) candidate(seq uint32) uint64 {
+
+	if !d.seqSet {
+		return uint64(seq)
+	}
+
+	offset := d.seq&^0xffffffff | uint64(seq)
+	switch {
+	case offset > d.seq && offset-d.seq > 1<<31 && offset >= 1<<32:
+		offset -= 1 << 32
+	case offset < d.seq && d.seq-offset > 1<<31:
+		offset += 1 << 32
+	}
+
+	return offset
+}
+
+// extend returns the 64-bit offset of a sequence number and records it if it
+// is the highest seen so far. The 64-bit offsets guarantee that the key stream
+// is not reused when the sequence numbers wrap.
+func (d *direction) extend(seq uint32) uint64 {
+
+	offset := d.candidate(seq)
+	if !d.seqSet || offset > d.seq {
+		d.seq = offset
+		d.seqSet = true
+	}
+
+	return offset
+}
+
+// xorKeyStream applies the key stream that starts at the given offset.
+func (d *direction) xorKeyStream(offset uint64, data []byte) {
+
+	if len(data) == 0 {
+		return
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, d.iv)
+	addCounter(iv, offset/aes.BlockSize)
+
+	stream := cipher.NewCTR(d.block, iv)
+
+	// Discard the part of the first block that precedes the offset.
+	if skip := int(offset % aes.BlockSize); skip > 0 {
+		discard := make([]byte, skip)
+		stream.XORKeyStream(discard, discard)
+	}
+
+	stream.XORKeyStream(data, data)
+}
+
+// tcpTag computes the authentication tag of an encrypted segment.
+func (d *direction) tcpTag(offset uint64, payload []byte) []byte {
+
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], offset)
+
+	mac := hmac.New(sha256.New, d.macKey)
+	mac.Write(seq[:])  // nolint
+	mac.Write(payload) // nolint
+
+	return mac.Sum(nil)[:tcpTagLength]
+}
+
+// nonce builds the AEAD nonce from the salt and the explicit counter.
+func (d *direction) nonce(counter []byte) []byte {
+
+	nonce := make([]byte, 0, saltLength+udpCounterLength)
+	nonce = append(nonce, d.salt...)
+
+	return append(nonce, counter...)
+}
+
+// addCounter adds n to the 128-bit big endian counter.
+func addCounter(counter []byte, n uint64) {
+
+	for i := len(counter) - 1; i >= 0 && n > 0; i-- {
+		sum := uint64(counter[i]) + n&0xff
+		counter[i] = byte(sum)
+		n = n>>8 + sum>>8
+	}
+}
+
+// hkdfExtract implements the extract step of HKDF (RFC 5869) with SHA-256.
+func hkdfExtract(salt, secret []byte) []byte {
+
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(secret) // nolint
+
+	return mac.Sum(nil)
+}
+
+// hkdfExpand implements the expand step of HKDF (RFC 5869) with SHA-256.
+func hkdfExpand(prk, info []byte, length int) []byte {
+
+	out := make([]byte, 0, length+sha256.Size)
+	var prev []byte
+
+	for i := byte(1); len(out) < length; i++ {
+		mac := hmac.New(sha256.New, prk)
+		mac.Write(prev)      // nolint
+		mac.Write(info)      // nolint
+		mac.Write([]byte{i}) // nolint
+		prev = mac.Sum(nil)
+		out = append(out, prev...)
+	}
+
+	return out[:length]
+}
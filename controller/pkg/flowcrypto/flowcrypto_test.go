@@ -0,0 +1,204 @@
+package flowcrypto
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func newCiphers() (*Cipher, *Cipher) {
+
+	clientKey, clientPublic, err := GenerateKey()
+	So(err, ShouldBeNil)
+	serverKey, serverPublic, err := GenerateKey()
+	So(err, ShouldBeNil)
+
+	clientNonce := []byte("0123456789abcdef")
+	serverNonce := []byte("fedcba9876543210")
+
+	client, err := NewCipher(clientKey, serverPublic, clientNonce, serverNonce, true)
+	So(err, ShouldBeNil)
+	server, err := NewCipher(serverKey, clientPublic, clientNonce, serverNonce, false)
+	So(err, ShouldBeNil)
+
+	return client, server
+}
+
+func TestNewCipher(t *testing.T) {
+	Convey("Given an ephemeral key", t, func() {
+		key, _, err := GenerateKey()
+		So(err, ShouldBeNil)
+
+		Convey("When I create a cipher with an invalid remote key", func() {
+			_, err := NewCipher(key, []byte("invalid"), nil, nil, true)
+
+			Convey("Then I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When I create a cipher without a local key", func() {
+			_, err := NewCipher(nil, []byte("invalid"), nil, nil, true)
+
+			Convey("Then I should get an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestTCP(t *testing.T) {
+	Convey("Given the ciphers of a client and a server", t, func() {
+		client, server := newCiphers()
+		plain := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+		Convey("When the client encrypts a segment", func() {
+			payload := append([]byte{}, plain...)
+			option := client.EncryptTCP(1000, payload)
+
+			Convey("Then the payload should be encrypted and the option valid", func() {
+				So(bytes.Equal(payload, plain), ShouldBeFalse)
+				So(len(payload), ShouldEqual, len(plain))
+				So(len(option), ShouldEqual, TCPOptionLength)
+				So(option[0], ShouldEqual, TCPOptionKind)
+			})
+
+			Convey("Then the server should decrypt it", func() {
+				So(server.DecryptTCP(1000, payload, option), ShouldBeNil)
+				So(bytes.Equal(payload, plain), ShouldBeTrue)
+			})
+
+			Convey("Then the client should not decrypt its own segment", func() {
+				So(client.DecryptTCP(1000, payload, option), ShouldEqual, ErrAuthenticationFailed)
+			})
+
+			Convey("Then a modified segment should fail authentication", func() {
+				payload[0] ^= 0xff
+				So(server.DecryptTCP(1000, payload, option), ShouldEqual, ErrAuthenticationFailed)
+			})
+
+			Convey("Then a segment with a different sequence number should fail authentication", func() {
+				So(server.DecryptTCP(1001, payload, option), ShouldEqual, ErrAuthenticationFailed)
+			})
+
+			Convey("Then a malformed option should be rejected", func() {
+				So(server.DecryptTCP(1000, payload, option[:4]), ShouldEqual, ErrInvalidOption)
+			})
+		})
+
+		Convey("When the client resegments a stream", func() {
+			whole := append([]byte{}, plain...)
+			client.EncryptTCP(5, whole)
+
+			first := append([]byte{}, plain[:7]...)
+			second := append([]byte{}, plain[7:]...)
+			option1 := client.EncryptTCP(5, first)
+			option2 := client.EncryptTCP(12, second)
+
+			Convey("Then the key stream should depend only on the sequence numbers", func() {
+				So(bytes.Equal(append(first, second...), whole), ShouldBeTrue)
+				So(server.DecryptTCP(12, second, option2), ShouldBeNil)
+				So(server.DecryptTCP(5, first, option1), ShouldBeNil)
+				So(bytes.Equal(append(first, second...), plain), ShouldBeTrue)
+			})
+		})
+
+		Convey("When the sequence numbers wrap", func() {
+			first := append([]byte{}, plain...)
+			option1 := client.EncryptTCP(0xfffffff0, first)
+			second := append([]byte{}, plain...)
+			option2 := client.EncryptTCP(0xfffffff0+uint32(len(plain)), second)
+
+			Convey("Then the server should decrypt both segments", func() {
+				So(server.DecryptTCP(0xfffffff0, first, option1), ShouldBeNil)
+				So(server.DecryptTCP(0xfffffff0+uint32(len(plain)), second, option2), ShouldBeNil)
+				So(bytes.Equal(first, plain), ShouldBeTrue)
+				So(bytes.Equal(second, plain), ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func TestUDP(t *testing.T) {
+	Convey("Given the ciphers of a client and a server", t, func() {
+		client, server := newCiphers()
+		plain := []byte("udp payload")
+
+		Convey("When the server encrypts a datagram", func() {
+			data := server.EncryptUDP(plain)
+
+			Convey("Then the payload should grow by the overhead", func() {
+				So(len(data), ShouldEqual, len(plain)+UDPOverhead)
+			})
+
+			Convey("Then the client should decrypt it", func() {
+				payload, err := client.DecryptUDP(data)
+				So(err, ShouldBeNil)
+				So(bytes.Equal(payload, plain), ShouldBeTrue)
+			})
+
+			Convey("Then a modified datagram should fail authentication", func() {
+				data[len(data)-1] ^= 0xff
+				_, err := client.DecryptUDP(data)
+				So(err, ShouldEqual, ErrAuthenticationFailed)
+			})
+
+			Convey("Then a truncated datagram should be rejected", func() {
+				_, err := client.DecryptUDP(data[:UDPOverhead-1])
+				So(err, ShouldEqual, ErrShortPayload)
+			})
+
+			Convey("Then a replayed datagram should be rejected", func() {
+				_, err := client.DecryptUDP(data)
+				So(err, ShouldBeNil)
+				_, err = client.DecryptUDP(data)
+				So(err, ShouldEqual, ErrReplayedPayload)
+			})
+
+			Convey("Then a forged datagram should not move the replay window", func() {
+				forged := server.EncryptUDP(plain)
+				forged[len(forged)-1] ^= 0xff
+				_, err := client.DecryptUDP(forged)
+				So(err, ShouldEqual, ErrAuthenticationFailed)
+
+				_, err = client.DecryptUDP(data)
+				So(err, ShouldBeNil)
+			})
+		})
+
+		Convey("When the server encrypts datagrams that are reordered", func() {
+			datagrams := make([][]byte, udpReplayWindow+2)
+			for i := range datagrams {
+				datagrams[i] = server.EncryptUDP(plain)
+			}
+
+			Convey("Then the datagrams within the replay window should be accepted once", func() {
+				_, err := client.DecryptUDP(datagrams[len(datagrams)-1])
+				So(err, ShouldBeNil)
+
+				_, err = client.DecryptUDP(datagrams[2])
+				So(err, ShouldBeNil)
+				_, err = client.DecryptUDP(datagrams[2])
+				So(err, ShouldEqual, ErrReplayedPayload)
+			})
+
+			Convey("Then the datagrams older than the replay window should be rejected", func() {
+				_, err := client.DecryptUDP(datagrams[len(datagrams)-1])
+				So(err, ShouldBeNil)
+
+				_, err = client.DecryptUDP(datagrams[0])
+				So(err, ShouldEqual, ErrReplayedPayload)
+			})
+		})
+
+		Convey("When the client encrypts the same datagram twice", func() {
+			data1 := client.EncryptUDP(plain)
+			data2 := client.EncryptUDP(plain)
+
+			Convey("Then the encrypted payloads should be different", func() {
+				So(bytes.Equal(data1, data2), ShouldBeFalse)
+			})
+		})
+	})
+}
@@ -5,10 +5,14 @@ package flowtracking
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"strings"
 
 	"github.com/mdlayher/netlink"
 	"github.com/ti-mo/conntrack"
+	"github.com/ti-mo/netfilter"
+	"go.uber.org/zap"
 )
 
 // Client is a flow update client
@@ -40,6 +44,62 @@ func (c *Client) Close() error {
 	return c.conn.Close()
 }
 
+// conntrackEventsPath holds the sysctl that enables the conntrack events.
+const conntrackEventsPath = "/proc/sys/net/netfilter/nf_conntrack_events"
+
+// WatchClosedFlows calls closed with the original tuple of every flow that is
+// destroyed in the conntrack table, until the context is done. The events are
+// received on their own netlink connection. The returned channel receives the
+// error that stopped the watch, like a lost event, and is closed when the
+// context is done, so that the caller can watch again.
+func WatchClosedFlows(ctx context.Context, closed func(ipSrc, ipDst net.IP, protonum uint8, srcport, dstport uint16)) (<-chan error, error) {
+
+	// Without the events the flows are destroyed silently. The sysctl is
+	// not readable in every namespace, in which case the events are assumed.
+	if data, err := ioutil.ReadFile(conntrackEventsPath); err == nil && strings.TrimSpace(string(data)) == "0" {
+		return nil, fmt.Errorf("flow watcher requires the conntrack events: %s is 0", conntrackEventsPath)
+	}
+
+	c, err := conntrack.Dial(&netlink.Config{
+		DisableNSLockThread: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("flow watcher is unable to dial netlink: %s", err)
+	}
+
+	events := make(chan conntrack.Event, 1024)
+	errs, err := c.Listen(events, 1, []netfilter.NetlinkGroup{netfilter.GroupCTDestroy})
+	if err != nil {
+		c.Close() // nolint errcheck
+		return nil, fmt.Errorf("flow watcher is unable to listen to conntrack events: %s", err)
+	}
+
+	stopped := make(chan error, 1)
+
+	go func() {
+		defer c.Close() // nolint errcheck
+
+		for {
+			select {
+			case <-ctx.Done():
+				close(stopped)
+				return
+			case err := <-errs:
+				stopped <- fmt.Errorf("flow watcher stopped: %s", err)
+				return
+			case ev := <-events:
+				if ev.Type != conntrack.EventDestroy || ev.Flow == nil {
+					continue
+				}
+				t := ev.Flow.TupleOrig
+				closed(t.IP.SourceAddress, t.IP.DestinationAddress, t.Proto.Protocol, t.Proto.SourcePort, t.Proto.DestinationPort)
+			}
+		}
+	}()
+
+	return stopped, nil
+}
+
 // UpdateMark updates the mark of the flow. Caller must indicate if this is an application
 // flow or a network flow.
 func (c *Client) UpdateMark(ipSrc, ipDst net.IP, protonum uint8, srcport, dstport uint16, newmark uint32, network bool) error {
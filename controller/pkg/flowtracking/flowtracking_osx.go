@@ -4,6 +4,7 @@ package flowtracking
 
 import (
 	"context"
+	"errors"
 	"net"
 )
 
@@ -21,6 +22,12 @@ func (c *Client) Close() error {
 	return nil
 }
 
+// WatchClosedFlows calls closed with the original tuple of every flow that is
+// destroyed in the conntrack table, until the context is done.
+func WatchClosedFlows(ctx context.Context, closed func(ipSrc, ipDst net.IP, protonum uint8, srcport, dstport uint16)) (<-chan error, error) {
+	return nil, errors.New("conntrack events are not supported")
+}
+
 // UpdateMark updates the mark of the flow. Caller must indicate if this is an application
 // flow or a network flow.
 func (c *Client) UpdateMark(ipSrc, ipDst net.IP, protonum uint8, srcport, dstport uint16, newmark uint32, network bool) error {
@@ -1,6 +1,10 @@
 package fqconfig
 
-import "strconv"
+import (
+	"strconv"
+
+	"go.aporeto.io/trireme-lib/policy"
+)
 
 // FilterQueue captures all the configuration parameters of the NFQUEUEs and Iptables configuration.
 type FilterQueue struct {
@@ -38,6 +42,10 @@ type FilterQueue struct {
 	ApplicationQueuesSynAckStr string
 	// DNSServerAddress
 	DNSServerAddress []string
+	// DNSUpstream is the encrypted DNS server that resolves the queries of
+	// the PUs without their own upstream. The queries are forwarded to the
+	// servers they are sent to if nil.
+	DNSUpstream *policy.DNSUpstream
 }
 
 // NewFilterQueueWithDefaults return a default filter queue config
@@ -57,6 +57,12 @@ const (
 
 	// IPProtocolUDP defines the constant for UDP protocol number
 	IPProtocolUDP = 17
+
+	// IPProtocolICMP defines the constant for ICMP protocol number
+	IPProtocolICMP = 1
+
+	// IPProtocolICMPv6 defines the constant for ICMPv6 protocol number
+	IPProtocolICMPv6 = 58
 )
 
 // IP Header masks
@@ -123,6 +129,12 @@ const (
 
 	// TCPMssOptionLen is the type for MSS option
 	TCPMssOptionLen = uint8(4)
+
+	// tcpEndOfOptionList is the option that terminates the list of options
+	tcpEndOfOptionList = uint8(0)
+
+	// tcpNoOperation is the option used for padding between options
+	tcpNoOperation = uint8(1)
 )
 
 // UDP related constants.
@@ -151,6 +163,14 @@ const (
 	UDPPacketMask = 0xF0
 )
 
+// ICMP related constants.
+const (
+	// icmpTypePos is the location of the ICMP type
+	icmpTypePos = 0
+	// icmpCodePos is the location of the ICMP code
+	icmpCodePos = 1
+)
+
 const (
 	// UDPAuthMarker is 18 byte Aporeto signature for UDP
 	UDPAuthMarker = "n30njxq7bmiwr6dtxq"
@@ -51,6 +51,42 @@ func (p *Packet) UpdateTCPChecksum() {
 	binary.BigEndian.PutUint16(buffer[tcpChecksumPos:tcpChecksumPos+2], p.tcpHdr.tcpChecksum)
 }
 
+// DecreaseTCPMSS decreases the value of the MSS option of the TCP packet. It
+// returns false if the packet has no MSS option. The caller must update the
+// checksum.
+func (p *Packet) DecreaseTCPMSS(decr uint16) bool {
+
+	buffer := p.ipHdr.Buffer[p.ipHdr.ipHeaderLen:]
+	options := buffer[minTCPIPPacketLen:p.TCPDataStartBytes()]
+
+	for i := 0; i < len(options); {
+		switch options[i] {
+		case tcpEndOfOptionList:
+			return false
+		case tcpNoOperation:
+			i++
+			continue
+		}
+
+		if i+1 >= len(options) || options[i+1] < 2 {
+			return false
+		}
+
+		length := int(options[i+1])
+		if options[i] == TCPMssOption && options[i+1] == TCPMssOptionLen && i+length <= len(options) {
+			mss := binary.BigEndian.Uint16(options[i+2 : i+4])
+			if mss > decr {
+				binary.BigEndian.PutUint16(options[i+2:i+4], mss-decr)
+			}
+			return true
+		}
+
+		i += length
+	}
+
+	return false
+}
+
 // UpdateTCPFlags
 func (p *Packet) updateTCPFlags(tcpFlags uint8) {
 	buffer := p.ipHdr.Buffer[p.ipHdr.ipHeaderLen:]
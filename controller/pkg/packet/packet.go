@@ -214,6 +214,11 @@ func (p *Packet) DropTCPDetachedBytes() {
 	p.tcpHdr.tcpData = []byte{}
 }
 
+// TCPSequenceNumber returns the sequence number of the TCP packet
+func (p *Packet) TCPSequenceNumber() uint32 {
+	return p.tcpHdr.tcpSeq
+}
+
 // TCPDataStartBytes provides the tcp data start offset in bytes
 func (p *Packet) TCPDataStartBytes() uint16 {
 	return uint16(p.tcpHdr.tcpDataOffset) * 4
@@ -550,6 +555,22 @@ func (p *Packet) IPHeaderLen() uint8 {
 	return p.ipHdr.ipHeaderLen
 }
 
+// ICMPTypeCode returns the type and the code of an ICMP or ICMPv6 packet. It
+// returns false if the packet is not an ICMP packet.
+func (p *Packet) ICMPTypeCode() (uint8, uint8, bool) {
+
+	if p.ipHdr.ipProto != IPProtocolICMP && p.ipHdr.ipProto != IPProtocolICMPv6 {
+		return 0, 0, false
+	}
+
+	buffer := p.ipHdr.Buffer[p.ipHdr.ipHeaderLen:]
+	if len(buffer) <= icmpCodePos {
+		return 0, 0, false
+	}
+
+	return buffer[icmpTypePos], buffer[icmpCodePos], true
+}
+
 //GetBuffer returns the slice representing the buffer at offset specified
 func (p *Packet) GetBuffer(offset int) []byte {
 	return p.ipHdr.Buffer[offset:]
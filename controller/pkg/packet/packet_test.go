@@ -567,3 +567,47 @@ func TestUDPTokenAttach(t *testing.T) {
 	assert.Equal(t, string(pkt.ReadUDPToken()), "helloworld", "token should match helloworld")
 
 }
+
+func TestDecreaseTCPMSS(t *testing.T) {
+
+	t.Parallel()
+	pkt := getTestPacket(t, synGoodTCPChecksum)
+
+	if !pkt.DecreaseTCPMSS(12) {
+		t.Fatal("Expected the MSS option to be found")
+	}
+
+	options := pkt.GetBuffer(int(pkt.IPHeaderLen()))[minTCPIPPacketLen:]
+	if options[2] != 0xff || options[3] != 0xcb {
+		t.Errorf("Unexpected MSS after decrease: %x", options[2:4])
+	}
+
+	pkt.UpdateTCPChecksum()
+	if !pkt.VerifyTCPChecksum() {
+		t.Error("TCP checksum is wrong after update")
+	}
+}
+
+func TestICMPTypeCode(t *testing.T) {
+
+	t.Parallel()
+
+	// ICMP fragmentation needed message from 10.0.0.1 to 10.0.0.2.
+	icmp := []byte{0x45, 0x00, 0x00, 0x1c, 0x00, 0x01, 0x00, 0x00, 0x40, 0x01, 0x00,
+		0x00, 0x0a, 0x00, 0x00, 0x01, 0x0a, 0x00, 0x00, 0x02, 0x03, 0x04, 0x00, 0x00, 0x00,
+		0x00, 0x05, 0xdc}
+
+	pkt, err := New(PacketTypeNetwork, icmp, "0", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	icmpType, code, ok := pkt.ICMPTypeCode()
+	if !ok || icmpType != 3 || code != 4 {
+		t.Errorf("Unexpected ICMP type and code: %d/%d", icmpType, code)
+	}
+
+	if _, _, ok := getTestPacket(t, synGoodTCPChecksum).ICMPTypeCode(); ok {
+		t.Error("Expected no ICMP type and code for a TCP packet")
+	}
+}
@@ -0,0 +1,170 @@
+package policyhistory
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.aporeto.io/trireme-lib/policy"
+)
+
+// Version is a policy that was enforced on a PU. Versions are numbered from 1
+// for each PU and must not be modified.
+type Version struct {
+	// Version is the number of the version.
+	Version int
+	// Timestamp is the time the policy was enforced.
+	Timestamp time.Time
+	// Hash is the SHA-256 of the content of the policy.
+	Hash string
+	// RollbackOf is the version that this version restored, or 0 if the policy
+	// was not enforced by a rollback.
+	RollbackOf int
+	// Policy is a copy of the policy.
+	Policy *policy.PUPolicy
+	// Runtime is a copy of the runtime the policy was enforced with.
+	Runtime *policy.PURuntime
+}
+
+// History keeps the last versions of the policies of the PUs.
+type History struct {
+	size     int
+	versions map[string][]*Version
+	last     map[string]int
+
+	sync.Mutex
+}
+
+// New returns a history that keeps the given number of versions per PU.
+func New(size int) *History {
+
+	if size < 1 {
+		size = 1
+	}
+
+	return &History{
+		size:     size,
+		versions: map[string][]*Version{},
+		last:     map[string]int{},
+	}
+}
+
+// Record adds a new version of the policy of the PU and drops the oldest
+// version if the history of the PU is full.
+func (h *History) Record(contextID string, plc *policy.PUPolicy, runtime *policy.PURuntime, rollbackOf int) (*Version, error) {
+
+	plc = plc.Clone()
+
+	hash, err := Hash(plc)
+	if err != nil {
+		return nil, err
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	h.last[contextID]++
+
+	v := &Version{
+		Version:    h.last[contextID],
+		Timestamp:  time.Now(),
+		Hash:       hash,
+		RollbackOf: rollbackOf,
+		Policy:     plc,
+		Runtime:    runtime.Clone(),
+	}
+
+	versions := append(h.versions[contextID], v)
+	if len(versions) > h.size {
+		versions = versions[len(versions)-h.size:]
+	}
+	h.versions[contextID] = versions
+
+	return v, nil
+}
+
+// Versions returns the versions of the policy of the PU, the oldest first.
+func (h *History) Versions(contextID string) ([]*Version, error) {
+
+	h.Lock()
+	defer h.Unlock()
+
+	versions, ok := h.versions[contextID]
+	if !ok {
+		return nil, fmt.Errorf("no policy history for pu %s", contextID)
+	}
+
+	return append([]*Version{}, versions...), nil
+}
+
+// Get returns a version of the policy of the PU.
+func (h *History) Get(contextID string, version int) (*Version, error) {
+
+	h.Lock()
+	defer h.Unlock()
+
+	for _, v := range h.versions[contextID] {
+		if v.Version == version {
+			return v, nil
+		}
+	}
+
+	return nil, fmt.Errorf("version %d of the policy of pu %s not found", version, contextID)
+}
+
+// Current returns the last version of the policy of the PU.
+func (h *History) Current(contextID string) (*Version, error) {
+
+	h.Lock()
+	defer h.Unlock()
+
+	versions := h.versions[contextID]
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("no policy history for pu %s", contextID)
+	}
+
+	return versions[len(versions)-1], nil
+}
+
+// Diff returns the rules added and removed to go from one version of the
+// policy of the PU to another.
+func (h *History) Diff(contextID string, from, to int) (*policy.PolicyDiff, error) {
+
+	oldVersion, err := h.Get(contextID, from)
+	if err != nil {
+		return nil, err
+	}
+
+	newVersion, err := h.Get(contextID, to)
+	if err != nil {
+		return nil, err
+	}
+
+	return policy.NewPolicyDiff(oldVersion.Policy, newVersion.Policy), nil
+}
+
+// Delete drops the history of the PU.
+func (h *History) Delete(contextID string) {
+
+	h.Lock()
+	defer h.Unlock()
+
+	delete(h.versions, contextID)
+	delete(h.last, contextID)
+}
+
+// Hash returns the SHA-256 of the content of the policy.
+func Hash(plc *policy.PUPolicy) (string, error) {
+
+	data, err := json.Marshal(plc.ToPublicPolicy())
+	if err != nil {
+		return "", fmt.Errorf("unable to marshal policy: %s", err)
+	}
+
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:]), nil
+}
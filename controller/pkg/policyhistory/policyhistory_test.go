@@ -0,0 +1,101 @@
+package policyhistory
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/trireme-lib/common"
+	"go.aporeto.io/trireme-lib/policy"
+)
+
+func testPolicy(policyID string) *policy.PUPolicy {
+
+	appACLs := policy.IPRuleList{
+		{
+			Addresses: []string{"10.0.0.0/8"},
+			Ports:     []string{"443"},
+			Protocols: []string{"6"},
+			Policy:    &policy.FlowPolicy{Action: policy.Accept, PolicyID: policyID},
+		},
+	}
+
+	return policy.NewPUPolicy("pu1", "/ns", policy.Police, appACLs, nil, nil, nil, nil, nil, nil, nil, nil, 0, 0, nil, nil, []string{})
+}
+
+func TestHistory(t *testing.T) {
+	Convey("Given a history of two versions", t, func() {
+
+		h := New(2)
+		runtime := policy.NewPURuntime("web", 100, "", nil, nil, common.ContainerPU, nil)
+
+		Convey("A PU without history should fail", func() {
+			_, err := h.Versions("pu1")
+			So(err, ShouldNotBeNil)
+			_, err = h.Current("pu1")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("When I record policies", func() {
+			v1, err := h.Record("pu1", testPolicy("a"), runtime, 0)
+			So(err, ShouldBeNil)
+			So(v1.Version, ShouldEqual, 1)
+
+			v2, err := h.Record("pu1", testPolicy("b"), runtime, 0)
+			So(err, ShouldBeNil)
+			So(v2.Version, ShouldEqual, 2)
+			So(v2.Hash, ShouldNotEqual, v1.Hash)
+
+			Convey("Identical policies should have the same hash", func() {
+				v3, err := h.Record("pu1", testPolicy("a"), runtime, 1)
+				So(err, ShouldBeNil)
+				So(v3.Hash, ShouldEqual, v1.Hash)
+				So(v3.RollbackOf, ShouldEqual, 1)
+
+				Convey("The oldest version should be dropped", func() {
+					versions, err := h.Versions("pu1")
+					So(err, ShouldBeNil)
+					So(len(versions), ShouldEqual, 2)
+					So(versions[0].Version, ShouldEqual, 2)
+					So(versions[1].Version, ShouldEqual, 3)
+
+					_, err = h.Get("pu1", 1)
+					So(err, ShouldNotBeNil)
+
+					current, err := h.Current("pu1")
+					So(err, ShouldBeNil)
+					So(current, ShouldEqual, v3)
+				})
+			})
+
+			Convey("I should get the diff of two versions", func() {
+				diff, err := h.Diff("pu1", 1, 2)
+				So(err, ShouldBeNil)
+				So(len(diff.ApplicationACLs.Added), ShouldEqual, 1)
+				So(diff.ApplicationACLs.Added[0].Policy.PolicyID, ShouldEqual, "b")
+				So(len(diff.ApplicationACLs.Removed), ShouldEqual, 1)
+				So(diff.ApplicationACLs.Removed[0].Policy.PolicyID, ShouldEqual, "a")
+
+				_, err = h.Diff("pu1", 1, 5)
+				So(err, ShouldNotBeNil)
+			})
+
+			Convey("The recorded policy should not change with the original", func() {
+				plc := testPolicy("c")
+				v, err := h.Record("pu1", plc, runtime, 0)
+				So(err, ShouldBeNil)
+				plc.AddIdentityTag("app", "web")
+				So(v.Policy.Identity().GetSlice(), ShouldBeEmpty)
+			})
+
+			Convey("When I delete the PU, the history should be dropped", func() {
+				h.Delete("pu1")
+				_, err := h.Versions("pu1")
+				So(err, ShouldNotBeNil)
+
+				v, err := h.Record("pu1", testPolicy("a"), runtime, 0)
+				So(err, ShouldBeNil)
+				So(v.Version, ShouldEqual, 1)
+			})
+		})
+	})
+}
@@ -0,0 +1,615 @@
+// Package policylint finds rules of a policy that do not behave as their
+// authors probably expect. The rules are analyzed with the same ordering as
+// the datapath: ACLs are evaluated by the ACL cache and tag selectors by the
+// policy lookup database.
+package policylint
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	version "github.com/hashicorp/go-version"
+	"go.aporeto.io/trireme-lib/controller/constants"
+	"go.aporeto.io/trireme-lib/policy"
+)
+
+// Kind is the kind of a finding.
+type Kind string
+
+const (
+	// Shadowed is a rule that never decides a flow because the rules
+	// evaluated before it cover all its addresses and ports.
+	Shadowed Kind = "shadowed"
+	// Contradictory is an accept rule that overlaps with a reject rule on
+	// the same prefix, port and protocol. The reject rule wins.
+	Contradictory Kind = "contradictory"
+	// Unmatchable is a tag selector that can never match.
+	Unmatchable Kind = "unmatchable"
+	// Duplicate is a DNS rule that overlaps with another rule of the same name.
+	Duplicate Kind = "duplicate"
+	// Invalid is a rule that cannot be parsed.
+	Invalid Kind = "invalid"
+)
+
+// Names of the lists of rules of a policy.
+const (
+	ApplicationACLs  = "applicationACLs"
+	NetworkACLs      = "networkACLs"
+	TransmitterRules = "transmitterRules"
+	ReceiverRules    = "receiverRules"
+	DNSACLs          = "dnsACLs"
+)
+
+// Finding is an issue found in a rule of a policy.
+type Finding struct {
+	// Kind is the kind of the finding.
+	Kind Kind `json:"kind"`
+	// List is the list of rules of the policy that holds the rule.
+	List string `json:"list"`
+	// Index is the index of the rule in the list. For DNS ACLs, it is the
+	// index in the rules of the name.
+	Index int `json:"index"`
+	// Name is the domain name of a DNS rule.
+	Name string `json:"name,omitempty"`
+	// PolicyID is the policy ID of the rule.
+	PolicyID string `json:"policyID"`
+	// RelatedPolicyIDs are the policy IDs of the rules that cause the finding.
+	RelatedPolicyIDs []string `json:"relatedPolicyIDs,omitempty"`
+	// Message describes the finding.
+	Message string `json:"message"`
+}
+
+// Lint analyzes the rules of the policy and returns the findings.
+func Lint(p *policy.PUPolicy) []*Finding {
+
+	findings := []*Finding{}
+
+	findings = append(findings, lintACLs(ApplicationACLs, p.ApplicationACLs())...)
+	findings = append(findings, lintACLs(NetworkACLs, p.NetworkACLs())...)
+	findings = append(findings, lintSelectors(TransmitterRules, p.TransmitterRules())...)
+	findings = append(findings, lintSelectors(ReceiverRules, p.ReceiverRules())...)
+	findings = append(findings, lintDNSACLs(p.DNSNameACLs())...)
+
+	return findings
+}
+
+// Classes of the ACL cache, in the order they are evaluated.
+const (
+	classReject = iota
+	classAccept
+	classObserve
+)
+
+// entry is an entry of the ACL cache: one protocol, address and port range
+// of a rule.
+type entry struct {
+	rule     int
+	seq      int
+	class    int
+	protocol string
+	network  *net.IPNet
+	ones     int
+	min      uint16
+	max      uint16
+	policy   *policy.FlowPolicy
+}
+
+// decides returns true if the datapath stops at the entry when it matches.
+func (e *entry) decides() bool {
+	return !e.policy.ObserveAction.ObserveContinue()
+}
+
+// contains returns true if the entry matches all the addresses of the other
+// entry.
+func (e *entry) contains(o *entry) bool {
+	return e.ones <= o.ones && e.network.Contains(o.network.IP) && len(e.network.IP) == len(o.network.IP)
+}
+
+// samePrefix returns true if the entries are stored at the same prefix.
+func (e *entry) samePrefix(o *entry) bool {
+	return e.ones == o.ones && e.network.IP.Equal(o.network.IP)
+}
+
+// overlaps returns true if the port ranges of the entries overlap.
+func (e *entry) overlaps(o *entry) bool {
+	return e.min <= o.max && o.min <= e.max
+}
+
+// precedes returns true if the entry is evaluated before the other entry for
+// all the flows that match the other entry.
+func (e *entry) precedes(o *entry) bool {
+
+	if e.protocol != o.protocol {
+		return false
+	}
+
+	if e.class < o.class {
+		return e.contains(o)
+	}
+
+	return e.class == o.class && e.samePrefix(o) && e.seq < o.seq
+}
+
+// lintACLs finds the shadowed and contradictory rules of a list of ACLs.
+func lintACLs(list string, rules policy.IPRuleList) []*Finding {
+
+	findings := []*Finding{}
+	entries := []*entry{}
+	ruleEntries := make([][]*entry, len(rules))
+
+	for i, rule := range rules {
+		e, err := ruleToEntries(i, len(entries), rule)
+		if err != nil {
+			findings = append(findings, &Finding{
+				Kind:     Invalid,
+				List:     list,
+				Index:    i,
+				PolicyID: policyID(rule.Policy),
+				Message:  err.Error(),
+			})
+			continue
+		}
+		ruleEntries[i] = e
+		entries = append(entries, e...)
+	}
+
+	for i, re := range ruleEntries {
+		if len(re) == 0 {
+			continue
+		}
+
+		shadowing := map[int]struct{}{}
+		shadowed := true
+		for _, e := range re {
+			covering := []*entry{}
+			for _, o := range entries {
+				if o.rule != i && o.decides() && o.precedes(e) && o.overlaps(e) {
+					covering = append(covering, o)
+				}
+			}
+			if !covers(covering, e.min, e.max) {
+				shadowed = false
+				break
+			}
+			for _, o := range covering {
+				shadowing[o.rule] = struct{}{}
+			}
+		}
+
+		if shadowed {
+			related := relatedPolicyIDs(rules, shadowing)
+			findings = append(findings, &Finding{
+				Kind:             Shadowed,
+				List:             list,
+				Index:            i,
+				PolicyID:         policyID(rules[i].Policy),
+				RelatedPolicyIDs: related,
+				Message:          fmt.Sprintf("rule is shadowed by %s", strings.Join(related, ", ")),
+			})
+		}
+	}
+
+	for i, re := range ruleEntries {
+		for _, e := range re {
+			if e.class != classAccept || !e.decides() {
+				continue
+			}
+			contradicting := map[int]struct{}{}
+			for _, o := range entries {
+				if o.class == classReject && o.decides() && o.protocol == e.protocol && o.samePrefix(e) && o.overlaps(e) {
+					contradicting[o.rule] = struct{}{}
+				}
+			}
+			if len(contradicting) == 0 {
+				continue
+			}
+			related := relatedPolicyIDs(rules, contradicting)
+			findings = append(findings, &Finding{
+				Kind:             Contradictory,
+				List:             list,
+				Index:            i,
+				PolicyID:         policyID(rules[i].Policy),
+				RelatedPolicyIDs: related,
+				Message:          fmt.Sprintf("rule accepts %s ports %d:%d rejected by %s", e.network, e.min, e.max, strings.Join(related, ", ")),
+			})
+			break
+		}
+	}
+
+	return findings
+}
+
+// ruleToEntries returns the entries of a rule in the order they are added to
+// the ACL cache. Identical entries of a rule are only added once.
+func ruleToEntries(index int, seq int, rule policy.IPRule) ([]*entry, error) {
+
+	if rule.Policy == nil {
+		return nil, fmt.Errorf("rule has no policy")
+	}
+
+	class := classReject
+	if rule.Policy.ObserveAction.ObserveApply() {
+		class = classObserve
+	} else if rule.Policy.Action.Accepted() {
+		class = classAccept
+	}
+
+	// The excluded addresses are removed from the networks of the rule, which
+	// keeps the addresses the rule matches.
+	addresses, err := policy.ExpandExclusions(rule.Addresses)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []*entry{}
+	for _, proto := range rule.Protocols {
+		for _, address := range addresses {
+			network, ones, err := parseAddress(address)
+			if err != nil {
+				return nil, err
+			}
+			for _, port := range rule.Ports {
+				min, max, err := parsePorts(port)
+				if err != nil {
+					return nil, err
+				}
+				e := &entry{
+					rule:     index,
+					seq:      seq + len(entries),
+					class:    class,
+					protocol: normalizeProtocol(proto),
+					network:  network,
+					ones:     ones,
+					min:      min,
+					max:      max,
+					policy:   rule.Policy,
+				}
+				duplicate := false
+				for _, o := range entries {
+					if o.protocol == e.protocol && o.samePrefix(e) && o.min == e.min && o.max == e.max {
+						duplicate = true
+						break
+					}
+				}
+				if !duplicate {
+					entries = append(entries, e)
+				}
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+// covers returns true if the union of the port ranges of the entries covers
+// the range min:max.
+func covers(entries []*entry, min, max uint16) bool {
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].min < entries[j].min
+	})
+
+	next := uint32(min)
+	for _, e := range entries {
+		if uint32(e.min) > next {
+			return false
+		}
+		if uint32(e.max)+1 > next {
+			next = uint32(e.max) + 1
+		}
+		if next > uint32(max) {
+			return true
+		}
+	}
+
+	return next > uint32(max)
+}
+
+// parseAddress parses an address or a subnet.
+func parseAddress(address string) (*net.IPNet, int, error) {
+
+	if !strings.Contains(address, "/") {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, 0, fmt.Errorf("invalid address: %s", address)
+		}
+		if ip.To4() != nil {
+			address = address + "/32"
+		} else {
+			address = address + "/128"
+		}
+	}
+
+	_, network, err := net.ParseCIDR(address)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid address: %s", err)
+	}
+
+	ones, _ := network.Mask.Size()
+
+	return network, ones, nil
+}
+
+// parsePorts parses a port or a port range min:max.
+func parsePorts(port string) (uint16, uint16, error) {
+
+	parts := strings.SplitN(port, ":", 2)
+
+	min, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port: %s", port)
+	}
+
+	max := min
+	if len(parts) == 2 {
+		if max, err = strconv.ParseUint(parts[1], 10, 16); err != nil {
+			return 0, 0, fmt.Errorf("invalid port: %s", port)
+		}
+	}
+
+	if min > max {
+		return 0, 0, fmt.Errorf("invalid port range: %s", port)
+	}
+
+	return uint16(min), uint16(max), nil
+}
+
+// normalizeProtocol returns the protocol number of tcp and udp.
+func normalizeProtocol(proto string) string {
+
+	switch p := strings.ToLower(proto); p {
+	case "tcp":
+		return constants.TCPProtoNum
+	case "udp":
+		return constants.UDPProtoNum
+	default:
+		return p
+	}
+}
+
+// lintSelectors finds the tag selectors that can never match.
+func lintSelectors(list string, selectors policy.TagSelectorList) []*Finding {
+
+	findings := []*Finding{}
+
+	for i, selector := range selectors {
+		if reason := unmatchable(selector.Clause); reason != "" {
+			findings = append(findings, &Finding{
+				Kind:     Unmatchable,
+				List:     list,
+				Index:    i,
+				PolicyID: policyID(selector.Policy),
+				Message:  reason,
+			})
+		}
+	}
+
+	return findings
+}
+
+// unmatchable returns the reason why the clauses can never match, or an
+// empty string if they can match.
+func unmatchable(clauses []policy.KeyValueOperator) string {
+
+	if len(clauses) == 0 {
+		return "selector has no clause"
+	}
+
+	required := map[string]bool{}
+	notExists := map[string]bool{}
+	counted := false
+
+	for _, c := range clauses {
+
+		switch c.Operator {
+
+		case policy.KeyNotExists:
+			notExists[c.Key] = true
+			continue
+
+		case policy.KeyExists:
+
+		case policy.NotEqual:
+			if len(c.Value) == 0 {
+				continue
+			}
+
+		case policy.Equal, policy.Prefix, policy.Suffix:
+			if len(c.Value) == 0 {
+				return fmt.Sprintf("clause %s %s has no value", c.Key, c.Operator)
+			}
+			for _, v := range c.Value {
+				if v == "" {
+					return fmt.Sprintf("clause %s %s has an empty value", c.Key, c.Operator)
+				}
+			}
+
+		case policy.Regex:
+			if len(c.Value) == 0 {
+				return fmt.Sprintf("clause %s %s has no value", c.Key, c.Operator)
+			}
+			for _, v := range c.Value {
+				if _, err := regexp.Compile(v); err != nil {
+					return fmt.Sprintf("clause %s %s has an invalid expression: %s", c.Key, c.Operator, err)
+				}
+			}
+
+		case policy.LessThan, policy.LessOrEqual, policy.GreaterThan, policy.GreaterOrEqual:
+			valid := false
+			for _, v := range c.Value {
+				if _, err := version.NewVersion(v); err == nil {
+					valid = true
+				} else if _, err := strconv.ParseFloat(v, 64); err == nil {
+					valid = true
+				}
+			}
+			if !valid {
+				return fmt.Sprintf("clause %s %s has no number or version", c.Key, c.Operator)
+			}
+
+		case policy.SemverRange:
+			valid := false
+			for _, v := range c.Value {
+				if _, err := version.NewConstraint(v); err == nil {
+					valid = true
+				}
+			}
+			if !valid {
+				return fmt.Sprintf("clause %s %s has no valid constraint", c.Key, c.Operator)
+			}
+
+		default:
+			return fmt.Sprintf("clause %s has an unknown operator %s", c.Key, c.Operator)
+		}
+
+		counted = true
+		if c.Operator != policy.NotEqual {
+			required[c.Key] = true
+		}
+	}
+
+	for key := range required {
+		if notExists[key] {
+			return fmt.Sprintf("key %s is both required and excluded", key)
+		}
+	}
+
+	// The lookup database only matches a selector when one of its clauses
+	// is hit, except for a selector with a single not exists clause.
+	if !counted && !(len(clauses) == 1 && clauses[0].Operator == policy.KeyNotExists) {
+		return "selector has no clause that can be hit"
+	}
+
+	return ""
+}
+
+// dnsRule is a rule of a DNS ACL.
+type dnsRule struct {
+	name  string
+	index int
+	rule  policy.PortProtocolPolicy
+}
+
+// lintDNSACLs finds the DNS rules that overlap with another rule of the same
+// name. Names are compared without case and trailing dot.
+func lintDNSACLs(acls policy.DNSRuleList) []*Finding {
+
+	findings := []*Finding{}
+
+	names := make([]string, 0, len(acls))
+	for name := range acls {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	byName := map[string][]*dnsRule{}
+	normalized := []string{}
+	for _, name := range names {
+		n := strings.TrimSuffix(strings.ToLower(name), ".")
+		if _, ok := byName[n]; !ok {
+			normalized = append(normalized, n)
+		}
+		for i, rule := range acls[name] {
+			byName[n] = append(byName[n], &dnsRule{name: name, index: i, rule: rule})
+		}
+	}
+
+	for _, n := range normalized {
+		rules := byName[n]
+		for j, r := range rules {
+			related := map[string]struct{}{}
+			for _, o := range rules[:j] {
+				if dnsOverlap(o.rule, r.rule) {
+					related[policyID(o.rule.Policy)] = struct{}{}
+				}
+			}
+			if len(related) == 0 {
+				continue
+			}
+			ids := sortedKeys(related)
+			findings = append(findings, &Finding{
+				Kind:             Duplicate,
+				List:             DNSACLs,
+				Index:            r.index,
+				Name:             r.name,
+				PolicyID:         policyID(r.rule.Policy),
+				RelatedPolicyIDs: ids,
+				Message:          fmt.Sprintf("rule for %s overlaps with %s", r.name, strings.Join(ids, ", ")),
+			})
+		}
+	}
+
+	return findings
+}
+
+// dnsOverlap returns true if the rules share a protocol and a port.
+func dnsOverlap(a, b policy.PortProtocolPolicy) bool {
+
+	protocol := false
+	for _, pa := range a.Protocols {
+		for _, pb := range b.Protocols {
+			if normalizeProtocol(pa) == normalizeProtocol(pb) {
+				protocol = true
+			}
+		}
+	}
+
+	if !protocol {
+		return false
+	}
+
+	for _, pa := range a.Ports {
+		mina, maxa, err := parsePorts(pa)
+		if err != nil {
+			continue
+		}
+		for _, pb := range b.Ports {
+			minb, maxb, err := parsePorts(pb)
+			if err != nil {
+				continue
+			}
+			if mina <= maxb && minb <= maxa {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// relatedPolicyIDs returns the sorted policy IDs of the rules.
+func relatedPolicyIDs(rules policy.IPRuleList, indexes map[int]struct{}) []string {
+
+	ids := map[string]struct{}{}
+	for i := range indexes {
+		ids[policyID(rules[i].Policy)] = struct{}{}
+	}
+
+	return sortedKeys(ids)
+}
+
+// sortedKeys returns the sorted keys of the set.
+func sortedKeys(set map[string]struct{}) []string {
+
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// policyID returns the policy ID of the flow policy.
+func policyID(f *policy.FlowPolicy) string {
+
+	if f == nil {
+		return ""
+	}
+
+	return f.PolicyID
+}
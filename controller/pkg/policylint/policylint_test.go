@@ -0,0 +1,221 @@
+package policylint
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/trireme-lib/policy"
+)
+
+func ipRule(address string, port string, protocol string, action policy.ActionType, id string) policy.IPRule {
+	return policy.IPRule{
+		Addresses: []string{address},
+		Ports:     []string{port},
+		Protocols: []string{protocol},
+		Policy:    &policy.FlowPolicy{Action: action, PolicyID: id},
+	}
+}
+
+func findingsOf(findings []*Finding, kind Kind, list string) map[string]*Finding {
+
+	m := map[string]*Finding{}
+	for _, f := range findings {
+		if f.Kind == kind && f.List == list {
+			m[f.PolicyID] = f
+		}
+	}
+
+	return m
+}
+
+func TestLintACLs(t *testing.T) {
+
+	Convey("Given a policy with overlapping ACLs", t, func() {
+
+		observe := ipRule("0.0.0.0/0", "1:65535", "6", policy.Reject|policy.Observe, "observe")
+		observe.Policy.ObserveAction = policy.ObserveContinue
+
+		apply := ipRule("10.0.0.0/8", "443", "6", policy.Reject|policy.Observe, "observe-apply")
+		apply.Policy.ObserveAction = policy.ObserveApply
+
+		appACLs := policy.IPRuleList{
+			observe,
+			ipRule("10.0.0.0/8", "22", "tcp", policy.Reject, "deny-ssh"),
+			ipRule("10.1.0.0/16", "22", "6", policy.Accept, "allow-ssh"),
+			ipRule("10.0.0.0/8", "80:90", "6", policy.Accept, "web-a"),
+			ipRule("10.0.0.0/8", "85", "6", policy.Accept, "web-b"),
+			ipRule("10.0.0.0/8", "80:100", "6", policy.Accept, "web-c"),
+			ipRule("10.0.0.0/8", "22", "6", policy.Accept|policy.Log, "ssh-accept"),
+			ipRule("10.0.0.0/8", "22", "udp", policy.Accept, "ssh-udp"),
+			ipRule("10.1.2.0/25", "8080", "6", policy.Reject, "deny-half"),
+			ipRule("10.1.2.0/24", "8080", "6", policy.Accept, "allow-proxy"),
+			ipRule("10.0.0.1", "443", "6", policy.Accept, "allow-host"),
+			apply,
+			ipRule("10.0.0", "443", "6", policy.Accept, "invalid"),
+		}
+
+		netACLs := policy.IPRuleList{
+			ipRule("0.0.0.0/0", "1:1000", "6", policy.Accept, "allow-low"),
+			ipRule("0.0.0.0/0", "1001:65535", "6", policy.Accept, "allow-high"),
+			ipRule("192.168.0.0/16", "8080", "6", policy.Accept, "allow-proxy"),
+			ipRule("0.0.0.0/0", "1:65535", "6", policy.Accept, "allow-all"),
+		}
+
+		p := policy.NewPUPolicy("pu1", "/ns", policy.Police, appACLs, netACLs, nil, nil, nil, nil, nil, nil, nil, 0, 0, nil, nil, []string{})
+
+		findings := Lint(p)
+
+		Convey("Then the shadowed rules should be found", func() {
+			shadowed := findingsOf(findings, Shadowed, ApplicationACLs)
+			So(len(shadowed), ShouldEqual, 3)
+
+			So(shadowed, ShouldContainKey, "allow-ssh")
+			So(shadowed["allow-ssh"].Index, ShouldEqual, 2)
+			So(shadowed["allow-ssh"].RelatedPolicyIDs, ShouldResemble, []string{"deny-ssh"})
+
+			So(shadowed, ShouldContainKey, "web-b")
+			So(shadowed["web-b"].RelatedPolicyIDs, ShouldResemble, []string{"web-a"})
+
+			So(shadowed, ShouldContainKey, "ssh-accept")
+
+			// More specific prefixes are evaluated first.
+			shadowed = findingsOf(findings, Shadowed, NetworkACLs)
+			So(len(shadowed), ShouldEqual, 1)
+			So(shadowed["allow-all"].RelatedPolicyIDs, ShouldResemble, []string{"allow-high", "allow-low"})
+		})
+
+		Convey("Then the contradictory rules should be found", func() {
+			contradictory := findingsOf(findings, Contradictory, ApplicationACLs)
+			So(len(contradictory), ShouldEqual, 1)
+			So(contradictory["ssh-accept"].Index, ShouldEqual, 6)
+			So(contradictory["ssh-accept"].RelatedPolicyIDs, ShouldResemble, []string{"deny-ssh"})
+		})
+
+		Convey("Then the invalid rules should be reported", func() {
+			invalid := findingsOf(findings, Invalid, ApplicationACLs)
+			So(len(invalid), ShouldEqual, 1)
+			So(invalid["invalid"].Index, ShouldEqual, 12)
+		})
+
+		Convey("Then the excluded addresses should not shadow rules", func() {
+			deny := ipRule("0.0.0.0/0", "22", "6", policy.Reject, "deny-ssh")
+			deny.Addresses = append(deny.Addresses, "!10.0.0.0/8")
+
+			p := policy.NewPUPolicy("pu1", "/ns", policy.Police, policy.IPRuleList{deny, ipRule("10.1.0.0/16", "22", "6", policy.Accept, "allow-ssh")}, nil, nil, nil, nil, nil, nil, nil, nil, 0, 0, nil, nil, []string{})
+			So(findingsOf(Lint(p), Shadowed, ApplicationACLs), ShouldBeEmpty)
+
+			p = policy.NewPUPolicy("pu1", "/ns", policy.Police, policy.IPRuleList{deny, ipRule("192.168.0.0/16", "22", "6", policy.Accept, "allow-ssh")}, nil, nil, nil, nil, nil, nil, nil, nil, 0, 0, nil, nil, []string{})
+			So(findingsOf(Lint(p), Shadowed, ApplicationACLs), ShouldContainKey, "allow-ssh")
+		})
+
+		Convey("Then the observed rules should be evaluated last", func() {
+			shadowed := findingsOf(findings, Shadowed, ApplicationACLs)
+			So(shadowed, ShouldNotContainKey, "observe-apply")
+
+			p := policy.NewPUPolicy("pu1", "/ns", policy.Police, policy.IPRuleList{apply, ipRule("10.0.0.0/8", "443", "6", policy.Accept, "allow-https")}, nil, nil, nil, nil, nil, nil, nil, nil, 0, 0, nil, nil, []string{})
+			shadowed = findingsOf(Lint(p), Shadowed, ApplicationACLs)
+			So(len(shadowed), ShouldEqual, 1)
+			So(shadowed["observe-apply"].RelatedPolicyIDs, ShouldResemble, []string{"allow-https"})
+		})
+	})
+}
+
+func TestLintSelectors(t *testing.T) {
+
+	Convey("Given a policy with tag selectors", t, func() {
+
+		selector := func(id string, clauses ...policy.KeyValueOperator) policy.TagSelector {
+			return policy.TagSelector{
+				Clause: clauses,
+				Policy: &policy.FlowPolicy{Action: policy.Accept, PolicyID: id},
+			}
+		}
+
+		rxRules := policy.TagSelectorList{
+			selector("valid",
+				policy.KeyValueOperator{Key: "app", Value: []string{"web"}, Operator: policy.Equal},
+				policy.KeyValueOperator{Key: "env", Operator: policy.KeyNotExists},
+			),
+			selector("not-exists", policy.KeyValueOperator{Key: "env", Operator: policy.KeyNotExists}),
+			selector("version", policy.KeyValueOperator{Key: "version", Value: []string{">= 1.0, < 2.0"}, Operator: policy.SemverRange}),
+			selector("empty"),
+			selector("no-value", policy.KeyValueOperator{Key: "app", Operator: policy.Equal}),
+			selector("empty-value", policy.KeyValueOperator{Key: "app", Value: []string{""}, Operator: policy.Prefix}),
+			selector("excluded",
+				policy.KeyValueOperator{Key: "app", Operator: policy.KeyExists},
+				policy.KeyValueOperator{Key: "app", Operator: policy.KeyNotExists},
+			),
+			selector("regex", policy.KeyValueOperator{Key: "app", Value: []string{"web("}, Operator: policy.Regex}),
+			selector("number", policy.KeyValueOperator{Key: "size", Value: []string{"large"}, Operator: policy.LessThan}),
+			selector("constraint", policy.KeyValueOperator{Key: "version", Value: []string{"~~ 1"}, Operator: policy.SemverRange}),
+			selector("not-exists-only",
+				policy.KeyValueOperator{Key: "app", Operator: policy.KeyNotExists},
+				policy.KeyValueOperator{Key: "env", Operator: policy.KeyNotExists},
+			),
+			selector("unknown", policy.KeyValueOperator{Key: "app", Value: []string{"web"}, Operator: "~"}),
+		}
+
+		txRules := policy.TagSelectorList{
+			selector("not-equal", policy.KeyValueOperator{Key: "app", Operator: policy.NotEqual}),
+		}
+
+		p := policy.NewPUPolicy("pu1", "/ns", policy.Police, nil, nil, nil, txRules, rxRules, nil, nil, nil, nil, 0, 0, nil, nil, []string{})
+
+		Convey("Then the selectors that can never match should be found", func() {
+			findings := Lint(p)
+
+			unmatchable := findingsOf(findings, Unmatchable, ReceiverRules)
+			So(len(unmatchable), ShouldEqual, 9)
+			So(unmatchable, ShouldNotContainKey, "valid")
+			So(unmatchable, ShouldNotContainKey, "not-exists")
+			So(unmatchable, ShouldNotContainKey, "version")
+			So(unmatchable["excluded"].Index, ShouldEqual, 6)
+			So(unmatchable["excluded"].Message, ShouldContainSubstring, "app")
+
+			unmatchable = findingsOf(findings, Unmatchable, TransmitterRules)
+			So(len(unmatchable), ShouldEqual, 1)
+			So(unmatchable, ShouldContainKey, "not-equal")
+		})
+	})
+}
+
+func TestLintDNSACLs(t *testing.T) {
+
+	Convey("Given a policy with DNS ACLs", t, func() {
+
+		rule := func(port string, protocol string, id string) policy.PortProtocolPolicy {
+			return policy.PortProtocolPolicy{
+				Ports:     []string{port},
+				Protocols: []string{protocol},
+				Policy:    &policy.FlowPolicy{Action: policy.Accept, PolicyID: id},
+			}
+		}
+
+		dnsACLs := policy.DNSRuleList{
+			"www.example.com": []policy.PortProtocolPolicy{
+				rule("443", "6", "team-a"),
+				rule("80", "6", "team-a"),
+			},
+			"WWW.example.com.": []policy.PortProtocolPolicy{
+				rule("400:500", "tcp", "team-b"),
+				rule("80", "udp", "team-b"),
+			},
+			"api.example.com": []policy.PortProtocolPolicy{
+				rule("443", "6", "team-a"),
+			},
+		}
+
+		p := policy.NewPUPolicy("pu1", "/ns", policy.Police, nil, nil, dnsACLs, nil, nil, nil, nil, nil, nil, 0, 0, nil, nil, []string{})
+
+		Convey("Then the duplicated rules should be found in the merged rules of the name", func() {
+			findings := Lint(p)
+
+			So(len(findings), ShouldEqual, 1)
+			So(findings[0].Kind, ShouldEqual, Duplicate)
+			So(findings[0].Name, ShouldEqual, "www.example.com")
+			So(findings[0].Index, ShouldEqual, 2)
+			So(findings[0].PolicyID, ShouldEqual, "team-a")
+			So(findings[0].RelatedPolicyIDs, ShouldResemble, []string{"team-b"})
+		})
+	})
+}
@@ -0,0 +1,224 @@
+// Package policysim simulates the policy decisions of the datapath. It answers
+// why a flow is allowed or denied without sending any traffic, by running the
+// same lookups as the datapath against the policy of a processing unit.
+package policysim
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.aporeto.io/trireme-lib/controller/constants"
+	"go.aporeto.io/trireme-lib/controller/pkg/pucontext"
+	"go.aporeto.io/trireme-lib/policy"
+)
+
+// Direction is the direction of a flow with respect to the processing unit.
+type Direction int
+
+const (
+	// Incoming is a flow that is initiated by the remote end towards the PU.
+	Incoming Direction = iota
+	// Outgoing is a flow that is initiated by the PU towards the remote end.
+	Outgoing
+)
+
+// String returns the name of the direction.
+func (d Direction) String() string {
+	if d == Outgoing {
+		return "outgoing"
+	}
+	return "incoming"
+}
+
+// Request describes the flow to simulate. Either the tags of a remote PU or
+// the IP address of an external network must be provided.
+type Request struct {
+	// Direction is the direction of the flow.
+	Direction Direction
+	// Tags are the tags of the remote PU.
+	Tags []string
+	// IP is the address of the remote end when it is not a PU.
+	IP net.IP
+	// Port is the destination port of the flow.
+	Port uint16
+	// Protocol is the protocol of the flow (tcp or udp). It defaults to tcp.
+	Protocol string
+	// MutualAuthorization is the mutual authorization setting of the enforcer.
+	// Without it, outgoing flows between PUs ignore the reject rules.
+	MutualAuthorization bool
+}
+
+// Match is a policy that the flow matched and the rule it comes from.
+type Match struct {
+	// Policy is the flow policy that was returned by the lookup.
+	Policy *policy.FlowPolicy `json:"policy"`
+	// TagSelector is the tag selector of the policy, for flows between PUs.
+	TagSelector *policy.TagSelector `json:"tagSelector,omitempty"`
+	// IPRule is the ACL of the policy, for flows with external networks.
+	IPRule *policy.IPRule `json:"ipRule,omitempty"`
+}
+
+// Decision is the decision of the datapath for the flow.
+type Decision struct {
+	// Accepted is true if the datapath forwards the flow.
+	Accepted bool `json:"accepted"`
+	// PolicyID is the ID of the policy that decided the fate of the packets.
+	PolicyID string `json:"policyID"`
+	// Default is true if no rule matched and the default reject applied.
+	Default bool `json:"default"`
+	// Observed is true if the reported policy is an observed policy that
+	// is not the one that is applied to the packets.
+	Observed bool `json:"observed"`
+	// Report is the policy that is reported in the flow records.
+	Report *Match `json:"report"`
+	// Packet is the policy that is applied to the packets.
+	Packet *Match `json:"packet"`
+}
+
+// Simulate returns the decision that the datapath would make for the flow
+// with the given policy. It uses the same policy databases and ACL caches as
+// the datapath, so the decision is exactly the one of the enforcer.
+func Simulate(contextID string, puPolicy *policy.PUPolicy, r *Request) (*Decision, error) {
+
+	if puPolicy == nil || r == nil {
+		return nil, errors.New("policy and request are required")
+	}
+
+	if len(r.Tags) == 0 && r.IP == nil {
+		return nil, errors.New("either the tags or the ip of the remote end must be provided")
+	}
+
+	proto, err := protocolName(r.Protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	puInfo := policy.PUInfoFromPolicyAndRuntime(contextID, puPolicy, policy.NewPURuntimeWithDefaults())
+
+	pu, err := pucontext.NewPU(contextID, puInfo, time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create pu context: %s", err)
+	}
+
+	if len(r.Tags) > 0 {
+		return simulateTags(pu, puPolicy, r, proto), nil
+	}
+
+	return simulateACLs(pu, puPolicy, r, proto)
+}
+
+// simulateTags looks up the policy of a flow between two PUs. The lookup of
+// incoming flows includes the port label that the datapath appends to the
+// claims of the remote PU.
+func simulateTags(pu *pucontext.PUContext, puPolicy *policy.PUPolicy, r *Request, proto string) *Decision {
+
+	tags := policy.NewTagStoreFromSlice(r.Tags)
+
+	var report, packet *policy.FlowPolicy
+	var rules policy.TagSelectorList
+
+	if r.Direction == Outgoing {
+		rules = puPolicy.TransmitterRules()
+		report, packet = pu.SearchTxtRules(tags, !r.MutualAuthorization)
+	} else {
+		rules = puPolicy.ReceiverRules()
+		tags.AppendKeyValue(constants.PortNumberLabelString, fmt.Sprintf("%s/%s", proto, strconv.Itoa(int(r.Port))))
+		report, packet = pu.SearchRcvRules(tags)
+	}
+
+	return newDecision(
+		&Match{Policy: report, TagSelector: findTagSelector(rules, report)},
+		&Match{Policy: packet, TagSelector: findTagSelector(rules, packet)},
+	)
+}
+
+// simulateACLs looks up the policy of a flow with an external network. The
+// datapath only evaluates the ACLs of TCP flows. The ACLs of other protocols
+// are enforced by the supervisor.
+func simulateACLs(pu *pucontext.PUContext, puPolicy *policy.PUPolicy, r *Request, proto string) (*Decision, error) {
+
+	if proto != constants.TCPProtoString {
+		return nil, fmt.Errorf("acls of protocol %s are not evaluated by the datapath", r.Protocol)
+	}
+
+	var report, packet *policy.FlowPolicy
+	var rules policy.IPRuleList
+
+	// The error only indicates that no ACL matched and the catch all
+	// policy is returned, which is the decision of the datapath.
+	if r.Direction == Outgoing {
+		rules = puPolicy.ApplicationACLs()
+		report, packet, _ = pu.ApplicationACLPolicyFromAddr(r.IP, r.Port) // nolint
+	} else {
+		rules = puPolicy.NetworkACLs()
+		report, packet, _ = pu.NetworkACLPolicyFromAddr(r.IP, r.Port) // nolint
+	}
+
+	return newDecision(
+		&Match{Policy: report, IPRule: findIPRule(rules, report)},
+		&Match{Policy: packet, IPRule: findIPRule(rules, packet)},
+	), nil
+}
+
+// newDecision creates the decision from the report and packet matches.
+func newDecision(report *Match, packet *Match) *Decision {
+
+	return &Decision{
+		Accepted: !packet.Policy.Action.Rejected(),
+		PolicyID: packet.Policy.PolicyID,
+		Default:  packet.TagSelector == nil && packet.IPRule == nil,
+		Observed: report.Policy != packet.Policy && report.Policy.ObserveAction.Observed(),
+		Report:   report,
+		Packet:   packet,
+	}
+}
+
+// findTagSelector returns the tag selector of a flow policy. The policy of
+// encrypted flows is a copy of the policy of the rule, so the policy ID is
+// used when the policy is not found.
+func findTagSelector(rules policy.TagSelectorList, p *policy.FlowPolicy) *policy.TagSelector {
+
+	for i := range rules {
+		if rules[i].Policy == p {
+			return &rules[i]
+		}
+	}
+
+	for i := range rules {
+		if rules[i].Policy != nil && rules[i].Policy.PolicyID == p.PolicyID && rules[i].Policy.Action.Accepted() && p.Action.Encrypted() {
+			return &rules[i]
+		}
+	}
+
+	return nil
+}
+
+// findIPRule returns the ACL of a flow policy.
+func findIPRule(rules policy.IPRuleList, p *policy.FlowPolicy) *policy.IPRule {
+
+	for i := range rules {
+		if rules[i].Policy == p {
+			return &rules[i]
+		}
+	}
+
+	return nil
+}
+
+// protocolName returns the name of the protocol that the datapath uses in
+// the port label. The datapath only processes TCP and UDP flows.
+func protocolName(proto string) (string, error) {
+
+	switch strings.ToUpper(proto) {
+	case "", constants.TCPProtoString, constants.TCPProtoNum:
+		return constants.TCPProtoString, nil
+	case constants.UDPProtoString, constants.UDPProtoNum:
+		return constants.UDPProtoString, nil
+	default:
+		return "", fmt.Errorf("unsupported protocol: %s", proto)
+	}
+}
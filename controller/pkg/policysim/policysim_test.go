@@ -0,0 +1,160 @@
+package policysim
+
+import (
+	"net"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/trireme-lib/policy"
+)
+
+func createTestPolicy() *policy.PUPolicy {
+
+	rcvRules := policy.TagSelectorList{
+		policy.TagSelector{
+			Clause: []policy.KeyValueOperator{
+				{Key: "app", Value: []string{"web"}, Operator: policy.Equal},
+			},
+			Policy: &policy.FlowPolicy{Action: policy.Accept, PolicyID: "accept-web"},
+		},
+		policy.TagSelector{
+			Clause: []policy.KeyValueOperator{
+				{Key: "app", Value: []string{"db"}, Operator: policy.Equal},
+			},
+			Policy: &policy.FlowPolicy{Action: policy.Accept, PolicyID: "accept-db"},
+		},
+		policy.TagSelector{
+			Clause: []policy.KeyValueOperator{
+				{Key: "app", Value: []string{"db"}, Operator: policy.Equal},
+			},
+			Policy: &policy.FlowPolicy{
+				Action:        policy.Reject,
+				ObserveAction: policy.ObserveContinue,
+				PolicyID:      "observe-db",
+			},
+		},
+	}
+
+	txtRules := policy.TagSelectorList{
+		policy.TagSelector{
+			Clause: []policy.KeyValueOperator{
+				{Key: "app", Value: []string{"db"}, Operator: policy.Equal},
+			},
+			Policy: &policy.FlowPolicy{Action: policy.Reject, PolicyID: "reject-db-out"},
+		},
+	}
+
+	appACLs := policy.IPRuleList{
+		policy.IPRule{
+			Addresses: []string{"10.1.0.0/16"},
+			Ports:     []string{"443"},
+			Protocols: []string{"6"},
+			Policy:    &policy.FlowPolicy{Action: policy.Accept, PolicyID: "acl-1", ServiceID: "s1"},
+		},
+	}
+
+	return policy.NewPUPolicy(
+		"pu1",
+		"/ns1",
+		policy.Police,
+		appACLs,
+		nil,
+		nil,
+		txtRules,
+		rcvRules,
+		nil,
+		nil,
+		nil,
+		policy.ExtendedMap{},
+		0,
+		0,
+		nil,
+		nil,
+		[]string{},
+	)
+}
+
+func TestSimulate(t *testing.T) {
+
+	Convey("Given a policy with tag and ip rules", t, func() {
+
+		p := createTestPolicy()
+
+		Convey("When I simulate an incoming flow of an accepted PU", func() {
+			d, err := Simulate("pu1", p, &Request{Tags: []string{"app=web"}, Port: 80})
+
+			Convey("Then the flow should be accepted by the matching selector", func() {
+				So(err, ShouldBeNil)
+				So(d.Accepted, ShouldBeTrue)
+				So(d.PolicyID, ShouldEqual, "accept-web")
+				So(d.Default, ShouldBeFalse)
+				So(d.Observed, ShouldBeFalse)
+				So(d.Packet.TagSelector, ShouldNotBeNil)
+				So(d.Packet.TagSelector.Clause[0].Value, ShouldResemble, []string{"web"})
+			})
+		})
+
+		Convey("When I simulate an incoming flow that is observed", func() {
+			d, err := Simulate("pu1", p, &Request{Tags: []string{"app=db"}, Port: 80})
+
+			Convey("Then the flow should be accepted and the observed policy reported", func() {
+				So(err, ShouldBeNil)
+				So(d.Accepted, ShouldBeTrue)
+				So(d.PolicyID, ShouldEqual, "accept-db")
+				So(d.Observed, ShouldBeTrue)
+				So(d.Report.Policy.PolicyID, ShouldEqual, "observe-db")
+				So(d.Report.TagSelector, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When I simulate an incoming flow that matches no rule", func() {
+			d, err := Simulate("pu1", p, &Request{Tags: []string{"app=other"}, Port: 80})
+
+			Convey("Then the default reject should apply", func() {
+				So(err, ShouldBeNil)
+				So(d.Accepted, ShouldBeFalse)
+				So(d.Default, ShouldBeTrue)
+				So(d.PolicyID, ShouldEqual, "default")
+			})
+		})
+
+		Convey("When I simulate an outgoing flow with and without mutual authorization", func() {
+			d, err := Simulate("pu1", p, &Request{Direction: Outgoing, Tags: []string{"app=db"}})
+			So(err, ShouldBeNil)
+			So(d.PolicyID, ShouldEqual, "default")
+
+			d, err = Simulate("pu1", p, &Request{Direction: Outgoing, Tags: []string{"app=db"}, MutualAuthorization: true})
+			So(err, ShouldBeNil)
+			So(d.PolicyID, ShouldEqual, "reject-db-out")
+			So(d.Accepted, ShouldBeFalse)
+		})
+
+		Convey("When I simulate an outgoing flow to an external network", func() {
+			d, err := Simulate("pu1", p, &Request{Direction: Outgoing, IP: net.ParseIP("10.1.2.3"), Port: 443})
+
+			Convey("Then the matching ACL should be returned", func() {
+				So(err, ShouldBeNil)
+				So(d.Accepted, ShouldBeTrue)
+				So(d.PolicyID, ShouldEqual, "acl-1")
+				So(d.Packet.IPRule, ShouldNotBeNil)
+				So(d.Packet.IPRule.Addresses, ShouldResemble, []string{"10.1.0.0/16"})
+			})
+
+			d, err = Simulate("pu1", p, &Request{Direction: Outgoing, IP: net.ParseIP("10.1.2.3"), Port: 80})
+			So(err, ShouldBeNil)
+			So(d.Accepted, ShouldBeFalse)
+			So(d.Default, ShouldBeTrue)
+		})
+
+		Convey("When I provide invalid requests", func() {
+			_, err := Simulate("pu1", p, &Request{})
+			So(err, ShouldNotBeNil)
+
+			_, err = Simulate("pu1", p, &Request{Tags: []string{"app=web"}, Protocol: "sctp"})
+			So(err, ShouldNotBeNil)
+
+			_, err = Simulate("pu1", p, &Request{IP: net.ParseIP("10.1.2.3"), Protocol: "udp"})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -1,22 +1,25 @@
 package pucontext
 
 import (
+	"crypto/ecdsa"
 	"fmt"
 	"net"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/minio/minio/pkg/wildcard"
 	"go.aporeto.io/trireme-lib/common"
 	"go.aporeto.io/trireme-lib/controller/constants"
 	"go.aporeto.io/trireme-lib/controller/internal/enforcer/acls"
 	"go.aporeto.io/trireme-lib/controller/internal/enforcer/lookup"
 
+	"go.aporeto.io/trireme-lib/controller/pkg/flowcrypto"
 	"go.aporeto.io/trireme-lib/controller/pkg/packet"
 	"go.aporeto.io/trireme-lib/policy"
 	"go.aporeto.io/trireme-lib/utils/cache"
+	"go.uber.org/zap"
 )
 
 type policies struct {
@@ -53,11 +56,18 @@ type PUContext struct {
 	synToken            []byte
 	synServiceContext   []byte
 	synExpiration       time.Time
+	encryptionKey       *ecdsa.PrivateKey
+	encryptionPublicKey []byte
 	jwt                 string
 	jwtExpiration       time.Time
 	scopes              []string
+	connectionLimits    *policy.ConnectionLimits
+	dnsFilterMode       policy.DNSFilterMode
+	dnsUpstream         *policy.DNSUpstream
 	Extension           interface{}
 	counters            []uint32
+	ruleCounters        ruleCounters
+	policy              *policy.PUPolicy
 
 	sync.RWMutex
 }
@@ -92,13 +102,26 @@ func NewPU(contextID string, puInfo *policy.PUInfo, timeout time.Duration) (*PUC
 		DNSACLs:             puInfo.Policy.DNSNameACLs(),
 		mark:                puInfo.Runtime.Options().CgroupMark,
 		scopes:              puInfo.Policy.Scopes(),
+		connectionLimits:    puInfo.Policy.ConnectionLimits(),
+		dnsFilterMode:       puInfo.Policy.DNSFilterMode(),
+		dnsUpstream:         puInfo.Policy.DNSUpstream(),
 		counters:            make([]uint32, len(countedEvents)),
+		policy:              puInfo.Policy.Clone(),
 	}
 
 	pu.CreateRcvRules(puInfo.Policy.ReceiverRules())
 
 	pu.CreateTxtRules(puInfo.Policy.TransmitterRules())
 
+	// The ephemeral key is sent with every flow, since the peer can decide
+	// to encrypt a flow even if no rule of the PU requires encryption.
+	key, public, err := flowcrypto.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	pu.encryptionKey = key
+	pu.encryptionPublicKey = public
+
 	tcpPorts, udpPorts := common.ConvertServicesToProtocolPortList(puInfo.Runtime.Options().Services)
 	pu.tcpPorts = strings.Split(tcpPorts, ",")
 	pu.udpPorts = strings.Split(udpPorts, ",")
@@ -114,21 +137,15 @@ func NewPU(contextID string, puInfo *policy.PUInfo, timeout time.Duration) (*PUC
 	return pu, nil
 }
 
-// GetPolicyFromFQDN gets the list of policies that are mapped with the hostname
+// GetPolicyFromFQDN gets the list of policies of the most specific DNS rule
+// that matches the hostname. Rules of the form *.domain match all the
+// subdomains of the domain.
 func (p *PUContext) GetPolicyFromFQDN(fqdn string) ([]policy.PortProtocolPolicy, error) {
 	p.RLock()
 	defer p.RUnlock()
 
-	// If we find a direct match, return policy
-	if v, ok := p.DNSACLs[fqdn]; ok {
-		return v, nil
-	}
-
-	// Try if there is a wildcard match
-	for policyName, policy := range p.DNSACLs {
-		if wildcard.MatchSimple(policyName, fqdn) {
-			return policy, nil
-		}
+	if policies, ok := p.DNSACLs.Lookup(fqdn); ok {
+		return policies, nil
 	}
 
 	return nil, fmt.Errorf("Policy doesn't exist")
@@ -241,6 +258,37 @@ func (p *PUContext) RemoveApplicationACL(addr net.IP, mask int) {
 	p.ApplicationACLs.RemoveIPMask(addr, mask)
 }
 
+// RemoveApplicationACLs removes the application ACLs of the rules. The other
+// ACLs of their addresses are kept. The cached policies of the external flows
+// from their addresses are removed too.
+func (p *PUContext) RemoveApplicationACLs(rules policy.IPRuleList) error {
+	defer p.Unlock()
+	p.Lock()
+
+	if err := p.ApplicationACLs.RemoveRuleList(rules); err != nil {
+		return err
+	}
+
+	addresses := map[string]bool{}
+	for _, rule := range rules {
+		for _, address := range rule.Addresses {
+			addresses[address] = true
+		}
+	}
+
+	for _, k := range p.externalIPCache.KeyList() {
+		key, ok := k.(string)
+		if !ok {
+			continue
+		}
+		if i := strings.LastIndex(key, ":"); i > 0 && addresses[key[:i]] {
+			p.externalIPCache.Remove(k) // nolint
+		}
+	}
+
+	return nil
+}
+
 // UpdateNetworkACLs updates the network ACL policy
 func (p *PUContext) UpdateNetworkACLs(rules policy.IPRuleList) error {
 	defer p.Unlock()
@@ -248,6 +296,108 @@ func (p *PUContext) UpdateNetworkACLs(rules policy.IPRuleList) error {
 	return p.networkACLs.AddRuleList(rules)
 }
 
+// UpdatePolicy applies the rules that were added to or removed from the
+// policy to the rule databases and the ACL caches of the PU, without
+// rebuilding them. It returns false without any change if the policy or the
+// runtime of the PU change more than the rules. A new context must be created
+// in this case.
+func (p *PUContext) UpdatePolicy(puInfo *policy.PUInfo) (bool, error) {
+
+	if !p.sameContext(puInfo) {
+		return false, nil
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	// The connection limits only apply to new connections.
+	p.connectionLimits = puInfo.Policy.ConnectionLimits()
+	p.dnsFilterMode = puInfo.Policy.DNSFilterMode()
+	p.dnsUpstream = puInfo.Policy.DNSUpstream()
+
+	diff := policy.NewPolicyDiff(p.policy, puInfo.Policy)
+	if diff.Empty() {
+		return true, nil
+	}
+
+	p.rcv.update(diff.ReceiverRules)
+	p.txt.update(diff.TransmitterRules)
+
+	if err := p.ApplicationACLs.RemoveRuleList(diff.ApplicationACLs.Removed); err != nil {
+		return false, err
+	}
+
+	if err := p.ApplicationACLs.AddRuleList(diff.ApplicationACLs.Added); err != nil {
+		return false, err
+	}
+
+	if err := p.networkACLs.RemoveRuleList(diff.NetworkACLs.Removed); err != nil {
+		return false, err
+	}
+
+	if err := p.networkACLs.AddRuleList(diff.NetworkACLs.Added); err != nil {
+		return false, err
+	}
+
+	p.updateDNSACLs(diff.DNSACLs)
+
+	// The cached decisions of external flows may come from removed rules.
+	for _, k := range p.externalIPCache.KeyList() {
+		p.externalIPCache.Remove(k) // nolint
+	}
+
+	p.policy = puInfo.Policy.Clone()
+
+	return true, nil
+}
+
+// sameContext returns true if the PU info only changes the rules of the
+// policy of the PU.
+func (p *PUContext) sameContext(puInfo *policy.PUInfo) bool {
+
+	options := puInfo.Runtime.Options()
+	tcpPorts, udpPorts := common.ConvertServicesToProtocolPortList(options.Services)
+
+	return p.puType == puInfo.Runtime.PUType() &&
+		p.mark == options.CgroupMark &&
+		p.username == options.UserID &&
+		p.autoport == options.AutoPort &&
+		reflect.DeepEqual(p.tcpPorts, strings.Split(tcpPorts, ",")) &&
+		reflect.DeepEqual(p.udpPorts, strings.Split(udpPorts, ",")) &&
+		p.managementID == puInfo.Policy.ManagementID() &&
+		p.managementNamespace == puInfo.Policy.ManagementNamespace() &&
+		reflect.DeepEqual(p.scopes, puInfo.Policy.Scopes()) &&
+		reflect.DeepEqual(p.identity.GetSlice(), puInfo.Policy.Identity().GetSlice()) &&
+		reflect.DeepEqual(p.annotations.GetSlice(), puInfo.Policy.Annotations().GetSlice()) &&
+		reflect.DeepEqual(p.compressedTags.GetSlice(), puInfo.Policy.CompressedTags().GetSlice())
+}
+
+// updateDNSACLs removes and adds the rules of the diff to the DNS ACLs. It
+// must be called with the lock held.
+func (p *PUContext) updateDNSACLs(diff policy.DNSRuleListDiff) {
+
+	for name, removed := range diff.Removed {
+		rules := p.DNSACLs[name]
+		for _, r := range removed {
+			for i := range rules {
+				if rules[i].Key() == r.Key() {
+					rules = append(rules[:i:i], rules[i+1:]...)
+					break
+				}
+			}
+		}
+		if len(rules) == 0 {
+			delete(p.DNSACLs, name)
+		} else {
+			p.DNSACLs[name] = rules
+		}
+	}
+
+	for name, added := range diff.Added {
+		p.DNSACLs[name] = append(p.DNSACLs[name], added...)
+	}
+}
+
 // CacheExternalFlowPolicy will cache an external flow
 func (p *PUContext) CacheExternalFlowPolicy(packet *packet.Packet, plc interface{}) {
 	p.externalIPCache.AddOrUpdate(packet.SourceAddress().String()+":"+strconv.Itoa(int(packet.SourcePort())), plc)
@@ -301,6 +451,15 @@ func (p *PUContext) UpdateCachedTokenAndServiceContext(token []byte, serviceCont
 
 }
 
+// EncryptionKey returns the ephemeral key of the PU that is used to derive
+// the keys of encrypted flows and its public part that is sent in the EK claim.
+func (p *PUContext) EncryptionKey() (*ecdsa.PrivateKey, []byte) {
+	p.RLock()
+	defer p.RUnlock()
+
+	return p.encryptionKey, p.encryptionPublicKey
+}
+
 // Scopes returns the scopes.
 func (p *PUContext) Scopes() []string {
 	p.RLock()
@@ -309,6 +468,32 @@ func (p *PUContext) Scopes() []string {
 	return p.scopes
 }
 
+// ConnectionLimits returns the connection limits of the PU.
+func (p *PUContext) ConnectionLimits() *policy.ConnectionLimits {
+	p.RLock()
+	defer p.RUnlock()
+
+	return p.connectionLimits
+}
+
+// DNSFilterMode returns how the queries for the names without DNS ACLs are
+// answered.
+func (p *PUContext) DNSFilterMode() policy.DNSFilterMode {
+	p.RLock()
+	defer p.RUnlock()
+
+	return p.dnsFilterMode
+}
+
+// DNSUpstream returns the encrypted DNS server that resolves the queries of
+// the PU, or nil if it has none.
+func (p *PUContext) DNSUpstream() *policy.DNSUpstream {
+	p.RLock()
+	defer p.RUnlock()
+
+	return p.dnsUpstream
+}
+
 // GetJWT retrieves the JWT if it exists in the cache. Returns error otherwise.
 func (p *PUContext) GetJWT() (string, error) {
 	p.RLock()
@@ -343,28 +528,56 @@ func (p *PUContext) createRuleDBs(policyRules policy.TagSelectorList) *policies
 	}
 
 	for _, rule := range policyRules {
-		// Add encrypt rule to encrypt table.
-		if rule.Policy.Action.Encrypted() {
-			policyDB.encryptRules.AddPolicy(rule)
+		for _, db := range policyDB.databases(rule) {
+			db.AddPolicy(rule)
 		}
+	}
+	return policyDB
+}
 
-		if rule.Policy.ObserveAction.ObserveContinue() {
-			if rule.Policy.Action.Accepted() {
-				policyDB.observeAcceptRules.AddPolicy(rule)
-			} else if rule.Policy.Action.Rejected() {
-				policyDB.observeRejectRules.AddPolicy(rule)
-			}
-		} else if rule.Policy.ObserveAction.ObserveApply() {
-			policyDB.observeApplyRules.AddPolicy(rule)
-		} else if rule.Policy.Action.Accepted() {
-			policyDB.acceptRules.AddPolicy(rule)
+// databases returns the databases that hold the rule.
+func (p *policies) databases(rule policy.TagSelector) []*lookup.PolicyDB {
+
+	dbs := []*lookup.PolicyDB{}
+
+	// Add encrypt rule to encrypt table.
+	if rule.Policy.Action.Encrypted() {
+		dbs = append(dbs, p.encryptRules)
+	}
+
+	if rule.Policy.ObserveAction.ObserveContinue() {
+		if rule.Policy.Action.Accepted() {
+			dbs = append(dbs, p.observeAcceptRules)
 		} else if rule.Policy.Action.Rejected() {
-			policyDB.rejectRules.AddPolicy(rule)
-		} else {
-			continue
+			dbs = append(dbs, p.observeRejectRules)
+		}
+	} else if rule.Policy.ObserveAction.ObserveApply() {
+		dbs = append(dbs, p.observeApplyRules)
+	} else if rule.Policy.Action.Accepted() {
+		dbs = append(dbs, p.acceptRules)
+	} else if rule.Policy.Action.Rejected() {
+		dbs = append(dbs, p.rejectRules)
+	}
+
+	return dbs
+}
+
+// update removes and adds the rules of the diff to the databases.
+func (p *policies) update(diff policy.TagSelectorListDiff) {
+
+	for _, rule := range diff.Removed {
+		for _, db := range p.databases(rule) {
+			if !db.RemovePolicy(rule) {
+				zap.L().Warn("Unable to find rule to remove", zap.String("policyID", rule.Policy.PolicyID))
+			}
+		}
+	}
+
+	for _, rule := range diff.Added {
+		for _, db := range p.databases(rule) {
+			db.AddPolicy(rule)
 		}
 	}
-	return policyDB
 }
 
 // CreateRcvRules create receive rules for this PU based on the update of the policy.
@@ -460,6 +673,9 @@ func (p *PUContext) SearchTxtRules(
 	tags *policy.TagStore,
 	skipRejectPolicies bool,
 ) (report *policy.FlowPolicy, packet *policy.FlowPolicy) {
+	p.RLock()
+	defer p.RUnlock()
+
 	return p.searchRules(p.txt, tags, skipRejectPolicies)
 }
 
@@ -467,5 +683,8 @@ func (p *PUContext) SearchTxtRules(
 func (p *PUContext) SearchRcvRules(
 	tags *policy.TagStore,
 ) (report *policy.FlowPolicy, packet *policy.FlowPolicy) {
+	p.RLock()
+	defer p.RUnlock()
+
 	return p.searchRules(p.rcv, tags, false)
 }
@@ -1,6 +1,7 @@
 package pucontext
 
 import (
+	"net"
 	"testing"
 	"time"
 
@@ -26,3 +27,211 @@ func Test_NewPU(t *testing.T) {
 		})
 	})
 }
+
+func Test_EncryptionKey(t *testing.T) {
+
+	Convey("When I create a PU without encryption rules", t, func() {
+
+		fp := &policy.PUInfo{
+			Runtime: policy.NewPURuntimeWithDefaults(),
+			Policy:  policy.NewPUPolicyWithDefaults(),
+		}
+
+		pu, err := NewPU("pu1", fp, 24*time.Hour)
+		So(err, ShouldBeNil)
+
+		Convey("Then the PU should have an encryption key", func() {
+			key, public := pu.EncryptionKey()
+			So(key, ShouldNotBeNil)
+			So(len(public), ShouldEqual, 65)
+		})
+	})
+
+	Convey("When I create a PU with encryption rules", t, func() {
+
+		rules := policy.TagSelectorList{
+			policy.TagSelector{
+				Clause: []policy.KeyValueOperator{
+					{
+						Key:      "app",
+						Value:    []string{"web"},
+						Operator: policy.Equal,
+					},
+				},
+				Policy: &policy.FlowPolicy{
+					Action:   policy.Accept | policy.Encrypt,
+					PolicyID: "1",
+				},
+			},
+		}
+
+		fp := &policy.PUInfo{
+			Runtime: policy.NewPURuntimeWithDefaults(),
+			Policy:  policy.NewPUPolicy("pu1", "/ns", policy.Police, nil, nil, nil, nil, rules, nil, nil, nil, nil, 0, 0, nil, nil, nil),
+		}
+
+		pu, err := NewPU("pu1", fp, 24*time.Hour)
+		So(err, ShouldBeNil)
+
+		Convey("Then the PU should have an encryption key", func() {
+			key, public := pu.EncryptionKey()
+			So(key, ShouldNotBeNil)
+			So(len(public), ShouldEqual, 65)
+		})
+	})
+}
+
+func Test_UpdatePolicy(t *testing.T) {
+
+	web := policy.TagSelector{
+		Clause: []policy.KeyValueOperator{
+			{Key: "app", Value: []string{"web"}, Operator: policy.Equal},
+		},
+		Policy: &policy.FlowPolicy{Action: policy.Accept, PolicyID: "web"},
+	}
+
+	db := policy.TagSelector{
+		Clause: []policy.KeyValueOperator{
+			{Key: "app", Value: []string{"db"}, Operator: policy.Equal},
+		},
+		Policy: &policy.FlowPolicy{Action: policy.Accept | policy.Encrypt, PolicyID: "db"},
+	}
+
+	ssh := policy.IPRule{
+		Addresses: []string{"10.0.0.0/8"},
+		Ports:     []string{"22"},
+		Protocols: []string{"6"},
+		Policy:    &policy.FlowPolicy{Action: policy.Accept, PolicyID: "ssh"},
+	}
+
+	https := policy.IPRule{
+		Addresses: []string{"10.0.0.0/8"},
+		Ports:     []string{"443"},
+		Protocols: []string{"6"},
+		Policy:    &policy.FlowPolicy{Action: policy.Accept, PolicyID: "https"},
+	}
+
+	dns := policy.DNSRuleList{
+		"www.example.com": []policy.PortProtocolPolicy{
+			{Ports: []string{"443"}, Protocols: []string{"6"}, Policy: &policy.FlowPolicy{Action: policy.Accept, PolicyID: "www"}},
+		},
+	}
+
+	Convey("Given a PU with some rules", t, func() {
+
+		runtime := policy.NewPURuntimeWithDefaults()
+
+		fp := &policy.PUInfo{
+			Runtime: runtime,
+			Policy:  policy.NewPUPolicy("pu1", "/ns", policy.Police, policy.IPRuleList{ssh}, nil, dns, nil, policy.TagSelectorList{web}, nil, nil, nil, nil, 0, 0, nil, nil, nil),
+		}
+
+		pu, err := NewPU("pu1", fp, 24*time.Hour)
+		So(err, ShouldBeNil)
+
+		_, packet := pu.SearchRcvRules(policy.NewTagStoreFromSlice([]string{"app=web"}))
+		So(packet.PolicyID, ShouldEqual, "web")
+
+		Convey("When I update the rules, only the new rules should apply", func() {
+
+			newDNS := policy.DNSRuleList{
+				"api.example.com": []policy.PortProtocolPolicy{
+					{Ports: []string{"443"}, Protocols: []string{"6"}, Policy: &policy.FlowPolicy{Action: policy.Accept, PolicyID: "api"}},
+				},
+			}
+
+			updated, err := pu.UpdatePolicy(&policy.PUInfo{
+				Runtime: runtime,
+				Policy:  policy.NewPUPolicy("pu1", "/ns", policy.Police, policy.IPRuleList{https}, nil, newDNS, nil, policy.TagSelectorList{db}, nil, nil, nil, nil, 0, 0, nil, nil, nil),
+			})
+			So(err, ShouldBeNil)
+			So(updated, ShouldBeTrue)
+
+			_, packet := pu.SearchRcvRules(policy.NewTagStoreFromSlice([]string{"app=web"}))
+			So(packet.PolicyID, ShouldEqual, "default")
+
+			_, packet = pu.SearchRcvRules(policy.NewTagStoreFromSlice([]string{"app=db"}))
+			So(packet.PolicyID, ShouldEqual, "db")
+			So(packet.Action.Encrypted(), ShouldBeTrue)
+
+			key, _ := pu.EncryptionKey()
+			So(key, ShouldNotBeNil)
+
+			_, _, err = pu.ApplicationACLPolicyFromAddr(net.ParseIP("10.1.1.1"), 22)
+			So(err, ShouldNotBeNil)
+
+			_, packet, err = pu.ApplicationACLPolicyFromAddr(net.ParseIP("10.1.1.1"), 443)
+			So(err, ShouldBeNil)
+			So(packet.PolicyID, ShouldEqual, "https")
+
+			_, err = pu.GetPolicyFromFQDN("www.example.com")
+			So(err, ShouldNotBeNil)
+
+			_, err = pu.GetPolicyFromFQDN("api.example.com")
+			So(err, ShouldBeNil)
+		})
+
+		Convey("When I add a wildcard DNS rule, the subdomains should match it", func() {
+
+			wildcardDNS := policy.DNSRuleList{
+				"*.storage.example.com": []policy.PortProtocolPolicy{
+					{Ports: []string{"443"}, Protocols: []string{"6"}, Policy: &policy.FlowPolicy{Action: policy.Accept, PolicyID: "storage"}},
+				},
+			}
+
+			updated, err := pu.UpdatePolicy(&policy.PUInfo{
+				Runtime: runtime,
+				Policy:  policy.NewPUPolicy("pu1", "/ns", policy.Police, policy.IPRuleList{ssh}, nil, wildcardDNS, nil, policy.TagSelectorList{web}, nil, nil, nil, nil, 0, 0, nil, nil, nil),
+			})
+			So(err, ShouldBeNil)
+			So(updated, ShouldBeTrue)
+
+			ps, err := pu.GetPolicyFromFQDN("bucket.eu.storage.example.com.")
+			So(err, ShouldBeNil)
+			So(ps[0].Policy.PolicyID, ShouldEqual, "storage")
+
+			_, err = pu.GetPolicyFromFQDN("storage.example.com.")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("When I remove learned ACLs, the other ACLs of the address should be kept", func() {
+
+			learned := policy.IPRule{
+				Addresses: []string{"10.1.1.1"},
+				Ports:     []string{"443"},
+				Protocols: []string{"6"},
+				Policy:    dns["www.example.com"][0].Policy,
+			}
+
+			So(pu.UpdateApplicationACLs(policy.IPRuleList{learned}), ShouldBeNil)
+
+			_, packet, err := pu.ApplicationACLPolicyFromAddr(net.ParseIP("10.1.1.1"), 443)
+			So(err, ShouldBeNil)
+			So(packet.PolicyID, ShouldEqual, "www")
+
+			So(pu.RemoveApplicationACLs(policy.IPRuleList{learned}), ShouldBeNil)
+
+			_, _, err = pu.ApplicationACLPolicyFromAddr(net.ParseIP("10.1.1.1"), 443)
+			So(err, ShouldNotBeNil)
+
+			_, packet, err = pu.ApplicationACLPolicyFromAddr(net.ParseIP("10.1.1.1"), 22)
+			So(err, ShouldBeNil)
+			So(packet.PolicyID, ShouldEqual, "ssh")
+		})
+
+		Convey("When I update the identity of the PU, the context should not be updated", func() {
+
+			identity := policy.NewTagStoreFromSlice([]string{"app=other"})
+
+			updated, err := pu.UpdatePolicy(&policy.PUInfo{
+				Runtime: runtime,
+				Policy:  policy.NewPUPolicy("pu1", "/ns", policy.Police, nil, nil, nil, nil, nil, identity, nil, nil, nil, 0, 0, nil, nil, nil),
+			})
+			So(err, ShouldBeNil)
+			So(updated, ShouldBeFalse)
+
+			_, packet := pu.SearchRcvRules(policy.NewTagStoreFromSlice([]string{"app=web"}))
+			So(packet.PolicyID, ShouldEqual, "web")
+		})
+	})
+}
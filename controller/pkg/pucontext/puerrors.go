@@ -76,6 +76,10 @@ const (
 	ErrUDPDropQueueFull
 	ErrUDPDropInNfQueue
 	ErrUDPSynDropped
+	ErrEncryptionFailed
+	ErrDecryptionFailed
+	ErrRateLimited
+	ErrConnectionLimit
 )
 
 // CounterNames is the name for each error reported to the collector
@@ -138,6 +142,10 @@ var CounterNames = []string{
 	ErrUDPDropQueueFull:             "UDPDROPQUEUEFULL",
 	ErrUDPDropInNfQueue:             "UDPDROPINNFQUEUE",
 	ErrUDPSynDropped:                "UDPSYNDROPPED",
+	ErrEncryptionFailed:             "ENCRYPTIONFAILED",
+	ErrDecryptionFailed:             "DECRYPTIONFAILED",
+	ErrRateLimited:                  "RATELIMITED",
+	ErrConnectionLimit:              "CONNECTIONLIMIT",
 }
 
 var countedEvents = []PuErrors{
@@ -377,6 +385,22 @@ var countedEvents = []PuErrors{
 		index: ErrUDPSynDropped,
 		err:   "UDP syn packet dropped missing claims",
 	},
+	ErrEncryptionFailed: {
+		index: ErrEncryptionFailed,
+		err:   "Packet dropped because payload encryption failed",
+	},
+	ErrDecryptionFailed: {
+		index: ErrDecryptionFailed,
+		err:   "Packet dropped because payload authentication failed",
+	},
+	ErrRateLimited: {
+		index: ErrRateLimited,
+		err:   "Packet dropped because the rate limit of the policy was exceeded",
+	},
+	ErrConnectionLimit: {
+		index: ErrConnectionLimit,
+		err:   "Packet dropped because the connection limit of the PU was reached",
+	},
 }
 
 // PuContextError increments the error counter and returns an error
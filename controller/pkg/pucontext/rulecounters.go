@@ -0,0 +1,88 @@
+package pucontext
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"go.aporeto.io/trireme-lib/collector"
+	"go.aporeto.io/trireme-lib/policy"
+)
+
+// ruleCounter holds the hits of the rules with the same policy ID
+type ruleCounter struct {
+	connections uint64
+}
+
+// ruleCounters holds the rule counters of a PU indexed by policy ID
+type ruleCounters struct {
+	counters map[string]*ruleCounter
+
+	sync.RWMutex
+}
+
+// counter returns the counter of the policy, creating it if needed
+func (r *ruleCounters) counter(policyID string) *ruleCounter {
+
+	r.RLock()
+	c, ok := r.counters[policyID]
+	r.RUnlock()
+
+	if ok {
+		return c
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if r.counters == nil {
+		r.counters = map[string]*ruleCounter{}
+	}
+
+	if c, ok = r.counters[policyID]; !ok {
+		c = &ruleCounter{}
+		r.counters[policyID] = c
+	}
+
+	return c
+}
+
+// CountRuleConnection records a connection decided by the given flow policy.
+func (p *PUContext) CountRuleConnection(flowPolicy *policy.FlowPolicy) {
+
+	if flowPolicy == nil || flowPolicy.PolicyID == "" {
+		return
+	}
+
+	c := p.ruleCounters.counter(flowPolicy.PolicyID)
+	atomic.AddUint64(&c.connections, 1)
+}
+
+// GetRuleCounters returns the rule counters with hits since the last call,
+// sorted by policy ID, and resets the counters to zero.
+func (p *PUContext) GetRuleCounters() []collector.RuleCounters {
+
+	p.ruleCounters.RLock()
+	defer p.ruleCounters.RUnlock()
+
+	report := []collector.RuleCounters{}
+	for policyID, c := range p.ruleCounters.counters {
+
+		counters := collector.RuleCounters{
+			PolicyID:    policyID,
+			Connections: atomic.SwapUint64(&c.connections, 0),
+		}
+
+		if counters.Connections == 0 {
+			continue
+		}
+
+		report = append(report, counters)
+	}
+
+	sort.Slice(report, func(i, j int) bool {
+		return report[i].PolicyID < report[j].PolicyID
+	})
+
+	return report
+}
@@ -0,0 +1,44 @@
+package pucontext
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/trireme-lib/collector"
+	"go.aporeto.io/trireme-lib/policy"
+)
+
+func TestRuleCounters(t *testing.T) {
+	Convey("Given a pu context", t, func() {
+		context := createPUContext()
+
+		web := &policy.FlowPolicy{Action: policy.Accept, PolicyID: "web"}
+		ssh := &policy.FlowPolicy{Action: policy.Reject, PolicyID: "ssh"}
+
+		Convey("When no rule is hit, no counters should be reported", func() {
+			So(context.GetRuleCounters(), ShouldBeEmpty)
+		})
+
+		Convey("When rules are hit, the counters should be reported by policy ID", func() {
+			context.CountRuleConnection(web)
+			context.CountRuleConnection(web)
+			context.CountRuleConnection(ssh)
+			context.CountRuleConnection(&policy.FlowPolicy{Action: policy.Accept})
+			context.CountRuleConnection(nil)
+
+			So(context.GetRuleCounters(), ShouldResemble, []collector.RuleCounters{
+				{PolicyID: "ssh", Connections: 1},
+				{PolicyID: "web", Connections: 2},
+			})
+
+			Convey("The counters should be reset once reported", func() {
+				So(context.GetRuleCounters(), ShouldBeEmpty)
+
+				context.CountRuleConnection(ssh)
+				So(context.GetRuleCounters(), ShouldResemble, []collector.RuleCounters{
+					{PolicyID: "ssh", Connections: 1},
+				})
+			})
+		})
+	})
+}
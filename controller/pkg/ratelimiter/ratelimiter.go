@@ -0,0 +1,99 @@
+package ratelimiter
+
+import (
+	"sync"
+	"time"
+
+	"go.aporeto.io/trireme-lib/utils/cache"
+)
+
+// bucket is a token bucket
+type bucket struct {
+	tokens float64
+	last   time.Time
+
+	sync.Mutex
+}
+
+// take refills the bucket since the last call and takes a token if there is one
+func (b *bucket) take(rate float64, burst int, now time.Time) bool {
+
+	b.Lock()
+	defer b.Unlock()
+
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * rate
+		b.last = now
+	}
+
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+
+	return true
+}
+
+// Limiter holds token buckets indexed by key. The buckets that are not used
+// for a while are released.
+type Limiter struct {
+	buckets cache.DataStore
+	now     func() time.Time
+
+	sync.Mutex
+}
+
+// New creates a new limiter. Idle buckets are released after the given time.
+func New(idle time.Duration) *Limiter {
+
+	return &Limiter{
+		buckets: cache.NewCacheWithExpiration("rate limiter", idle),
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token from the bucket of the key and returns false if the
+// bucket is empty. The bucket is refilled at the given rate per second and
+// holds at most burst tokens. A bucket is full when it is created.
+func (l *Limiter) Allow(key string, rate float64, burst int) bool {
+
+	if rate <= 0 {
+		return true
+	}
+
+	if burst < 1 {
+		burst = 1
+	}
+
+	now := l.now()
+
+	return l.bucket(key, burst, now).take(rate, burst, now)
+}
+
+// bucket returns the bucket of the key, creating it if needed
+func (l *Limiter) bucket(key string, burst int, now time.Time) *bucket {
+
+	if b, err := l.buckets.GetReset(key, 0); err == nil {
+		return b.(*bucket)
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	if b, err := l.buckets.GetReset(key, 0); err == nil {
+		return b.(*bucket)
+	}
+
+	b := &bucket{
+		tokens: float64(burst),
+		last:   now,
+	}
+	l.buckets.AddOrUpdate(key, b)
+
+	return b
+}
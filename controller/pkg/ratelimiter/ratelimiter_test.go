@@ -0,0 +1,54 @@
+package ratelimiter
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAllow(t *testing.T) {
+	Convey("Given a limiter", t, func() {
+
+		now := time.Date(2019, time.March, 11, 12, 0, 0, 0, time.UTC)
+		l := New(time.Minute)
+		l.now = func() time.Time { return now }
+
+		Convey("When the rate is zero, everything should be allowed", func() {
+			for i := 0; i < 100; i++ {
+				So(l.Allow("a", 0, 0), ShouldBeTrue)
+			}
+		})
+
+		Convey("When the burst is exhausted, the requests should be dropped", func() {
+			So(l.Allow("a", 2, 3), ShouldBeTrue)
+			So(l.Allow("a", 2, 3), ShouldBeTrue)
+			So(l.Allow("a", 2, 3), ShouldBeTrue)
+			So(l.Allow("a", 2, 3), ShouldBeFalse)
+
+			Convey("Other keys should have their own bucket", func() {
+				So(l.Allow("b", 2, 3), ShouldBeTrue)
+			})
+
+			Convey("The bucket should be refilled at the rate", func() {
+				now = now.Add(500 * time.Millisecond)
+				So(l.Allow("a", 2, 3), ShouldBeTrue)
+				So(l.Allow("a", 2, 3), ShouldBeFalse)
+
+				now = now.Add(time.Hour)
+				So(l.Allow("a", 2, 3), ShouldBeTrue)
+				So(l.Allow("a", 2, 3), ShouldBeTrue)
+				So(l.Allow("a", 2, 3), ShouldBeTrue)
+				So(l.Allow("a", 2, 3), ShouldBeFalse)
+			})
+		})
+
+		Convey("When the burst is zero, one request should be allowed at a time", func() {
+			So(l.Allow("a", 0.5, 0), ShouldBeTrue)
+			So(l.Allow("a", 0.5, 0), ShouldBeFalse)
+
+			now = now.Add(2 * time.Second)
+			So(l.Allow("a", 0.5, 0), ShouldBeTrue)
+		})
+	})
+}
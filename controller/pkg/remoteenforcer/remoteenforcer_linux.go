@@ -532,6 +532,7 @@ func (s *RemoteEnforcer) setupSupervisor(payload *rpcwrapper.InitRequestPayload)
 		constants.RemoteContainer,
 		payload.Configuration,
 		s.service,
+		payload.CaptureType,
 	)
 	if err != nil {
 		return fmt.Errorf("unable to setup supervisor: %s", err)
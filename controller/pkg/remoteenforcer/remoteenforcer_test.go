@@ -287,6 +287,7 @@ func TestInitEnforcer(t *testing.T) {
 			mode constants.ModeType,
 			cfg *runtime.Configuration,
 			p packetprocessor.PacketProcessor,
+			captureType rpcwrapper.CaptureType,
 		) (supervisor.Supervisor, error) {
 			return mockSupevisor, nil
 		}
@@ -403,6 +404,7 @@ func TestInitEnforcer(t *testing.T) {
 					mode constants.ModeType,
 					cfg *runtime.Configuration,
 					p packetprocessor.PacketProcessor,
+					captureType rpcwrapper.CaptureType,
 				) (supervisor.Supervisor, error) {
 					return nil, fmt.Errorf("failed supervisor")
 				}
@@ -0,0 +1,198 @@
+package policy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// AddressExclusionPrefix marks the addresses of an IP rule that are excluded
+// from the networks of the rule. For example, the addresses 0.0.0.0/0 and
+// !10.0.0.0/8 match all the addresses but the 10.0.0.0/8 network. An address
+// matches the rule if the longest prefix of the rule that contains it is not
+// excluded.
+const AddressExclusionPrefix = "!"
+
+// ExcludedAddress returns the address without the exclusion prefix and true
+// if the address is excluded.
+func ExcludedAddress(address string) (string, bool) {
+
+	if strings.HasPrefix(address, AddressExclusionPrefix) {
+		return strings.TrimPrefix(address, AddressExclusionPrefix), true
+	}
+
+	return address, false
+}
+
+// ParseRuleAddress parses an address or a subnet of an IP rule. Addresses are
+// returned as host networks. It returns true if the address is excluded.
+func ParseRuleAddress(address string) (*net.IPNet, bool, error) {
+
+	address, excluded := ExcludedAddress(address)
+
+	if !strings.Contains(address, "/") {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, false, fmt.Errorf("invalid address: %s", address)
+		}
+
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, excluded, nil
+		}
+
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, excluded, nil
+	}
+
+	_, network, err := net.ParseCIDR(address)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid address: %s", err)
+	}
+
+	return network, excluded, nil
+}
+
+// HasExcludedAddresses returns true if some addresses are excluded.
+func HasExcludedAddresses(addresses []string) bool {
+
+	for _, address := range addresses {
+		if _, excluded := ExcludedAddress(address); excluded {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ValidateExclusions returns an error if the excluded addresses of an IP rule
+// cannot be enforced the same way by the ipsets and by the expanded networks.
+// A network cannot be both included and excluded, and all the addresses
+// cannot be excluded at once. The invalid addresses are left to the callers.
+func ValidateExclusions(addresses []string) error {
+
+	included := map[string]bool{}
+	excluded := []*net.IPNet{}
+
+	for _, address := range addresses {
+		network, isExcluded, err := ParseRuleAddress(address)
+		if err != nil {
+			continue
+		}
+
+		if !isExcluded {
+			included[network.String()] = true
+			continue
+		}
+
+		if ones, _ := network.Mask.Size(); ones == 0 {
+			return fmt.Errorf("invalid exclusion %s: all the addresses cannot be excluded", address)
+		}
+
+		excluded = append(excluded, network)
+	}
+
+	for _, network := range excluded {
+		if included[network.String()] {
+			return fmt.Errorf("invalid exclusion %s: the network is also included", network)
+		}
+	}
+
+	return nil
+}
+
+// ExpandExclusions returns the networks matched by the addresses of an IP
+// rule without exclusions. The addresses are returned as is if none of them
+// is excluded.
+func ExpandExclusions(addresses []string) ([]string, error) {
+
+	included := []*net.IPNet{}
+	excluded := []*net.IPNet{}
+
+	for _, address := range addresses {
+		network, isExcluded, err := ParseRuleAddress(address)
+		if err != nil {
+			return nil, err
+		}
+
+		if isExcluded {
+			excluded = append(excluded, network)
+		} else {
+			included = append(included, network)
+		}
+	}
+
+	if len(excluded) == 0 {
+		return addresses, nil
+	}
+
+	if err := ValidateExclusions(addresses); err != nil {
+		return nil, err
+	}
+
+	expanded := []string{}
+	for _, network := range included {
+		ones, _ := network.Mask.Size()
+
+		networks := []*net.IPNet{network}
+		for _, e := range excluded {
+			// Only the longer prefixes are excluded from the network.
+			if eOnes, _ := e.Mask.Size(); eOnes > ones {
+				networks = subtractNetwork(networks, e)
+			}
+		}
+
+		for _, n := range networks {
+			expanded = append(expanded, n.String())
+		}
+	}
+
+	return expanded, nil
+}
+
+// subtractNetwork removes the excluded network from the networks. The
+// networks that contain the excluded network are split in the networks that
+// cover the rest of their addresses.
+func subtractNetwork(networks []*net.IPNet, excluded *net.IPNet) []*net.IPNet {
+
+	eOnes, bits := excluded.Mask.Size()
+
+	result := []*net.IPNet{}
+	for _, n := range networks {
+		ones, nBits := n.Mask.Size()
+
+		if nBits != bits {
+			result = append(result, n)
+			continue
+		}
+
+		if excluded.Contains(n.IP) && eOnes <= ones {
+			continue
+		}
+
+		if !n.Contains(excluded.IP) {
+			result = append(result, n)
+			continue
+		}
+
+		// Split the network in halves until the excluded network is reached
+		// and keep the halves that do not contain it.
+		current := n
+		for ones < eOnes {
+			ones++
+			mask := net.CIDRMask(ones, bits)
+			low := &net.IPNet{IP: current.IP.Mask(mask), Mask: mask}
+			high := &net.IPNet{IP: make(net.IP, len(low.IP)), Mask: mask}
+			copy(high.IP, low.IP)
+			high.IP[(ones-1)/8] |= 0x80 >> uint((ones-1)%8)
+
+			if low.Contains(excluded.IP) {
+				result = append(result, high)
+				current = low
+			} else {
+				result = append(result, low)
+				current = high
+			}
+		}
+	}
+
+	return result
+}
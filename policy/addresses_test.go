@@ -0,0 +1,68 @@
+package policy
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRuleAddresses(t *testing.T) {
+	Convey("Given the addresses of a rule", t, func() {
+
+		Convey("The excluded addresses should be parsed", func() {
+			network, excluded, err := ParseRuleAddress("!10.0.0.0/8")
+			So(err, ShouldBeNil)
+			So(excluded, ShouldBeTrue)
+			So(network.String(), ShouldEqual, "10.0.0.0/8")
+
+			network, excluded, err = ParseRuleAddress("169.254.169.254")
+			So(err, ShouldBeNil)
+			So(excluded, ShouldBeFalse)
+			So(network.String(), ShouldEqual, "169.254.169.254/32")
+
+			_, _, err = ParseRuleAddress("!10.0.0.0/33")
+			So(err, ShouldNotBeNil)
+
+			So(HasExcludedAddresses([]string{"0.0.0.0/0", "!10.0.0.0/8"}), ShouldBeTrue)
+			So(HasExcludedAddresses([]string{"0.0.0.0/0"}), ShouldBeFalse)
+		})
+
+		Convey("Addresses without exclusions should not be expanded", func() {
+			addresses := []string{"10.0.0.1", "192.168.0.0/16"}
+			expanded, err := ExpandExclusions(addresses)
+			So(err, ShouldBeNil)
+			So(expanded, ShouldResemble, addresses)
+		})
+
+		Convey("The excluded networks should be removed", func() {
+			expanded, err := ExpandExclusions([]string{"10.0.0.0/8", "!10.0.0.0/10", "!10.128.0.0/9"})
+			So(err, ShouldBeNil)
+			So(expanded, ShouldResemble, []string{"10.64.0.0/10"})
+		})
+
+		Convey("The longest prefix should decide", func() {
+			expanded, err := ExpandExclusions([]string{"0.0.0.0/0", "!10.0.0.0/8", "10.1.0.0/16", "!10.1.1.0/24", "::/0"})
+			So(err, ShouldBeNil)
+			So(expanded, ShouldContain, "0.0.0.0/5")
+			So(expanded, ShouldContain, "11.0.0.0/8")
+			So(expanded, ShouldContain, "128.0.0.0/1")
+			So(expanded, ShouldNotContain, "10.0.0.0/8")
+			So(expanded, ShouldContain, "10.1.0.0/24")
+			So(expanded, ShouldContain, "10.1.2.0/23")
+			So(expanded, ShouldContain, "10.1.128.0/17")
+			So(expanded, ShouldContain, "::/0")
+			So(len(expanded), ShouldEqual, 8+8+1)
+		})
+
+		Convey("The exclusions that the ipsets cannot hold should be refused", func() {
+			So(ValidateExclusions([]string{"0.0.0.0/0", "!10.0.0.0/8", "10.1.0.0/16"}), ShouldBeNil)
+			So(ValidateExclusions([]string{"10.0.0.0/8", "!10.0.0.0/8"}), ShouldNotBeNil)
+			So(ValidateExclusions([]string{"10.0.0.1", "!10.0.0.1/32"}), ShouldNotBeNil)
+			So(ValidateExclusions([]string{"10.0.0.0/8", "!0.0.0.0/0"}), ShouldNotBeNil)
+			So(ValidateExclusions([]string{"10.0.0.0/8", "!::/0"}), ShouldNotBeNil)
+
+			_, err := ExpandExclusions([]string{"10.0.0.0/8", "!10.0.0.0/8"})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,60 @@
+package policy
+
+import "errors"
+
+// ConnectionLimits caps the concurrent TCP connections of a PU. A connection
+// is counted from its Syn until its flow is destroyed in conntrack, or until
+// its Syn expires unanswered. A peer is the remote PU if its identity is known
+// or the remote IP address otherwise. Zero means no limit.
+type ConnectionLimits struct {
+	// MaxInbound is the number of concurrent connections the PU accepts.
+	MaxInbound int `json:"maxInbound,omitempty"`
+	// MaxOutbound is the number of concurrent connections the PU initiates.
+	MaxOutbound int `json:"maxOutbound,omitempty"`
+	// MaxInboundPerPeer is the number of concurrent connections the PU
+	// accepts from a single peer.
+	MaxInboundPerPeer int `json:"maxInboundPerPeer,omitempty"`
+	// MaxOutboundPerPeer is the number of concurrent connections the PU
+	// initiates to a single peer.
+	MaxOutboundPerPeer int `json:"maxOutboundPerPeer,omitempty"`
+}
+
+// Validate validates the connection limits.
+func (l *ConnectionLimits) Validate() error {
+
+	if l == nil {
+		return nil
+	}
+
+	if l.MaxInbound < 0 || l.MaxOutbound < 0 || l.MaxInboundPerPeer < 0 || l.MaxOutboundPerPeer < 0 {
+		return errors.New("connection limits must not be negative")
+	}
+
+	return nil
+}
+
+// Limits returns the total and per peer limits of the given direction.
+func (l *ConnectionLimits) Limits(inbound bool) (int, int) {
+
+	if l == nil {
+		return 0, 0
+	}
+
+	if inbound {
+		return l.MaxInbound, l.MaxInboundPerPeer
+	}
+
+	return l.MaxOutbound, l.MaxOutboundPerPeer
+}
+
+// Copy returns a copy of the connection limits.
+func (l *ConnectionLimits) Copy() *ConnectionLimits {
+
+	if l == nil {
+		return nil
+	}
+
+	c := *l
+
+	return &c
+}
@@ -0,0 +1,210 @@
+package policy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// IPRuleListDiff holds the IP rules that were added to and removed from a list.
+type IPRuleListDiff struct {
+	Added   IPRuleList
+	Removed IPRuleList
+}
+
+// TagSelectorListDiff holds the tag selectors that were added to and removed
+// from a list.
+type TagSelectorListDiff struct {
+	Added   TagSelectorList
+	Removed TagSelectorList
+}
+
+// DNSRuleListDiff holds the DNS rules that were added to and removed from a
+// list, indexed by name.
+type DNSRuleListDiff struct {
+	Added   DNSRuleList
+	Removed DNSRuleList
+}
+
+// PolicyDiff holds the changes of the rules between two policies. Rules are
+// compared by value. The removed rules are the ones of the old policy, so that
+// they can be looked up in the databases that were built from it.
+type PolicyDiff struct {
+	ApplicationACLs  IPRuleListDiff
+	NetworkACLs      IPRuleListDiff
+	TransmitterRules TagSelectorListDiff
+	ReceiverRules    TagSelectorListDiff
+	DNSACLs          DNSRuleListDiff
+}
+
+// NewPolicyDiff computes the rules that must be added and removed to go from
+// the old policy to the new policy.
+func NewPolicyDiff(oldPolicy, newPolicy *PUPolicy) *PolicyDiff {
+
+	d := &PolicyDiff{}
+
+	d.ApplicationACLs.Added, d.ApplicationACLs.Removed = diffIPRules(oldPolicy.ApplicationACLs(), newPolicy.ApplicationACLs())
+	d.NetworkACLs.Added, d.NetworkACLs.Removed = diffIPRules(oldPolicy.NetworkACLs(), newPolicy.NetworkACLs())
+	d.TransmitterRules.Added, d.TransmitterRules.Removed = diffTagSelectors(oldPolicy.TransmitterRules(), newPolicy.TransmitterRules())
+	d.ReceiverRules.Added, d.ReceiverRules.Removed = diffTagSelectors(oldPolicy.ReceiverRules(), newPolicy.ReceiverRules())
+	d.DNSACLs.Added, d.DNSACLs.Removed = diffDNSRules(oldPolicy.DNSNameACLs(), newPolicy.DNSNameACLs())
+
+	return d
+}
+
+// Empty returns true if the policies have the same rules.
+func (d *PolicyDiff) Empty() bool {
+
+	return len(d.ApplicationACLs.Added) == 0 && len(d.ApplicationACLs.Removed) == 0 &&
+		len(d.NetworkACLs.Added) == 0 && len(d.NetworkACLs.Removed) == 0 &&
+		len(d.TransmitterRules.Added) == 0 && len(d.TransmitterRules.Removed) == 0 &&
+		len(d.ReceiverRules.Added) == 0 && len(d.ReceiverRules.Removed) == 0 &&
+		len(d.DNSACLs.Added) == 0 && len(d.DNSACLs.Removed) == 0
+}
+
+// Key returns a string that identifies the flow policy by value. The schedule
+// is not part of the key, since only the active rules are enforced.
+func (f *FlowPolicy) Key() string {
+
+	if f == nil {
+		return ""
+	}
+
+	key := fmt.Sprintf("%d/%d/%s/%s/%q", f.Action, f.ObserveAction, f.ServiceID, f.PolicyID, f.Labels)
+	if f.RateLimit != nil {
+		key += fmt.Sprintf("/%+v", *f.RateLimit)
+	}
+
+	return key
+}
+
+// Key returns a string that identifies the rule by value.
+func (r IPRule) Key() string {
+
+	return fmt.Sprintf("%q|%q|%q|%q|%s", r.Addresses, r.Ports, r.Protocols, r.Extensions, r.Policy.Key())
+}
+
+// Key returns a string that identifies the selector by value.
+func (t TagSelector) Key() string {
+
+	clauses := make([]string, len(t.Clause))
+	for i, c := range t.Clause {
+		clauses[i] = fmt.Sprintf("%q %s %q %q", c.Key, c.Operator, c.Value, c.ID)
+	}
+
+	return strings.Join(clauses, "&") + "|" + t.Policy.Key()
+}
+
+// Key returns a string that identifies the rule by value.
+func (p PortProtocolPolicy) Key() string {
+
+	return fmt.Sprintf("%q|%q|%s", p.Ports, p.Protocols, p.Policy.Key())
+}
+
+// diffKeys returns the indexes of the old keys that are not in the new keys
+// and the indexes of the new keys that are not in the old keys. Duplicate
+// keys are matched one to one.
+func diffKeys(oldKeys, newKeys []string) (added []int, removed []int) {
+
+	missing := func(from, in []string) []int {
+		counts := map[string]int{}
+		for _, k := range in {
+			counts[k]++
+		}
+
+		indexes := []int{}
+		for i, k := range from {
+			if counts[k] > 0 {
+				counts[k]--
+				continue
+			}
+			indexes = append(indexes, i)
+		}
+
+		return indexes
+	}
+
+	return missing(newKeys, oldKeys), missing(oldKeys, newKeys)
+}
+
+// diffIPRules returns the rules that were added and removed.
+func diffIPRules(oldRules, newRules IPRuleList) (IPRuleList, IPRuleList) {
+
+	keys := func(l IPRuleList) []string {
+		k := make([]string, len(l))
+		for i, r := range l {
+			k[i] = r.Key()
+		}
+		return k
+	}
+
+	addedIndexes, removedIndexes := diffKeys(keys(oldRules), keys(newRules))
+
+	added := IPRuleList{}
+	for _, i := range addedIndexes {
+		added = append(added, newRules[i])
+	}
+
+	removed := IPRuleList{}
+	for _, i := range removedIndexes {
+		removed = append(removed, oldRules[i])
+	}
+
+	return added, removed
+}
+
+// diffTagSelectors returns the selectors that were added and removed.
+func diffTagSelectors(oldRules, newRules TagSelectorList) (TagSelectorList, TagSelectorList) {
+
+	keys := func(l TagSelectorList) []string {
+		k := make([]string, len(l))
+		for i, r := range l {
+			k[i] = r.Key()
+		}
+		return k
+	}
+
+	addedIndexes, removedIndexes := diffKeys(keys(oldRules), keys(newRules))
+
+	added := TagSelectorList{}
+	for _, i := range addedIndexes {
+		added = append(added, newRules[i])
+	}
+
+	removed := TagSelectorList{}
+	for _, i := range removedIndexes {
+		removed = append(removed, oldRules[i])
+	}
+
+	return added, removed
+}
+
+// diffDNSRules returns the rules that were added and removed for every name.
+func diffDNSRules(oldRules, newRules DNSRuleList) (DNSRuleList, DNSRuleList) {
+
+	keys := func(l []PortProtocolPolicy) []string {
+		k := make([]string, len(l))
+		for i, r := range l {
+			k[i] = r.Key()
+		}
+		return k
+	}
+
+	added := DNSRuleList{}
+	removed := DNSRuleList{}
+
+	for name, rules := range newRules {
+		addedIndexes, _ := diffKeys(keys(oldRules[name]), keys(rules))
+		for _, i := range addedIndexes {
+			added[name] = append(added[name], rules[i])
+		}
+	}
+
+	for name, rules := range oldRules {
+		_, removedIndexes := diffKeys(keys(rules), keys(newRules[name]))
+		for _, i := range removedIndexes {
+			removed[name] = append(removed[name], rules[i])
+		}
+	}
+
+	return added, removed
+}
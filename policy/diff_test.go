@@ -0,0 +1,101 @@
+package policy
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPolicyDiff(t *testing.T) {
+	Convey("Given an old policy", t, func() {
+
+		ssh := IPRule{
+			Addresses: []string{"10.0.0.0/8"},
+			Ports:     []string{"22"},
+			Protocols: []string{"6"},
+			Policy:    &FlowPolicy{Action: Accept, PolicyID: "ssh", ServiceID: "s1"},
+		}
+
+		https := IPRule{
+			Addresses: []string{"10.0.0.0/8"},
+			Ports:     []string{"443"},
+			Protocols: []string{"6"},
+			Policy:    &FlowPolicy{Action: Accept, PolicyID: "https", ServiceID: "s2"},
+		}
+
+		web := TagSelector{
+			Clause: []KeyValueOperator{{Key: "app", Value: []string{"web"}, Operator: Equal}},
+			Policy: &FlowPolicy{Action: Accept, PolicyID: "web"},
+		}
+
+		db := TagSelector{
+			Clause: []KeyValueOperator{{Key: "app", Value: []string{"db"}, Operator: Equal}},
+			Policy: &FlowPolicy{Action: Reject, PolicyID: "db"},
+		}
+
+		dns := DNSRuleList{
+			"www.example.com": []PortProtocolPolicy{
+				{Ports: []string{"443"}, Protocols: []string{"6"}, Policy: &FlowPolicy{Action: Accept, PolicyID: "www"}},
+			},
+			"ftp.example.com": []PortProtocolPolicy{
+				{Ports: []string{"21"}, Protocols: []string{"6"}, Policy: &FlowPolicy{Action: Accept, PolicyID: "ftp"}},
+			},
+		}
+
+		oldPolicy := NewPUPolicy("id1", "/abc", Police, IPRuleList{ssh, https}, nil, dns, TagSelectorList{web}, TagSelectorList{web, db}, nil, nil, nil, nil, 0, 0, nil, nil, []string{})
+
+		Convey("When the new policy has the same rules in new objects", func() {
+			newSSH := ssh
+			newSSH.Policy = &FlowPolicy{Action: Accept, PolicyID: "ssh", ServiceID: "s1"}
+
+			newPolicy := NewPUPolicy("id1", "/abc", Police, IPRuleList{https, newSSH}, nil, dns.Copy(), TagSelectorList{web}, TagSelectorList{db, web}, nil, nil, nil, nil, 0, 0, nil, nil, []string{})
+
+			Convey("Then the diff should be empty", func() {
+				So(NewPolicyDiff(oldPolicy, newPolicy).Empty(), ShouldBeTrue)
+			})
+		})
+
+		Convey("When the new policy changes some rules", func() {
+			newDB := TagSelector{
+				Clause: db.Clause,
+				Policy: &FlowPolicy{Action: Accept, PolicyID: "db"},
+			}
+
+			newDNS := DNSRuleList{
+				"www.example.com": []PortProtocolPolicy{
+					{Ports: []string{"443"}, Protocols: []string{"6"}, Policy: &FlowPolicy{Action: Accept, PolicyID: "www"}},
+					{Ports: []string{"80"}, Protocols: []string{"6"}, Policy: &FlowPolicy{Action: Accept, PolicyID: "www"}},
+				},
+			}
+
+			newPolicy := NewPUPolicy("id1", "/abc", Police, IPRuleList{https}, IPRuleList{ssh}, newDNS, TagSelectorList{web, web}, TagSelectorList{web, newDB}, nil, nil, nil, nil, 0, 0, nil, nil, []string{})
+
+			d := NewPolicyDiff(oldPolicy, newPolicy)
+
+			Convey("Then only the changes should be in the diff", func() {
+				So(d.Empty(), ShouldBeFalse)
+
+				So(d.ApplicationACLs.Added, ShouldBeEmpty)
+				So(d.ApplicationACLs.Removed, ShouldHaveLength, 1)
+				So(d.ApplicationACLs.Removed[0].Policy, ShouldPointTo, ssh.Policy)
+
+				So(d.NetworkACLs.Added, ShouldHaveLength, 1)
+				So(d.NetworkACLs.Removed, ShouldBeEmpty)
+
+				So(d.TransmitterRules.Added, ShouldHaveLength, 1)
+				So(d.TransmitterRules.Removed, ShouldBeEmpty)
+
+				So(d.ReceiverRules.Added, ShouldHaveLength, 1)
+				So(d.ReceiverRules.Added[0].Policy, ShouldPointTo, newDB.Policy)
+				So(d.ReceiverRules.Removed, ShouldHaveLength, 1)
+				So(d.ReceiverRules.Removed[0].Policy, ShouldPointTo, db.Policy)
+
+				So(d.DNSACLs.Added, ShouldHaveLength, 1)
+				So(d.DNSACLs.Added["www.example.com"], ShouldHaveLength, 1)
+				So(d.DNSACLs.Added["www.example.com"][0].Ports, ShouldResemble, []string{"80"})
+				So(d.DNSACLs.Removed, ShouldHaveLength, 1)
+				So(d.DNSACLs.Removed, ShouldContainKey, "ftp.example.com")
+			})
+		})
+	})
+}
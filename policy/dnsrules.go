@@ -0,0 +1,111 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DNSWildcardPrefix is the prefix of the names of the DNS rules that match all
+// the subdomains of a domain. For example, *.example.com matches the names
+// www.example.com and eu.s3.example.com, but not example.com.
+const DNSWildcardPrefix = "*."
+
+// DNSFilterMode defines how the DNS proxy answers the queries of a PU for the
+// names that are not covered by its DNS rules.
+type DNSFilterMode string
+
+const (
+	// DNSFilterNone forwards all the queries. This is the default.
+	DNSFilterNone DNSFilterMode = ""
+	// DNSFilterNXDomain answers the queries with NXDOMAIN.
+	DNSFilterNXDomain DNSFilterMode = "nxdomain"
+	// DNSFilterRefused answers the queries with REFUSED.
+	DNSFilterRefused DNSFilterMode = "refused"
+)
+
+// Validate validates the DNS filter mode.
+func (m DNSFilterMode) Validate() error {
+
+	switch m {
+	case DNSFilterNone, DNSFilterNXDomain, DNSFilterRefused:
+		return nil
+	default:
+		return fmt.Errorf("invalid dns filter mode %s: must be %s or %s", m, DNSFilterNXDomain, DNSFilterRefused)
+	}
+}
+
+// NormalizeDNSName returns the name in lower case without the trailing dot.
+func NormalizeDNSName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// ValidateDNSName validates the name of a DNS rule. Wildcards are only
+// allowed as the first label of the name.
+func ValidateDNSName(name string) error {
+
+	n := NormalizeDNSName(name)
+	if n == "" {
+		return errors.New("empty dns name")
+	}
+
+	suffix := strings.TrimPrefix(n, DNSWildcardPrefix)
+	if suffix == "" || strings.Contains(suffix, "*") {
+		return fmt.Errorf("invalid dns name %s: wildcards are only allowed as the first label", name)
+	}
+
+	for _, label := range strings.Split(suffix, ".") {
+		if label == "" {
+			return fmt.Errorf("invalid dns name %s: empty label", name)
+		}
+	}
+
+	return nil
+}
+
+// Normalize returns a copy of the list with the names normalized by
+// NormalizeDNSName. The rules of the names that only differ by their case or
+// trailing dot are merged in the order of their names, so that the order of
+// the merged rules does not change between two policies.
+func (l DNSRuleList) Normalize() DNSRuleList {
+
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	list := DNSRuleList{}
+	for _, name := range names {
+		n := NormalizeDNSName(name)
+		list[n] = append(list[n], l[name]...)
+	}
+
+	return list
+}
+
+// Lookup returns the policies of the most specific rule that matches the
+// name. The exact name is the most specific, then the wildcards of the
+// longest domains. Names are compared without case and trailing dot, the
+// names of the rules must be normalized as they are in the policies.
+func (l DNSRuleList) Lookup(name string) ([]PortProtocolPolicy, bool) {
+
+	name = NormalizeDNSName(name)
+
+	if policies, ok := l[name]; ok {
+		return policies, true
+	}
+
+	for domain := name; ; {
+		i := strings.IndexByte(domain, '.')
+		if i < 0 {
+			return nil, false
+		}
+
+		domain = domain[i+1:]
+		if policies, ok := l[DNSWildcardPrefix+domain]; ok {
+			return policies, true
+		}
+	}
+}
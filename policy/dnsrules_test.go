@@ -0,0 +1,94 @@
+package policy
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDNSRuleListLookup(t *testing.T) {
+	Convey("Given DNS rules with wildcards", t, func() {
+
+		rule := func(id string) []PortProtocolPolicy {
+			return []PortProtocolPolicy{{Ports: []string{"443"}, Protocols: []string{"6"}, Policy: &FlowPolicy{Action: Accept, PolicyID: id}}}
+		}
+
+		rules := DNSRuleList{
+			"www.example.com.": rule("www"),
+			"*.example.com":    rule("example"),
+			"*.S3.example.com": rule("s3"),
+		}.Normalize()
+
+		lookup := func(name string) string {
+			policies, ok := rules.Lookup(name)
+			if !ok {
+				return ""
+			}
+			return policies[0].Policy.PolicyID
+		}
+
+		Convey("Exact names should be preferred", func() {
+			So(lookup("WWW.example.com."), ShouldEqual, "www")
+		})
+
+		Convey("Wildcards should match all the subdomains", func() {
+			So(lookup("api.example.com."), ShouldEqual, "example")
+			So(lookup("a.b.c.example.com"), ShouldEqual, "example")
+			So(lookup("example.com"), ShouldEqual, "")
+			So(lookup("badexample.com"), ShouldEqual, "")
+		})
+
+		Convey("The longest domain should be preferred", func() {
+			So(lookup("bucket.s3.example.com."), ShouldEqual, "s3")
+			So(lookup("eu.bucket.s3.example.com."), ShouldEqual, "s3")
+			So(lookup("s3.example.com."), ShouldEqual, "example")
+		})
+
+		Convey("Names without rules should not match", func() {
+			So(lookup("www.example.net."), ShouldEqual, "")
+			So(lookup("com"), ShouldEqual, "")
+			So(lookup(""), ShouldEqual, "")
+		})
+	})
+}
+
+func TestDNSRuleListNormalize(t *testing.T) {
+	Convey("Given DNS rules with the same name in different forms", t, func() {
+
+		rules := DNSRuleList{
+			"WWW.example.com.": []PortProtocolPolicy{{Ports: []string{"443"}, Protocols: []string{"6"}, Policy: &FlowPolicy{Action: Accept}}},
+			"www.example.com":  []PortProtocolPolicy{{Ports: []string{"80"}, Protocols: []string{"6"}, Policy: &FlowPolicy{Action: Accept}}},
+		}
+
+		Convey("The rules should be merged under the normalized name", func() {
+			n := rules.Normalize()
+			So(len(n), ShouldEqual, 1)
+			So(len(n["www.example.com"]), ShouldEqual, 2)
+			So(n["www.example.com"][0].Ports, ShouldResemble, []string{"443"})
+			So(n["www.example.com"][1].Ports, ShouldResemble, []string{"80"})
+			So(len(rules), ShouldEqual, 2)
+		})
+
+		Convey("The policies should only have normalized names", func() {
+			p := NewPUPolicy("id", "/ns", Police, nil, nil, rules, nil, nil, nil, nil, nil, nil, 0, 0, nil, nil, nil)
+			So(p.DNSNameACLs(), ShouldContainKey, "www.example.com")
+			So(len(p.DNSNameACLs()), ShouldEqual, 1)
+		})
+	})
+}
+
+func TestValidateDNSName(t *testing.T) {
+	Convey("Valid names should be accepted", t, func() {
+		So(ValidateDNSName("www.example.com."), ShouldBeNil)
+		So(ValidateDNSName("*.example.com"), ShouldBeNil)
+	})
+
+	Convey("Invalid names should be rejected", t, func() {
+		So(ValidateDNSName(""), ShouldNotBeNil)
+		So(ValidateDNSName("*."), ShouldNotBeNil)
+		So(ValidateDNSName("*"), ShouldNotBeNil)
+		So(ValidateDNSName("www.*.example.com"), ShouldNotBeNil)
+		So(ValidateDNSName("*.*.example.com"), ShouldNotBeNil)
+		So(ValidateDNSName("www..example.com"), ShouldNotBeNil)
+	})
+}
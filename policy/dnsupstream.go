@@ -0,0 +1,71 @@
+package policy
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+const (
+	// DNSUpstreamTLS is the scheme of the addresses of the DNS over TLS
+	// upstream servers.
+	DNSUpstreamTLS = "tls"
+	// DNSUpstreamHTTPS is the scheme of the addresses of the DNS over HTTPS
+	// upstream servers.
+	DNSUpstreamHTTPS = "https"
+)
+
+// DNSUpstream is an encrypted DNS server that resolves the queries of the PUs
+// instead of the servers they send them to.
+type DNSUpstream struct {
+	// Address is tls://host[:port] for DNS over TLS, on port 853 by default,
+	// or https://host[:port]/path for DNS over HTTPS.
+	Address string `json:"address"`
+	// ServerName is the name verified in the certificate of the server. It
+	// defaults to the host of the address.
+	ServerName string `json:"serverName,omitempty"`
+	// CACertificates are the PEM encoded certificates of the CAs that sign
+	// the certificate of the server. Only these CAs are trusted if set, the
+	// CAs of the system otherwise.
+	CACertificates string `json:"caCertificates,omitempty"`
+}
+
+// Validate validates the DNS upstream.
+func (u *DNSUpstream) Validate() error {
+
+	if u == nil {
+		return nil
+	}
+
+	addr, err := url.Parse(u.Address)
+	if err != nil {
+		return fmt.Errorf("invalid address: %s", err)
+	}
+
+	if addr.Scheme != DNSUpstreamTLS && addr.Scheme != DNSUpstreamHTTPS {
+		return fmt.Errorf("invalid address %s: scheme must be %s or %s", u.Address, DNSUpstreamTLS, DNSUpstreamHTTPS)
+	}
+
+	if addr.Hostname() == "" {
+		return fmt.Errorf("invalid address %s: no host", u.Address)
+	}
+
+	if u.CACertificates != "" && !x509.NewCertPool().AppendCertsFromPEM([]byte(u.CACertificates)) {
+		return errors.New("invalid ca certificates: no certificate found")
+	}
+
+	return nil
+}
+
+// Copy returns a copy of the DNS upstream.
+func (u *DNSUpstream) Copy() *DNSUpstream {
+
+	if u == nil {
+		return nil
+	}
+
+	c := *u
+
+	return &c
+}
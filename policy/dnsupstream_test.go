@@ -0,0 +1,35 @@
+package policy
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDNSUpstream(t *testing.T) {
+	Convey("Given dns upstreams", t, func() {
+
+		Convey("Valid upstreams should be accepted", func() {
+			So((*DNSUpstream)(nil).Validate(), ShouldBeNil)
+			So((&DNSUpstream{Address: "tls://9.9.9.9"}).Validate(), ShouldBeNil)
+			So((&DNSUpstream{Address: "tls://[2620:fe::fe]:853", ServerName: "dns.quad9.net"}).Validate(), ShouldBeNil)
+			So((&DNSUpstream{Address: "https://dns.example.com/dns-query"}).Validate(), ShouldBeNil)
+		})
+
+		Convey("Invalid upstreams should be rejected", func() {
+			So((&DNSUpstream{}).Validate(), ShouldNotBeNil)
+			So((&DNSUpstream{Address: "9.9.9.9:853"}).Validate(), ShouldNotBeNil)
+			So((&DNSUpstream{Address: "udp://9.9.9.9"}).Validate(), ShouldNotBeNil)
+			So((&DNSUpstream{Address: "https:///dns-query"}).Validate(), ShouldNotBeNil)
+			So((&DNSUpstream{Address: "tls://9.9.9.9", CACertificates: "not a certificate"}).Validate(), ShouldNotBeNil)
+		})
+
+		Convey("The copies should not share the upstream", func() {
+			u := &DNSUpstream{Address: "tls://9.9.9.9"}
+			c := u.Copy()
+			c.Address = "tls://1.1.1.1"
+			So(u.Address, ShouldEqual, "tls://9.9.9.9")
+			So((*DNSUpstream)(nil).Copy(), ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,308 @@
+// Package fileresolver implements a policy.Resolver that reads the policies
+// of the PUs from YAML or JSON files. A PU gets the first policy whose selector
+// matches its name and tags, in the lexical order of the files and in the order
+// of the policies in each file. PUs that match no policy are not enforced.
+// The files are watched and the policies of the PUs are updated when they
+// change, so that the policies can be distributed with any file based
+// deployment tool.
+package fileresolver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.aporeto.io/trireme-lib/common"
+	"go.aporeto.io/trireme-lib/controller"
+	"go.aporeto.io/trireme-lib/policy"
+	"go.uber.org/zap"
+)
+
+// reloadDelay is the time to wait after a change of the files before the
+// policies are reloaded, so that a burst of changes triggers one reload.
+const reloadDelay = 500 * time.Millisecond
+
+// puState is the state of a PU known to the resolver.
+type puState struct {
+	runtime *policy.PURuntime
+	started bool
+
+	// spec and policy are the spec and the policy that are enforced. They
+	// are nil when the PU is not enforced.
+	spec   *PolicySpec
+	policy *policy.PUPolicy
+}
+
+// Resolver is a policy.Resolver backed by policy files.
+type Resolver struct {
+	path       string
+	controller controller.TriremeController
+	policies   []*compiledPolicy
+	pus        map[string]*puState
+
+	sync.Mutex
+}
+
+// NewResolver creates a resolver that reads the policies from the given file
+// or directory. It fails if the policies are invalid.
+func NewResolver(path string, c controller.TriremeController) (*Resolver, error) {
+
+	r := &Resolver{
+		path:       path,
+		controller: c,
+		pus:        map[string]*puState{},
+	}
+
+	policies, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	r.policies = policies
+
+	return r, nil
+}
+
+// Run watches the policy files and reloads the policies when they change,
+// until the context is cancelled.
+func (r *Resolver) Run(ctx context.Context) error {
+
+	dir := r.path
+	if info, err := os.Stat(r.path); err != nil {
+		return fmt.Errorf("unable to access policies: %s", err)
+	} else if !info.IsDir() {
+		// Watch the directory so that files replaced by a rename are seen.
+		dir = filepath.Dir(r.path)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("unable to create watcher: %s", err)
+	}
+
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close() // nolint
+		return fmt.Errorf("unable to watch %s: %s", dir, err)
+	}
+
+	go r.watch(ctx, watcher)
+
+	return nil
+}
+
+// watch reloads the policies after the changes of the watched directory.
+func (r *Resolver) watch(ctx context.Context, watcher *fsnotify.Watcher) {
+
+	defer watcher.Close() // nolint
+
+	var reload <-chan time.Time
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case _, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			reload = time.After(reloadDelay)
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			zap.L().Warn("Error while watching policy files", zap.String("path", r.path), zap.Error(err))
+
+		case <-reload:
+			reload = nil
+			if err := r.Reload(ctx); err != nil {
+				zap.L().Error("Unable to reload policy files", zap.String("path", r.path), zap.Error(err))
+			}
+		}
+	}
+}
+
+// Reload reads the policy files and updates the policies of the started PUs.
+// If the files are invalid, the current policies are kept.
+func (r *Resolver) Reload(ctx context.Context) error {
+
+	policies, err := r.load()
+	if err != nil {
+		return err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	r.policies = policies
+
+	failed := 0
+	for puID, pu := range r.pus {
+		if !pu.started {
+			continue
+		}
+		if err := r.resolve(ctx, puID, pu, false); err != nil {
+			zap.L().Error("Unable to update policy", zap.String("puID", puID), zap.Error(err))
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("unable to update the policy of %d processing units", failed)
+	}
+
+	return nil
+}
+
+// HandlePUEvent implements the policy.Resolver interface. Started PUs are
+// enforced with their policy and stopped PUs are unenforced.
+func (r *Resolver) HandlePUEvent(ctx context.Context, puID string, event common.Event, runtime policy.RuntimeReader) error {
+
+	r.Lock()
+	defer r.Unlock()
+
+	pu, ok := r.pus[puID]
+	if !ok {
+		pu = &puState{}
+		r.pus[puID] = pu
+	}
+
+	if runtime != nil {
+		pu.runtime = toPURuntime(runtime)
+	}
+
+	switch event {
+	case common.EventCreate:
+		return nil
+
+	case common.EventStart:
+		pu.started = true
+		return r.resolve(ctx, puID, pu, false)
+
+	case common.EventUpdate:
+		if !pu.started {
+			return nil
+		}
+		// The tags of the runtime may have changed.
+		return r.resolve(ctx, puID, pu, true)
+
+	case common.EventStop:
+		pu.started = false
+		return r.unenforce(ctx, puID, pu)
+
+	case common.EventDestroy:
+		delete(r.pus, puID)
+		return r.unenforce(ctx, puID, pu)
+
+	default:
+		return nil
+	}
+}
+
+// load reads and compiles the policy files.
+func (r *Resolver) load() ([]*compiledPolicy, error) {
+
+	specs, err := LoadConfig(r.path)
+	if err != nil {
+		return nil, err
+	}
+
+	return compile(specs)
+}
+
+// match returns the first policy that matches the runtime.
+func (r *Resolver) match(runtime policy.RuntimeReader) *compiledPolicy {
+
+	for _, c := range r.policies {
+		if c.matches(runtime) {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// resolve enforces the policy that matches the PU. The policy is not updated
+// if its spec did not change, unless force is true. It must be called with
+// the lock held.
+func (r *Resolver) resolve(ctx context.Context, puID string, pu *puState, force bool) error {
+
+	if pu.runtime == nil {
+		return fmt.Errorf("no runtime for %s", puID)
+	}
+
+	c := r.match(pu.runtime)
+	if c == nil {
+		if pu.policy == nil {
+			zap.L().Debug("No policy matches processing unit", zap.String("puID", puID), zap.String("name", pu.runtime.Name()))
+			return nil
+		}
+		return r.unenforce(ctx, puID, pu)
+	}
+
+	if pu.policy != nil && !force && reflect.DeepEqual(pu.spec, c.spec) {
+		return nil
+	}
+
+	plc := c.puPolicy(puID, pu.runtime)
+
+	if pu.policy == nil {
+		if err := r.controller.Enforce(ctx, puID, plc, pu.runtime); err != nil {
+			return fmt.Errorf("unable to enforce policy %s: %s", c.spec.Name, err)
+		}
+	} else {
+		if err := r.controller.UpdatePolicy(ctx, puID, plc, pu.runtime); err != nil {
+			return fmt.Errorf("unable to update policy %s: %s", c.spec.Name, err)
+		}
+	}
+
+	pu.spec = c.spec
+	pu.policy = plc
+
+	return nil
+}
+
+// unenforce unenforces the PU if it is enforced. It must be called with the
+// lock held.
+func (r *Resolver) unenforce(ctx context.Context, puID string, pu *puState) error {
+
+	if pu.policy == nil {
+		return nil
+	}
+
+	plc := pu.policy
+	pu.spec = nil
+	pu.policy = nil
+
+	if err := r.controller.UnEnforce(ctx, puID, plc, pu.runtime); err != nil {
+		return fmt.Errorf("unable to unenforce processing unit: %s", err)
+	}
+
+	return nil
+}
+
+// toPURuntime returns the runtime as a PURuntime, which is what the
+// controller expects.
+func toPURuntime(runtime policy.RuntimeReader) *policy.PURuntime {
+
+	if r, ok := runtime.(*policy.PURuntime); ok {
+		return r
+	}
+
+	options := runtime.Options()
+
+	return policy.NewPURuntime(
+		runtime.Name(),
+		runtime.Pid(),
+		runtime.NSPath(),
+		runtime.Tags(),
+		runtime.IPAddresses(),
+		runtime.PUType(),
+		&options,
+	)
+}
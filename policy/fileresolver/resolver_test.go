@@ -0,0 +1,186 @@
+package fileresolver
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/trireme-lib/common"
+	"go.aporeto.io/trireme-lib/controller/mockcontroller"
+	"go.aporeto.io/trireme-lib/policy"
+)
+
+const acceptPolicy = `
+policies:
+- name: web
+  selector:
+    tags: ["app=web"]
+  receiverRules:
+  - clause:
+    - key: app
+      values: [lb]
+    action: accept
+`
+
+const rejectPolicy = `
+policies:
+- name: web
+  selector:
+    tags: ["app=web"]
+  receiverRules:
+  - clause:
+    - key: app
+      values: [lb]
+    action: reject
+`
+
+const otherPolicy = `
+policies:
+- name: db
+  selector:
+    tags: ["app=db"]
+`
+
+func TestHandlePUEvent(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	Convey("Given a resolver", t, func() {
+
+		dir := writeFiles(map[string]string{"web.yaml": acceptPolicy})
+		defer os.RemoveAll(dir) // nolint
+
+		c := mockcontroller.NewMockTriremeController(ctrl)
+		r, err := NewResolver(dir, c)
+		So(err, ShouldBeNil)
+
+		ctx := context.Background()
+		web := policy.NewPURuntime("web-1", 100, "", policy.NewTagStoreFromSlice([]string{"app=web"}), nil, common.ContainerPU, nil)
+		db := policy.NewPURuntime("db-1", 101, "", policy.NewTagStoreFromSlice([]string{"app=db"}), nil, common.ContainerPU, nil)
+
+		Convey("When a matching PU starts, it should be enforced", func() {
+			c.EXPECT().Enforce(ctx, "pu1", gomock.Any(), web).Times(1).Return(nil)
+
+			So(r.HandlePUEvent(ctx, "pu1", common.EventCreate, web), ShouldBeNil)
+			So(r.HandlePUEvent(ctx, "pu1", common.EventStart, web), ShouldBeNil)
+			So(r.pus["pu1"].policy, ShouldNotBeNil)
+			So(r.pus["pu1"].policy.ReceiverRules()[0].Policy.Action, ShouldEqual, policy.Accept)
+
+			Convey("When the PU is updated, its policy should be updated", func() {
+				c.EXPECT().UpdatePolicy(ctx, "pu1", gomock.Any(), web).Times(1).Return(nil)
+				So(r.HandlePUEvent(ctx, "pu1", common.EventUpdate, web), ShouldBeNil)
+			})
+
+			Convey("When the PU is stopped and destroyed, it should be unenforced once", func() {
+				c.EXPECT().UnEnforce(ctx, "pu1", gomock.Any(), web).Times(1).Return(nil)
+				So(r.HandlePUEvent(ctx, "pu1", common.EventStop, web), ShouldBeNil)
+				So(r.HandlePUEvent(ctx, "pu1", common.EventDestroy, web), ShouldBeNil)
+				So(r.pus, ShouldNotContainKey, "pu1")
+			})
+
+			Convey("When the files are reloaded without changes, nothing should happen", func() {
+				So(r.Reload(ctx), ShouldBeNil)
+			})
+
+			Convey("When the policy changes, it should be updated", func() {
+				So(ioutil.WriteFile(filepath.Join(dir, "web.yaml"), []byte(rejectPolicy), 0600), ShouldBeNil)
+
+				c.EXPECT().UpdatePolicy(ctx, "pu1", gomock.Any(), web).Times(1).Return(nil)
+				So(r.Reload(ctx), ShouldBeNil)
+				So(r.pus["pu1"].policy.ReceiverRules()[0].Policy.Action, ShouldEqual, policy.Reject)
+			})
+
+			Convey("When the policy is removed, the PU should be unenforced", func() {
+				So(ioutil.WriteFile(filepath.Join(dir, "web.yaml"), []byte(otherPolicy), 0600), ShouldBeNil)
+
+				c.EXPECT().UnEnforce(ctx, "pu1", gomock.Any(), web).Times(1).Return(nil)
+				So(r.Reload(ctx), ShouldBeNil)
+				So(r.pus["pu1"].policy, ShouldBeNil)
+
+				Convey("When the PU matches the new policy, it should be enforced", func() {
+					c.EXPECT().Enforce(ctx, "pu1", gomock.Any(), db).Times(1).Return(nil)
+					So(r.HandlePUEvent(ctx, "pu1", common.EventUpdate, db), ShouldBeNil)
+					So(r.pus["pu1"].spec.Name, ShouldEqual, "db")
+				})
+			})
+
+			Convey("When the files become invalid, the policy should be kept", func() {
+				So(ioutil.WriteFile(filepath.Join(dir, "web.yaml"), []byte("policies: [{}]"), 0600), ShouldBeNil)
+
+				So(r.Reload(ctx), ShouldNotBeNil)
+				So(r.policies[0].spec.Name, ShouldEqual, "web")
+				So(r.pus["pu1"].policy, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When a PU that matches no policy starts, it should not be enforced", func() {
+			So(r.HandlePUEvent(ctx, "pu2", common.EventStart, db), ShouldBeNil)
+			So(r.pus["pu2"].policy, ShouldBeNil)
+			So(r.HandlePUEvent(ctx, "pu2", common.EventDestroy, db), ShouldBeNil)
+		})
+
+		Convey("When the controller fails to enforce the PU, an error should be returned", func() {
+			c.EXPECT().Enforce(ctx, "pu1", gomock.Any(), web).Times(1).Return(errors.New("error"))
+
+			So(r.HandlePUEvent(ctx, "pu1", common.EventStart, web), ShouldNotBeNil)
+			So(r.pus["pu1"].policy, ShouldBeNil)
+		})
+	})
+
+	Convey("Given invalid policy files, the resolver should not be created", t, func() {
+		dir := writeFiles(map[string]string{"web.yaml": "policies: [{}]"})
+		defer os.RemoveAll(dir) // nolint
+
+		_, err := NewResolver(dir, nil)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestRun(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	Convey("Given a running resolver with an enforced PU", t, func() {
+
+		dir := writeFiles(map[string]string{"web.yaml": acceptPolicy})
+		defer os.RemoveAll(dir) // nolint
+
+		c := mockcontroller.NewMockTriremeController(ctrl)
+		r, err := NewResolver(filepath.Join(dir, "web.yaml"), c)
+		So(err, ShouldBeNil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		So(r.Run(ctx), ShouldBeNil)
+
+		web := policy.NewPURuntime("web-1", 100, "", policy.NewTagStoreFromSlice([]string{"app=web"}), nil, common.ContainerPU, nil)
+		c.EXPECT().Enforce(ctx, "pu1", gomock.Any(), web).Times(1).Return(nil)
+		So(r.HandlePUEvent(ctx, "pu1", common.EventStart, web), ShouldBeNil)
+
+		Convey("When the file is replaced, the policy should be updated", func() {
+			updated := make(chan struct{})
+			c.EXPECT().UpdatePolicy(ctx, "pu1", gomock.Any(), web).Times(1).Do(
+				func(context.Context, string, *policy.PUPolicy, *policy.PURuntime) {
+					close(updated)
+				},
+			).Return(nil)
+
+			tmp := filepath.Join(dir, ".web.yaml.tmp")
+			So(ioutil.WriteFile(tmp, []byte(rejectPolicy), 0600), ShouldBeNil)
+			So(os.Rename(tmp, filepath.Join(dir, "web.yaml")), ShouldBeNil)
+
+			select {
+			case <-updated:
+			case <-time.After(5 * time.Second):
+				So("timeout", ShouldBeEmpty)
+			}
+		})
+	})
+}
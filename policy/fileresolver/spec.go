@@ -0,0 +1,828 @@
+package fileresolver
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"go.aporeto.io/trireme-lib/common"
+	"go.aporeto.io/trireme-lib/controller/constants"
+	"go.aporeto.io/trireme-lib/policy"
+	"go.aporeto.io/trireme-lib/utils/portspec"
+)
+
+// Config is the content of a policy file. Files can be written in YAML or
+// JSON.
+type Config struct {
+	// Policies are the policies defined in the file.
+	Policies []*PolicySpec `json:"policies"`
+}
+
+// PolicySpec is the declarative policy of the PUs that match its selector.
+type PolicySpec struct {
+	// Name is the name of the policy. It must be unique across all files.
+	Name string `json:"name"`
+
+	// Selector selects the PUs that get the policy.
+	Selector SelectorSpec `json:"selector"`
+
+	// Action is the action of the PU as a whole: police (default) or allowall.
+	Action string `json:"action,omitempty"`
+
+	// Identity are tags added to the tags of the runtime to build the
+	// identity of the PU.
+	Identity []string `json:"identity,omitempty"`
+
+	// Annotations are tags added to the tags of the runtime to build the
+	// annotations of the PU.
+	Annotations []string `json:"annotations,omitempty"`
+
+	// ApplicationACLs are the ACLs of the traffic initiated by the PU.
+	ApplicationACLs []*ACLSpec `json:"applicationACLs,omitempty"`
+
+	// NetworkACLs are the ACLs of the traffic received by the PU.
+	NetworkACLs []*ACLSpec `json:"networkACLs,omitempty"`
+
+	// TransmitterRules are the tag selectors of the PUs the PU can reach.
+	TransmitterRules []*RuleSpec `json:"transmitterRules,omitempty"`
+
+	// ReceiverRules are the tag selectors of the PUs that can reach the PU.
+	ReceiverRules []*RuleSpec `json:"receiverRules,omitempty"`
+
+	// DNSACLs are the ACLs of the traffic initiated by the PU, by domain name.
+	// Names of the form *.domain match all the subdomains of the domain.
+	DNSACLs map[string][]*PortProtocolSpec `json:"dnsACLs,omitempty"`
+
+	// DNSFilter answers the queries for the names without DNS ACLs locally
+	// instead of forwarding them: nxdomain or refused.
+	DNSFilter string `json:"dnsFilter,omitempty"`
+
+	// DNSUpstream resolves the queries of the PU over TLS or HTTPS instead
+	// of the servers they are sent to.
+	DNSUpstream *policy.DNSUpstream `json:"dnsUpstream,omitempty"`
+
+	// ExposedServices are the services exposed by the PU.
+	ExposedServices []*ServiceSpec `json:"exposedServices,omitempty"`
+
+	// DependentServices are the services the PU depends on.
+	DependentServices []*ServiceSpec `json:"dependentServices,omitempty"`
+
+	// Scopes are the scopes of the PU.
+	Scopes []string `json:"scopes,omitempty"`
+
+	// ConnectionLimits caps the concurrent connections of the PU.
+	ConnectionLimits *policy.ConnectionLimits `json:"connectionLimits,omitempty"`
+}
+
+// SelectorSpec selects PUs by name and by tags. An empty selector matches
+// all the PUs.
+type SelectorSpec struct {
+	// Names are shell patterns. The name of the PU must match one of them.
+	Names []string `json:"names,omitempty"`
+
+	// Tags are key=value pairs. The PU must have all of them.
+	Tags []string `json:"tags,omitempty"`
+}
+
+// ActionSpec is the action of a rule.
+type ActionSpec struct {
+	// Action is accept or reject.
+	Action string `json:"action"`
+
+	// Log logs the flows matching the rule.
+	Log bool `json:"log,omitempty"`
+
+	// Encrypt encrypts the flows matching the rule.
+	Encrypt bool `json:"encrypt,omitempty"`
+
+	// Observe makes the rule an observation rule: continue reports the
+	// action without applying it, apply reports and applies it.
+	Observe string `json:"observe,omitempty"`
+
+	// PolicyID is the ID reported for the flows matching the rule.
+	PolicyID string `json:"policyID,omitempty"`
+
+	// ServiceID is the ID of the service reported for the flows matching the
+	// rule.
+	ServiceID string `json:"serviceID,omitempty"`
+
+	// Labels are the labels of the rule.
+	Labels []string `json:"labels,omitempty"`
+
+	// Schedule restricts the time during which the rule is enforced.
+	Schedule *ScheduleSpec `json:"schedule,omitempty"`
+
+	// RateLimit drops the accepted flows that exceed the given rates.
+	RateLimit *RateLimitSpec `json:"rateLimit,omitempty"`
+}
+
+// RateLimitSpec is the rate limit of a rule.
+type RateLimitSpec struct {
+	// ConnectionsPerSecond is the number of new connections allowed per
+	// second for every remote endpoint.
+	ConnectionsPerSecond float64 `json:"connectionsPerSecond,omitempty"`
+
+	// PacketsPerSecond is the number of packets allowed per second for every
+	// remote endpoint.
+	PacketsPerSecond float64 `json:"packetsPerSecond,omitempty"`
+
+	// Burst is the number of connections or packets that can exceed the rate
+	// at once.
+	Burst int `json:"burst,omitempty"`
+
+	// Key groups the remote endpoints by identity or ip.
+	Key string `json:"key,omitempty"`
+}
+
+// ScheduleSpec is the schedule of a rule.
+type ScheduleSpec struct {
+	// NotBefore is the time the rule becomes valid, in RFC 3339 format.
+	NotBefore time.Time `json:"notBefore,omitempty"`
+
+	// NotAfter is the time the rule expires, in RFC 3339 format.
+	NotAfter time.Time `json:"notAfter,omitempty"`
+
+	// Recurrence is a cron expression evaluated in UTC.
+	Recurrence string `json:"recurrence,omitempty"`
+
+	// Duration is how long a window of the recurrence stays open, such as 1h30m.
+	Duration string `json:"duration,omitempty"`
+}
+
+// ACLSpec is an ACL rule.
+type ACLSpec struct {
+	ActionSpec
+
+	// Addresses are the networks of the rule in CIDR notation. The networks
+	// prefixed with ! are excluded from the rule.
+	Addresses []string `json:"addresses"`
+
+	// Ports are the ports or port ranges (min:max) of the rule.
+	Ports []string `json:"ports,omitempty"`
+
+	// Protocols are the protocols of the rule, by name or number.
+	Protocols []string `json:"protocols,omitempty"`
+}
+
+// ClauseSpec is one clause of a tag selector.
+type ClauseSpec struct {
+	// Key is the key of the tag.
+	Key string `json:"key"`
+
+	// Operator is the operator of the clause. It defaults to =.
+	Operator string `json:"operator,omitempty"`
+
+	// Values are the values of the clause.
+	Values []string `json:"values,omitempty"`
+
+	// ID is the ID of the clause.
+	ID string `json:"id,omitempty"`
+}
+
+// RuleSpec is a tag selector rule. All the clauses must match.
+type RuleSpec struct {
+	ActionSpec
+
+	// Clause are the clauses of the selector.
+	Clause []*ClauseSpec `json:"clause"`
+}
+
+// PortProtocolSpec is a DNS ACL rule.
+type PortProtocolSpec struct {
+	ActionSpec
+
+	// Ports are the ports or port ranges (min:max) of the rule.
+	Ports []string `json:"ports,omitempty"`
+
+	// Protocols are the protocols of the rule, by name or number.
+	Protocols []string `json:"protocols,omitempty"`
+}
+
+// ServiceSpec is an application service.
+type ServiceSpec struct {
+	// ID is the ID of the service.
+	ID string `json:"id"`
+
+	// Type is the type of the service: l3 (default), tcp or http.
+	Type string `json:"type,omitempty"`
+
+	// Ports are the port or port range (min:max) of the service.
+	Ports string `json:"ports"`
+
+	// Protocol is the protocol of the service. It defaults to tcp.
+	Protocol string `json:"protocol,omitempty"`
+
+	// Addresses are the networks of the service in CIDR notation. An
+	// empty list means any address.
+	Addresses []string `json:"addresses,omitempty"`
+
+	// FQDNs are the domain names of the service.
+	FQDNs []string `json:"fqdns,omitempty"`
+
+	// PrivatePorts are the ports the application listens to, if they are
+	// different from the ports of the service. Only used for exposed services.
+	PrivatePorts string `json:"privatePorts,omitempty"`
+
+	// External indicates that the service is outside of the network
+	// controlled by the enforcers.
+	External bool `json:"external,omitempty"`
+
+	// Tags are the tags of the service.
+	Tags []string `json:"tags,omitempty"`
+}
+
+// validOperators are the operators of the tag selectors.
+var validOperators = map[string]policy.Operator{
+	policy.Equal:          policy.Equal,
+	policy.NotEqual:       policy.NotEqual,
+	policy.KeyExists:      policy.KeyExists,
+	policy.KeyNotExists:   policy.KeyNotExists,
+	policy.Prefix:         policy.Prefix,
+	policy.Suffix:         policy.Suffix,
+	policy.Regex:          policy.Regex,
+	policy.LessThan:       policy.LessThan,
+	policy.LessOrEqual:    policy.LessOrEqual,
+	policy.GreaterThan:    policy.GreaterThan,
+	policy.GreaterOrEqual: policy.GreaterOrEqual,
+	policy.SemverRange:    policy.SemverRange,
+}
+
+// compiledPolicy is a policy spec with the rules converted to their policy
+// representation. The rules do not depend on the PU and are shared by all the
+// PUs of the policy.
+type compiledPolicy struct {
+	spec              *PolicySpec
+	action            policy.PUAction
+	applicationACLs   policy.IPRuleList
+	networkACLs       policy.IPRuleList
+	transmitterRules  policy.TagSelectorList
+	receiverRules     policy.TagSelectorList
+	dnsACLs           policy.DNSRuleList
+	exposedServices   policy.ApplicationServicesList
+	dependentServices policy.ApplicationServicesList
+}
+
+// LoadConfig reads the policies of a file, or of all the .yaml, .yml and
+// .json files of a directory in lexical order.
+func LoadConfig(configPath string) ([]*PolicySpec, error) {
+
+	files, err := configFiles(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	specs := []*PolicySpec{}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s: %s", file, err)
+		}
+
+		config := &Config{}
+		if err := yaml.Unmarshal(data, config); err != nil {
+			return nil, fmt.Errorf("unable to decode %s: %s", file, err)
+		}
+
+		specs = append(specs, config.Policies...)
+	}
+
+	return specs, nil
+}
+
+// configFiles returns the policy files of the path.
+func configFiles(configPath string) ([]string, error) {
+
+	info, err := os.Stat(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to access policies: %s", err)
+	}
+
+	if !info.IsDir() {
+		return []string{configPath}, nil
+	}
+
+	entries, err := ioutil.ReadDir(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list policies: %s", err)
+	}
+
+	files := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		switch filepath.Ext(entry.Name()) {
+		case ".yaml", ".yml", ".json":
+			files = append(files, filepath.Join(configPath, entry.Name()))
+		}
+	}
+
+	sort.Strings(files)
+
+	return files, nil
+}
+
+// compile validates the specs and converts their rules.
+func compile(specs []*PolicySpec) ([]*compiledPolicy, error) {
+
+	names := map[string]struct{}{}
+	policies := make([]*compiledPolicy, len(specs))
+
+	for i, spec := range specs {
+		if spec == nil || spec.Name == "" {
+			return nil, fmt.Errorf("policy %d has no name", i)
+		}
+
+		if _, ok := names[spec.Name]; ok {
+			return nil, fmt.Errorf("duplicate policy %s", spec.Name)
+		}
+		names[spec.Name] = struct{}{}
+
+		c, err := spec.compile()
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy %s: %s", spec.Name, err)
+		}
+		policies[i] = c
+	}
+
+	return policies, nil
+}
+
+// compile validates the spec and converts its rules.
+func (s *PolicySpec) compile() (*compiledPolicy, error) {
+
+	c := &compiledPolicy{
+		spec:             s,
+		dnsACLs:          policy.DNSRuleList{},
+		transmitterRules: policy.TagSelectorList{},
+		receiverRules:    policy.TagSelectorList{},
+	}
+
+	switch strings.ToLower(s.Action) {
+	case "", "police":
+		c.action = policy.Police
+	case "allowall":
+		c.action = policy.AllowAll
+	default:
+		return nil, fmt.Errorf("invalid action %s", s.Action)
+	}
+
+	for _, pattern := range s.Selector.Names {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid name pattern %s: %s", pattern, err)
+		}
+	}
+
+	for _, tags := range [][]string{s.Selector.Tags, s.Identity, s.Annotations} {
+		for _, tag := range tags {
+			if !strings.Contains(tag, "=") {
+				return nil, fmt.Errorf("invalid tag %s: expected key=value", tag)
+			}
+		}
+	}
+
+	var err error
+	if c.applicationACLs, err = compileACLs(s.ApplicationACLs); err != nil {
+		return nil, fmt.Errorf("invalid application acl: %s", err)
+	}
+
+	if c.networkACLs, err = compileACLs(s.NetworkACLs); err != nil {
+		return nil, fmt.Errorf("invalid network acl: %s", err)
+	}
+
+	for _, r := range s.TransmitterRules {
+		selector, err := r.compile()
+		if err != nil {
+			return nil, fmt.Errorf("invalid transmitter rule: %s", err)
+		}
+		c.transmitterRules = append(c.transmitterRules, selector)
+	}
+
+	for _, r := range s.ReceiverRules {
+		selector, err := r.compile()
+		if err != nil {
+			return nil, fmt.Errorf("invalid receiver rule: %s", err)
+		}
+		c.receiverRules = append(c.receiverRules, selector)
+	}
+
+	for name, rules := range s.DNSACLs {
+		if err := policy.ValidateDNSName(name); err != nil {
+			return nil, fmt.Errorf("invalid dns acl: %s", err)
+		}
+		for _, r := range rules {
+			if r == nil {
+				return nil, fmt.Errorf("invalid dns acl for %s: empty rule", name)
+			}
+			flowPolicy, err := r.ActionSpec.compile()
+			if err != nil {
+				return nil, fmt.Errorf("invalid dns acl for %s: %s", name, err)
+			}
+			protocols, err := compileProtocols(r.Protocols)
+			if err != nil {
+				return nil, fmt.Errorf("invalid dns acl for %s: %s", name, err)
+			}
+			c.dnsACLs[name] = append(c.dnsACLs[name], policy.PortProtocolPolicy{
+				Ports:     r.Ports,
+				Protocols: protocols,
+				Policy:    flowPolicy,
+			})
+		}
+	}
+
+	if c.exposedServices, err = compileServices(s.ExposedServices, true); err != nil {
+		return nil, fmt.Errorf("invalid exposed service: %s", err)
+	}
+
+	if c.dependentServices, err = compileServices(s.DependentServices, false); err != nil {
+		return nil, fmt.Errorf("invalid dependent service: %s", err)
+	}
+
+	if err := s.ConnectionLimits.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid connection limits: %s", err)
+	}
+
+	if err := policy.DNSFilterMode(strings.ToLower(s.DNSFilter)).Validate(); err != nil {
+		return nil, fmt.Errorf("invalid dns filter: %s", err)
+	}
+
+	if err := s.DNSUpstream.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid dns upstream: %s", err)
+	}
+
+	return c, nil
+}
+
+// matches returns true if the runtime is selected by the policy.
+func (c *compiledPolicy) matches(runtime policy.RuntimeReader) bool {
+
+	selector := c.spec.Selector
+
+	if len(selector.Names) > 0 {
+		matched := false
+		for _, pattern := range selector.Names {
+			if ok, _ := path.Match(pattern, runtime.Name()); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	tags := runtime.Tags()
+	if tags == nil {
+		return len(selector.Tags) == 0
+	}
+
+	for _, tag := range selector.Tags {
+		parts := strings.SplitN(tag, "=", 2)
+		if value, ok := tags.Get(parts[0]); !ok || value != parts[1] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// puPolicy builds the policy of a PU.
+func (c *compiledPolicy) puPolicy(puID string, runtime policy.RuntimeReader) *policy.PUPolicy {
+
+	identity := policy.NewTagStore()
+	annotations := policy.NewTagStore()
+	if tags := runtime.Tags(); tags != nil {
+		identity.Merge(tags)
+		annotations.Merge(tags)
+	}
+	identity.Merge(policy.NewTagStoreFromSlice(c.spec.Identity))
+	annotations.Merge(policy.NewTagStoreFromSlice(c.spec.Annotations))
+
+	scopes := []string{}
+	scopes = append(scopes, c.spec.Scopes...)
+
+	p := policy.NewPUPolicy(
+		puID,
+		"",
+		c.action,
+		c.applicationACLs.Copy(),
+		c.networkACLs.Copy(),
+		c.dnsACLs.Copy(),
+		c.transmitterRules.Copy(),
+		c.receiverRules.Copy(),
+		identity,
+		annotations,
+		nil,
+		runtime.IPAddresses(),
+		0,
+		0,
+		c.exposedServices,
+		c.dependentServices,
+		scopes,
+	)
+	p.SetConnectionLimits(c.spec.ConnectionLimits)
+	p.SetDNSFilterMode(policy.DNSFilterMode(strings.ToLower(c.spec.DNSFilter)))
+	p.SetDNSUpstream(c.spec.DNSUpstream)
+
+	return p
+}
+
+// compile converts the action to a flow policy.
+func (a *ActionSpec) compile() (*policy.FlowPolicy, error) {
+
+	f := &policy.FlowPolicy{
+		PolicyID:  a.PolicyID,
+		ServiceID: a.ServiceID,
+		Labels:    a.Labels,
+	}
+
+	switch strings.ToLower(a.Action) {
+	case "accept":
+		f.Action = policy.Accept
+	case "reject":
+		f.Action = policy.Reject
+	default:
+		return nil, fmt.Errorf("invalid action %s", a.Action)
+	}
+
+	if a.Log {
+		f.Action |= policy.Log
+	}
+
+	if a.Encrypt {
+		f.Action |= policy.Encrypt
+	}
+
+	switch strings.ToLower(a.Observe) {
+	case "":
+	case "continue":
+		f.Action |= policy.Observe
+		f.ObserveAction = policy.ObserveContinue
+	case "apply":
+		f.Action |= policy.Observe
+		f.ObserveAction = policy.ObserveApply
+	default:
+		return nil, fmt.Errorf("invalid observe action %s", a.Observe)
+	}
+
+	if a.Schedule != nil {
+		schedule := &policy.Schedule{
+			NotBefore:  a.Schedule.NotBefore,
+			NotAfter:   a.Schedule.NotAfter,
+			Recurrence: a.Schedule.Recurrence,
+		}
+
+		if a.Schedule.Duration != "" {
+			d, err := time.ParseDuration(a.Schedule.Duration)
+			if err != nil {
+				return nil, fmt.Errorf("invalid schedule duration: %s", err)
+			}
+			schedule.Duration = d
+		}
+
+		if err := schedule.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid schedule: %s", err)
+		}
+
+		f.Schedule = schedule
+	}
+
+	if a.RateLimit != nil {
+		if !f.Action.Accepted() {
+			return nil, errors.New("rate limit requires an accept action")
+		}
+
+		limit := &policy.RateLimitSpec{
+			ConnectionsPerSecond: a.RateLimit.ConnectionsPerSecond,
+			PacketsPerSecond:     a.RateLimit.PacketsPerSecond,
+			Burst:                a.RateLimit.Burst,
+			Key:                  policy.RateLimitKey(strings.ToLower(a.RateLimit.Key)),
+		}
+
+		if err := limit.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid rate limit: %s", err)
+		}
+
+		f.Action |= policy.RateLimit
+		f.RateLimit = limit
+	}
+
+	return f, nil
+}
+
+// compile converts the rule to a tag selector.
+func (r *RuleSpec) compile() (policy.TagSelector, error) {
+
+	if r == nil || len(r.Clause) == 0 {
+		return policy.TagSelector{}, errors.New("no clause")
+	}
+
+	clauses := make([]policy.KeyValueOperator, len(r.Clause))
+	for i, c := range r.Clause {
+		if c == nil || c.Key == "" {
+			return policy.TagSelector{}, errors.New("clause without key")
+		}
+
+		operator := policy.Operator(policy.Equal)
+		if c.Operator != "" {
+			var ok bool
+			if operator, ok = validOperators[c.Operator]; !ok {
+				return policy.TagSelector{}, fmt.Errorf("invalid operator %s", c.Operator)
+			}
+		}
+
+		clauses[i] = policy.KeyValueOperator{
+			Key:      c.Key,
+			Value:    c.Values,
+			Operator: operator,
+			ID:       c.ID,
+		}
+	}
+
+	flowPolicy, err := r.ActionSpec.compile()
+	if err != nil {
+		return policy.TagSelector{}, err
+	}
+
+	return policy.TagSelector{
+		Clause: clauses,
+		Policy: flowPolicy,
+	}, nil
+}
+
+// compileACLs converts the ACLs to IP rules.
+func compileACLs(acls []*ACLSpec) (policy.IPRuleList, error) {
+
+	rules := policy.IPRuleList{}
+
+	for _, acl := range acls {
+		if acl == nil || len(acl.Addresses) == 0 {
+			return nil, errors.New("no address")
+		}
+
+		included := false
+		for _, address := range acl.Addresses {
+			network, excluded := policy.ExcludedAddress(address)
+			if _, _, err := net.ParseCIDR(network); err != nil {
+				return nil, fmt.Errorf("invalid address: %s", err)
+			}
+			included = included || !excluded
+		}
+
+		if !included {
+			return nil, errors.New("all the addresses are excluded")
+		}
+
+		if err := policy.ValidateExclusions(acl.Addresses); err != nil {
+			return nil, err
+		}
+
+		for _, port := range acl.Ports {
+			if _, err := portspec.NewPortSpecFromString(port, nil); err != nil {
+				return nil, fmt.Errorf("invalid port %s: %s", port, err)
+			}
+		}
+
+		protocols, err := compileProtocols(acl.Protocols)
+		if err != nil {
+			return nil, err
+		}
+
+		flowPolicy, err := acl.ActionSpec.compile()
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, policy.IPRule{
+			Addresses: acl.Addresses,
+			Ports:     acl.Ports,
+			Protocols: protocols,
+			Policy:    flowPolicy,
+		})
+	}
+
+	return rules, nil
+}
+
+// compileProtocols converts the tcp and udp protocol names to the numbers
+// used by the datapath and validates the type and codes of the icmp
+// protocols. Other protocols are passed through.
+func compileProtocols(protocols []string) ([]string, error) {
+
+	converted := make([]string, len(protocols))
+	for i, p := range protocols {
+		switch strings.ToLower(p) {
+		case "":
+			return nil, errors.New("empty protocol")
+		case "tcp":
+			converted[i] = constants.TCPProtoNum
+		case "udp":
+			converted[i] = constants.UDPProtoNum
+		default:
+			if !policy.IsICMPProtocol(p) {
+				converted[i] = strings.ToLower(p)
+				continue
+			}
+
+			m, err := policy.ParseICMPMatch(p)
+			if err != nil {
+				return nil, err
+			}
+			converted[i] = m.String()
+		}
+	}
+
+	return converted, nil
+}
+
+// compileServices converts the services to application services.
+func compileServices(services []*ServiceSpec, exposed bool) (policy.ApplicationServicesList, error) {
+
+	list := policy.ApplicationServicesList{}
+
+	for _, s := range services {
+		if s == nil || s.ID == "" {
+			return nil, errors.New("service without id")
+		}
+
+		a := &policy.ApplicationService{
+			ID:       s.ID,
+			External: s.External,
+			Tags:     policy.NewTagStoreFromSlice(s.Tags),
+		}
+
+		switch strings.ToLower(s.Type) {
+		case "", "l3":
+			a.Type = policy.ServiceL3
+		case "tcp":
+			a.Type = policy.ServiceTCP
+		case "http":
+			a.Type = policy.ServiceHTTP
+		default:
+			return nil, fmt.Errorf("service %s: invalid type %s", s.ID, s.Type)
+		}
+
+		var err error
+		if a.NetworkInfo, err = s.networkInfo(s.Ports); err != nil {
+			return nil, fmt.Errorf("service %s: %s", s.ID, err)
+		}
+
+		if exposed {
+			privatePorts := s.PrivatePorts
+			if privatePorts == "" {
+				privatePorts = s.Ports
+			}
+			if a.PrivateNetworkInfo, err = s.networkInfo(privatePorts); err != nil {
+				return nil, fmt.Errorf("service %s: %s", s.ID, err)
+			}
+		}
+
+		list = append(list, a)
+	}
+
+	return list, nil
+}
+
+// networkInfo returns the network information of the service with the given
+// ports.
+func (s *ServiceSpec) networkInfo(ports string) (*common.Service, error) {
+
+	spec, err := portspec.NewPortSpecFromString(ports, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ports %s: %s", ports, err)
+	}
+
+	var protocol uint8
+	switch strings.ToLower(s.Protocol) {
+	case "", "tcp":
+		protocol = 6
+	case "udp":
+		protocol = 17
+	default:
+		return nil, fmt.Errorf("invalid protocol %s", s.Protocol)
+	}
+
+	service := &common.Service{
+		Ports:    spec,
+		Protocol: protocol,
+		FQDNs:    s.FQDNs,
+	}
+
+	for _, address := range s.Addresses {
+		_, network, err := net.ParseCIDR(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address: %s", err)
+		}
+		service.Addresses = append(service.Addresses, network)
+	}
+
+	return service, nil
+}
@@ -0,0 +1,296 @@
+package fileresolver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.aporeto.io/trireme-lib/common"
+	"go.aporeto.io/trireme-lib/policy"
+)
+
+const webPolicy = `
+policies:
+- name: web
+  selector:
+    names: ["web-*"]
+    tags: ["app=web"]
+  identity: ["tier=frontend"]
+  applicationACLs:
+  - addresses: ["10.0.0.0/8"]
+    ports: ["443"]
+    protocols: ["tcp"]
+    action: accept
+    log: true
+    policyID: web-out
+    schedule:
+      notAfter: 2019-03-11T11:30:00Z
+  networkACLs:
+  - addresses: ["0.0.0.0/0"]
+    ports: ["80", "8000:8080"]
+    protocols: ["TCP", "udp"]
+    action: reject
+    observe: continue
+  transmitterRules:
+  - clause:
+    - key: app
+      values: [db]
+    action: accept
+  receiverRules:
+  - clause:
+    - key: version
+      operator: ">="
+      values: ["2.0"]
+    - key: app
+      operator: "^="
+      values: [lb]
+    action: accept
+    encrypt: true
+    rateLimit:
+      connectionsPerSecond: 10
+      key: IP
+  dnsACLs:
+    www.example.com:
+    - ports: ["443"]
+      protocols: ["tcp"]
+      action: accept
+  dnsFilter: nxdomain
+  dnsUpstream:
+    address: tls://9.9.9.9
+    serverName: dns.quad9.net
+  exposedServices:
+  - id: web
+    type: http
+    ports: "443"
+    privatePorts: "8443"
+  dependentServices:
+  - id: db
+    ports: "5432"
+    addresses: ["10.1.0.0/16"]
+  connectionLimits:
+    maxInbound: 100
+    maxInboundPerPeer: 10
+`
+
+const defaultPolicy = `{
+  "policies": [
+    {
+      "name": "default",
+      "action": "allowall"
+    }
+  ]
+}`
+
+func writeFiles(files map[string]string) string {
+
+	dir, err := ioutil.TempDir("", "fileresolver")
+	So(err, ShouldBeNil)
+
+	for name, content := range files {
+		So(ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600), ShouldBeNil)
+	}
+
+	return dir
+}
+
+func TestLoadConfig(t *testing.T) {
+	Convey("Given a directory with YAML and JSON policy files", t, func() {
+
+		dir := writeFiles(map[string]string{
+			"10-web.yaml":  webPolicy,
+			"20-all.json":  defaultPolicy,
+			"README.md":    "not a policy",
+			".hidden.yaml": "invalid: [",
+		})
+		defer os.RemoveAll(dir) // nolint
+
+		Convey("The policies should be loaded in order", func() {
+			specs, err := LoadConfig(dir)
+			So(err, ShouldBeNil)
+			So(len(specs), ShouldEqual, 2)
+			So(specs[0].Name, ShouldEqual, "web")
+			So(specs[1].Name, ShouldEqual, "default")
+
+			policies, err := compile(specs)
+			So(err, ShouldBeNil)
+			So(len(policies), ShouldEqual, 2)
+			So(policies[1].action, ShouldEqual, policy.AllowAll)
+		})
+
+		Convey("A single file should be loaded", func() {
+			specs, err := LoadConfig(filepath.Join(dir, "20-all.json"))
+			So(err, ShouldBeNil)
+			So(len(specs), ShouldEqual, 1)
+		})
+
+		Convey("A missing path should fail", func() {
+			_, err := LoadConfig(filepath.Join(dir, "missing"))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestCompile(t *testing.T) {
+	Convey("Given a valid policy", t, func() {
+
+		dir := writeFiles(map[string]string{"web.yaml": webPolicy})
+		defer os.RemoveAll(dir) // nolint
+
+		specs, err := LoadConfig(dir)
+		So(err, ShouldBeNil)
+
+		policies, err := compile(specs)
+		So(err, ShouldBeNil)
+		c := policies[0]
+
+		runtime := policy.NewPURuntime("web-1", 100, "", policy.NewTagStoreFromSlice([]string{"app=web", "env=prod"}), policy.ExtendedMap{"bridge": "172.17.0.2"}, common.ContainerPU, nil)
+
+		Convey("It should match the PUs by name and tags", func() {
+			So(c.matches(runtime), ShouldBeTrue)
+
+			other := policy.NewPURuntime("db-1", 100, "", policy.NewTagStoreFromSlice([]string{"app=web"}), nil, common.ContainerPU, nil)
+			So(c.matches(other), ShouldBeFalse)
+
+			other = policy.NewPURuntime("web-2", 100, "", policy.NewTagStoreFromSlice([]string{"app=db"}), nil, common.ContainerPU, nil)
+			So(c.matches(other), ShouldBeFalse)
+		})
+
+		Convey("It should build the policy of a PU", func() {
+			p := c.puPolicy("pu1", runtime)
+
+			So(p.ManagementID(), ShouldEqual, "pu1")
+			So(p.TriremeAction(), ShouldEqual, policy.Police)
+			So(p.Identity().GetSlice(), ShouldContain, "app=web")
+			So(p.Identity().GetSlice(), ShouldContain, "tier=frontend")
+			So(p.Annotations().GetSlice(), ShouldNotContain, "tier=frontend")
+			So(p.IPAddresses(), ShouldResemble, policy.ExtendedMap{"bridge": "172.17.0.2"})
+
+			appACLs := p.ApplicationACLs()
+			So(len(appACLs), ShouldEqual, 1)
+			So(appACLs[0].Protocols, ShouldResemble, []string{"6"})
+			So(appACLs[0].Policy.Action, ShouldEqual, policy.Accept|policy.Log)
+			So(appACLs[0].Policy.PolicyID, ShouldEqual, "web-out")
+			So(appACLs[0].Policy.Schedule, ShouldNotBeNil)
+			So(appACLs[0].Policy.Active(time.Date(2019, time.March, 11, 12, 0, 0, 0, time.UTC)), ShouldBeFalse)
+
+			netACLs := p.NetworkACLs()
+			So(len(netACLs), ShouldEqual, 1)
+			So(netACLs[0].Protocols, ShouldResemble, []string{"6", "17"})
+			So(netACLs[0].Policy.Action, ShouldEqual, policy.Reject|policy.Observe)
+			So(netACLs[0].Policy.ObserveAction, ShouldEqual, policy.ObserveContinue)
+
+			txRules := p.TransmitterRules()
+			So(len(txRules), ShouldEqual, 1)
+			So(txRules[0].Clause[0].Operator, ShouldEqual, policy.Operator(policy.Equal))
+
+			rxRules := p.ReceiverRules()
+			So(len(rxRules), ShouldEqual, 1)
+			So(len(rxRules[0].Clause), ShouldEqual, 2)
+			So(rxRules[0].Clause[0].Operator, ShouldEqual, policy.Operator(policy.GreaterOrEqual))
+			So(rxRules[0].Clause[1].Operator, ShouldEqual, policy.Operator(policy.Prefix))
+			So(rxRules[0].Policy.Action, ShouldEqual, policy.Accept|policy.Encrypt|policy.RateLimit)
+			So(rxRules[0].Policy.RateLimit, ShouldResemble, &policy.RateLimitSpec{ConnectionsPerSecond: 10, Key: policy.RateLimitKeyIP})
+
+			So(p.DNSNameACLs(), ShouldContainKey, "www.example.com")
+
+			exposed := p.ExposedServices()
+			So(len(exposed), ShouldEqual, 1)
+			So(exposed[0].Type, ShouldEqual, policy.ServiceHTTP)
+			So(exposed[0].NetworkInfo.Ports.String(), ShouldEqual, "443")
+			So(exposed[0].PrivateNetworkInfo.Ports.String(), ShouldEqual, "8443")
+
+			dependent := p.DependentServices()
+			So(len(dependent), ShouldEqual, 1)
+			So(dependent[0].NetworkInfo.Protocol, ShouldEqual, 6)
+			So(dependent[0].NetworkInfo.Addresses[0].String(), ShouldEqual, "10.1.0.0/16")
+			So(dependent[0].PrivateNetworkInfo, ShouldBeNil)
+
+			So(p.ConnectionLimits(), ShouldResemble, &policy.ConnectionLimits{MaxInbound: 100, MaxInboundPerPeer: 10})
+			So(p.DNSFilterMode(), ShouldEqual, policy.DNSFilterNXDomain)
+			So(p.DNSUpstream(), ShouldResemble, &policy.DNSUpstream{Address: "tls://9.9.9.9", ServerName: "dns.quad9.net"})
+		})
+	})
+
+	Convey("Given invalid policies", t, func() {
+		invalid := []string{
+			`{"policies": [{"selector": {}}]}`,
+			`{"policies": [{"name": "a"}, {"name": "a"}]}`,
+			`{"policies": [{"name": "a", "action": "deny"}]}`,
+			`{"policies": [{"name": "a", "selector": {"names": ["[a"]}}]}`,
+			`{"policies": [{"name": "a", "selector": {"tags": ["app"]}}]}`,
+			`{"policies": [{"name": "a", "applicationACLs": [{"addresses": ["10.0.0.0"], "action": "accept"}]}]}`,
+			`{"policies": [{"name": "a", "applicationACLs": [{"addresses": ["10.0.0.0/8"], "ports": ["http"], "action": "accept"}]}]}`,
+			`{"policies": [{"name": "a", "applicationACLs": [{"addresses": ["10.0.0.0/8"], "action": "drop"}]}]}`,
+			`{"policies": [{"name": "a", "networkACLs": [{"addresses": ["10.0.0.0/8"], "action": "accept", "observe": "later"}]}]}`,
+			`{"policies": [{"name": "a", "networkACLs": [{"addresses": ["10.0.0.0/8"], "action": "accept", "schedule": {"recurrence": "* * *"}}]}]}`,
+			`{"policies": [{"name": "a", "receiverRules": [{"action": "accept"}]}]}`,
+			`{"policies": [{"name": "a", "receiverRules": [{"clause": [{"key": "app", "operator": "~"}], "action": "accept"}]}]}`,
+			`{"policies": [{"name": "a", "receiverRules": [{"clause": [{"key": "app"}], "action": "reject", "rateLimit": {"connectionsPerSecond": 1}}]}]}`,
+			`{"policies": [{"name": "a", "networkACLs": [{"addresses": ["10.0.0.0/8"], "action": "accept", "rateLimit": {"burst": 1}}]}]}`,
+			`{"policies": [{"name": "a", "exposedServices": [{"id": "s", "ports": "80", "type": "udp"}]}]}`,
+			`{"policies": [{"name": "a", "dependentServices": [{"id": "s", "ports": "80", "protocol": "sctp"}]}]}`,
+			`{"policies": [{"name": "a", "connectionLimits": {"maxOutbound": -1}}]}`,
+			`{"policies": [{"name": "a", "networkACLs": [{"addresses": ["10.0.0.0/8"], "protocols": ["icmp/echo"], "action": "accept"}]}]}`,
+			`{"policies": [{"name": "a", "networkACLs": [{"addresses": ["!10.0.0.0/8"], "action": "accept"}]}]}`,
+			`{"policies": [{"name": "a", "dnsACLs": {"www.*.example.com": [{"ports": ["443"], "action": "accept"}]}}]}`,
+			`{"policies": [{"name": "a", "networkACLs": [{"addresses": ["0.0.0.0/0", "!10.0.0.0"], "action": "accept"}]}]}`,
+			`{"policies": [{"name": "a", "networkACLs": [{"addresses": ["10.0.0.0/8"], "protocols": ["icmp/3/4:1"], "action": "accept"}]}]}`,
+			`{"policies": [{"name": "a", "dnsFilter": "drop"}]}`,
+			`{"policies": [{"name": "a", "dnsUpstream": {"address": "udp://9.9.9.9"}}]}`,
+		}
+
+		dir := writeFiles(map[string]string{})
+		defer os.RemoveAll(dir) // nolint
+
+		Convey("They should be rejected", func() {
+			for _, content := range invalid {
+				So(ioutil.WriteFile(filepath.Join(dir, "p.json"), []byte(content), 0600), ShouldBeNil)
+
+				specs, err := LoadConfig(dir)
+				So(err, ShouldBeNil)
+
+				_, err = compile(specs)
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+}
+
+func TestCompileProtocols(t *testing.T) {
+	Convey("Given protocols", t, func() {
+
+		Convey("The names should be converted and the icmp protocols validated", func() {
+			protocols, err := compileProtocols([]string{"TCP", "udp", "ICMP/8", "1/3/4", "icmpv6/128/0", "gre"})
+			So(err, ShouldBeNil)
+			So(protocols, ShouldResemble, []string{"6", "17", "icmp/8", "icmp/3/4", "icmpv6/128/0", "gre"})
+		})
+
+		Convey("Empty protocols should be rejected", func() {
+			_, err := compileProtocols([]string{""})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestCompileACLs(t *testing.T) {
+	Convey("Given ACLs with excluded addresses", t, func() {
+
+		acls := []*ACLSpec{
+			{
+				Addresses:  []string{"0.0.0.0/0", "!10.0.0.0/8", "!169.254.169.254/32"},
+				Ports:      []string{"443"},
+				ActionSpec: ActionSpec{Action: "accept"},
+			},
+		}
+
+		Convey("The exclusions should be kept in the rules", func() {
+			rules, err := compileACLs(acls)
+			So(err, ShouldBeNil)
+			So(len(rules), ShouldEqual, 1)
+			So(rules[0].Addresses, ShouldResemble, []string{"0.0.0.0/0", "!10.0.0.0/8", "!169.254.169.254/32"})
+		})
+	})
+}
@@ -0,0 +1,193 @@
+package policy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ICMP protocols of the IP rules.
+const (
+	ICMPProtoString   = "icmp"
+	ICMPv6ProtoString = "icmpv6"
+	ICMPProtoNum      = "1"
+	ICMPv6ProtoNum    = "58"
+)
+
+// ICMPCodeRange is a range of ICMP codes.
+type ICMPCodeRange struct {
+	Min uint8
+	Max uint8
+}
+
+// ICMPMatch is an ICMP or ICMPv6 protocol of an IP rule with optional type
+// and code constraints. It is written proto[/type[/codes]] in the protocols
+// of the rule, where the codes are a comma separated list of codes and ranges
+// of codes. For example icmp/8 matches the echo requests and icmp/3/4 the
+// fragmentation needed messages.
+type ICMPMatch struct {
+	// V6 is true for ICMPv6.
+	V6 bool
+	// Type is the ICMP type, or -1 for all the types.
+	Type int
+	// Codes are the ranges of ICMP codes. No range means all the codes.
+	Codes []ICMPCodeRange
+}
+
+// BaseProtocol returns the protocol of a protocol of an IP rule without the
+// ICMP type and code constraints.
+func BaseProtocol(proto string) string {
+
+	base := strings.ToLower(strings.SplitN(proto, "/", 2)[0])
+
+	switch base {
+	case ICMPProtoNum:
+		return ICMPProtoString
+	case ICMPv6ProtoNum, "ipv6-icmp":
+		return ICMPv6ProtoString
+	}
+
+	return base
+}
+
+// IsICMPProtocol returns true if the protocol of an IP rule is ICMP or ICMPv6.
+func IsICMPProtocol(proto string) bool {
+
+	base := BaseProtocol(proto)
+
+	return base == ICMPProtoString || base == ICMPv6ProtoString
+}
+
+// ParseICMPMatch parses an ICMP protocol of an IP rule.
+func ParseICMPMatch(proto string) (*ICMPMatch, error) {
+
+	if !IsICMPProtocol(proto) {
+		return nil, fmt.Errorf("%s is not an icmp protocol", proto)
+	}
+
+	parts := strings.Split(proto, "/")
+	if len(parts) > 3 {
+		return nil, fmt.Errorf("invalid icmp protocol %s: expected proto[/type[/codes]]", proto)
+	}
+
+	m := &ICMPMatch{
+		V6:   BaseProtocol(proto) == ICMPv6ProtoString,
+		Type: -1,
+	}
+
+	if len(parts) == 1 {
+		return m, nil
+	}
+
+	t, err := strconv.ParseUint(parts[1], 10, 8)
+	if err != nil {
+		return nil, fmt.Errorf("invalid icmp type %s: %s", parts[1], err)
+	}
+	m.Type = int(t)
+
+	if len(parts) == 2 {
+		return m, nil
+	}
+
+	for _, c := range strings.Split(parts[2], ",") {
+		bounds := strings.SplitN(c, ":", 2)
+
+		min, err := strconv.ParseUint(bounds[0], 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid icmp code %s: %s", c, err)
+		}
+
+		max := min
+		if len(bounds) == 2 {
+			if max, err = strconv.ParseUint(bounds[1], 10, 8); err != nil {
+				return nil, fmt.Errorf("invalid icmp code %s: %s", c, err)
+			}
+		}
+
+		if min > max {
+			return nil, fmt.Errorf("invalid icmp code range %s", c)
+		}
+
+		m.Codes = append(m.Codes, ICMPCodeRange{Min: uint8(min), Max: uint8(max)})
+	}
+
+	return m, nil
+}
+
+// Protocol returns the name of the protocol.
+func (m *ICMPMatch) Protocol() string {
+
+	if m.V6 {
+		return ICMPv6ProtoString
+	}
+
+	return ICMPProtoString
+}
+
+// Matches returns true if the ICMP message matches the type and the codes.
+func (m *ICMPMatch) Matches(icmpType, code uint8) bool {
+
+	if m.Type >= 0 && int(icmpType) != m.Type {
+		return false
+	}
+
+	if len(m.Codes) == 0 {
+		return true
+	}
+
+	for _, r := range m.Codes {
+		if code >= r.Min && code <= r.Max {
+			return true
+		}
+	}
+
+	return false
+}
+
+// TypeCodes returns the type and the codes matched, written type or type/code.
+// It returns nil if all the types are matched.
+func (m *ICMPMatch) TypeCodes() []string {
+
+	if m.Type < 0 {
+		return nil
+	}
+
+	t := strconv.Itoa(m.Type)
+
+	if len(m.Codes) == 0 {
+		return []string{t}
+	}
+
+	typeCodes := []string{}
+	for _, r := range m.Codes {
+		for c := int(r.Min); c <= int(r.Max); c++ {
+			typeCodes = append(typeCodes, t+"/"+strconv.Itoa(c))
+		}
+	}
+
+	return typeCodes
+}
+
+// String returns the protocol as it is written in the IP rules.
+func (m *ICMPMatch) String() string {
+
+	s := m.Protocol()
+	if m.Type < 0 {
+		return s
+	}
+
+	s += "/" + strconv.Itoa(m.Type)
+	if len(m.Codes) == 0 {
+		return s
+	}
+
+	codes := make([]string, len(m.Codes))
+	for i, r := range m.Codes {
+		codes[i] = strconv.Itoa(int(r.Min))
+		if r.Max != r.Min {
+			codes[i] += ":" + strconv.Itoa(int(r.Max))
+		}
+	}
+
+	return s + "/" + strings.Join(codes, ",")
+}
@@ -0,0 +1,58 @@
+package policy
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestICMPMatch(t *testing.T) {
+	Convey("Given ICMP protocols", t, func() {
+
+		Convey("The base protocols should be recognized", func() {
+			So(IsICMPProtocol("icmp"), ShouldBeTrue)
+			So(IsICMPProtocol("ICMP/8"), ShouldBeTrue)
+			So(IsICMPProtocol("58/128"), ShouldBeTrue)
+			So(IsICMPProtocol("6"), ShouldBeFalse)
+			So(BaseProtocol("1/8/0"), ShouldEqual, ICMPProtoString)
+			So(BaseProtocol("ipv6-icmp"), ShouldEqual, ICMPv6ProtoString)
+			So(BaseProtocol("TCP"), ShouldEqual, "tcp")
+		})
+
+		Convey("A protocol without type should match all the messages", func() {
+			m, err := ParseICMPMatch("icmpv6")
+			So(err, ShouldBeNil)
+			So(m.V6, ShouldBeTrue)
+			So(m.Matches(128, 0), ShouldBeTrue)
+			So(m.TypeCodes(), ShouldBeNil)
+			So(m.String(), ShouldEqual, "icmpv6")
+		})
+
+		Convey("A protocol with a type should only match the type", func() {
+			m, err := ParseICMPMatch("1/8")
+			So(err, ShouldBeNil)
+			So(m.Protocol(), ShouldEqual, ICMPProtoString)
+			So(m.Matches(8, 0), ShouldBeTrue)
+			So(m.Matches(0, 0), ShouldBeFalse)
+			So(m.TypeCodes(), ShouldResemble, []string{"8"})
+			So(m.String(), ShouldEqual, "icmp/8")
+		})
+
+		Convey("A protocol with codes should only match the codes", func() {
+			m, err := ParseICMPMatch("icmp/3/0:1,4")
+			So(err, ShouldBeNil)
+			So(m.Matches(3, 4), ShouldBeTrue)
+			So(m.Matches(3, 1), ShouldBeTrue)
+			So(m.Matches(3, 3), ShouldBeFalse)
+			So(m.TypeCodes(), ShouldResemble, []string{"3/0", "3/1", "3/4"})
+			So(m.String(), ShouldEqual, "icmp/3/0:1,4")
+		})
+
+		Convey("Invalid protocols should be rejected", func() {
+			for _, p := range []string{"tcp", "icmp/echo", "icmp/256", "icmp/3/4:1", "icmp/3/x", "icmp/3/4/5"} {
+				_, err := ParseICMPMatch(p)
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+}
@@ -0,0 +1,67 @@
+package policy
+
+// ObserveRules returns a copy of the policy that also observes the rules of
+// the candidate policy. The rules of the candidate are added before the rules
+// of the policy as observation rules that continue to the rules of the policy,
+// so that the flows are reported with the action the candidate would take
+// while the policy is still enforced.
+func (p *PUPolicy) ObserveRules(candidate *PUPolicy) *PUPolicy {
+
+	np := p.Clone()
+
+	p.Lock()
+	np.servicesCA = p.servicesCA
+	np.servicesCertificate = p.servicesCertificate
+	np.servicesPrivateKey = p.servicesPrivateKey
+	p.Unlock()
+
+	np.applicationACLs = append(observeIPRules(candidate.ApplicationACLs()), np.applicationACLs...)
+	np.networkACLs = append(observeIPRules(candidate.NetworkACLs()), np.networkACLs...)
+	np.transmitterRules = append(observeTagSelectors(candidate.TransmitterRules()), np.transmitterRules...)
+	np.receiverRules = append(observeTagSelectors(candidate.ReceiverRules()), np.receiverRules...)
+
+	for name, rules := range candidate.DNSNameACLs() {
+		observed := make([]PortProtocolPolicy, len(rules))
+		for i, r := range rules {
+			r.Policy = observeFlowPolicy(r.Policy)
+			observed[i] = r
+		}
+		np.DNSACLs[name] = append(observed, np.DNSACLs[name]...)
+	}
+
+	return np
+}
+
+// observeIPRules returns the rules as observation rules.
+func observeIPRules(rules IPRuleList) IPRuleList {
+
+	for i := range rules {
+		rules[i].Policy = observeFlowPolicy(rules[i].Policy)
+	}
+
+	return rules
+}
+
+// observeTagSelectors returns the tag selectors as observation rules.
+func observeTagSelectors(rules TagSelectorList) TagSelectorList {
+
+	for i := range rules {
+		rules[i].Policy = observeFlowPolicy(rules[i].Policy)
+	}
+
+	return rules
+}
+
+// observeFlowPolicy returns a copy of the flow policy that is only observed.
+func observeFlowPolicy(f *FlowPolicy) *FlowPolicy {
+
+	if f == nil {
+		return nil
+	}
+
+	observed := *f
+	observed.Action |= Observe
+	observed.ObserveAction = ObserveContinue
+
+	return &observed
+}
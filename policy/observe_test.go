@@ -0,0 +1,56 @@
+package policy
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestObserveRules(t *testing.T) {
+	Convey("Given a policy and a candidate policy", t, func() {
+
+		current := NewPUPolicy("id1", "/abc", Police,
+			IPRuleList{{Addresses: []string{"10.0.0.0/8"}, Ports: []string{"443"}, Protocols: []string{"6"}, Policy: &FlowPolicy{Action: Accept, PolicyID: "old"}}},
+			nil, nil, nil,
+			TagSelectorList{{Clause: []KeyValueOperator{{Key: "app", Value: []string{"web"}, Operator: Equal}}, Policy: &FlowPolicy{Action: Accept, PolicyID: "old"}}},
+			nil, nil, nil, nil, 0, 0, nil, nil, []string{})
+		current.UpdateServiceCertificates("cert", "key")
+
+		candidateACL := &FlowPolicy{Action: Reject, PolicyID: "new"}
+		candidate := NewPUPolicy("id1", "/abc", Police,
+			IPRuleList{{Addresses: []string{"10.0.0.0/8"}, Ports: []string{"443"}, Protocols: []string{"6"}, Policy: candidateACL}},
+			nil,
+			DNSRuleList{"www.example.com": []PortProtocolPolicy{{Ports: []string{"443"}, Protocols: []string{"6"}, Policy: &FlowPolicy{Action: Accept, PolicyID: "new"}}}},
+			nil,
+			TagSelectorList{{Clause: []KeyValueOperator{{Key: "app", Value: []string{"db"}, Operator: Equal}}, Policy: &FlowPolicy{Action: Accept, PolicyID: "new"}}},
+			nil, nil, nil, nil, 0, 0, nil, nil, []string{})
+
+		Convey("The rules of the candidate should be observed before the rules of the policy", func() {
+			p := current.ObserveRules(candidate)
+
+			appACLs := p.ApplicationACLs()
+			So(len(appACLs), ShouldEqual, 2)
+			So(appACLs[0].Policy.PolicyID, ShouldEqual, "new")
+			So(appACLs[0].Policy.Action, ShouldEqual, Reject|Observe)
+			So(appACLs[0].Policy.ObserveAction, ShouldEqual, ObserveContinue)
+			So(appACLs[1].Policy.PolicyID, ShouldEqual, "old")
+			So(appACLs[1].Policy.ObserveAction, ShouldEqual, ObserveNone)
+
+			rxRules := p.ReceiverRules()
+			So(len(rxRules), ShouldEqual, 2)
+			So(rxRules[0].Policy.ObserveAction, ShouldEqual, ObserveContinue)
+
+			So(p.DNSNameACLs()["www.example.com"][0].Policy.ObserveAction, ShouldEqual, ObserveContinue)
+
+			cert, key, _ := p.ServiceCertificates()
+			So(cert, ShouldEqual, "cert")
+			So(key, ShouldEqual, "key")
+
+			Convey("The policies should not be modified", func() {
+				So(len(current.ApplicationACLs()), ShouldEqual, 1)
+				So(candidateACL.ObserveAction, ShouldEqual, ObserveNone)
+				So(candidateACL.Action, ShouldEqual, Reject)
+			})
+		})
+	})
+}
@@ -56,6 +56,13 @@ type PUPolicy struct {
 	servicesCA string
 	// scopes are the processing unit granted scopes
 	scopes []string
+	// connectionLimits caps the concurrent connections of the PU
+	connectionLimits *ConnectionLimits
+	// dnsFilterMode defines how the queries for names without DNS rules
+	// are answered
+	dnsFilterMode DNSFilterMode
+	// dnsUpstream resolves the queries of the PU instead of its servers
+	dnsUpstream *DNSUpstream
 
 	sync.Mutex
 }
@@ -99,9 +106,8 @@ func NewPUPolicy(
 	if netACLs == nil {
 		netACLs = IPRuleList{}
 	}
-	if dnsACLs == nil {
-		dnsACLs = DNSRuleList{}
-	}
+	// The DNS rules are looked up by their normalized names.
+	dnsACLs = dnsACLs.Normalize()
 	if txtags == nil {
 		txtags = TagSelectorList{}
 	}
@@ -183,6 +189,9 @@ func (p *PUPolicy) Clone() *PUPolicy {
 		p.dependentServices,
 		p.scopes,
 	)
+	np.connectionLimits = p.connectionLimits.Copy()
+	np.dnsFilterMode = p.dnsFilterMode
+	np.dnsUpstream = p.dnsUpstream.Copy()
 
 	return np
 }
@@ -227,6 +236,14 @@ func (p *PUPolicy) ApplicationACLs() IPRuleList {
 	return p.applicationACLs.Copy()
 }
 
+// SetApplicationACLs sets the application ACLs of the policy
+func (p *PUPolicy) SetApplicationACLs(acls IPRuleList) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.applicationACLs = acls.Copy()
+}
+
 // NetworkACLs returns a copy of IPRuleList
 func (p *PUPolicy) NetworkACLs() IPRuleList {
 	p.Lock()
@@ -360,7 +377,7 @@ func (p *PUPolicy) UpdateDNSNetworks(networks DNSRuleList) {
 	p.Lock()
 	defer p.Unlock()
 
-	for k, v := range networks {
+	for k, v := range networks.Normalize() {
 		p.DNSACLs[k] = v
 	}
 }
@@ -390,6 +407,59 @@ func (p *PUPolicy) Scopes() []string {
 	return p.scopes
 }
 
+// ConnectionLimits returns the connection limits of the policy. It returns nil
+// if the connections of the PU are not limited.
+func (p *PUPolicy) ConnectionLimits() *ConnectionLimits {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.connectionLimits.Copy()
+}
+
+// SetConnectionLimits sets the connection limits of the policy.
+func (p *PUPolicy) SetConnectionLimits(l *ConnectionLimits) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.connectionLimits = l.Copy()
+}
+
+// DNSFilterMode returns how the queries of the PU for the names without DNS
+// rules are answered.
+func (p *PUPolicy) DNSFilterMode() DNSFilterMode {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.dnsFilterMode
+}
+
+// SetDNSFilterMode sets how the queries of the PU for the names without DNS
+// rules are answered.
+func (p *PUPolicy) SetDNSFilterMode(m DNSFilterMode) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.dnsFilterMode = m
+}
+
+// DNSUpstream returns the encrypted DNS server that resolves the queries of
+// the PU, or nil if they are forwarded to the servers they are sent to.
+func (p *PUPolicy) DNSUpstream() *DNSUpstream {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.dnsUpstream.Copy()
+}
+
+// SetDNSUpstream sets the encrypted DNS server that resolves the queries of
+// the PU.
+func (p *PUPolicy) SetDNSUpstream(u *DNSUpstream) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.dnsUpstream = u.Copy()
+}
+
 // ToPublicPolicy converts the object to a marshallable object.
 func (p *PUPolicy) ToPublicPolicy() *PUPolicyPublic {
 	p.Lock()
@@ -416,6 +486,9 @@ func (p *PUPolicy) ToPublicPolicy() *PUPolicyPublic {
 		ServicesCA:            p.servicesCA,
 		ServicesCertificate:   p.servicesCertificate,
 		ServicesPrivateKey:    p.servicesPrivateKey,
+		ConnectionLimits:      p.connectionLimits.Copy(),
+		DNSFilterMode:         p.dnsFilterMode,
+		DNSUpstream:           p.dnsUpstream.Copy(),
 	}
 }
 
@@ -442,6 +515,9 @@ type PUPolicyPublic struct {
 	ServicesPrivateKey    string                  `json:"servicesPrivateKey,omitempty"`
 	ServicesCA            string                  `json:"servicesCA,omitempty"`
 	Scopes                []string                `json:"scopes,omitempty"`
+	ConnectionLimits      *ConnectionLimits       `json:"connectionLimits,omitempty"`
+	DNSFilterMode         DNSFilterMode           `json:"dnsFilterMode,omitempty"`
+	DNSUpstream           *DNSUpstream            `json:"dnsUpstream,omitempty"`
 }
 
 // ToPrivatePolicy converts the object to a private object.
@@ -480,5 +556,8 @@ func (p *PUPolicyPublic) ToPrivatePolicy(convert bool) (*PUPolicy, error) {
 		servicesCA:            p.ServicesCA,
 		servicesCertificate:   p.ServicesCertificate,
 		servicesPrivateKey:    p.ServicesPrivateKey,
+		connectionLimits:      p.ConnectionLimits.Copy(),
+		dnsFilterMode:         p.DNSFilterMode,
+		dnsUpstream:           p.DNSUpstream.Copy(),
 	}, nil
 }
@@ -339,6 +339,55 @@ func TestAllLockedSetGet(t *testing.T) {
 			So(p.IPAddresses(), ShouldResemble, ExtendedMap{DefaultNamespace: "40.0.0.0/8"})
 		})
 
+		Convey("If I set the application ACLs, it should succeed", func() {
+			acls := IPRuleList{{Addresses: []string{"10.1.1.1"}, Ports: []string{"443"}, Protocols: []string{"6"}, Policy: &FlowPolicy{Action: Accept}}}
+			p.SetApplicationACLs(acls)
+			acls[0].Ports = []string{"80"}
+			So(p.ApplicationACLs(), ShouldHaveLength, 1)
+			So(p.ApplicationACLs()[0].Ports, ShouldResemble, []string{"443"})
+		})
+
+		Convey("If I set the connection limits, they should be kept by the copies of the policy", func() {
+			limits := &ConnectionLimits{MaxInbound: 100, MaxOutboundPerPeer: 5}
+			p.SetConnectionLimits(limits)
+			limits.MaxInbound = 1
+			So(p.ConnectionLimits(), ShouldResemble, &ConnectionLimits{MaxInbound: 100, MaxOutboundPerPeer: 5})
+			So(p.Clone().ConnectionLimits(), ShouldResemble, p.ConnectionLimits())
+
+			private, err := p.ToPublicPolicy().ToPrivatePolicy(false)
+			So(err, ShouldBeNil)
+			So(private.ConnectionLimits(), ShouldResemble, p.ConnectionLimits())
+
+			max, maxPerPeer := p.ConnectionLimits().Limits(false)
+			So(max, ShouldEqual, 0)
+			So(maxPerPeer, ShouldEqual, 5)
+			So((&ConnectionLimits{MaxInbound: -1}).Validate(), ShouldNotBeNil)
+		})
+
+		Convey("If I set the dns filter mode, it should be kept by the copies of the policy", func() {
+			p.SetDNSFilterMode(DNSFilterNXDomain)
+			So(p.DNSFilterMode(), ShouldEqual, DNSFilterNXDomain)
+			So(p.Clone().DNSFilterMode(), ShouldEqual, DNSFilterNXDomain)
+
+			private, err := p.ToPublicPolicy().ToPrivatePolicy(false)
+			So(err, ShouldBeNil)
+			So(private.DNSFilterMode(), ShouldEqual, DNSFilterNXDomain)
+
+			So(DNSFilterRefused.Validate(), ShouldBeNil)
+			So(DNSFilterMode("drop").Validate(), ShouldNotBeNil)
+		})
+
+		Convey("If I set the dns upstream, it should be kept by the copies of the policy", func() {
+			upstream := &DNSUpstream{Address: "tls://9.9.9.9", ServerName: "dns.quad9.net"}
+			p.SetDNSUpstream(upstream)
+			So(p.DNSUpstream(), ShouldResemble, upstream)
+			So(p.Clone().DNSUpstream(), ShouldResemble, upstream)
+
+			private, err := p.ToPublicPolicy().ToPrivatePolicy(false)
+			So(err, ShouldBeNil)
+			So(private.DNSUpstream(), ShouldResemble, upstream)
+		})
+
 		newclause := KeyValueOperator{
 			Key:      "app",
 			Value:    []string{"added"},
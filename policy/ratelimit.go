@@ -0,0 +1,87 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// RateLimitKey selects how the remote endpoints of rate limited flows are
+// grouped. Every group has its own budget.
+type RateLimitKey string
+
+const (
+	// RateLimitKeyIdentity groups the flows by the identity of the remote PU.
+	// Flows without a remote identity, like flows of external networks,
+	// are grouped by remote IP address.
+	RateLimitKeyIdentity RateLimitKey = "identity"
+	// RateLimitKeyIP groups the flows by remote IP address.
+	RateLimitKeyIP RateLimitKey = "ip"
+)
+
+// RateLimitSpec holds the parameters of the RateLimit action. The flows
+// accepted by a rate limited policy are dropped once the budget of their
+// remote endpoint is exhausted.
+type RateLimitSpec struct {
+	// ConnectionsPerSecond is the number of new connections allowed per
+	// second for every remote endpoint. Zero means no limit.
+	ConnectionsPerSecond float64
+	// PacketsPerSecond is the number of packets processed by the datapath
+	// allowed per second for every remote endpoint. Zero means no limit.
+	PacketsPerSecond float64
+	// Burst is the number of connections or packets that can exceed the rate
+	// at once. It defaults to the rate rounded up.
+	Burst int
+	// Key selects how the remote endpoints are grouped. It defaults to
+	// RateLimitKeyIdentity.
+	Key RateLimitKey
+}
+
+// Validate validates the rate limit.
+func (r *RateLimitSpec) Validate() error {
+
+	if r == nil {
+		return nil
+	}
+
+	if r.ConnectionsPerSecond < 0 || r.PacketsPerSecond < 0 {
+		return errors.New("rate limit must not be negative")
+	}
+
+	if r.ConnectionsPerSecond == 0 && r.PacketsPerSecond == 0 {
+		return errors.New("rate limit requires a connection or packet rate")
+	}
+
+	if r.Burst < 0 {
+		return errors.New("rate limit burst must not be negative")
+	}
+
+	switch r.Key {
+	case "", RateLimitKeyIdentity, RateLimitKeyIP:
+	default:
+		return fmt.Errorf("invalid rate limit key %s", r.Key)
+	}
+
+	return nil
+}
+
+// BurstFor returns the burst of the given rate.
+func (r *RateLimitSpec) BurstFor(rate float64) int {
+
+	if r.Burst > 0 {
+		return r.Burst
+	}
+
+	return int(math.Ceil(rate))
+}
+
+// RemoteKey returns the key of the remote endpoint with the given identity
+// and IP address.
+func (r *RateLimitSpec) RemoteKey(remoteID string, remoteIP string) string {
+
+	if r.Key == RateLimitKeyIP || remoteID == "" {
+		return "ip:" + remoteIP
+	}
+
+	return "id:" + remoteID
+}
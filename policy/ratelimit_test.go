@@ -0,0 +1,44 @@
+package policy
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRateLimitSpec(t *testing.T) {
+	Convey("Given rate limits", t, func() {
+
+		Convey("Valid rate limits should be accepted", func() {
+			So((*RateLimitSpec)(nil).Validate(), ShouldBeNil)
+			So((&RateLimitSpec{ConnectionsPerSecond: 10}).Validate(), ShouldBeNil)
+			So((&RateLimitSpec{PacketsPerSecond: 0.5, Burst: 5, Key: RateLimitKeyIP}).Validate(), ShouldBeNil)
+		})
+
+		Convey("Invalid rate limits should be rejected", func() {
+			So((&RateLimitSpec{}).Validate(), ShouldNotBeNil)
+			So((&RateLimitSpec{ConnectionsPerSecond: -1, PacketsPerSecond: 10}).Validate(), ShouldNotBeNil)
+			So((&RateLimitSpec{ConnectionsPerSecond: 10, Burst: -1}).Validate(), ShouldNotBeNil)
+			So((&RateLimitSpec{ConnectionsPerSecond: 10, Key: "port"}).Validate(), ShouldNotBeNil)
+		})
+
+		Convey("The burst should default to the rate", func() {
+			So((&RateLimitSpec{}).BurstFor(2.5), ShouldEqual, 3)
+			So((&RateLimitSpec{Burst: 10}).BurstFor(2.5), ShouldEqual, 10)
+		})
+
+		Convey("The remote endpoints should be grouped by the key", func() {
+			So((&RateLimitSpec{}).RemoteKey("pu1", "10.0.0.1"), ShouldEqual, "id:pu1")
+			So((&RateLimitSpec{}).RemoteKey("", "10.0.0.1"), ShouldEqual, "ip:10.0.0.1")
+			So((&RateLimitSpec{Key: RateLimitKeyIP}).RemoteKey("pu1", "10.0.0.1"), ShouldEqual, "ip:10.0.0.1")
+		})
+
+		Convey("The rate limited flow policies should have different keys", func() {
+			f := &FlowPolicy{Action: Accept | RateLimit, PolicyID: "web", RateLimit: &RateLimitSpec{ConnectionsPerSecond: 10}}
+			g := &FlowPolicy{Action: Accept | RateLimit, PolicyID: "web", RateLimit: &RateLimitSpec{ConnectionsPerSecond: 20}}
+			So(f.Key(), ShouldNotEqual, g.Key())
+			So(f.Action.RateLimited(), ShouldBeTrue)
+			So(RateLimit.String(), ShouldEqual, actionRateLimit)
+		})
+	})
+}
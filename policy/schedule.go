@@ -0,0 +1,445 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxScheduleSteps bounds the search for the next transition of a schedule.
+const maxScheduleSteps = 1024
+
+// Schedule restricts the time during which a flow policy is enforced. The
+// policy is only valid between NotBefore and NotAfter. If a recurrence is
+// provided, the policy is further restricted to the windows that open at every
+// activation of the recurrence and stay open for the duration of the schedule.
+type Schedule struct {
+	// NotBefore is the time the policy becomes valid. Zero means no bound.
+	NotBefore time.Time
+	// NotAfter is the time the policy expires. Zero means no bound.
+	NotAfter time.Time
+	// Recurrence is a cron expression with five fields (minute, hour,
+	// day of month, month and day of week) evaluated in UTC.
+	Recurrence string
+	// Duration is how long a window of the recurrence stays open.
+	Duration time.Duration
+}
+
+// Validate validates the schedule.
+func (s *Schedule) Validate() error {
+
+	if s == nil {
+		return nil
+	}
+
+	if !s.NotBefore.IsZero() && !s.NotAfter.IsZero() && !s.NotAfter.After(s.NotBefore) {
+		return errors.New("schedule expires before it becomes valid")
+	}
+
+	if s.Recurrence == "" {
+		return nil
+	}
+
+	if _, err := parseCronSpec(s.Recurrence); err != nil {
+		return err
+	}
+
+	if s.Duration <= 0 {
+		return errors.New("recurring schedule requires a positive duration")
+	}
+
+	return nil
+}
+
+// Active returns true if the schedule is active at the given time. A nil
+// schedule is always active. An invalid schedule is never active.
+func (s *Schedule) Active(t time.Time) bool {
+
+	if s == nil {
+		return true
+	}
+
+	if !s.NotBefore.IsZero() && t.Before(s.NotBefore) {
+		return false
+	}
+
+	if !s.NotAfter.IsZero() && !t.Before(s.NotAfter) {
+		return false
+	}
+
+	if s.Recurrence == "" {
+		return true
+	}
+
+	spec, err := parseCronSpec(s.Recurrence)
+	if err != nil || s.Duration <= 0 {
+		return false
+	}
+
+	// The window that contains t opened in (t-Duration, t].
+	start, ok := spec.next(t.Add(-s.Duration))
+
+	return ok && !start.After(t)
+}
+
+// NextTransition returns the earliest time after t at which the schedule
+// becomes active or inactive. When the windows of the recurrence overlap, the
+// search may stop early and return a time at which nothing changes. The
+// caller is expected to evaluate the schedule again at that time.
+func (s *Schedule) NextTransition(t time.Time) (time.Time, bool) {
+
+	if s == nil {
+		return time.Time{}, false
+	}
+
+	var spec *cronSpec
+	if s.Recurrence != "" {
+		var err error
+		if spec, err = parseCronSpec(s.Recurrence); err != nil || s.Duration <= 0 {
+			// The schedule is never active.
+			return time.Time{}, false
+		}
+	}
+
+	active := s.Active(t)
+	at := t
+
+	for i := 0; i < maxScheduleSteps; i++ {
+		next, ok := s.nextCandidate(spec, at)
+		if !ok {
+			return time.Time{}, false
+		}
+
+		if s.Active(next) != active {
+			return next, true
+		}
+
+		at = next
+	}
+
+	return at, true
+}
+
+// nextCandidate returns the earliest time after t at which the schedule
+// might change state. These are the bounds of the validity period and the
+// opening and closing times of the windows of the recurrence.
+func (s *Schedule) nextCandidate(spec *cronSpec, t time.Time) (time.Time, bool) {
+
+	var candidate time.Time
+
+	update := func(c time.Time) {
+		if c.After(t) && (candidate.IsZero() || c.Before(candidate)) {
+			candidate = c
+		}
+	}
+
+	update(s.NotBefore)
+	update(s.NotAfter)
+
+	if spec != nil {
+		if start, ok := spec.next(t); ok {
+			update(start)
+		}
+		if start, ok := spec.next(t.Add(-s.Duration)); ok {
+			update(start.Add(s.Duration))
+		}
+	}
+
+	return candidate, !candidate.IsZero()
+}
+
+// Active returns true if the flow policy is active at the given time.
+func (f *FlowPolicy) Active(t time.Time) bool {
+
+	return f == nil || f.Schedule.Active(t)
+}
+
+// activeAt returns the rules of the list that are active at the given time.
+func (l IPRuleList) activeAt(t time.Time) IPRuleList {
+
+	list := IPRuleList{}
+	for _, r := range l {
+		if r.Policy.Active(t) {
+			list = append(list, r)
+		}
+	}
+
+	return list
+}
+
+// activeAt returns the rules of the list that are active at the given time.
+func (l TagSelectorList) activeAt(t time.Time) TagSelectorList {
+
+	list := TagSelectorList{}
+	for _, r := range l {
+		if r.Policy.Active(t) {
+			list = append(list, r)
+		}
+	}
+
+	return list
+}
+
+// activeAt returns the rules of the list that are active at the given time.
+// Names without any active rule are removed.
+func (l DNSRuleList) activeAt(t time.Time) DNSRuleList {
+
+	list := DNSRuleList{}
+	for name, rules := range l {
+		active := []PortProtocolPolicy{}
+		for _, r := range rules {
+			if r.Policy.Active(t) {
+				active = append(active, r)
+			}
+		}
+		if len(active) > 0 {
+			list[name] = active
+		}
+	}
+
+	return list
+}
+
+// flowPolicies returns all the flow policies of the rules of the policy.
+// It must be called with the lock held.
+func (p *PUPolicy) flowPolicies() []*FlowPolicy {
+
+	policies := []*FlowPolicy{}
+
+	for _, l := range []IPRuleList{p.applicationACLs, p.networkACLs} {
+		for _, r := range l {
+			policies = append(policies, r.Policy)
+		}
+	}
+
+	for _, l := range []TagSelectorList{p.transmitterRules, p.receiverRules} {
+		for _, r := range l {
+			policies = append(policies, r.Policy)
+		}
+	}
+
+	for _, rules := range p.DNSACLs {
+		for _, r := range rules {
+			policies = append(policies, r.Policy)
+		}
+	}
+
+	return policies
+}
+
+// Scheduled returns true if any rule of the policy has a schedule.
+func (p *PUPolicy) Scheduled() bool {
+	p.Lock()
+	defer p.Unlock()
+
+	for _, f := range p.flowPolicies() {
+		if f != nil && f.Schedule != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ActivePolicy returns the policy that must be enforced at the given time.
+// It is a copy of the policy without the rules that are not active. If no
+// rule has a schedule, the policy itself is returned.
+func (p *PUPolicy) ActivePolicy(t time.Time) *PUPolicy {
+
+	if !p.Scheduled() {
+		return p
+	}
+
+	// The policy is cloned so that all the other fields are kept.
+	np := p.Clone()
+
+	p.Lock()
+	defer p.Unlock()
+
+	np.servicesCA = p.servicesCA
+	np.servicesCertificate = p.servicesCertificate
+	np.servicesPrivateKey = p.servicesPrivateKey
+
+	np.applicationACLs = p.applicationACLs.activeAt(t)
+	np.networkACLs = p.networkACLs.activeAt(t)
+	np.DNSACLs = p.DNSACLs.activeAt(t)
+	np.transmitterRules = p.transmitterRules.activeAt(t)
+	np.receiverRules = p.receiverRules.activeAt(t)
+
+	return np
+}
+
+// NextScheduleTransition returns the earliest time after t at which a rule
+// of the policy becomes active or inactive.
+func (p *PUPolicy) NextScheduleTransition(t time.Time) (time.Time, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	var next time.Time
+
+	for _, f := range p.flowPolicies() {
+		if f == nil || f.Schedule == nil {
+			continue
+		}
+		if c, ok := f.Schedule.NextTransition(t); ok && (next.IsZero() || c.Before(next)) {
+			next = c
+		}
+	}
+
+	return next, !next.IsZero()
+}
+
+// cronSpec is a parsed cron expression. Every field is a bit set of the
+// values that match.
+type cronSpec struct {
+	minute  uint64
+	hour    uint64
+	dom     uint64
+	month   uint64
+	dow     uint64
+	domStar bool
+	dowStar bool
+}
+
+// cronFields are the bounds of the fields of a cron expression.
+var cronFields = []struct {
+	name string
+	min  int
+	max  int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// parseCronSpec parses a cron expression with five fields. Each field is a
+// comma separated list of values, ranges (a-b) or wildcards, with optional
+// steps (*/15).
+func parseCronSpec(expr string) (*cronSpec, error) {
+
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("invalid recurrence %s: expected %d fields", expr, len(cronFields))
+	}
+
+	bits := make([]uint64, len(fields))
+	for i, field := range fields {
+		var err error
+		if bits[i], err = parseCronField(field, cronFields[i].min, cronFields[i].max); err != nil {
+			return nil, fmt.Errorf("invalid %s in recurrence %s: %s", cronFields[i].name, expr, err)
+		}
+	}
+
+	// Sunday is both 0 and 7.
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+
+	return &cronSpec{
+		minute:  bits[0],
+		hour:    bits[1],
+		dom:     bits[2],
+		month:   bits[3],
+		dow:     bits[4],
+		domStar: strings.HasPrefix(fields[2], "*"),
+		dowStar: strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+// parseCronField parses one field of a cron expression.
+func parseCronField(field string, min, max int) (uint64, error) {
+
+	var bits uint64
+
+	for _, item := range strings.Split(field, ",") {
+
+		step := 1
+		if parts := strings.SplitN(item, "/", 2); len(parts) == 2 {
+			var err error
+			if step, err = strconv.Atoi(parts[1]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %s", parts[1])
+			}
+			item = parts[0]
+		}
+
+		low, high := min, max
+		if item != "*" {
+			bounds := strings.SplitN(item, "-", 2)
+
+			var err error
+			if low, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value %s", bounds[0])
+			}
+
+			high = low
+			if len(bounds) == 2 {
+				if high, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value %s", bounds[1])
+				}
+			}
+		}
+
+		if low < min || high > max || low > high {
+			return 0, fmt.Errorf("%s out of range %d-%d", item, min, max)
+		}
+
+		for v := low; v <= high; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+// dayMatches returns true if the day matches the spec. Like cron, if both
+// the day of month and the day of week are restricted, either can match.
+func (c *cronSpec) dayMatches(t time.Time) bool {
+
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+
+	return dom || dow
+}
+
+// next returns the first activation of the spec strictly after t. It returns
+// false if there is no activation in the next five years.
+func (c *cronSpec) next(t time.Time) (time.Time, bool) {
+
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.Year() + 5
+
+	for t.Year() <= limit {
+
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = t.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t, true
+	}
+
+	return time.Time{}, false
+}
@@ -0,0 +1,220 @@
+package policy
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestScheduleActive(t *testing.T) {
+	Convey("Given a time", t, func() {
+
+		now := time.Date(2019, time.March, 11, 10, 30, 0, 0, time.UTC) // Monday
+
+		Convey("A nil schedule should always be active", func() {
+			var s *Schedule
+			So(s.Active(now), ShouldBeTrue)
+			_, ok := s.NextTransition(now)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("A validity window should be honored", func() {
+			s := &Schedule{
+				NotBefore: now.Add(-time.Hour),
+				NotAfter:  now.Add(time.Hour),
+			}
+			So(s.Validate(), ShouldBeNil)
+			So(s.Active(now), ShouldBeTrue)
+			So(s.Active(now.Add(-2*time.Hour)), ShouldBeFalse)
+			So(s.Active(now.Add(time.Hour)), ShouldBeFalse)
+
+			next, ok := s.NextTransition(now)
+			So(ok, ShouldBeTrue)
+			So(next, ShouldEqual, now.Add(time.Hour))
+
+			next, ok = s.NextTransition(now.Add(-2 * time.Hour))
+			So(ok, ShouldBeTrue)
+			So(next, ShouldEqual, now.Add(-time.Hour))
+
+			_, ok = s.NextTransition(now.Add(2 * time.Hour))
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("A recurring maintenance window should be honored", func() {
+			// Every weekday at 10:00 for an hour.
+			s := &Schedule{
+				Recurrence: "0 10 * * 1-5",
+				Duration:   time.Hour,
+			}
+			So(s.Validate(), ShouldBeNil)
+			So(s.Active(now), ShouldBeTrue)
+			So(s.Active(now.Add(-31*time.Minute)), ShouldBeFalse)
+			So(s.Active(now.Add(30*time.Minute)), ShouldBeFalse)
+
+			// Saturday
+			So(s.Active(now.Add(5*24*time.Hour)), ShouldBeFalse)
+
+			next, ok := s.NextTransition(now)
+			So(ok, ShouldBeTrue)
+			So(next, ShouldEqual, time.Date(2019, time.March, 11, 11, 0, 0, 0, time.UTC))
+
+			next, ok = s.NextTransition(next)
+			So(ok, ShouldBeTrue)
+			So(next, ShouldEqual, time.Date(2019, time.March, 12, 10, 0, 0, 0, time.UTC))
+
+			// Friday to Monday
+			next, ok = s.NextTransition(time.Date(2019, time.March, 15, 12, 0, 0, 0, time.UTC))
+			So(ok, ShouldBeTrue)
+			So(next, ShouldEqual, time.Date(2019, time.March, 18, 10, 0, 0, 0, time.UTC))
+		})
+
+		Convey("Overlapping windows should be merged", func() {
+			s := &Schedule{
+				Recurrence: "*/30 * * * *",
+				Duration:   45 * time.Minute,
+				NotAfter:   now.Add(2 * time.Hour),
+			}
+			So(s.Active(now), ShouldBeTrue)
+
+			next, ok := s.NextTransition(now)
+			So(ok, ShouldBeTrue)
+			So(next, ShouldEqual, now.Add(2*time.Hour))
+		})
+
+		Convey("Invalid schedules should never be active", func() {
+			for _, s := range []*Schedule{
+				{Recurrence: "0 10 * *", Duration: time.Hour},
+				{Recurrence: "60 10 * * *", Duration: time.Hour},
+				{Recurrence: "0 10 * * mon", Duration: time.Hour},
+				{Recurrence: "0 10 * * *"},
+			} {
+				So(s.Validate(), ShouldNotBeNil)
+				So(s.Active(now), ShouldBeFalse)
+			}
+
+			s := &Schedule{NotBefore: now, NotAfter: now}
+			So(s.Validate(), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestCronSpec(t *testing.T) {
+	Convey("Given a cron expression with both days restricted", t, func() {
+		spec, err := parseCronSpec("15 8,20 1 * 0")
+		So(err, ShouldBeNil)
+
+		Convey("Either day should match", func() {
+			next, ok := spec.next(time.Date(2019, time.March, 1, 9, 0, 0, 0, time.UTC))
+			So(ok, ShouldBeTrue)
+			So(next, ShouldEqual, time.Date(2019, time.March, 1, 20, 15, 0, 0, time.UTC))
+
+			next, ok = spec.next(next)
+			So(ok, ShouldBeTrue)
+			So(next, ShouldEqual, time.Date(2019, time.March, 3, 8, 15, 0, 0, time.UTC))
+		})
+	})
+
+	Convey("Given a cron expression that never matches", t, func() {
+		spec, err := parseCronSpec("0 0 31 2 *")
+		So(err, ShouldBeNil)
+
+		_, ok := spec.next(time.Date(2019, time.March, 1, 9, 0, 0, 0, time.UTC))
+		So(ok, ShouldBeFalse)
+	})
+}
+
+func TestActivePolicy(t *testing.T) {
+	Convey("Given a policy with scheduled rules", t, func() {
+
+		now := time.Date(2019, time.March, 11, 10, 30, 0, 0, time.UTC)
+
+		breakGlass := &FlowPolicy{
+			Action:   Accept,
+			PolicyID: "break-glass",
+			Schedule: &Schedule{NotAfter: now.Add(time.Hour)},
+		}
+
+		permanent := &FlowPolicy{Action: Accept, PolicyID: "permanent"}
+
+		appACLs := IPRuleList{
+			{Addresses: []string{"10.0.0.0/8"}, Ports: []string{"22"}, Protocols: []string{"6"}, Policy: breakGlass},
+			{Addresses: []string{"10.0.0.0/8"}, Ports: []string{"443"}, Protocols: []string{"6"}, Policy: permanent},
+		}
+
+		rxtags := TagSelectorList{
+			{Clause: []KeyValueOperator{{Key: "app", Value: []string{"web"}, Operator: Equal}}, Policy: breakGlass},
+		}
+
+		dnsACLs := DNSRuleList{
+			"ssh.example.com": []PortProtocolPolicy{{Ports: []string{"22"}, Protocols: []string{"6"}, Policy: breakGlass}},
+			"www.example.com": []PortProtocolPolicy{{Ports: []string{"443"}, Protocols: []string{"6"}, Policy: permanent}},
+		}
+
+		p := NewPUPolicy("id1", "/abc", Police, appACLs, nil, dnsACLs, nil, rxtags, nil, nil, nil, nil, 0, 0, nil, nil, []string{})
+		p.UpdateServiceCertificates("cert", "key")
+		p.SetConnectionLimits(&ConnectionLimits{MaxInbound: 10})
+		p.SetDNSFilterMode(DNSFilterRefused)
+		p.SetDNSUpstream(&DNSUpstream{Address: "https://dns.example.com/dns-query"})
+
+		Convey("While the window is open, all the rules should be enforced", func() {
+			So(p.Scheduled(), ShouldBeTrue)
+
+			active := p.ActivePolicy(now)
+			So(active, ShouldNotPointTo, p)
+			So(len(active.ApplicationACLs()), ShouldEqual, 2)
+			So(len(active.ReceiverRules()), ShouldEqual, 1)
+			So(len(active.DNSNameACLs()), ShouldEqual, 2)
+
+			cert, key, _ := active.ServiceCertificates()
+			So(cert, ShouldEqual, "cert")
+			So(key, ShouldEqual, "key")
+			So(active.ConnectionLimits(), ShouldResemble, &ConnectionLimits{MaxInbound: 10})
+			So(active.DNSFilterMode(), ShouldEqual, DNSFilterRefused)
+			So(active.DNSUpstream(), ShouldResemble, &DNSUpstream{Address: "https://dns.example.com/dns-query"})
+
+			next, ok := p.NextScheduleTransition(now)
+			So(ok, ShouldBeTrue)
+			So(next, ShouldEqual, now.Add(time.Hour))
+		})
+
+		Convey("When the window closes, the scheduled rules should be removed", func() {
+			active := p.ActivePolicy(now.Add(time.Hour))
+			So(len(active.ApplicationACLs()), ShouldEqual, 1)
+			So(active.ApplicationACLs()[0].Policy.PolicyID, ShouldEqual, "permanent")
+			So(active.ReceiverRules(), ShouldBeEmpty)
+			So(active.DNSNameACLs(), ShouldNotContainKey, "ssh.example.com")
+			So(active.DNSNameACLs(), ShouldContainKey, "www.example.com")
+
+			_, ok := p.NextScheduleTransition(now.Add(time.Hour))
+			So(ok, ShouldBeFalse)
+
+			// The original policy is not modified.
+			So(len(p.ApplicationACLs()), ShouldEqual, 2)
+		})
+
+		Convey("All the fields but the rules should be kept", func() {
+			expected := p.ToPublicPolicy()
+			public := p.ActivePolicy(now.Add(time.Hour)).ToPublicPolicy()
+
+			for _, pp := range []*PUPolicyPublic{expected, public} {
+				pp.ApplicationACLs = nil
+				pp.NetworkACLs = nil
+				pp.DNSACLs = nil
+				pp.TransmitterRules = nil
+				pp.ReceiverRules = nil
+			}
+
+			So(public, ShouldResemble, expected)
+		})
+	})
+
+	Convey("Given a policy without scheduled rules", t, func() {
+		p := NewPUPolicy("id1", "/abc", Police, nil, nil, nil, nil, nil, nil, nil, nil, nil, 0, 0, nil, nil, []string{})
+
+		Convey("The policy itself should be enforced", func() {
+			So(p.Scheduled(), ShouldBeFalse)
+			So(p.ActivePolicy(time.Now()), ShouldPointTo, p)
+		})
+	})
+}
@@ -22,6 +22,7 @@ const (
 	actionPassthrough = "passthrough"
 	actionEncrypt     = "encrypt"
 	actionLog         = "log"
+	actionRateLimit   = "ratelimit"
 
 	oactionContinue = "continue"
 	oactionApply    = "apply"
@@ -42,6 +43,27 @@ const (
 	KeyExists = "*"
 	// KeyNotExists means that the key doesnt exist in the incoming tags
 	KeyNotExists = "!*"
+	// Prefix is the operator that matches values starting with one of the values
+	Prefix = "^="
+	// Suffix is the operator that matches values ending with one of the values
+	Suffix = "$="
+	// Regex is the operator that matches values with one of the regular
+	// expressions. The expressions are anchored to the whole value.
+	Regex = "=~"
+	// LessThan is the operator that matches values lower than one of the values.
+	// Values are compared as versions, or as numbers if they are not versions.
+	LessThan = "<"
+	// LessOrEqual is the operator that matches values lower than or equal to one
+	// of the values.
+	LessOrEqual = "<="
+	// GreaterThan is the operator that matches values greater than one of the values.
+	GreaterThan = ">"
+	// GreaterOrEqual is the operator that matches values greater than or equal to
+	// one of the values.
+	GreaterOrEqual = ">="
+	// SemverRange is the operator that matches versions that satisfy one of the
+	// version constraints, such as ">= 2.3, < 3.0" or "~> 2.3".
+	SemverRange = "semver"
 )
 
 // ActionType   is the action that can be applied to a flow.
@@ -72,6 +94,11 @@ func (f ActionType) Observed() bool {
 	return f&Observe > 0
 }
 
+// RateLimited returns if the action mask contains the RateLimit mask.
+func (f ActionType) RateLimited() bool {
+	return f&RateLimit > 0
+}
+
 // ActionString returns if the action if accepted of rejected as a long string.
 func (f ActionType) ActionString() string {
 	if f.Accepted() && !f.Rejected() {
@@ -95,6 +122,8 @@ func (f ActionType) String() string {
 		return actionEncrypt
 	case Log:
 		return actionLog
+	case RateLimit:
+		return actionRateLimit
 	}
 
 	return actionUnknown
@@ -111,6 +140,9 @@ const (
 	Log ActionType = 0x8
 	// Observe instructs the datapath to observe policy results
 	Observe ActionType = 0x10
+	// RateLimit instructs the datapath to drop accepted flows that exceed
+	// the rate limit of the policy
+	RateLimit ActionType = 0x20
 )
 
 // ObserveActionType is the action that can be applied to a flow for an observation rule.
@@ -162,6 +194,11 @@ type FlowPolicy struct {
 	ServiceID     string
 	PolicyID      string
 	Labels        []string
+	// Schedule restricts the time during which the policy is enforced.
+	// The policy is always enforced if it is nil.
+	Schedule *Schedule
+	// RateLimit holds the parameters of the RateLimit action.
+	RateLimit *RateLimitSpec
 }
 
 // DefaultAcceptLogPrefix return the prefix used in nf-log action for default rule.